@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/raian621/dump/models/storage"
+)
+
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// API keys look like `dump_<key ID>_<secret>`. The key ID is public and used
+// to look the key up; only a hash of the whole key is stored.
+const (
+	APIKeyPrefix      = "dump_"
+	apiKeyIdLength    = 8  // bytes, hex encoded
+	apiKeySecretBytes = 32 // base64url encoded
+)
+
+// Scopes limit what an authenticated request may do. Sessions are granted
+// every scope; API keys can only be granted APIKeyScopes, so that a leaked key
+// can't be used to manage the account itself.
+const (
+	ScopeRead    = "read"    // read vaults and their objects
+	ScopeWrite   = "write"   // create, modify and delete vaults and objects
+	ScopeAccount = "account" // manage the account: API keys, provider keys, sessions
+)
+
+var (
+	APIKeyScopes  = []string{ScopeRead, ScopeWrite}
+	sessionScopes = []string{ScopeRead, ScopeWrite, ScopeAccount}
+)
+
+// What an authenticated request is allowed to do, set in the request context
+// as "grant"
+type Grant struct {
+	UserId   int32
+	Scopes   []string
+	VaultId  int32 // if non-zero, the only vault the request may access
+	APIKeyId int32 // ID of the API key that authenticated the request, if any
+	// When the user signed in to the session of the access token that
+	// authenticated the request. Zero for API keys and tokens that don't say.
+	AuthTime time.Time
+	// Refresh token family of the session of the access token that
+	// authenticated the request. Empty for API keys and tokens that don't say.
+	SessionFamilyId string
+}
+
+func (g *Grant) HasScope(scope string) bool {
+	return slices.Contains(g.Scopes, scope)
+}
+
+// Whether the request may access a vault at all
+func (g *Grant) AllowsVault(vaultId int32) bool {
+	return g.VaultId == 0 || g.VaultId == vaultId
+}
+
+// Issues and verifies API keys. Keys are random enough that a fast keyed hash
+// is as good as a password hash, and cheap enough to compute on every
+// request.
+type APIKeyVerifier struct {
+	pepper []byte
+	// look up a key by its key ID, returning ErrInvalidAPIKey if there is no
+	// such key
+	lookup func(keyId string) (*storage.APIKey, error)
+	// record that a key was used to authenticate a request
+	touch func(key *storage.APIKey) error
+	now   func() time.Time
+}
+
+// The pepper keys the stored hashes, so that a copy of the database alone
+// can't be used to confirm a key
+func NewAPIKeyVerifier(
+	pepper []byte,
+	lookup func(keyId string) (*storage.APIKey, error),
+	touch func(key *storage.APIKey) error,
+) *APIKeyVerifier {
+	return &APIKeyVerifier{pepper: pepper, lookup: lookup, touch: touch, now: time.Now}
+}
+
+// Generate a new API key, returning the key to hand to the user along with
+// its key ID and the hash to store
+func (v *APIKeyVerifier) Generate() (key, keyId string, hash []byte) {
+	id := make([]byte, apiKeyIdLength)
+	secret := make([]byte, apiKeySecretBytes)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	keyId = hex.EncodeToString(id)
+	key = APIKeyPrefix + keyId + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	return key, keyId, v.hash(key)
+}
+
+// Check an API key and return what it grants
+func (v *APIKeyVerifier) Verify(key string) (*Grant, error) {
+	keyId, ok := parseAPIKey(key)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	stored, err := v.lookup(keyId)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(stored.KeyHash, v.hash(key)) {
+		return nil, ErrInvalidAPIKey
+	}
+	if stored.ExpiresAt != nil && !v.now().Before(*stored.ExpiresAt) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err := v.touch(stored); err != nil {
+		return nil, err
+	}
+	return &Grant{
+		UserId:   stored.UserId,
+		Scopes:   stored.Scopes,
+		VaultId:  stored.VaultId,
+		APIKeyId: stored.Id,
+	}, nil
+}
+
+func (v *APIKeyVerifier) hash(key string) []byte {
+	mac := hmac.New(sha256.New, v.pepper)
+	mac.Write([]byte(key))
+	return mac.Sum(nil)
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// Extract the key ID from an API key
+func parseAPIKey(key string) (keyId string, ok bool) {
+	rest, found := strings.CutPrefix(key, APIKeyPrefix)
+	if !found {
+		return "", false
+	}
+	keyId, secret, found := strings.Cut(rest, "_")
+	if !found || len(keyId) != hex.EncodedLen(apiKeyIdLength) ||
+		len(secret) != base64.RawURLEncoding.EncodedLen(apiKeySecretBytes) {
+		return "", false
+	}
+	if _, err := hex.DecodeString(keyId); err != nil {
+		return "", false
+	}
+	return keyId, true
+}
+
+// Validate the scopes requested for an API key
+func ValidAPIKeyScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(APIKeyScopes, scope) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raian621/dump/models/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A verifier backed by a map of keys by key ID
+func testAPIKeyVerifier() (*APIKeyVerifier, map[string]*storage.APIKey) {
+	keys := map[string]*storage.APIKey{}
+	lookup := func(keyId string) (*storage.APIKey, error) {
+		if key, found := keys[keyId]; found {
+			return key, nil
+		}
+		return nil, ErrInvalidAPIKey
+	}
+	touch := func(key *storage.APIKey) error { return nil }
+	return NewAPIKeyVerifier([]byte("pepper"), lookup, touch), keys
+}
+
+func TestVerifyAPIKey(t *testing.T) {
+	apiKeys, keys := testAPIKeyVerifier()
+	key, keyId, hash := apiKeys.Generate()
+	assert.True(t, IsAPIKey(key))
+	keys[keyId] = &storage.APIKey{
+		Id: 3, UserId: 1, KeyId: keyId, KeyHash: hash,
+		Scopes: []string{ScopeRead, ScopeWrite}, VaultId: 5,
+	}
+
+	grant, err := apiKeys.Verify(key)
+	require.NoError(t, err)
+	assert.Equal(t, &Grant{UserId: 1, Scopes: []string{ScopeRead, ScopeWrite}, VaultId: 5, APIKeyId: 3}, grant)
+	assert.True(t, grant.AllowsVault(5))
+	assert.False(t, grant.AllowsVault(6))
+	assert.False(t, grant.HasScope(ScopeAccount))
+}
+
+func TestVerifyAPIKeyRejectsWrongSecret(t *testing.T) {
+	apiKeys, keys := testAPIKeyVerifier()
+	_, keyId, hash := apiKeys.Generate()
+	keys[keyId] = &storage.APIKey{UserId: 1, KeyId: keyId, KeyHash: hash, Scopes: []string{ScopeRead}}
+
+	// same key ID, different secret
+	other, _, _ := apiKeys.Generate()
+	forged := APIKeyPrefix + keyId + other[len(APIKeyPrefix)+len(keyId):]
+	_, err := apiKeys.Verify(forged)
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+
+	// hashed with another pepper
+	otherPepper := NewAPIKeyVerifier([]byte("other"), apiKeys.lookup, apiKeys.touch)
+	key, keyId, _ := otherPepper.Generate()
+	keys[keyId] = &storage.APIKey{UserId: 1, KeyId: keyId, KeyHash: otherPepper.hash(key)}
+	_, err = apiKeys.Verify(key)
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+}
+
+func TestVerifyAPIKeyRejectsExpiredKeys(t *testing.T) {
+	apiKeys, keys := testAPIKeyVerifier()
+	now := time.Now()
+	apiKeys.now = func() time.Time { return now }
+	key, keyId, hash := apiKeys.Generate()
+	expiresAt := now.Add(time.Hour)
+	keys[keyId] = &storage.APIKey{UserId: 1, KeyId: keyId, KeyHash: hash, ExpiresAt: &expiresAt}
+
+	_, err := apiKeys.Verify(key)
+	assert.NoError(t, err)
+	now = expiresAt
+	_, err = apiKeys.Verify(key)
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+}
+
+func TestVerifyAPIKeyRejectsMalformedKeys(t *testing.T) {
+	apiKeys, _ := testAPIKeyVerifier()
+	for _, key := range []string{"", "dump_", "dump_abc_def", "dump_zzzzzzzzzzzzzzzz_" + string(make([]byte, 43))} {
+		_, err := apiKeys.Verify(key)
+		assert.ErrorIs(t, err, ErrInvalidAPIKey, key)
+	}
+}
+
+func TestValidAPIKeyScopes(t *testing.T) {
+	assert.True(t, ValidAPIKeyScopes([]string{ScopeRead}))
+	assert.True(t, ValidAPIKeyScopes([]string{ScopeRead, ScopeWrite}))
+	assert.False(t, ValidAPIKeyScopes(nil))
+	assert.False(t, ValidAPIKeyScopes([]string{ScopeAccount}))
+	assert.False(t, ValidAPIKeyScopes([]string{"admin"}))
+}
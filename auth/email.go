@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const TokenTypeEmailVerification = "email_verification"
+
+// How long email verification links stay valid, in seconds
+const EmailVerificationTtl = 24 * 60 * 60
+
+// Email verification tokens are sent to an address to prove the user can
+// read mail sent there. They name the address, so that a token stops working
+// once the user changes it.
+type EmailVerificationClaims struct {
+	UserId    int32  `json:"user_id"`
+	TokenType string `json:"typ"`
+	Email     string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+func (c *EmailVerificationClaims) Validate() error {
+	return validateClaims(c.TokenType, TokenTypeEmailVerification, c.UserId, &c.RegisteredClaims)
+}
+
+func (f TokenFactory) CreateEmailVerificationToken(userId int32, email string) *jwt.Token {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &EmailVerificationClaims{
+		UserId:           userId,
+		TokenType:        TokenTypeEmailVerification,
+		Email:            email,
+		RegisteredClaims: f.createRegisteredClaims(userId, EmailVerificationTtl),
+	})
+}
+
+func (f TokenFactory) ParseEmailVerificationToken(tokenString string) (*jwt.Token, error) {
+	return f.parseToken(tokenString, &EmailVerificationClaims{}, EmailVerificationTtl)
+}
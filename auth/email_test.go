@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmailVerificationToken(t *testing.T) {
+	tf := NewTokenFactory(60, 60, generateRandomSecret())
+	tokenStr, err := tf.SignedString(tf.CreateEmailVerificationToken(7, "alice@example.com"))
+	require.NoError(t, err)
+
+	token, err := tf.ParseEmailVerificationToken(tokenStr)
+	require.NoError(t, err)
+	claims := token.Claims.(*EmailVerificationClaims)
+	assert.Equal(t, int32(7), claims.UserId)
+	assert.Equal(t, "alice@example.com", claims.Email)
+	assert.Equal(t, EmailVerificationTtl, int(claims.ExpiresAt.Sub(claims.IssuedAt.Time).Seconds()))
+}
+
+func TestEmailVerificationTokenIsNotASessionToken(t *testing.T) {
+	tf := NewTokenFactory(60, 60, generateRandomSecret())
+	verificationStr, err := tf.SignedString(tf.CreateEmailVerificationToken(7, "alice@example.com"))
+	require.NoError(t, err)
+	_, err = tf.ParseAccessToken(verificationStr)
+	assert.ErrorIs(t, err, ErrWrongTokenType)
+	_, err = tf.ParseRefreshToken(verificationStr)
+	assert.ErrorIs(t, err, ErrWrongTokenType)
+
+	accessStr, err := tf.SignedString(tf.CreateAccessToken(7))
+	require.NoError(t, err)
+	_, err = tf.ParseEmailVerificationToken(accessStr)
+	assert.ErrorIs(t, err, ErrWrongTokenType)
+}
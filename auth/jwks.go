@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"encoding/base64"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyId     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// The public keys that tokens valid at the given time may have been signed
+// with. HS256 keys are secret and never included.
+func (f TokenFactory) PublicKeys(now time.Time) JWKSet {
+	ttl := time.Second * time.Duration(max(f.accessTtl, f.refreshTtl))
+	set := JWKSet{Keys: make([]JWK, 0)}
+	for _, key := range f.keys.keys {
+		if key.retired() && now.After(key.RetiredAt.Add(ttl)) {
+			continue
+		}
+		if jwk, ok := key.publicJWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	slices.SortFunc(set.Keys, func(a, b JWK) int { return strings.Compare(a.KeyId, b.KeyId) })
+	return set
+}
+
+func (k *SigningKey) publicJWK() (JWK, bool) {
+	if k.Algorithm == AlgorithmHS256 {
+		return JWK{}, false
+	}
+	jwk := JWK{KeyId: k.Id, Algorithm: k.Algorithm, Use: "sig"}
+	switch public := k.PrivateKey.Public().(type) {
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	case *ecdsa.PublicKey:
+		ecdhKey, err := public.ECDH()
+		if err != nil {
+			return JWK{}, false
+		}
+		// uncompressed point: 0x04 followed by the coordinates
+		point := ecdhKey.Bytes()
+		size := (len(point) - 1) / 2
+		jwk.KeyType = "EC"
+		jwk.Curve = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(point[1 : 1+size])
+		jwk.Y = base64.RawURLEncoding.EncodeToString(point[1+size:])
+	default:
+		return JWK{}, false
+	}
+	return jwk, true
+}
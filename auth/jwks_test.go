@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func generateEd25519Key(t *testing.T, id string) *SigningKey {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return &SigningKey{Id: id, Algorithm: AlgorithmEdDSA, PrivateKey: private, CreatedAt: time.Now()}
+}
+
+func generateP256Key(t *testing.T, id string) *SigningKey {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return &SigningKey{Id: id, Algorithm: AlgorithmES256, PrivateKey: private, CreatedAt: time.Now()}
+}
+
+// Rebuild a verification key from a JWK, as a downstream service would
+func publicKeyFromJWK(t *testing.T, jwk JWK) any {
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	require.NoError(t, err)
+	switch jwk.KeyType {
+	case "OKP":
+		require.Equal(t, "Ed25519", jwk.Curve)
+		return ed25519.PublicKey(x)
+	case "EC":
+		require.Equal(t, "P-256", jwk.Curve)
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		require.NoError(t, err)
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	}
+	t.Fatalf("unexpected key type %s", jwk.KeyType)
+	return nil
+}
+
+func TestAsymmetricSigning(t *testing.T) {
+	for _, key := range []*SigningKey{generateEd25519Key(t, "ed"), generateP256Key(t, "ec")} {
+		keys, err := NewKeyring(key)
+		require.NoError(t, err)
+		tf := NewTokenFactoryWithKeyring(60, 60, keys)
+
+		tokenStr, err := tf.SignedString(tf.CreateAccessToken(1))
+		require.NoError(t, err)
+		token, err := tf.ParseAccessToken(tokenStr)
+		require.NoError(t, err, key.Algorithm)
+		assert.Equal(t, key.Algorithm, token.Method.Alg())
+		assert.Equal(t, key.Id, token.Header["kid"])
+
+		// verifiable with nothing but the published key
+		set := tf.PublicKeys(time.Now())
+		require.Len(t, set.Keys, 1)
+		jwk := set.Keys[0]
+		assert.Equal(t, key.Id, jwk.KeyId)
+		assert.Equal(t, key.Algorithm, jwk.Algorithm)
+		assert.Equal(t, "sig", jwk.Use)
+		claims := &AccessTokenClaims{}
+		_, err = jwt.ParseWithClaims(tokenStr, claims, func(*jwt.Token) (any, error) {
+			return publicKeyFromJWK(t, jwk), nil
+		}, jwt.WithValidMethods([]string{key.Algorithm}))
+		require.NoError(t, err, key.Algorithm)
+		assert.Equal(t, int32(1), claims.UserId)
+	}
+}
+
+func TestPublicKeysExcludeSecretsAndExpiredKeys(t *testing.T) {
+	current := generateEd25519Key(t, "current")
+	retiredRecently := generateP256Key(t, "recent")
+	retiredRecently.RetiredAt = time.Now().Add(-time.Minute)
+	retiredLongAgo := generateEd25519Key(t, "old")
+	retiredLongAgo.RetiredAt = time.Now().Add(-time.Hour)
+	keys, err := NewKeyring(
+		current, retiredRecently, retiredLongAgo,
+		&SigningKey{Id: "hmac", Secret: generateRandomSecret()})
+	require.NoError(t, err)
+	tf := NewTokenFactoryWithKeyring(60, 600, keys)
+
+	set := tf.PublicKeys(time.Now())
+	ids := make([]string, 0)
+	for _, jwk := range set.Keys {
+		ids = append(ids, jwk.KeyId)
+	}
+	assert.Equal(t, []string{"current", "recent"}, ids)
+}
+
+// An attacker who knows a published public key must not be able to pass it
+// off as an HMAC secret
+func TestAlgorithmConfusionIsRejected(t *testing.T) {
+	key := generateEd25519Key(t, "ed")
+	hmacKey := &SigningKey{Id: "hmac", Secret: generateRandomSecret(), CreatedAt: time.Unix(0, 0)}
+	keys, err := NewKeyring(key, hmacKey)
+	require.NoError(t, err)
+	tf := NewTokenFactoryWithKeyring(60, 60, keys)
+
+	public := key.PrivateKey.Public().(ed25519.PublicKey)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, tf.CreateAccessToken(1).Claims)
+	forged.Header["kid"] = "ed"
+	forgedStr, err := forged.SignedString([]byte(public))
+	require.NoError(t, err)
+	_, err = tf.ParseAccessToken(forgedStr)
+	assert.ErrorIs(t, err, ErrAlgorithmMismatch)
+
+	// nor can an HMAC key be used with an asymmetric algorithm's name
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	mislabelled := jwt.NewWithClaims(jwt.SigningMethodEdDSA, tf.CreateAccessToken(1).Claims)
+	mislabelled.Header["kid"] = "hmac"
+	mislabelledStr, err := mislabelled.SignedString(other)
+	require.NoError(t, err)
+	_, err = tf.ParseAccessToken(mislabelledStr)
+	assert.ErrorIs(t, err, ErrAlgorithmMismatch)
+
+	unsigned := jwt.NewWithClaims(jwt.SigningMethodNone, tf.CreateAccessToken(1).Claims)
+	unsignedStr, err := unsigned.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	_, err = tf.ParseAccessToken(unsignedStr)
+	assert.Error(t, err)
+}
+
+func TestNewKeyringRejectsMismatchedKeys(t *testing.T) {
+	ed := generateEd25519Key(t, "ed")
+	ed.Algorithm = AlgorithmES256
+	_, err := NewKeyring(ed)
+	assert.ErrorIs(t, err, ErrInvalidPrivateKey)
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, err = NewKeyring(&SigningKey{Id: "ec", Algorithm: AlgorithmES256, PrivateKey: p384})
+	assert.ErrorIs(t, err, ErrInvalidPrivateKey)
+
+	_, err = NewKeyring(&SigningKey{Id: "x", Algorithm: "RS256", Secret: []byte("x")})
+	assert.ErrorIs(t, err, ErrUnknownAlgorithm)
+}
+
+func TestLoadAsymmetricKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDer, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecDer, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+
+	writeKey := func(name, pemType string, der []byte) {
+		pemData := pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der})
+		data := `{"created_at": "2024-01-01T00:00:00Z", "private_key": ` + jsonString(string(pemData)) + `}`
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0600))
+	}
+	writeKey("ed.json", "PRIVATE KEY", edDer)
+	writeKey("ec.json", "EC PRIVATE KEY", ecDer)
+
+	keys, err := LoadKeyDir(dir)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "ec", keys[0].Id)
+	assert.Equal(t, AlgorithmES256, keys[0].Algorithm)
+	assert.True(t, ecKey.Equal(keys[0].PrivateKey))
+	assert.Equal(t, "ed", keys[1].Id)
+	assert.Equal(t, AlgorithmEdDSA, keys[1].Algorithm)
+	assert.True(t, edKey.Equal(keys[1].PrivateKey))
+}
+
+func jsonString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
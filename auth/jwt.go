@@ -2,10 +2,12 @@ package auth
 
 import (
 	"errors"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/raian621/dump/util"
 )
 
 var (
@@ -15,107 +17,292 @@ var (
 	ErrDistinctUserIds      = errors.New("refresh and access token user IDs do not match")
 	ErrDecodingAccessToken  = errors.New("error decoding access token")
 	ErrDecodingRefreshToken = errors.New("error decoding refresh token")
+	ErrWrongTokenType       = errors.New("token is not of the expected type")
+	ErrInvalidSubject       = errors.New("token subject does not match its user ID")
+	ErrMissingTokenId       = errors.New("token has no ID")
+)
+
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
 )
 
 type TokenFactory struct {
 	accessTtl  int
 	refreshTtl int
-	secret     []byte
+	keys       *Keyring
+	issuer     string
+	audience   string
+	leeway     time.Duration
+	now        func() time.Time
+}
+
+type TokenFactoryOption func(*TokenFactory)
+
+// Set the `iss` claim of issued tokens and require it of parsed ones
+func WithIssuer(issuer string) TokenFactoryOption {
+	return func(f *TokenFactory) { f.issuer = issuer }
+}
+
+// Set the `aud` claim of issued tokens and require it of parsed ones
+func WithAudience(audience string) TokenFactoryOption {
+	return func(f *TokenFactory) { f.audience = audience }
 }
 
+// Tolerate clocks this far apart when checking `exp`, `nbf` and `iat`
+func WithLeeway(leeway time.Duration) TokenFactoryOption {
+	return func(f *TokenFactory) { f.leeway = leeway }
+}
+
+// Access and refresh tokens carry a `typ` claim, checked when they are
+// parsed, so that one can't be passed off as the other.
 type AccessTokenClaims struct {
-	UserId int32 `json:"user_id"`
+	UserId    int32  `json:"user_id"`
+	TokenType string `json:"typ"`
+	// when the user signed in to the session, carried over by refreshes
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	// family of the session's refresh tokens, if the token says
+	FamilyId string `json:"fid,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// Called by the jwt package once the registered claims have been validated
+func (c *AccessTokenClaims) Validate() error {
+	return validateClaims(c.TokenType, TokenTypeAccess, c.UserId, &c.RegisteredClaims)
+}
+
+// Refresh tokens are single use: each refresh replaces the refresh token with
+// a new one in the same family. The ID (jti) identifies a token and the
+// family ID ties it to the sign-in it descends from, so that reuse of a
+// replaced token can revoke every token of that sign-in.
 type RefreshTokenClaims struct {
-	UserId int32 `json:"user_id"`
+	UserId    int32            `json:"user_id"`
+	TokenType string           `json:"typ"`
+	FamilyId  string           `json:"fid"`
+	AuthTime  *jwt.NumericDate `json:"auth_time,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func NewTokenFactory(accessTtl int, refreshTtl int, secret []byte) *TokenFactory {
-	return &TokenFactory{accessTtl, refreshTtl, secret}
+func (c *RefreshTokenClaims) Validate() error {
+	if err := validateClaims(c.TokenType, TokenTypeRefresh, c.UserId, &c.RegisteredClaims); err != nil {
+		return err
+	}
+	if c.FamilyId == "" {
+		return ErrDecodingRefreshToken
+	}
+	return nil
+}
+
+func validateClaims(tokenType, expectedType string, userId int32, claims *jwt.RegisteredClaims) error {
+	if tokenType != expectedType {
+		return ErrWrongTokenType
+	}
+	if claims.Subject != strconv.Itoa(int(userId)) {
+		return ErrInvalidSubject
+	}
+	if claims.ID == "" {
+		return ErrMissingTokenId
+	}
+	return nil
+}
+
+// The tokens issued by a refresh
+type RefreshedTokens struct {
+	AccessToken string
+	// the replacement refresh token and its claims
+	RefreshToken  string
+	RefreshClaims *RefreshTokenClaims
+	// claims of the refresh token that was presented, which must not be
+	// accepted again
+	UsedClaims *RefreshTokenClaims
 }
 
+// Create a token factory that signs and verifies tokens with a single secret
+func NewTokenFactory(accessTtl int, refreshTtl int, secret []byte, opts ...TokenFactoryOption) *TokenFactory {
+	keys, err := NewKeyring(NewSigningKey(secret))
+	if err != nil {
+		panic(err)
+	}
+	return NewTokenFactoryWithKeyring(accessTtl, refreshTtl, keys, opts...)
+}
+
+func NewTokenFactoryWithKeyring(accessTtl int, refreshTtl int, keys *Keyring, opts ...TokenFactoryOption) *TokenFactory {
+	f := &TokenFactory{accessTtl: accessTtl, refreshTtl: refreshTtl, keys: keys, now: time.Now}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Create the access token of a session the user has just signed in to
 func (f TokenFactory) CreateAccessToken(userId int32) *jwt.Token {
+	return f.createAccessToken(userId, "", jwt.NewNumericDate(f.now()))
+}
+
+// Create the access token and first refresh token of a session the user has
+// just signed in to. The access token names the refresh token's family, so
+// that requests tell which session they belong to.
+func (f TokenFactory) CreateSessionTokens(userId int32) (accessToken, refreshToken *jwt.Token) {
+	familyId, authTime := util.GenerateRandomId(), jwt.NewNumericDate(f.now())
+	return f.createAccessToken(userId, familyId, authTime), f.createRefreshToken(userId, familyId, authTime)
+}
+
+func (f TokenFactory) createAccessToken(userId int32, familyId string, authTime *jwt.NumericDate) *jwt.Token {
 	return jwt.NewWithClaims(jwt.SigningMethodHS256, &AccessTokenClaims{
 		UserId:           userId,
-		RegisteredClaims: createRegisteredClaims(f.accessTtl),
+		TokenType:        TokenTypeAccess,
+		AuthTime:         authTime,
+		FamilyId:         familyId,
+		RegisteredClaims: f.createRegisteredClaims(userId, f.accessTtl),
 	})
 }
 
+// Create the first refresh token of a new family
 func (f TokenFactory) CreateRefreshToken(userId int32) *jwt.Token {
+	return f.createRefreshToken(userId, util.GenerateRandomId(), jwt.NewNumericDate(f.now()))
+}
+
+func (f TokenFactory) createRefreshToken(userId int32, familyId string, authTime *jwt.NumericDate) *jwt.Token {
 	return jwt.NewWithClaims(jwt.SigningMethodHS256, &RefreshTokenClaims{
 		UserId:           userId,
-		RegisteredClaims: createRegisteredClaims(f.refreshTtl),
+		TokenType:        TokenTypeRefresh,
+		FamilyId:         familyId,
+		AuthTime:         authTime,
+		RegisteredClaims: f.createRegisteredClaims(userId, f.refreshTtl),
 	})
 }
 
-func createRegisteredClaims(ttl int) jwt.RegisteredClaims {
-	issuedTime := time.Now()
+func (f TokenFactory) createRegisteredClaims(userId int32, ttl int) jwt.RegisteredClaims {
+	issuedTime := f.now()
 	expireTime := issuedTime.Add(time.Second * time.Duration(ttl))
-	return jwt.RegisteredClaims{
+	claims := jwt.RegisteredClaims{
+		ID:        util.GenerateRandomId(),
+		Issuer:    f.issuer,
+		Subject:   strconv.Itoa(int(userId)),
 		IssuedAt:  jwt.NewNumericDate(issuedTime),
+		NotBefore: jwt.NewNumericDate(issuedTime),
 		ExpiresAt: jwt.NewNumericDate(expireTime),
 	}
+	if f.audience != "" {
+		claims.Audience = jwt.ClaimStrings{f.audience}
+	}
+	return claims
 }
 
+// Sign a token with the signing key, naming the key in the `kid` header
 func (f TokenFactory) SignedString(token *jwt.Token) (string, error) {
-	return token.SignedString(f.secret)
+	key := f.keys.signing
+	token.Method = signingMethods[key.Algorithm]
+	token.Header["alg"] = key.Algorithm
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.signingKey())
 }
 
 func (f TokenFactory) ParseAccessToken(tokenString string) (*jwt.Token, error) {
-	return f.parseToken(tokenString, &AccessTokenClaims{})
+	return f.parseToken(tokenString, &AccessTokenClaims{}, f.accessTtl)
 }
 
 func (f TokenFactory) ParseRefreshToken(tokenString string) (*jwt.Token, error) {
-	return f.parseToken(tokenString, &RefreshTokenClaims{})
+	return f.parseToken(tokenString, &RefreshTokenClaims{}, f.refreshTtl)
 }
 
-func (f TokenFactory) parseToken(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+// Parse a token of a kind that lives for ttl seconds, verifying it with the
+// key named by its `kid` header
+func (f TokenFactory) parseToken(tokenString string, claims jwt.Claims, ttl int) (*jwt.Token, error) {
 	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
-		return f.secret, nil
-	})
+		kid, _ := token.Header["kid"].(string)
+		key, err := f.keys.verificationKey(
+			kid, token.Method.Alg(), time.Second*time.Duration(ttl), f.now())
+		if err != nil {
+			return nil, err
+		}
+		return key.verificationKey(), nil
+	}, f.parserOptions()...)
+}
+
+// Validate claims as of the time they were issued, when they hadn't expired
+func (f TokenFactory) validateAsIssued(claims *AccessTokenClaims) error {
+	if claims.IssuedAt == nil {
+		return ErrDecodingAccessToken
+	}
+	issuedAt := claims.IssuedAt.Time
+	opts := append(f.parserOptions(), jwt.WithTimeFunc(func() time.Time { return issuedAt }))
+	return jwt.NewValidator(opts...).Validate(claims)
 }
 
-func (f TokenFactory) RefreshAccessToken(accessTokenStr, refreshTokenStr string) (string, error) {
+func (f TokenFactory) parserOptions() []jwt.ParserOption {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(f.keys.algorithms()),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(f.leeway),
+		jwt.WithTimeFunc(f.now),
+	}
+	if f.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(f.issuer))
+	}
+	if f.audience != "" {
+		opts = append(opts, jwt.WithAudience(f.audience))
+	}
+	return opts
+}
+
+// Validate a refresh token and the access token it accompanies, and issue a
+// new access token and a replacement refresh token. Whether the refresh token
+// has already been used is up to the caller to check.
+func (f TokenFactory) RefreshAccessToken(accessTokenStr, refreshTokenStr string) (*RefreshedTokens, error) {
 	accessToken, err := f.ParseAccessToken(accessTokenStr)
-	// Ignore token expired errors
-	if err != nil && !strings.Contains(err.Error(), jwt.ErrTokenExpired.Error()) {
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		// an expired access token is fine, as long as it was otherwise valid
+		err = f.validateAsIssued(accessToken.Claims.(*AccessTokenClaims))
+	}
+	if err != nil {
 		if strings.Contains(err.Error(), jwt.ErrSignatureInvalid.Error()) {
-			return "", ErrInvalidSignature
+			return nil, ErrInvalidSignature
 		}
-		return "", err
+		return nil, err
 	}
 
 	refreshToken, err := f.ParseRefreshToken(refreshTokenStr)
 	if err != nil {
 		if strings.Contains(err.Error(), jwt.ErrSignatureInvalid.Error()) {
-			return "", ErrInvalidSignature
+			return nil, ErrInvalidSignature
 		} else if strings.Contains(err.Error(), jwt.ErrTokenExpired.Error()) {
-			return "", ErrExpiredRefreshToken
+			return nil, ErrExpiredRefreshToken
 		}
-		return "", err
+		return nil, err
 	}
 
 	accessTokenClaims, ok := accessToken.Claims.(*AccessTokenClaims)
 	if !ok {
-		return "", ErrDecodingAccessToken
+		return nil, ErrDecodingAccessToken
 	}
 	refreshTokenClaims, ok := refreshToken.Claims.(*RefreshTokenClaims)
 	if !ok {
-		return "", ErrDecodingRefreshToken
+		return nil, ErrDecodingRefreshToken
 	}
 
 	if accessTokenClaims.UserId != refreshTokenClaims.UserId {
-		return "", ErrDistinctUserIds
+		return nil, ErrDistinctUserIds
 	}
 
-	issuedTime := time.Now()
-	expireTime := issuedTime.Add(time.Second * time.Duration(f.accessTtl))
-	accessTokenClaims.IssuedAt = jwt.NewNumericDate(issuedTime)
-	accessTokenClaims.ExpiresAt = jwt.NewNumericDate(expireTime)
-
-	newAccessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessTokenClaims)
-	return f.SignedString(newAccessToken)
+	// the session is the same one, so it keeps the time the user signed in
+	newAccessToken := f.createAccessToken(
+		accessTokenClaims.UserId, refreshTokenClaims.FamilyId, refreshTokenClaims.AuthTime)
+	newAccessTokenStr, err := f.SignedString(newAccessToken)
+	if err != nil {
+		return nil, err
+	}
+	newRefreshToken := f.createRefreshToken(
+		refreshTokenClaims.UserId, refreshTokenClaims.FamilyId, refreshTokenClaims.AuthTime)
+	newRefreshTokenStr, err := f.SignedString(newRefreshToken)
+	if err != nil {
+		return nil, err
+	}
+	return &RefreshedTokens{
+		AccessToken:   newAccessTokenStr,
+		RefreshToken:  newRefreshTokenStr,
+		RefreshClaims: newRefreshToken.Claims.(*RefreshTokenClaims),
+		UsedClaims:    refreshTokenClaims,
+	}, nil
 }
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"net/http"
 	"testing"
 	"time"
 
@@ -17,6 +18,14 @@ func generateRandomSecret() []byte {
 	return secret
 }
 
+// A copy of tf that issues tokens as if it were ago in the past, so that
+// tests don't have to wait for tokens to expire
+func issuedAgo(tf *TokenFactory, ago time.Duration) *TokenFactory {
+	past := *tf
+	past.now = func() time.Time { return time.Now().Add(-ago) }
+	return &past
+}
+
 func TestCreateAccessToken(t *testing.T) {
 	accessTtl := 20
 	tf := NewTokenFactory(accessTtl, 40, generateRandomSecret())
@@ -40,16 +49,17 @@ func TestValidateExpiredAccessToken(t *testing.T) {
 func TestRefreshAccessToken(t *testing.T) {
 	accessTtl := 1
 	tf := NewTokenFactory(accessTtl /*refreshTtl=*/, 20, generateRandomSecret())
-	accessToken := tf.CreateAccessToken(1)
-	accessTokenStr, err := tf.SignedString(accessToken)
+	// the access token has expired
+	past := issuedAgo(tf, 2*time.Second)
+	accessToken := past.CreateAccessToken(1)
+	accessTokenStr, err := past.SignedString(accessToken)
 	assert.NoError(t, err)
 	refreshToken := tf.CreateRefreshToken(1)
 	refreshTokenStr, err := tf.SignedString(refreshToken)
 	assert.NoError(t, err)
-	time.Sleep(time.Second) // wait for access token to expire
-	newAccessTokenStr, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
+	refreshed, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
 	assert.NoError(t, err)
-	newAccessToken, err := tf.ParseAccessToken(newAccessTokenStr)
+	newAccessToken, err := tf.ParseAccessToken(refreshed.AccessToken)
 	assert.NoError(t, err)
 	issuedAt, err := newAccessToken.Claims.GetIssuedAt()
 	assert.NoError(t, err)
@@ -60,29 +70,31 @@ func TestRefreshAccessToken(t *testing.T) {
 func TestRefreshAccessTokenWithDifferentUserId(t *testing.T) {
 	accessTtl := 1
 	tf := NewTokenFactory(accessTtl /*refreshTtl=*/, 20, generateRandomSecret())
-	accessToken := tf.CreateAccessToken(1)
-	accessTokenStr, err := tf.SignedString(accessToken)
+	// the access token has expired
+	past := issuedAgo(tf, 2*time.Second)
+	accessToken := past.CreateAccessToken(1)
+	accessTokenStr, err := past.SignedString(accessToken)
 	assert.NoError(t, err)
 	refreshToken := tf.CreateRefreshToken(2)
 	refreshTokenStr, err := tf.SignedString(refreshToken)
 	assert.NoError(t, err)
-	time.Sleep(time.Second) // wait for access token to expire
-	newAccessTokenStr, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
+	refreshed, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
 	assert.ErrorIs(t, err, ErrDistinctUserIds)
-	assert.Empty(t, newAccessTokenStr)
+	assert.Nil(t, refreshed)
 }
 func TestRefreshAccessTokenWithExpiredRefreshToken(t *testing.T) {
 	tf := NewTokenFactory(10, 1, generateRandomSecret())
 	accessToken := tf.CreateAccessToken(1)
-	refreshToken := tf.CreateRefreshToken(1)
+	// the refresh token has expired
+	past := issuedAgo(tf, 2*time.Second)
+	refreshToken := past.CreateRefreshToken(1)
 	accessTokenStr, err := tf.SignedString(accessToken)
 	assert.NoError(t, err)
-	refreshTokenStr, err := tf.SignedString(refreshToken)
+	refreshTokenStr, err := past.SignedString(refreshToken)
 	assert.NoError(t, err)
-	time.Sleep(time.Second) // wait for refresh token to expire
-	newAccessToken, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
+	refreshed, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
 	assert.ErrorIs(t, err, ErrExpiredRefreshToken)
-	assert.Empty(t, newAccessToken)
+	assert.Nil(t, refreshed)
 }
 
 func TestRefreshAccessTokenWithInvalidAccessTokenSignature(t *testing.T) {
@@ -94,9 +106,9 @@ func TestRefreshAccessTokenWithInvalidAccessTokenSignature(t *testing.T) {
 	refreshTokenStr, err := tf.SignedString(refreshToken)
 	accessTokenStr += "1" // mess up signature at the end of the jwt
 	assert.NoError(t, err)
-	newAccessToken, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
+	refreshed, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
 	assert.ErrorIs(t, err, ErrInvalidSignature)
-	assert.Empty(t, newAccessToken)
+	assert.Nil(t, refreshed)
 }
 
 func TestRefreshAccessTokenWithInvalidRefreshTokenSignature(t *testing.T) {
@@ -108,9 +120,9 @@ func TestRefreshAccessTokenWithInvalidRefreshTokenSignature(t *testing.T) {
 	refreshTokenStr, err := tf.SignedString(refreshToken)
 	refreshTokenStr += "1" // mess up signature at the end of the jwt
 	assert.NoError(t, err)
-	newAccessToken, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
+	refreshed, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
 	assert.ErrorIs(t, err, ErrInvalidSignature)
-	assert.Empty(t, newAccessToken)
+	assert.Nil(t, refreshed)
 }
 
 func TestRefreshAccessTokenWithDistinctUserIds(t *testing.T) {
@@ -122,7 +134,189 @@ func TestRefreshAccessTokenWithDistinctUserIds(t *testing.T) {
 	refreshTokenStr, err := tf.SignedString(refreshToken)
 	accessTokenStr += "1" // mess up signature at the end of the jwt
 	assert.NoError(t, err)
-	newAccessToken, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
+	refreshed, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
 	assert.Error(t, err)
-	assert.Empty(t, newAccessToken)
+	assert.Nil(t, refreshed)
+}
+
+func TestRefreshRotatesRefreshToken(t *testing.T) {
+	tf := NewTokenFactory(10, 20, generateRandomSecret())
+	accessTokenStr, err := tf.SignedString(tf.CreateAccessToken(1))
+	assert.NoError(t, err)
+	refreshToken := tf.CreateRefreshToken(1)
+	refreshTokenStr, err := tf.SignedString(refreshToken)
+	assert.NoError(t, err)
+	claims := refreshToken.Claims.(*RefreshTokenClaims)
+	assert.NotEmpty(t, claims.ID)
+	assert.NotEmpty(t, claims.FamilyId)
+
+	refreshed, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
+	assert.NoError(t, err)
+	assert.Equal(t, claims.ID, refreshed.UsedClaims.ID)
+	assert.NotEqual(t, refreshTokenStr, refreshed.RefreshToken)
+	// the replacement is a new token in the same family
+	parsed, err := tf.ParseRefreshToken(refreshed.RefreshToken)
+	assert.NoError(t, err)
+	newClaims := parsed.Claims.(*RefreshTokenClaims)
+	assert.Equal(t, refreshed.RefreshClaims, newClaims)
+	assert.NotEqual(t, claims.ID, newClaims.ID)
+	assert.Equal(t, claims.FamilyId, newClaims.FamilyId)
+	assert.Equal(t, int32(1), newClaims.UserId)
+
+	// separate sign-ins start separate families
+	other := tf.CreateRefreshToken(1).Claims.(*RefreshTokenClaims)
+	assert.NotEqual(t, claims.FamilyId, other.FamilyId)
+}
+
+func TestRefreshKeepsAuthTime(t *testing.T) {
+	tf := NewTokenFactory(10, 20, generateRandomSecret())
+	// signed in a while before the refresh
+	past := issuedAgo(tf, 2*time.Second)
+	accessTokenStr, err := past.SignedString(past.CreateAccessToken(1))
+	assert.NoError(t, err)
+	refreshToken := past.CreateRefreshToken(1)
+	refreshTokenStr, err := past.SignedString(refreshToken)
+	assert.NoError(t, err)
+	authTime := refreshToken.Claims.(*RefreshTokenClaims).AuthTime
+	assert.NotNil(t, authTime)
+
+	refreshed, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
+	assert.NoError(t, err)
+	assert.Equal(t, authTime, refreshed.RefreshClaims.AuthTime)
+	parsed, err := tf.ParseAccessToken(refreshed.AccessToken)
+	assert.NoError(t, err)
+	claims := parsed.Claims.(*AccessTokenClaims)
+	assert.Equal(t, authTime.Unix(), claims.AuthTime.Unix())
+	assert.True(t, claims.IssuedAt.After(authTime.Time))
+}
+
+func TestRefreshTokenIsNotAnAccessToken(t *testing.T) {
+	tf := NewTokenFactory(60, 60, generateRandomSecret())
+	refreshTokenStr, err := tf.SignedString(tf.CreateRefreshToken(1))
+	assert.NoError(t, err)
+
+	_, err = tf.ParseAccessToken(refreshTokenStr)
+	assert.ErrorIs(t, err, ErrWrongTokenType)
+	revocations := NewRevocationCache(time.Minute, func(userId int32) (time.Time, error) {
+		return time.Time{}, nil
+	})
+	assert.Equal(t, http.StatusUnauthorized, authenticate(t, tf, revocations, nil, refreshTokenStr, ScopeRead))
+}
+
+func TestAccessTokenIsNotARefreshToken(t *testing.T) {
+	tf := NewTokenFactory(60, 60, generateRandomSecret())
+	accessTokenStr, err := tf.SignedString(tf.CreateAccessToken(1))
+	assert.NoError(t, err)
+
+	_, err = tf.ParseRefreshToken(accessTokenStr)
+	assert.ErrorIs(t, err, ErrWrongTokenType)
+	refreshed, err := tf.RefreshAccessToken(accessTokenStr, accessTokenStr)
+	assert.ErrorIs(t, err, ErrWrongTokenType)
+	assert.Nil(t, refreshed)
+}
+
+func TestRefreshRejectsExpiredRefreshTokenPresentedAsAccessToken(t *testing.T) {
+	tf := NewTokenFactory(1, 1, generateRandomSecret())
+	// expired tokens are accepted in place of the access token
+	past := issuedAgo(tf, 2*time.Second)
+	refreshTokenStr, err := past.SignedString(past.CreateRefreshToken(1))
+	assert.NoError(t, err)
+
+	refreshed, err := tf.RefreshAccessToken(refreshTokenStr, refreshTokenStr)
+	assert.ErrorIs(t, err, ErrWrongTokenType)
+	assert.Nil(t, refreshed)
+}
+
+func TestRegisteredClaims(t *testing.T) {
+	tf := NewTokenFactory(60, 60, generateRandomSecret(), WithIssuer("https://dump.example"), WithAudience("dump-api"))
+	token := tf.CreateAccessToken(42)
+	claims := token.Claims.(*AccessTokenClaims)
+	assert.Equal(t, "https://dump.example", claims.Issuer)
+	assert.Equal(t, jwt.ClaimStrings{"dump-api"}, claims.Audience)
+	assert.Equal(t, "42", claims.Subject)
+	assert.Equal(t, TokenTypeAccess, claims.TokenType)
+	assert.Equal(t, claims.IssuedAt, claims.NotBefore)
+	assert.NotEmpty(t, claims.ID)
+	assert.NotEqual(t, claims.ID, tf.CreateAccessToken(42).Claims.(*AccessTokenClaims).ID)
+
+	tokenStr, err := tf.SignedString(token)
+	assert.NoError(t, err)
+	_, err = tf.ParseAccessToken(tokenStr)
+	assert.NoError(t, err)
+}
+
+func TestIssuerAndAudienceAreValidated(t *testing.T) {
+	secret := generateRandomSecret()
+	tf := NewTokenFactory(60, 60, secret, WithIssuer("dump"), WithAudience("dump-api"))
+	for name, other := range map[string]*TokenFactory{
+		"wrong issuer":     NewTokenFactory(60, 60, secret, WithIssuer("other"), WithAudience("dump-api")),
+		"wrong audience":   NewTokenFactory(60, 60, secret, WithIssuer("dump"), WithAudience("other-api")),
+		"missing issuer":   NewTokenFactory(60, 60, secret, WithAudience("dump-api")),
+		"missing audience": NewTokenFactory(60, 60, secret, WithIssuer("dump")),
+	} {
+		tokenStr, err := other.SignedString(other.CreateAccessToken(1))
+		assert.NoError(t, err)
+		_, err = tf.ParseAccessToken(tokenStr)
+		assert.ErrorIs(t, err, jwt.ErrTokenInvalidClaims, name)
+	}
+}
+
+func TestSubjectMustMatchUserId(t *testing.T) {
+	tf := NewTokenFactory(60, 60, generateRandomSecret())
+	token := tf.CreateAccessToken(1)
+	token.Claims.(*AccessTokenClaims).Subject = "2"
+	tokenStr, err := tf.SignedString(token)
+	assert.NoError(t, err)
+
+	_, err = tf.ParseAccessToken(tokenStr)
+	assert.ErrorIs(t, err, ErrInvalidSubject)
+}
+
+func TestNotBeforeAndLeeway(t *testing.T) {
+	secret := generateRandomSecret()
+	tf := NewTokenFactory(60, 60, secret)
+	token := tf.CreateAccessToken(1)
+	// issued by a server whose clock runs 10 seconds fast
+	claims := token.Claims.(*AccessTokenClaims)
+	claims.IssuedAt = jwt.NewNumericDate(time.Now().Add(10 * time.Second))
+	claims.NotBefore = claims.IssuedAt
+	tokenStr, err := tf.SignedString(token)
+	assert.NoError(t, err)
+
+	_, err = tf.ParseAccessToken(tokenStr)
+	assert.ErrorIs(t, err, jwt.ErrTokenNotValidYet)
+	lenient := NewTokenFactory(60, 60, secret, WithLeeway(30*time.Second))
+	_, err = lenient.ParseAccessToken(tokenStr)
+	assert.NoError(t, err)
+}
+
+func TestTokensMustExpire(t *testing.T) {
+	tf := NewTokenFactory(60, 60, generateRandomSecret())
+	token := tf.CreateAccessToken(1)
+	token.Claims.(*AccessTokenClaims).ExpiresAt = nil
+	tokenStr, err := tf.SignedString(token)
+	assert.NoError(t, err)
+
+	_, err = tf.ParseAccessToken(tokenStr)
+	assert.ErrorIs(t, err, jwt.ErrTokenRequiredClaimMissing)
+}
+
+func TestSessionTokensShareFamily(t *testing.T) {
+	tf := NewTokenFactory(10, 20, generateRandomSecret())
+	accessToken, refreshToken := tf.CreateSessionTokens(1)
+	accessClaims := accessToken.Claims.(*AccessTokenClaims)
+	refreshClaims := refreshToken.Claims.(*RefreshTokenClaims)
+	assert.NotEmpty(t, refreshClaims.FamilyId)
+	assert.Equal(t, refreshClaims.FamilyId, accessClaims.FamilyId)
+	assert.Equal(t, refreshClaims.AuthTime, accessClaims.AuthTime)
+
+	accessTokenStr, err := tf.SignedString(accessToken)
+	assert.NoError(t, err)
+	refreshTokenStr, err := tf.SignedString(refreshToken)
+	assert.NoError(t, err)
+	refreshed, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
+	assert.NoError(t, err)
+	parsed, err := tf.ParseAccessToken(refreshed.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, refreshClaims.FamilyId, parsed.Claims.(*AccessTokenClaims).FamilyId)
 }
@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgorithmHS256 = "HS256" // HMAC with SHA-256
+	AlgorithmEdDSA = "EdDSA" // Ed25519
+	AlgorithmES256 = "ES256" // ECDSA with P-256 and SHA-256
+)
+
+var signingMethods = map[string]jwt.SigningMethod{
+	AlgorithmHS256: jwt.SigningMethodHS256,
+	AlgorithmEdDSA: jwt.SigningMethodEdDSA,
+	AlgorithmES256: jwt.SigningMethodES256,
+}
+
+var (
+	ErrNoSigningKey      = errors.New("keyring has no active signing key")
+	ErrUnknownAlgorithm  = errors.New("unsupported signing algorithm")
+	ErrInvalidPrivateKey = errors.New("private key does not suit the key's algorithm")
+	ErrAlgorithmMismatch = errors.New("token algorithm does not match its key")
+	ErrDuplicateKeyId    = errors.New("keyring has two keys with the same ID")
+	ErrEmptySecret       = errors.New("signing key secret is empty")
+	ErrUnknownKeyId      = errors.New("token signed with an unknown key")
+	ErrRetiredSigningKey = errors.New("token signed with a key retired too long ago")
+)
+
+// A key tokens are signed with. Keys that haven't been retired are active:
+// the active key created last signs new tokens and the others are only used
+// for verification, which lets every server learn a new key before any
+// server signs with it. A retired key keeps verifying tokens until every
+// token it could have signed has expired.
+//
+// HS256 keys are shared secrets. The public halves of EdDSA and ES256 keys
+// are published so that other services can verify tokens on their own.
+type SigningKey struct {
+	Id         string
+	Algorithm  string        // one of the Algorithm* constants; HS256 if empty
+	Secret     []byte        // HS256 keys only
+	PrivateKey crypto.Signer // ed25519.PrivateKey for EdDSA, *ecdsa.PrivateKey for ES256
+	CreatedAt  time.Time
+	RetiredAt  time.Time // zero while the key is active
+}
+
+// Create an active key with an ID derived from its secret
+func NewSigningKey(secret []byte) *SigningKey {
+	sum := sha256.Sum256(append([]byte("dump jwt key id\x00"), secret...))
+	return &SigningKey{Id: hex.EncodeToString(sum[:8]), Secret: secret}
+}
+
+func (k *SigningKey) retired() bool {
+	return !k.RetiredAt.IsZero()
+}
+
+func (k *SigningKey) validate() error {
+	if k.Algorithm == "" {
+		k.Algorithm = AlgorithmHS256
+	}
+	switch k.Algorithm {
+	case AlgorithmHS256:
+		if len(k.Secret) == 0 {
+			return ErrEmptySecret
+		}
+	case AlgorithmEdDSA:
+		if _, ok := k.PrivateKey.(ed25519.PrivateKey); !ok {
+			return ErrInvalidPrivateKey
+		}
+	case AlgorithmES256:
+		key, ok := k.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok || key.Curve != elliptic.P256() {
+			return ErrInvalidPrivateKey
+		}
+	default:
+		return ErrUnknownAlgorithm
+	}
+	return nil
+}
+
+// The key passed to the jwt package to sign tokens
+func (k *SigningKey) signingKey() any {
+	if k.Algorithm == AlgorithmHS256 {
+		return k.Secret
+	}
+	return k.PrivateKey
+}
+
+// The key passed to the jwt package to verify tokens
+func (k *SigningKey) verificationKey() any {
+	if k.Algorithm == AlgorithmHS256 {
+		return k.Secret
+	}
+	return k.PrivateKey.Public()
+}
+
+type Keyring struct {
+	signing *SigningKey
+	keys    map[string]*SigningKey
+}
+
+func NewKeyring(keys ...*SigningKey) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]*SigningKey, len(keys))}
+	for _, key := range keys {
+		if err := key.validate(); err != nil {
+			return nil, fmt.Errorf("%w: %s", err, key.Id)
+		}
+		if _, found := k.keys[key.Id]; found {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateKeyId, key.Id)
+		}
+		k.keys[key.Id] = key
+		if !key.retired() && (k.signing == nil || key.CreatedAt.After(k.signing.CreatedAt)) {
+			k.signing = key
+		}
+	}
+	if k.signing == nil {
+		return nil, ErrNoSigningKey
+	}
+	return k, nil
+}
+
+// ID of the key new tokens are signed with
+func (k *Keyring) SigningKeyId() string {
+	return k.signing.Id
+}
+
+// Find the key a token was signed with. Tokens live for at most ttl, so a
+// key retired longer ago than that can't have signed a valid token. Tokens
+// without a key ID predate key IDs and can only have been signed with the
+// signing key.
+//
+// The token's algorithm must be its key's: otherwise a token "signed" with
+// HS256 using a published public key as the secret would verify.
+func (k *Keyring) verificationKey(kid, alg string, ttl time.Duration, now time.Time) (*SigningKey, error) {
+	key := k.signing
+	if kid != "" {
+		var found bool
+		if key, found = k.keys[kid]; !found {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKeyId, kid)
+		}
+	}
+	if key.retired() && now.After(key.RetiredAt.Add(ttl)) {
+		return nil, fmt.Errorf("%w: %s", ErrRetiredSigningKey, key.Id)
+	}
+	if alg != key.Algorithm {
+		return nil, fmt.Errorf("%w: %s", ErrAlgorithmMismatch, key.Id)
+	}
+	return key, nil
+}
+
+// Algorithms of the keys in the keyring
+func (k *Keyring) algorithms() []string {
+	algs := make([]string, 0, len(signingMethods))
+	for alg := range signingMethods {
+		for _, key := range k.keys {
+			if key.Algorithm == alg {
+				algs = append(algs, alg)
+				break
+			}
+		}
+	}
+	return algs
+}
+
+// A key file holds one key as JSON. HS256 keys have a base64url encoded
+// secret, like JWT_SECRET; EdDSA and ES256 keys have a PEM encoded PKCS #8
+// (or, for ES256, SEC 1) private key. alg defaults to the one the key suits.
+// Times are RFC 3339.
+type keyFile struct {
+	Id         string    `json:"kid"`
+	Algorithm  string    `json:"alg"`
+	Secret     string    `json:"secret"`
+	PrivateKey string    `json:"private_key"`
+	CreatedAt  time.Time `json:"created_at"`
+	RetiredAt  time.Time `json:"retired_at,omitzero"`
+}
+
+// Load the keys in every *.json file in a directory
+func LoadKeyDir(dir string) ([]*SigningKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*SigningKey, 0, len(paths))
+	for _, path := range paths {
+		key, err := loadKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func loadKeyFile(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &keyFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, err
+	}
+	if file.Id == "" {
+		file.Id = strings.TrimSuffix(filepath.Base(path), ".json")
+	}
+	key := &SigningKey{
+		Id:        file.Id,
+		Algorithm: file.Algorithm,
+		CreatedAt: file.CreatedAt,
+		RetiredAt: file.RetiredAt,
+	}
+	if file.PrivateKey == "" {
+		key.Secret, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(file.Secret, "="))
+		return key, err
+	}
+
+	key.PrivateKey, err = parsePrivateKey([]byte(file.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	if key.Algorithm == "" {
+		switch key.PrivateKey.(type) {
+		case ed25519.PrivateKey:
+			key.Algorithm = AlgorithmEdDSA
+		case *ecdsa.PrivateKey:
+			key.Algorithm = AlgorithmES256
+		}
+	}
+	return key, nil
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrInvalidPrivateKey
+	}
+	return signer, nil
+}
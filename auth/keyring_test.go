@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokensCarryKeyId(t *testing.T) {
+	keys, err := NewKeyring(&SigningKey{Id: "key-1", Secret: generateRandomSecret()})
+	require.NoError(t, err)
+	tf := NewTokenFactoryWithKeyring(60, 60, keys)
+
+	tokenStr, err := tf.SignedString(tf.CreateAccessToken(1))
+	require.NoError(t, err)
+	token, err := tf.ParseAccessToken(tokenStr)
+	require.NoError(t, err)
+	assert.Equal(t, "key-1", token.Header["kid"])
+}
+
+func TestTokensSignedWithPreviousKeyVerifyAfterRotation(t *testing.T) {
+	oldKey := &SigningKey{Id: "old", Secret: generateRandomSecret(), CreatedAt: time.Unix(1000, 0)}
+	oldKeys, err := NewKeyring(oldKey)
+	require.NoError(t, err)
+	oldFactory := NewTokenFactoryWithKeyring(60, 600, oldKeys)
+	accessTokenStr, err := oldFactory.SignedString(oldFactory.CreateAccessToken(1))
+	require.NoError(t, err)
+	refreshTokenStr, err := oldFactory.SignedString(oldFactory.CreateRefreshToken(1))
+	require.NoError(t, err)
+
+	retired := *oldKey
+	retired.RetiredAt = time.Now()
+	newKey := &SigningKey{Id: "new", Secret: generateRandomSecret(), CreatedAt: time.Unix(2000, 0)}
+	newKeys, err := NewKeyring(&retired, newKey)
+	require.NoError(t, err)
+	assert.Equal(t, "new", newKeys.SigningKeyId())
+	tf := NewTokenFactoryWithKeyring(60, 600, newKeys)
+
+	_, err = tf.ParseAccessToken(accessTokenStr)
+	assert.NoError(t, err)
+	refreshed, err := tf.RefreshAccessToken(accessTokenStr, refreshTokenStr)
+	require.NoError(t, err)
+	// tokens issued after the rotation are signed with the new key
+	token, err := tf.ParseRefreshToken(refreshed.RefreshToken)
+	require.NoError(t, err)
+	assert.Equal(t, "new", token.Header["kid"])
+}
+
+func TestRetiredKeysStopVerifyingOnceTheirTokensExpire(t *testing.T) {
+	secret := generateRandomSecret()
+	oldKeys, err := NewKeyring(&SigningKey{Id: "old", Secret: secret})
+	require.NoError(t, err)
+	oldFactory := NewTokenFactoryWithKeyring(60, 600, oldKeys)
+	accessTokenStr, err := oldFactory.SignedString(oldFactory.CreateAccessToken(1))
+	require.NoError(t, err)
+	refreshTokenStr, err := oldFactory.SignedString(oldFactory.CreateRefreshToken(1))
+	require.NoError(t, err)
+
+	// retired 2 minutes ago: access tokens it signed have all expired, but
+	// refresh tokens haven't
+	keys, err := NewKeyring(
+		&SigningKey{Id: "old", Secret: secret, RetiredAt: time.Now().Add(-2 * time.Minute)},
+		&SigningKey{Id: "new", Secret: generateRandomSecret(), CreatedAt: time.Now()})
+	require.NoError(t, err)
+	tf := NewTokenFactoryWithKeyring(60, 600, keys)
+
+	_, err = tf.ParseAccessToken(accessTokenStr)
+	assert.ErrorIs(t, err, ErrRetiredSigningKey)
+	_, err = tf.ParseRefreshToken(refreshTokenStr)
+	assert.NoError(t, err)
+}
+
+func TestTokensWithUnknownKeyIdAreRejected(t *testing.T) {
+	tf := NewTokenFactory(60, 60, generateRandomSecret())
+	token := tf.CreateAccessToken(1)
+	token.Header["kid"] = "unknown"
+	tokenStr, err := token.SignedString(tf.keys.signing.Secret)
+	require.NoError(t, err)
+
+	_, err = tf.ParseAccessToken(tokenStr)
+	assert.ErrorIs(t, err, ErrUnknownKeyId)
+}
+
+func TestTokensWithoutKeyIdUseSigningKey(t *testing.T) {
+	tf := NewTokenFactory(60, 60, generateRandomSecret())
+	tokenStr, err := tf.CreateAccessToken(1).SignedString(tf.keys.signing.Secret)
+	require.NoError(t, err)
+
+	_, err = tf.ParseAccessToken(tokenStr)
+	assert.NoError(t, err)
+}
+
+func TestTokensWithOtherAlgorithmsAreRejected(t *testing.T) {
+	tf := NewTokenFactory(60, 60, generateRandomSecret())
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, tf.CreateAccessToken(1).Claims)
+	token.Header["kid"] = tf.keys.SigningKeyId()
+	tokenStr, err := token.SignedString(tf.keys.signing.Secret)
+	require.NoError(t, err)
+
+	_, err = tf.ParseAccessToken(tokenStr)
+	assert.ErrorIs(t, err, jwt.ErrTokenSignatureInvalid)
+}
+
+func TestNewKeyringValidation(t *testing.T) {
+	_, err := NewKeyring()
+	assert.ErrorIs(t, err, ErrNoSigningKey)
+	_, err = NewKeyring(&SigningKey{Id: "a", Secret: []byte("x"), RetiredAt: time.Now()})
+	assert.ErrorIs(t, err, ErrNoSigningKey)
+	_, err = NewKeyring(&SigningKey{Id: "a", Secret: []byte("x")}, &SigningKey{Id: "a", Secret: []byte("y")})
+	assert.ErrorIs(t, err, ErrDuplicateKeyId)
+	_, err = NewKeyring(&SigningKey{Id: "a"})
+	assert.ErrorIs(t, err, ErrEmptySecret)
+}
+
+func TestLoadKeyDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "2024-01.json"), []byte(`{
+		"secret": "c2VjcmV0LW9uZQ",
+		"created_at": "2024-01-01T00:00:00Z",
+		"retired_at": "2024-06-01T00:00:00Z"
+	}`), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "second.json"), []byte(`{
+		"kid": "2024-06",
+		"secret": "c2VjcmV0LXR3bw",
+		"created_at": "2024-06-01T00:00:00Z"
+	}`), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0600))
+
+	keys, err := LoadKeyDir(dir)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "2024-01", keys[0].Id)
+	assert.Equal(t, []byte("secret-one"), keys[0].Secret)
+	assert.Equal(t, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), keys[0].RetiredAt.UTC())
+	assert.Equal(t, "2024-06", keys[1].Id)
+	assert.Equal(t, []byte("secret-two"), keys[1].Secret)
+	assert.True(t, keys[1].RetiredAt.IsZero())
+
+	keyring, err := NewKeyring(keys...)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-06", keyring.SigningKeyId())
+}
+
+func TestLoadKeyDirRejectsInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bad.json"), []byte(`{"secret": "!!"}`), 0600))
+	_, err := LoadKeyDir(dir)
+	assert.Error(t, err)
+}
@@ -1,28 +1,88 @@
 package auth
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/labstack/echo/v4"
 )
 
-func AuthMiddleware(tf *TokenFactory) echo.MiddlewareFunc {
+// Authenticate a request by the access token or API key in its Authorization
+// header, setting "user_id" and "grant" (a *Grant) in its context
+func AuthMiddleware(tf *TokenFactory, revocations *RevocationCache, apiKeys *APIKeyVerifier) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			accessTokenStr, found := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer: ")
+			token, found := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer: ")
 			if !found {
 				return c.String(http.StatusUnauthorized, "No access token provided")
 			}
 
-			accessToken, err := tf.parseToken(accessTokenStr, &AccessTokenClaims{})
+			var grant *Grant
+			var err error
+			if IsAPIKey(token) {
+				grant, err = authenticateAPIKey(c, apiKeys, token)
+			} else {
+				grant, err = authenticateAccessToken(c, tf, revocations, token)
+			}
 			if err != nil {
-				c.Logger().Error("error authenticating user:", err)
-				return echo.NewHTTPError(http.StatusUnauthorized, "invalid access token")
+				return err
 			}
 
-			c.Set("user_id", accessToken.Claims.(*AccessTokenClaims).UserId)
+			c.Set("user_id", grant.UserId)
+			c.Set("grant", grant)
+
+			return next(c)
+		}
+	}
+}
+
+func authenticateAccessToken(c echo.Context, tf *TokenFactory, revocations *RevocationCache, accessTokenStr string) (*Grant, error) {
+	accessToken, err := tf.ParseAccessToken(accessTokenStr)
+	if err != nil {
+		c.Logger().Error("error authenticating user:", err)
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid access token")
+	}
+	claims := accessToken.Claims.(*AccessTokenClaims)
+
+	if claims.IssuedAt == nil {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid access token")
+	}
+	revoked, err := revocations.IsRevoked(claims.UserId, claims.IssuedAt.Time)
+	if err != nil {
+		c.Logger().Error("error checking access token revocation:", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	} else if revoked {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "access token revoked")
+	}
+
+	grant := &Grant{UserId: claims.UserId, Scopes: sessionScopes, SessionFamilyId: claims.FamilyId}
+	if claims.AuthTime != nil {
+		grant.AuthTime = claims.AuthTime.Time
+	}
+	return grant, nil
+}
+
+func authenticateAPIKey(c echo.Context, apiKeys *APIKeyVerifier, key string) (*Grant, error) {
+	grant, err := apiKeys.Verify(key)
+	if errors.Is(err, ErrInvalidAPIKey) {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid API key")
+	} else if err != nil {
+		c.Logger().Error("error checking API key:", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	return grant, nil
+}
 
+// Reject requests, authenticated by AuthMiddleware, that weren't granted a
+// scope
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			grant, ok := c.Get("grant").(*Grant)
+			if !ok || !grant.HasScope(scope) {
+				return echo.NewHTTPError(http.StatusForbidden, "missing scope: "+scope)
+			}
 			return next(c)
 		}
 	}
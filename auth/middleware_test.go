@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/models/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run a request with the given access token or API key through the
+// middleware and return the resulting status
+func authenticate(t *testing.T, tf *TokenFactory, revocations *RevocationCache, apiKeys *APIKeyVerifier, accessToken string, scope string) int {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer: "+accessToken)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	handler := func(c echo.Context) error {
+		assert.Equal(t, int32(1), c.Get("user_id"))
+		return c.NoContent(http.StatusOK)
+	}
+	err := AuthMiddleware(tf, revocations, apiKeys)(RequireScope(scope)(handler))(c)
+	if err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	return rec.Code
+}
+
+func TestAuthMiddlewareRejectsRevokedTokens(t *testing.T) {
+	tf := NewTokenFactory(60, 60, generateRandomSecret())
+	validAfter := time.Time{}
+	revocations := NewRevocationCache(time.Minute, func(userId int32) (time.Time, error) {
+		return validAfter, nil
+	})
+	accessToken, err := tf.SignedString(tf.CreateAccessToken(1))
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, authenticate(t, tf, revocations, nil, accessToken, ScopeAccount))
+	revocations.Revoke(1, time.Now())
+	assert.Equal(t, http.StatusUnauthorized, authenticate(t, tf, revocations, nil, accessToken, ScopeAccount))
+}
+
+func TestAuthMiddlewareRejectsInvalidTokens(t *testing.T) {
+	tf := NewTokenFactory(60, 60, generateRandomSecret())
+	revocations := NewRevocationCache(time.Minute, func(userId int32) (time.Time, error) {
+		return time.Time{}, nil
+	})
+	other := NewTokenFactory(60, 60, generateRandomSecret())
+	forged, err := other.SignedString(other.CreateAccessToken(1))
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, authenticate(t, tf, revocations, nil, forged, ScopeRead))
+	assert.Equal(t, http.StatusUnauthorized, authenticate(t, tf, revocations, nil, "garbage", ScopeRead))
+}
+
+func TestAuthMiddlewareAcceptsAPIKeys(t *testing.T) {
+	apiKeys, keys := testAPIKeyVerifier()
+	key, keyId, hash := apiKeys.Generate()
+	keys[keyId] = &storage.APIKey{Id: 7, UserId: 1, KeyId: keyId, KeyHash: hash, Scopes: []string{ScopeRead}}
+
+	assert.Equal(t, http.StatusOK, authenticate(t, nil, nil, apiKeys, key, ScopeRead))
+	assert.Equal(t, http.StatusForbidden, authenticate(t, nil, nil, apiKeys, key, ScopeWrite))
+	assert.Equal(t, http.StatusForbidden, authenticate(t, nil, nil, apiKeys, key, ScopeAccount))
+
+	unknown, _, _ := apiKeys.Generate()
+	assert.Equal(t, http.StatusUnauthorized, authenticate(t, nil, nil, apiKeys, unknown, ScopeRead))
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Caches each user's "tokens valid after" time: access tokens issued at or
+// before it have been revoked. Entries are reloaded once they are older than
+// the cache's TTL, so a revocation made through another server takes up to
+// that long to be enforced here; revocations made through this server should
+// be recorded with Revoke to take effect immediately.
+type RevocationCache struct {
+	ttl  time.Duration
+	load func(userId int32) (time.Time, error)
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[int32]revocationEntry
+}
+
+type revocationEntry struct {
+	validAfter time.Time
+	loadedAt   time.Time
+}
+
+// Sweep stale entries whenever the cache grows past this many users
+const revocationCacheSweepSize = 10000
+
+// load looks up a user's "tokens valid after" time, returning the zero time if
+// none of their tokens have been revoked
+func NewRevocationCache(ttl time.Duration, load func(userId int32) (time.Time, error)) *RevocationCache {
+	return &RevocationCache{
+		ttl:     ttl,
+		load:    load,
+		now:     time.Now,
+		entries: make(map[int32]revocationEntry),
+	}
+}
+
+func (r *RevocationCache) ValidAfter(userId int32) (time.Time, error) {
+	r.mu.Lock()
+	entry, found := r.entries[userId]
+	r.mu.Unlock()
+	if found && r.now().Sub(entry.loadedAt) < r.ttl {
+		return entry.validAfter, nil
+	}
+
+	validAfter, err := r.load(userId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return r.store(userId, validAfter), nil
+}
+
+// Reports whether a token issued to the user at the given time has been
+// revoked
+func (r *RevocationCache) IsRevoked(userId int32, issuedAt time.Time) (bool, error) {
+	validAfter, err := r.ValidAfter(userId)
+	if err != nil {
+		return false, err
+	}
+	// issued-at times are truncated to the second, so a token issued in the
+	// same second as a revocation is treated as issued before it
+	return !issuedAt.After(validAfter), nil
+}
+
+// Record that the user's tokens issued at or before validAfter are revoked
+func (r *RevocationCache) Revoke(userId int32, validAfter time.Time) {
+	r.store(userId, validAfter)
+}
+
+func (r *RevocationCache) store(userId int32, validAfter time.Time) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	// never move the time back: a slow load may race with a revocation
+	if entry, found := r.entries[userId]; found && entry.validAfter.After(validAfter) {
+		validAfter = entry.validAfter
+	}
+	r.entries[userId] = revocationEntry{validAfter: validAfter, loadedAt: now}
+	if len(r.entries) > revocationCacheSweepSize {
+		for id, entry := range r.entries {
+			if now.Sub(entry.loadedAt) >= r.ttl {
+				delete(r.entries, id)
+			}
+		}
+	}
+	return validAfter
+}
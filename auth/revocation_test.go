@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevocationCacheReloadsAfterTtl(t *testing.T) {
+	now := time.Unix(1000, 0)
+	validAfter := time.Time{}
+	loads := 0
+	cache := NewRevocationCache(time.Minute, func(userId int32) (time.Time, error) {
+		loads++
+		return validAfter, nil
+	})
+	cache.now = func() time.Time { return now }
+
+	revoked, err := cache.IsRevoked(1, now.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.False(t, revoked)
+	assert.Equal(t, 1, loads)
+
+	// revoked through another server: not seen until the entry goes stale
+	validAfter = now
+	now = now.Add(30 * time.Second)
+	revoked, err = cache.IsRevoked(1, now.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.False(t, revoked)
+	assert.Equal(t, 1, loads)
+
+	now = now.Add(30 * time.Second)
+	revoked, err = cache.IsRevoked(1, now.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.True(t, revoked)
+	assert.Equal(t, 2, loads)
+}
+
+func TestRevocationCacheRevokeTakesEffectImmediately(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := NewRevocationCache(time.Minute, func(userId int32) (time.Time, error) {
+		return time.Time{}, nil
+	})
+	cache.now = func() time.Time { return now }
+	issuedAt := now.Add(-time.Second)
+
+	revoked, err := cache.IsRevoked(1, issuedAt)
+	require.NoError(t, err)
+	assert.False(t, revoked)
+
+	cache.Revoke(1, now)
+	revoked, err = cache.IsRevoked(1, issuedAt)
+	require.NoError(t, err)
+	assert.True(t, revoked)
+	// tokens issued in the same second are revoked too; later ones aren't
+	revoked, err = cache.IsRevoked(1, now)
+	require.NoError(t, err)
+	assert.True(t, revoked)
+	revoked, err = cache.IsRevoked(1, now.Add(time.Second))
+	require.NoError(t, err)
+	assert.False(t, revoked)
+	// other users are unaffected
+	revoked, err = cache.IsRevoked(2, issuedAt)
+	require.NoError(t, err)
+	assert.False(t, revoked)
+}
+
+func TestRevocationCacheNeverMovesBack(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := NewRevocationCache(time.Minute, func(userId int32) (time.Time, error) {
+		return time.Time{}, nil // a load that started before the revocation
+	})
+	cache.now = func() time.Time { return now }
+	cache.Revoke(1, now)
+	now = now.Add(time.Hour)
+
+	validAfter, err := cache.ValidAfter(1)
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1000, 0), validAfter)
+}
+
+func TestRevocationCacheLoadErrors(t *testing.T) {
+	loadErr := errors.New("database unavailable")
+	cache := NewRevocationCache(time.Minute, func(userId int32) (time.Time, error) {
+		return time.Time{}, loadErr
+	})
+	_, err := cache.IsRevoked(1, time.Now())
+	assert.ErrorIs(t, err, loadErr)
+}
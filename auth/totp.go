@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time-based one-time passwords (RFC 6238) with the parameters every
+// authenticator app supports: HMAC-SHA1, 6 digits and a 30 second period
+const (
+	TOTPDigits      = 6
+	TOTPPeriod      = 30 * time.Second
+	totpSecretSize  = 20 // bytes, the size of a SHA1 HMAC key as RFC 4226 recommends
+	totpSkew        = 1  // steps either side of the current one that are accepted
+	recoveryCodeLen = 10 // base32 characters, 50 bits
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func GenerateTOTPSecret() []byte {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// The secret as users type it into authenticator apps
+func EncodeTOTPSecret(secret []byte) string {
+	return totpEncoding.EncodeToString(secret)
+}
+
+// The otpauth:// URI authenticator apps read from QR codes
+func TOTPProvisioningURI(secret []byte, issuer, account string) string {
+	query := url.Values{}
+	query.Set("secret", EncodeTOTPSecret(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(TOTPDigits))
+	query.Set("period", fmt.Sprint(int(TOTPPeriod.Seconds())))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// The time step a time falls in
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod.Seconds())
+}
+
+// The code for the time step t falls in
+func TOTPCode(secret []byte, t time.Time) string {
+	return hotp(secret, uint64(TOTPStep(t)))
+}
+
+// Check a code against the steps around now, returning the step it matched.
+// Steps up to and including lastStep are rejected so that a code can't be
+// used twice.
+func ValidateTOTP(secret []byte, code string, now time.Time, lastStep int64) (step int64, ok bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+	current := TOTPStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, uint64(step))), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// RFC 4226 HOTP
+func hotp(secret []byte, counter uint64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for range TOTPDigits {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%modulus)
+}
+
+// Generate single use codes that stand in for a TOTP code when the user has
+// lost their authenticator
+func GenerateRecoveryCodes(n int) []string {
+	codes := make([]string, n)
+	for i := range codes {
+		random := make([]byte, 7)
+		if _, err := rand.Read(random); err != nil {
+			panic(err)
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(random))[:recoveryCodeLen]
+		codes[i] = code[:recoveryCodeLen/2] + "-" + code[recoveryCodeLen/2:]
+	}
+	return codes
+}
+
+// Normalize a recovery code as typed by a user to the form it was generated
+// in
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Join(strings.Fields(code), ""))
+	code = strings.ReplaceAll(code, "-", "")
+	if len(code) != recoveryCodeLen {
+		return ""
+	}
+	return code[:recoveryCodeLen/2] + "-" + code[recoveryCodeLen/2:]
+}
+
+// Hash a recovery code for storage. The codes are random enough that a fast
+// hash protects them as well as a password hash would.
+func HashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Whether a recovery code matches a stored hash of one
+func RecoveryCodeMatches(code, codeHash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashRecoveryCode(code)), []byte(codeHash)) == 1
+}
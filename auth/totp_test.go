@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// RFC 6238 appendix B, SHA1. The 6 digit codes are the last 6 digits of the
+// RFC's 8 digit ones.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, code := range vectors {
+		assert.Equal(t, code, TOTPCode(secret, time.Unix(unix, 0)), unix)
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := GenerateTOTPSecret()
+	now := time.Unix(1700000000, 0)
+	current := TOTPStep(now)
+
+	step, ok := ValidateTOTP(secret, TOTPCode(secret, now), now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, current, step)
+
+	// codes of neighbouring steps are accepted to allow for clock drift
+	step, ok = ValidateTOTP(secret, TOTPCode(secret, now.Add(-TOTPPeriod)), now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, current-1, step)
+	_, ok = ValidateTOTP(secret, TOTPCode(secret, now.Add(TOTPPeriod)), now, 0)
+	assert.True(t, ok)
+	_, ok = ValidateTOTP(secret, TOTPCode(secret, now.Add(-2*TOTPPeriod)), now, 0)
+	assert.False(t, ok)
+
+	_, ok = ValidateTOTP(secret, "", now, 0)
+	assert.False(t, ok)
+	_, ok = ValidateTOTP(GenerateTOTPSecret(), TOTPCode(secret, now), now, 0)
+	assert.False(t, ok)
+}
+
+func TestValidateTOTPRejectsReplays(t *testing.T) {
+	secret := GenerateTOTPSecret()
+	now := time.Unix(1700000000, 0)
+	code := TOTPCode(secret, now)
+
+	step, ok := ValidateTOTP(secret, code, now, 0)
+	assert.True(t, ok)
+	_, ok = ValidateTOTP(secret, code, now, step)
+	assert.False(t, ok)
+	// nor can an earlier step be used once a later one has been
+	_, ok = ValidateTOTP(secret, TOTPCode(secret, now.Add(-TOTPPeriod)), now, step)
+	assert.False(t, ok)
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := TOTPProvisioningURI([]byte("12345678901234567890"), "dump", "alice")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/dump:alice?"), uri)
+	assert.Contains(t, uri, "secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	assert.Contains(t, uri, "issuer=dump")
+	assert.Contains(t, uri, "digits=6")
+	assert.Contains(t, uri, "period=30")
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes := GenerateRecoveryCodes(10)
+	assert.Len(t, codes, 10)
+	seen := map[string]bool{}
+	for _, code := range codes {
+		assert.Len(t, code, recoveryCodeLen+1)
+		assert.Equal(t, code, NormalizeRecoveryCode(code))
+		assert.False(t, seen[code])
+		seen[code] = true
+	}
+
+	assert.Equal(t, codes[0], NormalizeRecoveryCode(" "+strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))+" "))
+	assert.Equal(t, "", NormalizeRecoveryCode("abc"))
+
+	codeHash := HashRecoveryCode(codes[0])
+	assert.True(t, RecoveryCodeMatches(codes[0], codeHash))
+	assert.False(t, RecoveryCodeMatches(codes[1], codeHash))
+}
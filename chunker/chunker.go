@@ -0,0 +1,142 @@
+// Package chunker splits streams into content-defined chunks using FastCDC
+// (Xia et al., "FastCDC: a Fast and Efficient Content-Defined Chunking
+// Approach for Data Deduplication", USENIX ATC 2016).
+//
+// Chunk boundaries depend only on the bytes around them, so an insertion or
+// deletion in a stream only changes the chunks next to the edit. Boundaries
+// must never change between releases for a given Options, or previously
+// stored chunks stop deduplicating against new uploads.
+package chunker
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+const (
+	DefaultMinSize = 256 * 1024
+	DefaultAvgSize = 1024 * 1024
+	DefaultMaxSize = 4 * 1024 * 1024
+)
+
+type Options struct {
+	MinSize int
+	AvgSize int // must be a power of two
+	MaxSize int
+}
+
+var DefaultOptions = Options{
+	MinSize: DefaultMinSize,
+	AvgSize: DefaultAvgSize,
+	MaxSize: DefaultMaxSize,
+}
+
+// Splits a stream into chunks
+type Chunker struct {
+	r       io.Reader
+	opts    Options
+	maskS   uint64 // harder to match; used before the average size
+	maskL   uint64 // easier to match; used after the average size
+	buf     []byte
+	start   int // start of unconsumed data in buf
+	end     int // end of valid data in buf
+	readErr error
+}
+
+func New(r io.Reader, opts Options) (*Chunker, error) {
+	if opts.MinSize <= 0 || opts.MinSize > opts.AvgSize || opts.AvgSize > opts.MaxSize {
+		return nil, errors.New("chunker: sizes must satisfy 0 < min <= avg <= max")
+	}
+	if bits.OnesCount(uint(opts.AvgSize)) != 1 {
+		return nil, errors.New("chunker: average size must be a power of two")
+	}
+	// normalized chunking: one bit harder before the average size and one bit
+	// easier after it pulls chunk sizes towards the average
+	avgBits := bits.TrailingZeros(uint(opts.AvgSize))
+	return &Chunker{
+		r:     r,
+		opts:  opts,
+		maskS: mask(avgBits + 1),
+		maskL: mask(avgBits - 1),
+		buf:   make([]byte, 2*opts.MaxSize),
+	}, nil
+}
+
+// The top n bits of the fingerprint, which depend on the most recent bytes
+func mask(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Return the next chunk, or io.EOF once the stream is exhausted. The chunk is
+// only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.opts.MaxSize && c.readErr == nil {
+		c.fill()
+	}
+	if c.start == c.end {
+		if c.readErr == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, c.readErr
+	}
+
+	n := c.cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// Read until buf holds at least MaxSize bytes or the reader is exhausted
+func (c *Chunker) fill() {
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	for c.end < c.opts.MaxSize && c.readErr == nil {
+		var n int
+		n, c.readErr = c.r.Read(c.buf[c.end:])
+		c.end += n
+	}
+}
+
+func (c *Chunker) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= c.opts.MinSize {
+		return n
+	}
+	if n > c.opts.MaxSize {
+		n = c.opts.MaxSize
+	}
+	normal := min(c.opts.AvgSize, n)
+
+	var fp uint64
+	i := c.opts.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Random values mixed into the rolling fingerprint, one per byte value.
+// Generated with splitmix64 from a fixed seed; changing them changes every
+// chunk boundary.
+var gear = func() (table [256]uint64) {
+	state := uint64(0x64756d70) // "dump"
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
@@ -0,0 +1,88 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testOptions = Options{MinSize: 1024, AvgSize: 4096, MaxSize: 16384}
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func split(t *testing.T, data []byte, opts Options) [][]byte {
+	c, err := New(bytes.NewReader(data), opts)
+	require.NoError(t, err)
+	chunks := make([][]byte, 0)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunksReassembleWithinBounds(t *testing.T) {
+	data := randomData(1, 1<<20)
+	chunks := split(t, data, testOptions)
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	for i, chunk := range chunks {
+		assert.LessOrEqual(t, len(chunk), testOptions.MaxSize)
+		if i < len(chunks)-1 {
+			assert.GreaterOrEqual(t, len(chunk), testOptions.MinSize)
+		}
+	}
+	// normalized chunking keeps the mean near the average size
+	mean := len(data) / len(chunks)
+	assert.InDelta(t, testOptions.AvgSize, mean, float64(testOptions.AvgSize)/2)
+}
+
+func TestChunkingIsDeterministic(t *testing.T) {
+	data := randomData(2, 256*1024)
+	assert.Equal(t, split(t, data, testOptions), split(t, data, testOptions))
+}
+
+func TestEditOnlyChangesNearbyChunks(t *testing.T) {
+	data := randomData(3, 1<<20)
+	edited := append(append(append([]byte(nil), data[:1000]...), []byte("inserted bytes")...), data[1000:]...)
+
+	hashes := make(map[[32]byte]bool)
+	original := split(t, data, testOptions)
+	for _, chunk := range original {
+		hashes[sha256.Sum256(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range split(t, edited, testOptions) {
+		if !hashes[sha256.Sum256(chunk)] {
+			changed++
+		}
+	}
+	assert.LessOrEqual(t, changed, 2)
+	assert.Greater(t, len(original), 100)
+}
+
+func TestEmptyStream(t *testing.T) {
+	assert.Empty(t, split(t, nil, testOptions))
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{MinSize: 0, AvgSize: 4096, MaxSize: 16384},
+		{MinSize: 8192, AvgSize: 4096, MaxSize: 16384},
+		{MinSize: 1024, AvgSize: 5000, MaxSize: 16384},
+	} {
+		_, err := New(bytes.NewReader(nil), opts)
+		assert.Error(t, err)
+	}
+}
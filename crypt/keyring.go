@@ -0,0 +1,158 @@
+// Package crypt encrypts vault contents with envelope encryption. Every vault
+// has its own data key (DEK), which is stored in the database wrapped by a
+// server master key. Rotating the master key only means re-wrapping the
+// DEKs; data encrypted under a DEK never has to be rewritten.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const KeySize = 32 // AES-256
+
+var (
+	ErrInvalidKeySize    = errors.New("keys must be 32 bytes")
+	ErrUnknownMasterKey  = errors.New("data key is wrapped by an unknown master key")
+	ErrInvalidWrappedKey = errors.New("wrapped data key is invalid or was wrapped by another key")
+)
+
+// Authenticated with every wrapped data key
+var wrapAdditionalData = []byte("dump data key v1")
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// The server's master keys: the current one, which wraps new and rotated data
+// keys, and any previous ones that data keys may still be wrapped by
+type Keyring struct {
+	current *masterKey
+	keys    map[string]*masterKey
+}
+
+func NewKeyring(current []byte, previous ...[]byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]*masterKey)}
+	for i, key := range append([][]byte{current}, previous...) {
+		master, err := newMasterKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			k.current = master
+		}
+		if _, found := k.keys[master.id]; !found {
+			k.keys[master.id] = master
+		}
+	}
+	return k, nil
+}
+
+func newMasterKey(key []byte) (*masterKey, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKeySize
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// identifies the key without revealing anything about it
+	sum := sha256.Sum256(append([]byte("dump master key id\x00"), key...))
+	return &masterKey{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// ID of the master key that wraps new data keys
+func (k *Keyring) CurrentId() string {
+	return k.current.id
+}
+
+// Generate a new data key, wrapped by the current master key
+func (k *Keyring) GenerateDataKey() (wrapped []byte, masterKeyId string, err error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", err
+	}
+	return k.current.wrap(key), k.current.id, nil
+}
+
+// Unwrap a data key wrapped by the master key with the given ID
+func (k *Keyring) UnwrapDataKey(wrapped []byte, masterKeyId string) (*DataKey, error) {
+	key, err := k.unwrap(wrapped, masterKeyId)
+	if err != nil {
+		return nil, err
+	}
+	return newDataKey(key)
+}
+
+// Re-wrap a data key with the current master key
+func (k *Keyring) Rewrap(wrapped []byte, masterKeyId string) ([]byte, string, error) {
+	key, err := k.unwrap(wrapped, masterKeyId)
+	if err != nil {
+		return nil, "", err
+	}
+	return k.current.wrap(key), k.current.id, nil
+}
+
+func (k *Keyring) unwrap(wrapped []byte, masterKeyId string) ([]byte, error) {
+	master, found := k.keys[masterKeyId]
+	if !found {
+		return nil, fmt.Errorf("%w %s", ErrUnknownMasterKey, masterKeyId)
+	}
+	nonceSize := master.aead.NonceSize()
+	if len(wrapped) < nonceSize {
+		return nil, ErrInvalidWrappedKey
+	}
+	key, err := master.aead.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], wrapAdditionalData)
+	if err != nil || len(key) != KeySize {
+		return nil, ErrInvalidWrappedKey
+	}
+	return key, nil
+}
+
+// Wrapped keys are the random nonce followed by the sealed key
+func (m *masterKey) wrap(key []byte) []byte {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return m.aead.Seal(nonce, nonce, key, wrapAdditionalData)
+}
+
+// An unwrapped vault data key
+type DataKey struct {
+	streamKey []byte // derives the key of each stream
+	nameKey   []byte // derives the backend names of chunks
+}
+
+func newDataKey(key []byte) (*DataKey, error) {
+	streamKey, err := hkdf.Key(sha256.New, key, nil, "dump stream keys v1", KeySize)
+	if err != nil {
+		return nil, err
+	}
+	nameKey, err := hkdf.Key(sha256.New, key, nil, "dump chunk names v1", KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{streamKey: streamKey, nameKey: nameKey}, nil
+}
+
+// The name a chunk is stored under in the vault's backend. Storing chunks
+// under the hash of their plaintext would let anyone with access to the
+// backend confirm whether a vault holds a known file.
+func (d *DataKey) ChunkName(hash string) string {
+	mac := hmac.New(sha256.New, d.nameKey)
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
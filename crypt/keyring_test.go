@@ -0,0 +1,114 @@
+package crypt
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+// Encrypt and decrypt a short stream to check that two data keys are the same
+func assertSameDataKey(t *testing.T, a, b *DataKey) {
+	encrypted, err := a.EncryptReader(strings.NewReader("hello"), "stream")
+	require.NoError(t, err)
+	decrypted, err := b.DecryptReader(encrypted, "stream", 0)
+	require.NoError(t, err)
+	plain, err := io.ReadAll(decrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(plain))
+	assert.Equal(t, a.ChunkName("hash"), b.ChunkName("hash"))
+}
+
+func TestKeyringRejectsInvalidKeys(t *testing.T) {
+	_, err := NewKeyring(make([]byte, 16))
+	assert.ErrorIs(t, err, ErrInvalidKeySize)
+	_, err = NewKeyring(testKey(1), make([]byte, 31))
+	assert.ErrorIs(t, err, ErrInvalidKeySize)
+}
+
+func TestWrapAndUnwrapDataKey(t *testing.T) {
+	keyring, err := NewKeyring(testKey(1))
+	require.NoError(t, err)
+
+	wrapped, masterKeyId, err := keyring.GenerateDataKey()
+	require.NoError(t, err)
+	assert.Equal(t, keyring.CurrentId(), masterKeyId)
+	first, err := keyring.UnwrapDataKey(wrapped, masterKeyId)
+	require.NoError(t, err)
+	second, err := keyring.UnwrapDataKey(wrapped, masterKeyId)
+	require.NoError(t, err)
+	assertSameDataKey(t, first, second)
+
+	other, _, err := keyring.GenerateDataKey()
+	require.NoError(t, err)
+	assert.NotEqual(t, wrapped, other)
+}
+
+func TestUnwrapRejectsTamperedKeys(t *testing.T) {
+	keyring, err := NewKeyring(testKey(1))
+	require.NoError(t, err)
+	wrapped, masterKeyId, err := keyring.GenerateDataKey()
+	require.NoError(t, err)
+
+	tampered := bytes.Clone(wrapped)
+	tampered[len(tampered)-1] ^= 1
+	_, err = keyring.UnwrapDataKey(tampered, masterKeyId)
+	assert.ErrorIs(t, err, ErrInvalidWrappedKey)
+	_, err = keyring.UnwrapDataKey(wrapped[:4], masterKeyId)
+	assert.ErrorIs(t, err, ErrInvalidWrappedKey)
+	_, err = keyring.UnwrapDataKey(wrapped, "0000000000000000")
+	assert.ErrorIs(t, err, ErrUnknownMasterKey)
+}
+
+func TestMasterKeyRotation(t *testing.T) {
+	old, err := NewKeyring(testKey(1))
+	require.NoError(t, err)
+	wrapped, oldId, err := old.GenerateDataKey()
+	require.NoError(t, err)
+	original, err := old.UnwrapDataKey(wrapped, oldId)
+	require.NoError(t, err)
+
+	rotated, err := NewKeyring(testKey(2), testKey(1))
+	require.NoError(t, err)
+	assert.NotEqual(t, oldId, rotated.CurrentId())
+	// data keys wrapped by the previous master key can still be unwrapped
+	stillValid, err := rotated.UnwrapDataKey(wrapped, oldId)
+	require.NoError(t, err)
+	assertSameDataKey(t, original, stillValid)
+
+	rewrapped, newId, err := rotated.Rewrap(wrapped, oldId)
+	require.NoError(t, err)
+	assert.Equal(t, rotated.CurrentId(), newId)
+
+	// once every data key is re-wrapped, the old master key can be dropped
+	current, err := NewKeyring(testKey(2))
+	require.NoError(t, err)
+	_, err = current.UnwrapDataKey(wrapped, oldId)
+	assert.ErrorIs(t, err, ErrUnknownMasterKey)
+	unwrapped, err := current.UnwrapDataKey(rewrapped, newId)
+	require.NoError(t, err)
+	assertSameDataKey(t, original, unwrapped)
+}
+
+func TestChunkNamesDependOnDataKey(t *testing.T) {
+	keyring, err := NewKeyring(testKey(1))
+	require.NoError(t, err)
+	wrappedA, id, _ := keyring.GenerateDataKey()
+	wrappedB, _, _ := keyring.GenerateDataKey()
+	a, err := keyring.UnwrapDataKey(wrappedA, id)
+	require.NoError(t, err)
+	b, err := keyring.UnwrapDataKey(wrappedB, id)
+	require.NoError(t, err)
+
+	hash := strings.Repeat("ab", 32)
+	assert.Len(t, a.ChunkName(hash), 64)
+	assert.NotEqual(t, hash, a.ChunkName(hash))
+	assert.NotEqual(t, a.ChunkName(hash), b.ChunkName(hash))
+}
@@ -0,0 +1,201 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Streams are encrypted in segments so that they can be encrypted and
+// decrypted without holding them in memory, and so that a range of a stream
+// can be decrypted without reading what comes before it.
+//
+// An encrypted stream is a 4 byte header followed by the plaintext in
+// segments of SegmentSize bytes (the last one may be shorter, or empty if the
+// plaintext is), each sealed with AES-256-GCM. Every stream has its own key,
+// derived from the data key and a stream ID, so nonces only have to be unique
+// within a stream: a segment's nonce is its index followed by a flag marking
+// the last segment, which stops streams from being truncated or reordered.
+
+const (
+	SegmentSize = 64 * 1024
+	tagSize     = 16
+)
+
+var streamHeader = []byte("DVE\x01")
+
+var ErrInvalidStream = errors.New("encrypted stream is invalid or has been tampered with")
+
+// Size of the encrypted stream of a plaintext of the given size
+func EncryptedSize(size int64) int64 {
+	segments := max((size+SegmentSize-1)/SegmentSize, 1)
+	return int64(len(streamHeader)) + size + segments*tagSize
+}
+
+// Locate a plaintext offset in an encrypted stream: where to start reading
+// the stream to decrypt it (the segment holding it, or the header if that is
+// the first segment), the index of that segment and the offset within it
+func SegmentOffset(offset int64) (encryptedOffset int64, segment uint32, skip int64) {
+	index := offset / SegmentSize
+	if index > 0 {
+		encryptedOffset = int64(len(streamHeader)) + index*(SegmentSize+tagSize)
+	}
+	return encryptedOffset, uint32(index), offset % SegmentSize
+}
+
+// The stream ID must be unique to the stream's plaintext; the same plaintext
+// may be encrypted under the same ID any number of times.
+func (d *DataKey) streamCipher(streamId string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, d.streamKey, nil, streamId, KeySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(segment uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:11], segment)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Read r as an encrypted stream
+func (d *DataKey) EncryptReader(r io.Reader, streamId string) (io.Reader, error) {
+	aead, err := d.streamCipher(streamId)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		src:    bufio.NewReader(r),
+		aead:   aead,
+		plain:  make([]byte, SegmentSize),
+		sealed: make([]byte, 0, SegmentSize+tagSize),
+		out:    bytes.Clone(streamHeader),
+	}, nil
+}
+
+type encryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	segment uint32
+	done    bool
+	plain   []byte
+	sealed  []byte
+	out     []byte // encrypted bytes that haven't been read yet
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.src, e.plain)
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			return 0, err
+		}
+		if !last {
+			if _, err := e.src.Peek(1); errors.Is(err, io.EOF) {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		if !last && e.segment == math.MaxUint32 {
+			return 0, errors.New("stream is too long to encrypt")
+		}
+		e.sealed = e.aead.Seal(e.sealed[:0], segmentNonce(e.segment, last), e.plain[:n], nil)
+		e.out = e.sealed
+		e.segment++
+		e.done = last
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// Decrypt an encrypted stream. r must start at the segment with index
+// firstSegment (see SegmentOffset), or at the header if that is 0.
+func (d *DataKey) DecryptReader(r io.Reader, streamId string, firstSegment uint32) (io.Reader, error) {
+	aead, err := d.streamCipher(streamId)
+	if err != nil {
+		return nil, err
+	}
+	src := bufio.NewReader(r)
+	if firstSegment == 0 {
+		header := make([]byte, len(streamHeader))
+		if _, err := io.ReadFull(src, header); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrInvalidStream
+		} else if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(header, streamHeader) {
+			return nil, ErrInvalidStream
+		}
+	}
+	return &decryptReader{
+		src:     src,
+		aead:    aead,
+		segment: firstSegment,
+		sealed:  make([]byte, SegmentSize+tagSize),
+		plain:   make([]byte, 0, SegmentSize),
+	}, nil
+}
+
+type decryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	segment uint32
+	done    bool
+	sealed  []byte
+	plain   []byte
+	out     []byte // decrypted bytes that haven't been read yet
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.src, d.sealed)
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			return 0, err
+		}
+		if !last {
+			if _, err := d.src.Peek(1); errors.Is(err, io.EOF) {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		// a stream always ends with a sealed segment, even an empty one
+		if n < tagSize {
+			return 0, ErrInvalidStream
+		}
+		plain, err := d.aead.Open(d.plain[:0], segmentNonce(d.segment, last), d.sealed[:n], nil)
+		if err != nil {
+			return 0, ErrInvalidStream
+		}
+		d.out = plain
+		d.segment++
+		d.done = last
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
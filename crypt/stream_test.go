@@ -0,0 +1,117 @@
+package crypt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDataKey(t *testing.T) *DataKey {
+	key, err := newDataKey(testKey(7))
+	require.NoError(t, err)
+	return key
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rng := rand.New(rand.NewPCG(1, uint64(n)))
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	return data
+}
+
+func encrypt(t *testing.T, key *DataKey, plain []byte, streamId string) []byte {
+	r, err := key.EncryptReader(bytes.NewReader(plain), streamId)
+	require.NoError(t, err)
+	encrypted, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return encrypted
+}
+
+func decrypt(key *DataKey, encrypted []byte, streamId string, firstSegment uint32) ([]byte, error) {
+	r, err := key.DecryptReader(bytes.NewReader(encrypted), streamId, firstSegment)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := testDataKey(t)
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 17} {
+		plain := randomBytes(size)
+		encrypted := encrypt(t, key, plain, "stream")
+		assert.Equal(t, EncryptedSize(int64(size)), int64(len(encrypted)), size)
+		assert.False(t, bytes.Contains(encrypted, plain) && size > 0, size)
+
+		decrypted, err := decrypt(key, encrypted, "stream", 0)
+		require.NoError(t, err, size)
+		assert.Equal(t, plain, decrypted, size)
+	}
+}
+
+func TestStreamEncryptionIsDeterministicPerStreamId(t *testing.T) {
+	key := testDataKey(t)
+	plain := randomBytes(1000)
+	assert.Equal(t, encrypt(t, key, plain, "a"), encrypt(t, key, plain, "a"))
+	assert.NotEqual(t, encrypt(t, key, plain, "a"), encrypt(t, key, plain, "b"))
+
+	_, err := decrypt(key, encrypt(t, key, plain, "a"), "b", 0)
+	assert.ErrorIs(t, err, ErrInvalidStream)
+}
+
+func TestDecryptFromSegment(t *testing.T) {
+	key := testDataKey(t)
+	plain := randomBytes(4*SegmentSize + 100)
+	encrypted := encrypt(t, key, plain, "stream")
+
+	for _, offset := range []int64{0, 10, SegmentSize, 2*SegmentSize + 5, 4 * SegmentSize, 4*SegmentSize + 99} {
+		encryptedOffset, segment, skip := SegmentOffset(offset)
+		decrypted, err := decrypt(key, encrypted[encryptedOffset:], "stream", segment)
+		require.NoError(t, err, offset)
+		assert.Equal(t, plain[offset:], decrypted[skip:], offset)
+	}
+}
+
+func TestDecryptRejectsTamperedStreams(t *testing.T) {
+	key := testDataKey(t)
+	plain := randomBytes(2*SegmentSize + 10)
+	encrypted := encrypt(t, key, plain, "stream")
+	segment := SegmentSize + tagSize
+
+	for name, tampered := range map[string][]byte{
+		"flipped bit":        append(bytes.Clone(encrypted[:100]), append([]byte{encrypted[100] ^ 1}, encrypted[101:]...)...),
+		"truncated":          encrypted[:4+2*segment],
+		"missing last bytes": encrypted[:len(encrypted)-1],
+		"reordered": append(append(bytes.Clone(encrypted[:4]), encrypted[4+segment:4+2*segment]...),
+			append(bytes.Clone(encrypted[4:4+segment]), encrypted[4+2*segment:]...)...),
+		"bad header": append([]byte("DVE\x02"), encrypted[4:]...),
+		"empty":      {},
+	} {
+		_, err := decrypt(key, tampered, "stream", 0)
+		assert.ErrorIs(t, err, ErrInvalidStream, name)
+	}
+
+	// a segment can't be passed off as the one at another index
+	_, err := decrypt(key, encrypted[4+segment:], "stream", 0)
+	assert.ErrorIs(t, err, ErrInvalidStream)
+	_, err = decrypt(key, encrypted[4:], "stream", 1)
+	assert.ErrorIs(t, err, ErrInvalidStream)
+}
+
+func TestEncryptedSize(t *testing.T) {
+	for size, expected := range map[int64]int64{
+		0:               4 + 16,
+		1:               4 + 1 + 16,
+		SegmentSize:     4 + SegmentSize + 16,
+		SegmentSize + 1: 4 + SegmentSize + 1 + 32,
+	} {
+		assert.Equal(t, expected, EncryptedSize(size), fmt.Sprint(size))
+	}
+}
@@ -0,0 +1,202 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/models/storage"
+)
+
+// What's left to clean up outside the database once a user is deleted
+type DeletedUser struct {
+	UploadIds []string // uploads whose staged data is on the server's disk
+	ExportIds []string // data exports whose archives are on the server's disk
+	Purges    int      // storage purges scheduled for the user's vaults
+}
+
+// Delete a user and, by cascade, everything they own. A storage purge is
+// scheduled for each of their vaults, holding the credentials of the
+// vault's provider key, so that the stored objects can still be deleted once
+// the provider keys are gone. Returns pgx.ErrNoRows if there is no such user.
+func DeleteUser(db *pgxpool.Pool, userId int32) (*DeletedUser, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	// vaults and uploads reference the user row, so locking it keeps new ones
+	// from being created while the user is deleted
+	var username string
+	row := tx.QueryRow(context.Background(),
+		"SELECT COALESCE(username, '') FROM users WHERE id = $1 FOR UPDATE", userId)
+	if err := row.Scan(&username); err != nil {
+		return nil, err
+	}
+
+	deleted := &DeletedUser{}
+	rows, err := tx.Query(context.Background(), `
+		SELECT uploads.id FROM uploads
+		JOIN vaults ON vaults.id = uploads.vault_id
+		WHERE vaults.owner_id = $1`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	if deleted.UploadIds, err = pgx.CollectRows(rows, pgx.RowTo[string]); err != nil {
+		return nil, err
+	}
+	rows, err = tx.Query(context.Background(), "SELECT id FROM data_exports WHERE user_id = $1", userId)
+	if err != nil {
+		return nil, err
+	}
+	if deleted.ExportIds, err = pgx.CollectRows(rows, pgx.RowTo[string]); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(context.Background(),
+		"SELECT "+vaultColumns+" FROM vaults WHERE owner_id = $1 ORDER BY id", userId)
+	if err != nil {
+		return nil, err
+	}
+	vaults, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*storage.Vault, error) {
+		return scanVault(row)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, vault := range vaults {
+		if err := insertStoragePurge(tx, vault); err != nil {
+			return nil, err
+		}
+		deleted.Purges++
+	}
+
+	if _, err := tx.Exec(context.Background(), "DELETE FROM users WHERE id = $1", userId); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(context.Background(),
+		"DELETE FROM login_failures WHERE login = $1", username); err != nil {
+		return nil, err
+	}
+	return deleted, tx.Commit(context.Background())
+}
+
+// Schedule a storage purge of a vault about to be deleted, holding the
+// credentials of its provider key
+func insertStoragePurge(tx pgx.Tx, vault *storage.Vault) error {
+	key := &storage.ProviderKey{}
+	if vault.ProviderKeyId != 0 {
+		row := tx.QueryRow(context.Background(),
+			"SELECT "+providerKeyColumns+" FROM provider_keys WHERE id = $1", vault.ProviderKeyId)
+		var err error
+		if key, err = scanProviderKey(row); err != nil {
+			return err
+		}
+	}
+	// without a key nothing can reach the bucket, but the purge is kept so
+	// that the objects left behind are on record
+	_, err := tx.Exec(context.Background(), `
+		INSERT INTO storage_purges (vault_id, vault_type, bucket, key_id, secret, region, endpoint)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), NULLIF($7, ''))`,
+		vault.Id, vault.Type, vault.Bucket, key.KeyId, key.Secret, key.Region, key.Endpoint)
+	return err
+}
+
+// Claim the storage purge due next, holding it off from other servers for
+// lease. Returns pgx.ErrNoRows if none is due.
+func ClaimStoragePurge(db *pgxpool.Pool, lease time.Duration) (*storage.StoragePurge, error) {
+	row := db.QueryRow(context.Background(), `
+		UPDATE storage_purges SET next_attempt_at = now() + $1 * interval '1 second'
+		WHERE id = (
+			SELECT id FROM storage_purges WHERE next_attempt_at <= now()
+			ORDER BY next_attempt_at LIMIT 1 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, vault_id, vault_type, COALESCE(bucket, ''), COALESCE(key_id, ''),
+			COALESCE(secret, ''), COALESCE(region, ''), COALESCE(endpoint, ''), attempts`,
+		lease.Seconds())
+	purge := &storage.StoragePurge{Vault: &storage.Vault{}, ProviderKey: &storage.ProviderKey{}}
+	err := row.Scan(
+		&purge.Id, &purge.Vault.Id, &purge.Vault.Type, &purge.Vault.Bucket, &purge.ProviderKey.KeyId,
+		&purge.ProviderKey.Secret, &purge.ProviderKey.Region, &purge.ProviderKey.Endpoint, &purge.Attempts)
+	if err != nil {
+		return nil, err
+	}
+	return purge, nil
+}
+
+// Remove a storage purge that's done, along with the credentials it held
+func DeleteStoragePurge(db *pgxpool.Pool, id int32) error {
+	_, err := db.Exec(context.Background(), "DELETE FROM storage_purges WHERE id = $1", id)
+	return err
+}
+
+// Record a failed attempt at a storage purge and when to try again
+func RetryStoragePurge(db *pgxpool.Pool, id int32, lastError string, retryAfter time.Duration) error {
+	_, err := db.Exec(context.Background(), `
+		UPDATE storage_purges
+		SET attempts = attempts + 1, last_error = $2, next_attempt_at = now() + $3 * interval '1 second'
+		WHERE id = $1`,
+		id, lastError, retryAfter.Seconds())
+	return err
+}
+
+const dataExportColumns = "id, user_id, status, created_at, completed_at, expires_at"
+
+// Insert a pending data export and fill in its creation time
+func InsertDataExport(db *pgxpool.Pool, export *storage.DataExport) error {
+	row := db.QueryRow(context.Background(), `
+		INSERT INTO data_exports (id, user_id, status, expires_at) VALUES ($1, $2, $3, $4)
+		RETURNING created_at`,
+		export.Id, export.UserId, export.Status, export.ExpiresAt)
+	return row.Scan(&export.CreatedAt)
+}
+
+// Get the user's most recent data export that hasn't expired
+func GetLatestDataExport(db *pgxpool.Pool, userId int32) (*storage.DataExport, error) {
+	row := db.QueryRow(context.Background(), `
+		SELECT `+dataExportColumns+` FROM data_exports
+		WHERE user_id = $1 AND expires_at > now()
+		ORDER BY created_at DESC LIMIT 1`,
+		userId)
+	return scanDataExport(row)
+}
+
+// Mark a pending data export READY or FAILED. Returns pgx.ErrNoRows if it is
+// gone, as it is once the user has been deleted.
+func CompleteDataExport(db *pgxpool.Pool, id, status string) error {
+	tag, err := db.Exec(context.Background(), `
+		UPDATE data_exports SET status = $2, completed_at = now()
+		WHERE id = $1 AND status = $3`,
+		id, status, storage.DataExportPending)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// Delete every expired data export and return their IDs so that their
+// archives can be removed
+func DeleteExpiredDataExports(db *pgxpool.Pool) ([]string, error) {
+	rows, err := db.Query(context.Background(),
+		"DELETE FROM data_exports WHERE expires_at <= now() RETURNING id")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func scanDataExport(row pgx.Row) (*storage.DataExport, error) {
+	export := &storage.DataExport{}
+	err := row.Scan(
+		&export.Id, &export.UserId, &export.Status, &export.CreatedAt, &export.CompletedAt, &export.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/models/storage"
+)
+
+const apiKeyColumns = "id, user_id, key_id, key_hash, key_name, scopes, COALESCE(vault_id, 0), created_at, expires_at, last_used_at"
+
+// Insert an API key and fill in the ID and creation time assigned by the
+// database
+func InsertAPIKey(db *pgxpool.Pool, key *storage.APIKey) error {
+	row := db.QueryRow(context.Background(), `
+		INSERT INTO api_keys (user_id, key_id, key_hash, key_name, scopes, vault_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0), $7) RETURNING id, created_at`,
+		key.UserId, key.KeyId, key.KeyHash, key.Name, key.Scopes, key.VaultId, key.ExpiresAt)
+	return row.Scan(&key.Id, &key.CreatedAt)
+}
+
+// Get an API key by the key ID embedded in it. Not scoped by user: used to
+// authenticate requests.
+func GetAPIKeyByKeyId(db *pgxpool.Pool, keyId string) (*storage.APIKey, error) {
+	row := db.QueryRow(context.Background(),
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE key_id = $1", keyId)
+	return scanAPIKey(row)
+}
+
+// Record that an API key was used. Only written about once a minute per key
+// so that busy keys don't cost a write per request.
+func TouchAPIKey(db *pgxpool.Pool, id int32) error {
+	_, err := db.Exec(context.Background(), `
+		UPDATE api_keys SET last_used_at = now()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() - INTERVAL '1 minute')`,
+		id)
+	return err
+}
+
+func ListAPIKeysForUser(db *pgxpool.Pool, userId int32) ([]*storage.APIKey, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id = $1 ORDER BY id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]*storage.APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Rename an API key and return the updated row
+func RenameAPIKey(db *pgxpool.Pool, userId, id int32, name string) (*storage.APIKey, error) {
+	row := db.QueryRow(context.Background(),
+		"UPDATE api_keys SET key_name = $1 WHERE id = $2 AND user_id = $3 RETURNING "+apiKeyColumns,
+		name, id, userId)
+	return scanAPIKey(row)
+}
+
+// Revoke every API key of the user by deleting them, returning how many
+// there were
+func DeleteAPIKeysForUser(db *pgxpool.Pool, userId int32) (int64, error) {
+	tag, err := db.Exec(context.Background(), "DELETE FROM api_keys WHERE user_id = $1", userId)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Revoke an API key by deleting it
+func DeleteAPIKey(db *pgxpool.Pool, userId, id int32) error {
+	tag, err := db.Exec(context.Background(),
+		"DELETE FROM api_keys WHERE id = $1 AND user_id = $2", id, userId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func scanAPIKey(row pgx.Row) (*storage.APIKey, error) {
+	key := &storage.APIKey{}
+	err := row.Scan(
+		&key.Id, &key.UserId, &key.KeyId, &key.KeyHash, &key.Name, &key.Scopes,
+		&key.VaultId, &key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
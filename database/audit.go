@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/models/storage"
+)
+
+const auditEventColumns = "id, user_id, event, ip, details, created_at"
+
+// Record an audit event and fill in the ID and time assigned by the database
+func InsertAuditEvent(db *pgxpool.Pool, event *storage.AuditEvent) error {
+	details := event.Details
+	if details == nil {
+		details = map[string]string{}
+	}
+	row := db.QueryRow(context.Background(), `
+		INSERT INTO audit_events (user_id, event, ip, details) VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`,
+		event.UserId, event.Event, event.IP, details)
+	return row.Scan(&event.Id, &event.CreatedAt)
+}
+
+// List every audit event of a user, oldest first
+func ListAuditEventsForUser(db *pgxpool.Pool, userId int32) ([]*storage.AuditEvent, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT "+auditEventColumns+" FROM audit_events WHERE user_id = $1 ORDER BY id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*storage.AuditEvent, 0)
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func scanAuditEvent(row pgx.Row) (*storage.AuditEvent, error) {
+	event := &storage.AuditEvent{}
+	err := row.Scan(&event.Id, &event.UserId, &event.Event, &event.IP, &event.Details, &event.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
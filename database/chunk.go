@@ -0,0 +1,267 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/models/storage"
+)
+
+// Chunks are reference counted. A chunk is claimed (ref_count incremented)
+// before an upload decides whether to write it to the backend, and only
+// removed by CollectChunks while its row is locked with a zero ref_count. A
+// concurrent claim therefore either lands before collection starts and keeps
+// the chunk alive, or waits for the row to be deleted and writes the chunk
+// again.
+
+// Implemented by both *pgxpool.Pool and pgx.Tx
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// The previous version of an object replaced or deleted by a write
+type ReplacedObject struct {
+	Existed     bool
+	Chunked     bool
+	ChunkHashes []string // chunks whose references were released
+}
+
+// Take a reference to a chunk, creating its row if needed. Reports whether
+// the chunk is already stored in the vault's backend, and if so whether it
+// was encrypted; a chunk that isn't stored yet will be written with the given
+// encryption.
+func ClaimChunk(db *pgxpool.Pool, vaultId int32, hash string, size int32, encrypt bool) (stored, encrypted bool, err error) {
+	row := db.QueryRow(context.Background(), `
+		INSERT INTO chunks (vault_id, hash, size, ref_count, encrypted) VALUES ($1, $2, $3, 1, $4)
+		ON CONFLICT (vault_id, hash) DO UPDATE SET
+			ref_count = chunks.ref_count + 1,
+			encrypted = CASE WHEN chunks.stored THEN chunks.encrypted ELSE EXCLUDED.encrypted END
+		RETURNING stored, encrypted`,
+		vaultId, hash, size, encrypt)
+	err = row.Scan(&stored, &encrypted)
+	return stored, encrypted, err
+}
+
+func MarkChunkStored(db *pgxpool.Pool, vaultId int32, hash string) error {
+	_, err := db.Exec(context.Background(),
+		"UPDATE chunks SET stored = TRUE WHERE vault_id = $1 AND hash = $2", vaultId, hash)
+	return err
+}
+
+// Drop one reference per occurrence of each hash
+func ReleaseChunks(db *pgxpool.Pool, vaultId int32, hashes []string) error {
+	return releaseChunks(db, vaultId, hashes)
+}
+
+func releaseChunks(db execer, vaultId int32, hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	_, err := db.Exec(context.Background(), `
+		UPDATE chunks SET ref_count = ref_count - released.n
+		FROM (SELECT hash, COUNT(*) AS n FROM unnest($2::text[]) AS hash GROUP BY hash) released
+		WHERE chunks.vault_id = $1 AND chunks.hash = released.hash`,
+		vaultId, hashes)
+	return err
+}
+
+// Remove the chunks among hashes that are no longer referenced. deleteData is
+// called for each one that was written to the backend, while its row is
+// locked; if it fails the chunk is left for a later collection.
+func CollectChunks(db *pgxpool.Pool, vaultId int32, hashes []string, deleteData func(hash string, encrypted bool) error) error {
+	var errs []error
+	for _, hash := range uniqueStrings(hashes) {
+		if err := collectChunk(db, vaultId, hash, deleteData); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func collectChunk(db *pgxpool.Pool, vaultId int32, hash string, deleteData func(hash string, encrypted bool) error) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var stored, encrypted bool
+	row := tx.QueryRow(context.Background(),
+		"SELECT stored, encrypted FROM chunks WHERE vault_id = $1 AND hash = $2 AND ref_count <= 0 FOR UPDATE",
+		vaultId, hash)
+	if err := row.Scan(&stored, &encrypted); errors.Is(err, pgx.ErrNoRows) {
+		return nil // still referenced, or already collected
+	} else if err != nil {
+		return err
+	}
+	if stored {
+		if err := deleteData(hash, encrypted); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(context.Background(),
+		"DELETE FROM chunks WHERE vault_id = $1 AND hash = $2", vaultId, hash); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// Record an object made of the given chunks, replacing any previous version.
+// The chunks must already have been claimed; the references held by the
+// previous version are released.
+func SaveChunkedObject(db *pgxpool.Pool, object *storage.Object, chunks []storage.ObjectChunk) (*ReplacedObject, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	replaced, err := lockObjectForReplacement(tx, object.VaultId, object.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	row := tx.QueryRow(context.Background(), `
+		INSERT INTO objects (vault_id, object_key, size, content_hash, content_type, etag, metadata, chunked)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, TRUE)
+		ON CONFLICT (vault_id, object_key) DO UPDATE SET
+			size = EXCLUDED.size,
+			content_hash = EXCLUDED.content_hash,
+			content_type = EXCLUDED.content_type,
+			etag = EXCLUDED.etag,
+			metadata = EXCLUDED.metadata,
+			chunked = TRUE,
+			updated_at = now()
+		RETURNING id, created_at, updated_at`,
+		object.VaultId, object.Key, object.Size, object.ContentHash, object.ContentType,
+		object.ETag, object.Metadata)
+	if err := row.Scan(&object.Id, &object.CreatedAt, &object.UpdatedAt); err != nil {
+		return nil, err
+	}
+	object.Chunked = true
+
+	if _, err := tx.Exec(context.Background(),
+		"DELETE FROM object_chunks WHERE object_id = $1", object.Id); err != nil {
+		return nil, err
+	}
+	_, err = tx.CopyFrom(context.Background(),
+		pgx.Identifier{"object_chunks"},
+		[]string{"object_id", "seq", "vault_id", "chunk_hash", "chunk_offset", "size"},
+		pgx.CopyFromSlice(len(chunks), func(i int) ([]any, error) {
+			chunk := chunks[i]
+			return []any{object.Id, chunk.Seq, object.VaultId, chunk.Hash, chunk.Offset, chunk.Size}, nil
+		}))
+	if err != nil {
+		return nil, err
+	}
+	if err := releaseChunks(tx, object.VaultId, replaced.ChunkHashes); err != nil {
+		return nil, err
+	}
+	return replaced, tx.Commit(context.Background())
+}
+
+// Remove an object from the catalog, releasing its chunks. Returns
+// pgx.ErrNoRows if there is no such object.
+func DeleteObject(db *pgxpool.Pool, vaultId int32, key string) (*ReplacedObject, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	replaced, err := lockObjectForReplacement(tx, vaultId, key)
+	if err != nil {
+		return nil, err
+	}
+	if !replaced.Existed {
+		return nil, pgx.ErrNoRows
+	}
+	// the object's manifest is removed by ON DELETE CASCADE
+	if _, err := tx.Exec(context.Background(),
+		"DELETE FROM objects WHERE vault_id = $1 AND object_key = $2", vaultId, key); err != nil {
+		return nil, err
+	}
+	if err := releaseChunks(tx, vaultId, replaced.ChunkHashes); err != nil {
+		return nil, err
+	}
+	return replaced, tx.Commit(context.Background())
+}
+
+// Lock the current version of an object, if there is one, and read its
+// manifest
+func lockObjectForReplacement(tx pgx.Tx, vaultId int32, key string) (*ReplacedObject, error) {
+	replaced := &ReplacedObject{}
+	var objectId int32
+	row := tx.QueryRow(context.Background(),
+		"SELECT id, chunked FROM objects WHERE vault_id = $1 AND object_key = $2 FOR UPDATE",
+		vaultId, key)
+	if err := row.Scan(&objectId, &replaced.Chunked); errors.Is(err, pgx.ErrNoRows) {
+		return replaced, nil
+	} else if err != nil {
+		return nil, err
+	}
+	replaced.Existed = true
+
+	rows, err := tx.Query(context.Background(),
+		"SELECT chunk_hash FROM object_chunks WHERE object_id = $1", objectId)
+	if err != nil {
+		return nil, err
+	}
+	if replaced.ChunkHashes, err = pgx.CollectRows(rows, pgx.RowTo[string]); err != nil {
+		return nil, err
+	}
+	return replaced, nil
+}
+
+// Get the manifest of a chunked object, in order
+func GetObjectChunks(db *pgxpool.Pool, objectId int32) ([]storage.ObjectChunk, error) {
+	rows, err := db.Query(context.Background(), `
+		SELECT o.seq, o.chunk_hash, o.chunk_offset, o.size, c.encrypted
+		FROM object_chunks o JOIN chunks c ON c.vault_id = o.vault_id AND c.hash = o.chunk_hash
+		WHERE o.object_id = $1 ORDER BY o.seq`,
+		objectId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chunks := make([]storage.ObjectChunk, 0)
+	for rows.Next() {
+		var chunk storage.ObjectChunk
+		if err := rows.Scan(&chunk.Seq, &chunk.Hash, &chunk.Offset, &chunk.Size, &chunk.Encrypted); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+func GetVaultStats(db *pgxpool.Pool, vaultId int32) (*storage.VaultStats, error) {
+	stats := &storage.VaultStats{}
+	row := db.QueryRow(context.Background(), `
+		SELECT
+			(SELECT COUNT(*) FROM objects WHERE vault_id = $1),
+			(SELECT COALESCE(SUM(size), 0) FROM objects WHERE vault_id = $1),
+			(SELECT COALESCE(SUM(size), 0) FROM chunks WHERE vault_id = $1 AND stored)
+				+ (SELECT COALESCE(SUM(size), 0) FROM objects WHERE vault_id = $1 AND NOT chunked)`,
+		vaultId)
+	if err := row.Scan(&stats.ObjectCount, &stats.LogicalBytes, &stats.StoredBytes); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/raian621/dump/models/storage"
 )
@@ -25,3 +26,28 @@ func GetPasshashForUsername(db *pgxpool.Pool, username string) (string, error) {
 	}
 	return passhash, nil
 }
+
+func GetPasshashForUserId(db *pgxpool.Pool, userId int32) (string, error) {
+	var passhash string
+	row := db.QueryRow(
+		context.Background(),
+		"SELECT passhash FROM credentials WHERE user_id = $1", userId)
+	if err := row.Scan(&passhash); err != nil {
+		return "", err
+	}
+	return passhash, nil
+}
+
+// Replace a user's password hash. Returns pgx.ErrNoRows if the user has no
+// password.
+func UpdatePasshash(db *pgxpool.Pool, userId int32, passhash string) error {
+	tag, err := db.Exec(context.Background(),
+		"UPDATE credentials SET passhash = $2 WHERE user_id = $1", userId, passhash)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const uniqueViolationCode = "23505"
+
+// Unique index keeping usernames that differ only in case apart
+const UsernameConstraint = "users_username_lower_key"
+
+// Reports whether err was caused by a UNIQUE constraint rejecting a write
+func IsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode
+}
+
+// Reports whether err was caused by the named UNIQUE constraint rejecting a
+// write
+func IsUniqueViolationOf(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode && pgErr.ConstraintName == constraint
+}
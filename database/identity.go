@@ -0,0 +1,147 @@
+package database
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/models/storage"
+)
+
+const identityColumns = "id, user_id, provider, subject, COALESCE(email, ''), created_at, last_used_at"
+
+// Link an identity to a user and fill in the ID and creation time assigned by
+// the database
+func InsertIdentity(db *pgxpool.Pool, identity *storage.Identity) error {
+	row := db.QueryRow(context.Background(), `
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, NULLIF($4, '')) RETURNING id, created_at`,
+		identity.UserId, identity.Provider, identity.Subject, identity.Email)
+	return row.Scan(&identity.Id, &identity.CreatedAt)
+}
+
+// Create a user who signs in with an identity at a provider rather than a
+// password
+func CreateUserWithIdentity(db *pgxpool.Pool, username string, identity *storage.Identity) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	row := tx.QueryRow(context.Background(),
+		"INSERT INTO users (username) VALUES ($1) RETURNING id", username)
+	if err := row.Scan(&identity.UserId); err != nil {
+		return err
+	}
+	row = tx.QueryRow(context.Background(), `
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, NULLIF($4, '')) RETURNING id, created_at`,
+		identity.UserId, identity.Provider, identity.Subject, identity.Email)
+	if err := row.Scan(&identity.Id, &identity.CreatedAt); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// Get the identity a provider knows a user by. Not scoped by user: used to
+// sign in.
+func GetIdentity(db *pgxpool.Pool, provider, subject string) (*storage.Identity, error) {
+	row := db.QueryRow(context.Background(),
+		"SELECT "+identityColumns+" FROM user_identities WHERE provider = $1 AND subject = $2",
+		provider, subject)
+	return scanIdentity(row)
+}
+
+// Record a sign in with an identity, along with the email the provider
+// currently reports
+func UseIdentity(db *pgxpool.Pool, id int32, email string) error {
+	_, err := db.Exec(context.Background(),
+		"UPDATE user_identities SET email = NULLIF($2, ''), last_used_at = now() WHERE id = $1",
+		id, email)
+	return err
+}
+
+func ListIdentitiesForUser(db *pgxpool.Pool, userId int32) ([]*storage.Identity, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT "+identityColumns+" FROM user_identities WHERE user_id = $1 ORDER BY id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := make([]*storage.Identity, 0)
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+func DeleteIdentity(db *pgxpool.Pool, userId, id int32) error {
+	tag, err := db.Exec(context.Background(),
+		"DELETE FROM user_identities WHERE id = $1 AND user_id = $2", id, userId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// Count the ways a user can sign in on their own: a password, passkeys and
+// linked identities
+func CountSignInMethods(db *pgxpool.Pool, userId int32) (count int, err error) {
+	row := db.QueryRow(context.Background(), `
+		SELECT (SELECT COUNT(*) FROM credentials WHERE user_id = $1)
+			+ (SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = $1)
+			+ (SELECT COUNT(*) FROM user_identities WHERE user_id = $1)`,
+		userId)
+	err = row.Scan(&count)
+	return count, err
+}
+
+func scanIdentity(row pgx.Row) (*storage.Identity, error) {
+	identity := &storage.Identity{}
+	err := row.Scan(
+		&identity.Id, &identity.UserId, &identity.Provider, &identity.Subject, &identity.Email,
+		&identity.CreatedAt, &identity.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+func InsertOIDCLogin(db *pgxpool.Pool, login *storage.OIDCLogin) error {
+	_, err := db.Exec(context.Background(), `
+		INSERT INTO oidc_logins (state, provider, nonce, code_verifier, user_id, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6)`,
+		login.State, login.Provider, login.Nonce, login.CodeVerifier, login.UserId, login.ExpiresAt)
+	return err
+}
+
+// Remove and return an unexpired authorization request to a provider, so that
+// it can only be finished once. Returns pgx.ErrNoRows if there is none.
+func TakeOIDCLogin(db *pgxpool.Pool, state, provider string) (*storage.OIDCLogin, error) {
+	login := &storage.OIDCLogin{}
+	row := db.QueryRow(context.Background(), `
+		DELETE FROM oidc_logins
+		WHERE state = $1 AND provider = $2 AND expires_at > now()
+		RETURNING state, provider, nonce, code_verifier, COALESCE(user_id, 0), expires_at`,
+		state, provider)
+	err := row.Scan(
+		&login.State, &login.Provider, &login.Nonce, &login.CodeVerifier, &login.UserId, &login.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return login, nil
+}
+
+func DeleteExpiredOIDCLogins(db *pgxpool.Pool) error {
+	_, err := db.Exec(context.Background(), "DELETE FROM oidc_logins WHERE expires_at <= now()")
+	return err
+}
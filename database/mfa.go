@@ -0,0 +1,181 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/models/storage"
+)
+
+var ErrTOTPAlreadyEnabled = errors.New("TOTP is already enabled")
+
+// Store a new, unconfirmed TOTP secret for a user, replacing any other
+// unconfirmed one. Returns ErrTOTPAlreadyEnabled if the user has already
+// confirmed a secret.
+func SetPendingTOTP(db *pgxpool.Pool, userId int32, secret []byte) error {
+	tag, err := db.Exec(context.Background(), `
+		INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = $2, last_step = 0
+		WHERE user_totp.confirmed_at IS NULL`,
+		userId, secret)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+	return nil
+}
+
+// Get a user's TOTP secret, confirmed or not
+func GetTOTP(db *pgxpool.Pool, userId int32) (*storage.TOTP, error) {
+	totp := &storage.TOTP{UserId: userId}
+	row := db.QueryRow(context.Background(),
+		"SELECT secret, confirmed_at, last_step FROM user_totp WHERE user_id = $1", userId)
+	if err := row.Scan(&totp.Secret, &totp.ConfirmedAt, &totp.LastStep); err != nil {
+		return nil, err
+	}
+	return totp, nil
+}
+
+// Whether the user has to provide a second factor to sign in
+func TOTPEnabled(db *pgxpool.Pool, userId int32) (bool, error) {
+	var enabled bool
+	row := db.QueryRow(context.Background(),
+		"SELECT COUNT(*) > 0 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL",
+		userId)
+	err := row.Scan(&enabled)
+	return enabled, err
+}
+
+// Confirm a user's pending TOTP secret with the step of the code they
+// confirmed it with, replacing their recovery codes. Returns pgx.ErrNoRows if
+// there is no pending secret.
+func ConfirmTOTP(db *pgxpool.Pool, userId int32, step int64, recoveryCodeHashes []string) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	tag, err := tx.Exec(context.Background(), `
+		UPDATE user_totp SET confirmed_at = now(), last_step = $2
+		WHERE user_id = $1 AND confirmed_at IS NULL AND last_step < $2`,
+		userId, step)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	if err := replaceRecoveryCodes(tx, userId, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+func replaceRecoveryCodes(tx pgx.Tx, userId int32, hashes []string) error {
+	if _, err := tx.Exec(context.Background(),
+		"DELETE FROM recovery_codes WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+	_, err := tx.Exec(context.Background(),
+		"INSERT INTO recovery_codes (user_id, code_hash) SELECT $1, unnest($2::TEXT[])",
+		userId, hashes)
+	return err
+}
+
+// Record that a code of the given time step was accepted. Reports false if a
+// code of that step or a later one was already accepted, in which case the
+// code must be rejected as a replay.
+func UseTOTPStep(db *pgxpool.Pool, userId int32, step int64) (bool, error) {
+	tag, err := db.Exec(context.Background(), `
+		UPDATE user_totp SET last_step = $2
+		WHERE user_id = $1 AND confirmed_at IS NOT NULL AND last_step < $2`,
+		userId, step)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func ListUnusedRecoveryCodes(db *pgxpool.Pool, userId int32) ([]*storage.RecoveryCode, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT id, user_id, code_hash FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL ORDER BY id",
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := make([]*storage.RecoveryCode, 0)
+	for rows.Next() {
+		code := &storage.RecoveryCode{}
+		if err := rows.Scan(&code.Id, &code.UserId, &code.CodeHash); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+// Mark a recovery code as used. Reports false if it already was.
+func UseRecoveryCode(db *pgxpool.Pool, id int32) (bool, error) {
+	tag, err := db.Exec(context.Background(),
+		"UPDATE recovery_codes SET used_at = now() WHERE id = $1 AND used_at IS NULL", id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Turn off TOTP for a user, deleting their secret and recovery codes
+func DeleteTOTP(db *pgxpool.Pool, userId int32) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(context.Background(),
+		"DELETE FROM user_totp WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(context.Background(),
+		"DELETE FROM recovery_codes WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+func InsertMFAChallenge(db *pgxpool.Pool, challenge *storage.MFAChallenge) error {
+	_, err := db.Exec(context.Background(),
+		"INSERT INTO mfa_challenges (id, user_id, expires_at) VALUES ($1, $2, $3)",
+		challenge.Id, challenge.UserId, challenge.ExpiresAt)
+	return err
+}
+
+// Count an attempt at answering an MFA challenge and return the user it was
+// issued to. Returns pgx.ErrNoRows if the challenge doesn't exist, has
+// expired or has used up its attempts.
+func AttemptMFAChallenge(db *pgxpool.Pool, id string, maxAttempts int) (userId int32, err error) {
+	row := db.QueryRow(context.Background(), `
+		UPDATE mfa_challenges SET attempts = attempts + 1
+		WHERE id = $1 AND expires_at > now() AND attempts < $2
+		RETURNING user_id`,
+		id, maxAttempts)
+	err = row.Scan(&userId)
+	return userId, err
+}
+
+func DeleteMFAChallenge(db *pgxpool.Pool, id string) error {
+	_, err := db.Exec(context.Background(), "DELETE FROM mfa_challenges WHERE id = $1", id)
+	return err
+}
+
+func DeleteExpiredMFAChallenges(db *pgxpool.Pool) error {
+	_, err := db.Exec(context.Background(), "DELETE FROM mfa_challenges WHERE expires_at <= now()")
+	return err
+}
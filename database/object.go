@@ -0,0 +1,191 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/models/storage"
+)
+
+// Keys are compared with the "C" collation everywhere so that listings and
+// cursors follow byte order regardless of the database's locale.
+
+const objectColumns = "id, vault_id, object_key, size, content_hash, content_type, etag, metadata, chunked, created_at, updated_at"
+
+var objectSortColumns = map[string]string{
+	"key":     `object_key COLLATE "C"`,
+	"size":    "size",
+	"updated": "updated_at",
+}
+
+// Where a listing left off: the key of the last object returned, plus the
+// value of the sort column when sorting by something other than the key
+type ObjectCursor struct {
+	Key       string    `json:"k"`
+	Size      int64     `json:"s,omitempty"`
+	UpdatedAt time.Time `json:"u,omitzero"`
+}
+
+type ObjectListQuery struct {
+	VaultId    int32
+	Prefix     string
+	Sort       string // one of "key", "size" or "updated"
+	Descending bool
+	After      *ObjectCursor
+	Limit      int
+}
+
+func GetObject(db *pgxpool.Pool, vaultId int32, key string) (*storage.Object, error) {
+	row := db.QueryRow(context.Background(),
+		"SELECT "+objectColumns+" FROM objects WHERE vault_id = $1 AND object_key = $2",
+		vaultId, key)
+	return scanObject(row)
+}
+
+// List the objects whose keys start with query.Prefix, resuming after
+// query.After
+func ListObjects(db *pgxpool.Pool, query *ObjectListQuery) ([]*storage.Object, error) {
+	sortColumn, ok := objectSortColumns[query.Sort]
+	if !ok {
+		return nil, fmt.Errorf("unknown object sort %q", query.Sort)
+	}
+	direction, comparison := "ASC", ">"
+	if query.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	sql := "SELECT " + objectColumns + " FROM objects WHERE vault_id = $1 AND starts_with(object_key, $2)"
+	args := []any{query.VaultId, query.Prefix}
+	if query.After != nil {
+		switch query.Sort {
+		case "key":
+			sql += ` AND object_key COLLATE "C" ` + comparison + " $3"
+			args = append(args, query.After.Key)
+		case "size":
+			sql += ` AND (size, object_key COLLATE "C") ` + comparison + " ($3, $4)"
+			args = append(args, query.After.Size, query.After.Key)
+		case "updated":
+			sql += ` AND (updated_at, object_key COLLATE "C") ` + comparison + " ($3, $4)"
+			args = append(args, query.After.UpdatedAt, query.After.Key)
+		}
+	}
+	sql += " ORDER BY " + sortColumn + " " + direction
+	if query.Sort != "key" {
+		// break ties so that the cursor is unambiguous
+		sql += `, object_key COLLATE "C" ` + direction
+	}
+	sql += fmt.Sprintf(" LIMIT $%d", len(args)+1)
+	args = append(args, query.Limit)
+
+	rows, err := db.Query(context.Background(), sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanObjects(rows)
+}
+
+// An object, or a common prefix standing in for every object under it
+type ObjectEntry struct {
+	Key      string
+	IsPrefix bool
+	Object   *storage.Object // nil for common prefixes
+}
+
+// List the objects whose keys start with prefix in key order, rolling keys
+// that contain delimiter after the prefix up into common prefixes. Listing
+// resumes after the entry with key `after`, if it isn't empty.
+func ListObjectEntries(db *pgxpool.Pool, vaultId int32, prefix, delimiter, after string, descending bool, limit int) ([]*ObjectEntry, error) {
+	direction, comparison := "ASC", ">"
+	if descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	// entry is the key cut off just past the first delimiter after the prefix
+	sql := `
+		SELECT entry, bool_or(entry <> object_key) AS is_prefix FROM (
+			SELECT object_key, CASE
+				WHEN strpos(substr(object_key, $3), $4) > 0
+				THEN substr(object_key, 1, $3 - 1 + strpos(substr(object_key, $3), $4) + length($4) - 1)
+				ELSE object_key
+			END AS entry
+			FROM objects WHERE vault_id = $1 AND starts_with(object_key, $2)
+		) entries
+		WHERE $5 = '' OR entry COLLATE "C" ` + comparison + ` $5
+		GROUP BY entry
+		ORDER BY entry COLLATE "C" ` + direction + `
+		LIMIT $6`
+	// substr and strpos count characters, not bytes
+	rows, err := db.Query(context.Background(), sql,
+		vaultId, prefix, utf8.RuneCountInString(prefix)+1, delimiter, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*ObjectEntry, 0)
+	objectKeys := make([]string, 0)
+	for rows.Next() {
+		entry := &ObjectEntry{}
+		if err := rows.Scan(&entry.Key, &entry.IsPrefix); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, entry)
+		if !entry.IsPrefix {
+			objectKeys = append(objectKeys, entry.Key)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(objectKeys) == 0 {
+		return entries, nil
+	}
+
+	rows, err = db.Query(context.Background(),
+		"SELECT "+objectColumns+" FROM objects WHERE vault_id = $1 AND object_key = ANY($2)",
+		vaultId, objectKeys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	objects, err := scanObjects(rows)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]*storage.Object, len(objects))
+	for _, object := range objects {
+		byKey[object.Key] = object
+	}
+	for _, entry := range entries {
+		entry.Object = byKey[entry.Key]
+	}
+	return entries, nil
+}
+
+func scanObjects(rows pgx.Rows) ([]*storage.Object, error) {
+	objects := make([]*storage.Object, 0)
+	for rows.Next() {
+		object, err := scanObject(rows)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	return objects, rows.Err()
+}
+
+func scanObject(row pgx.Row) (*storage.Object, error) {
+	object := &storage.Object{}
+	err := row.Scan(
+		&object.Id, &object.VaultId, &object.Key, &object.Size, &object.ContentHash,
+		&object.ContentType, &object.ETag, &object.Metadata, &object.Chunked, &object.CreatedAt, &object.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return object, nil
+}
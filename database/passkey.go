@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/models/storage"
+)
+
+const passkeyColumns = "id, user_id, credential_id, public_key, sign_count, credential_name, attestation_type, aaguid, backup_eligible, created_at, last_used_at"
+
+// Insert a passkey and fill in the ID and creation time assigned by the
+// database
+func InsertPasskey(db *pgxpool.Pool, passkey *storage.Passkey) error {
+	row := db.QueryRow(context.Background(), `
+		INSERT INTO webauthn_credentials
+			(user_id, credential_id, public_key, sign_count, credential_name, attestation_type, aaguid, backup_eligible)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+		passkey.UserId, passkey.CredentialId, passkey.PublicKey, int64(passkey.SignCount),
+		passkey.Name, passkey.AttestationType, passkey.AAGUID, passkey.BackupEligible)
+	return row.Scan(&passkey.Id, &passkey.CreatedAt)
+}
+
+func ListPasskeysForUser(db *pgxpool.Pool, userId int32) ([]*storage.Passkey, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT "+passkeyColumns+" FROM webauthn_credentials WHERE user_id = $1 ORDER BY id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := make([]*storage.Passkey, 0)
+	for rows.Next() {
+		passkey, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	return passkeys, rows.Err()
+}
+
+// Get a passkey by the credential ID authenticators know it by. Not scoped by
+// user: used to sign in.
+func GetPasskeyByCredentialId(db *pgxpool.Pool, credentialId []byte) (*storage.Passkey, error) {
+	row := db.QueryRow(context.Background(),
+		"SELECT "+passkeyColumns+" FROM webauthn_credentials WHERE credential_id = $1", credentialId)
+	return scanPasskey(row)
+}
+
+// Record a sign in with a passkey and its new signature counter, as long as
+// the counter hasn't changed since it was read. Reports false if it has, in
+// which case a concurrent sign in got there first.
+func UsePasskey(db *pgxpool.Pool, id int32, oldSignCount, newSignCount uint32) (bool, error) {
+	tag, err := db.Exec(context.Background(), `
+		UPDATE webauthn_credentials SET sign_count = $3, last_used_at = now()
+		WHERE id = $1 AND sign_count = $2`,
+		id, int64(oldSignCount), int64(newSignCount))
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func DeletePasskey(db *pgxpool.Pool, userId, id int32) error {
+	tag, err := db.Exec(context.Background(),
+		"DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2", id, userId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func scanPasskey(row pgx.Row) (*storage.Passkey, error) {
+	passkey := &storage.Passkey{}
+	var signCount int64
+	err := row.Scan(
+		&passkey.Id, &passkey.UserId, &passkey.CredentialId, &passkey.PublicKey, &signCount,
+		&passkey.Name, &passkey.AttestationType, &passkey.AAGUID, &passkey.BackupEligible,
+		&passkey.CreatedAt, &passkey.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	passkey.SignCount = uint32(signCount)
+	return passkey, nil
+}
+
+func InsertWebAuthnChallenge(db *pgxpool.Pool, challenge *storage.WebAuthnChallenge) error {
+	_, err := db.Exec(context.Background(), `
+		INSERT INTO webauthn_challenges (id, user_id, challenge, ceremony, expires_at)
+		VALUES ($1, NULLIF($2, 0), $3, $4, $5)`,
+		challenge.Id, challenge.UserId, challenge.Challenge, challenge.Ceremony, challenge.ExpiresAt)
+	return err
+}
+
+// Remove and return an unexpired challenge of the given ceremony, so that it
+// can only be answered once. Returns pgx.ErrNoRows if there is none.
+func TakeWebAuthnChallenge(db *pgxpool.Pool, id, ceremony string) (*storage.WebAuthnChallenge, error) {
+	challenge := &storage.WebAuthnChallenge{}
+	row := db.QueryRow(context.Background(), `
+		DELETE FROM webauthn_challenges
+		WHERE id = $1 AND ceremony = $2 AND expires_at > now()
+		RETURNING id, COALESCE(user_id, 0), challenge, ceremony, expires_at`,
+		id, ceremony)
+	err := row.Scan(
+		&challenge.Id, &challenge.UserId, &challenge.Challenge, &challenge.Ceremony, &challenge.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func DeleteExpiredWebAuthnChallenges(db *pgxpool.Pool) error {
+	_, err := db.Exec(context.Background(), "DELETE FROM webauthn_challenges WHERE expires_at <= now()")
+	return err
+}
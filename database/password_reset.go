@@ -0,0 +1,57 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Store a password reset token for a user, replacing any they were sent
+// before
+func ReplacePasswordResetToken(db *pgxpool.Pool, userId int32, tokenHash []byte, expiresAt time.Time) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(context.Background(),
+		"DELETE FROM password_reset_tokens WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(context.Background(),
+		"INSERT INTO password_reset_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		tokenHash, userId, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// Remove an unexpired password reset token, so that it can only be used once,
+// and return the ID of the user it was sent to. Returns pgx.ErrNoRows if there
+// is none.
+func TakePasswordResetToken(db *pgxpool.Pool, tokenHash []byte) (userId int32, err error) {
+	row := db.QueryRow(context.Background(), `
+		DELETE FROM password_reset_tokens
+		WHERE token_hash = $1 AND expires_at > now()
+		RETURNING user_id`,
+		tokenHash)
+	err = row.Scan(&userId)
+	return userId, err
+}
+
+func DeleteExpiredPasswordResetTokens(db *pgxpool.Pool) error {
+	_, err := db.Exec(context.Background(), "DELETE FROM password_reset_tokens WHERE expires_at <= now()")
+	return err
+}
+
+// Get the ID of the user an unexpired password reset token was sent to,
+// leaving the token in place. Returns pgx.ErrNoRows if there is none.
+func GetPasswordResetTokenUser(db *pgxpool.Pool, tokenHash []byte) (userId int32, err error) {
+	row := db.QueryRow(context.Background(),
+		"SELECT user_id FROM password_reset_tokens WHERE token_hash = $1 AND expires_at > now()",
+		tokenHash)
+	err = row.Scan(&userId)
+	return userId, err
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/models/storage"
+)
+
+const providerKeyColumns = "id, user_id, provider_type, COALESCE(key_id, ''), COALESCE(secret, ''), COALESCE(region, ''), COALESCE(endpoint, '')"
+
+// Insert provider credentials and fill in the ID assigned by the database
+func InsertProviderKey(db *pgxpool.Pool, key *storage.ProviderKey) error {
+	row := db.QueryRow(
+		context.Background(),
+		"INSERT INTO provider_keys (user_id, provider_type, key_id, secret, region, endpoint) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		key.UserId, key.ProviderType, key.KeyId, key.Secret, key.Region, key.Endpoint)
+	return row.Scan(&key.Id)
+}
+
+func ListProviderKeysForUser(db *pgxpool.Pool, userId int32) ([]*storage.ProviderKey, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT "+providerKeyColumns+" FROM provider_keys WHERE user_id = $1 ORDER BY id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]*storage.ProviderKey, 0)
+	for rows.Next() {
+		key, err := scanProviderKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Get one of the user's provider keys. Returns pgx.ErrNoRows if the user has
+// no such key.
+func GetProviderKey(db *pgxpool.Pool, userId, keyId int32) (*storage.ProviderKey, error) {
+	row := db.QueryRow(context.Background(),
+		"SELECT "+providerKeyColumns+" FROM provider_keys WHERE id = $1 AND user_id = $2",
+		keyId, userId)
+	return scanProviderKey(row)
+}
+
+// Get the user's most recently added credentials for a provider
+func GetProviderKeyForUser(db *pgxpool.Pool, userId int32, providerType string) (*storage.ProviderKey, error) {
+	row := db.QueryRow(context.Background(),
+		"SELECT "+providerKeyColumns+" FROM provider_keys WHERE user_id = $1 AND provider_type = $2 ORDER BY id DESC LIMIT 1",
+		userId, providerType)
+	return scanProviderKey(row)
+}
+
+func scanProviderKey(row pgx.Row) (*storage.ProviderKey, error) {
+	key := &storage.ProviderKey{}
+	err := row.Scan(
+		&key.Id, &key.UserId, &key.ProviderType, &key.KeyId, &key.Secret, &key.Region, &key.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
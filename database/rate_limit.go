@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/ratelimit"
+)
+
+// Take a token from the bucket with the given key. Returns whether there was
+// one to take, and if not, how long until there is.
+func TakeRateLimitToken(db *pgxpool.Pool, key string, bucket ratelimit.TokenBucket) (bool, time.Duration, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback(context.Background())
+
+	now := time.Now()
+	// make sure there's a row to lock
+	if _, err := tx.Exec(context.Background(), `
+		INSERT INTO rate_limits (key, tokens, updated_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO NOTHING`,
+		key, bucket.Capacity, now); err != nil {
+		return false, 0, err
+	}
+	state := ratelimit.State{}
+	row := tx.QueryRow(context.Background(),
+		"SELECT tokens, updated_at FROM rate_limits WHERE key = $1 FOR UPDATE", key)
+	if err := row.Scan(&state.Tokens, &state.UpdatedAt); err != nil {
+		return false, 0, err
+	}
+
+	state, ok, wait := bucket.Take(state, now)
+	if _, err := tx.Exec(context.Background(),
+		"UPDATE rate_limits SET tokens = $2, updated_at = $3 WHERE key = $1",
+		key, state.Tokens, state.UpdatedAt); err != nil {
+		return false, 0, err
+	}
+	return ok, wait, tx.Commit(context.Background())
+}
+
+// Delete buckets untouched since before the given time. A bucket that has
+// had time to refill is no different from one that was never used.
+func DeleteStaleRateLimits(db *pgxpool.Pool, before time.Time) error {
+	_, err := db.Exec(context.Background(), "DELETE FROM rate_limits WHERE updated_at < $1", before)
+	return err
+}
+
+// Get the time a login name is locked out until, or the zero time if it isn't
+func GetLoginLockout(db *pgxpool.Pool, login string) (time.Time, error) {
+	var lockedUntil *time.Time
+	row := db.QueryRow(context.Background(),
+		"SELECT locked_until FROM login_failures WHERE login = $1", login)
+	if err := row.Scan(&lockedUntil); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, err
+	}
+	if lockedUntil == nil {
+		return time.Time{}, nil
+	}
+	return *lockedUntil, nil
+}
+
+// Record a failed sign in and lock the login name out for as long as the
+// backoff calls for. Failures older than resetAfter are forgotten. Returns the
+// number of consecutive failures and the lockout, if any.
+func RecordLoginFailure(
+	db *pgxpool.Pool, login string, backoff ratelimit.Backoff, resetAfter time.Duration,
+) (int, time.Duration, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var failures int
+	row := tx.QueryRow(context.Background(), `
+		INSERT INTO login_failures (login, failures, last_failure_at) VALUES ($1, 1, now())
+		ON CONFLICT (login) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure_at < now() - $2 * interval '1 second'
+				THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure_at = now()
+		RETURNING failures`,
+		login, resetAfter.Seconds())
+	if err := row.Scan(&failures); err != nil {
+		return 0, 0, err
+	}
+	lockout := backoff.Lockout(failures)
+	if lockout > 0 {
+		if _, err := tx.Exec(context.Background(),
+			"UPDATE login_failures SET locked_until = now() + $2 * interval '1 second' WHERE login = $1",
+			login, lockout.Seconds()); err != nil {
+			return 0, 0, err
+		}
+	}
+	return failures, lockout, tx.Commit(context.Background())
+}
+
+// Forget the failed sign ins of a login name after a successful one
+func ClearLoginFailures(db *pgxpool.Pool, login string) error {
+	_, err := db.Exec(context.Background(), "DELETE FROM login_failures WHERE login = $1", login)
+	return err
+}
+
+// Delete failures older than the given time that no longer lock anyone out
+func DeleteStaleLoginFailures(db *pgxpool.Pool, before time.Time) error {
+	_, err := db.Exec(context.Background(), `
+		DELETE FROM login_failures
+		WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < now())`,
+		before)
+	return err
+}
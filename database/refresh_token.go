@@ -0,0 +1,132 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/models/storage"
+)
+
+var ErrRefreshTokenReused = errors.New("refresh token has already been used or revoked")
+
+func InsertRefreshToken(db *pgxpool.Pool, token *storage.RefreshToken) error {
+	_, err := db.Exec(context.Background(), `
+		INSERT INTO refresh_tokens (id, family_id, user_id, issued_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		token.Id, token.FamilyId, token.UserId, token.IssuedAt, token.ExpiresAt)
+	return err
+}
+
+// Mark the refresh token with the given ID as used and record its
+// replacement. If the token was already used or revoked, its whole family is
+// revoked and ErrRefreshTokenReused is returned: either the token was stolen
+// or its rightful owner's replacement was. Returns pgx.ErrNoRows if no such
+// token was issued.
+func RotateRefreshToken(db *pgxpool.Pool, usedId string, next *storage.RefreshToken) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var familyId string
+	var userId int32
+	var available bool
+	row := tx.QueryRow(context.Background(), `
+		SELECT family_id, user_id, used_at IS NULL AND revoked_at IS NULL
+		FROM refresh_tokens WHERE id = $1 FOR UPDATE`,
+		usedId)
+	if err := row.Scan(&familyId, &userId, &available); err != nil {
+		return err
+	}
+	if !available || familyId != next.FamilyId || userId != next.UserId {
+		if _, err := tx.Exec(context.Background(),
+			"UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL",
+			familyId); err != nil {
+			return err
+		}
+		if err := tx.Commit(context.Background()); err != nil {
+			return err
+		}
+		return ErrRefreshTokenReused
+	}
+
+	if _, err := tx.Exec(context.Background(),
+		"UPDATE refresh_tokens SET used_at = now() WHERE id = $1", usedId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(context.Background(), `
+		INSERT INTO refresh_tokens (id, family_id, user_id, issued_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		next.Id, next.FamilyId, next.UserId, next.IssuedAt, next.ExpiresAt); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// Delete refresh tokens that have expired; they can't be used or reused
+func DeleteExpiredRefreshTokens(db *pgxpool.Pool) error {
+	_, err := db.Exec(context.Background(), "DELETE FROM refresh_tokens WHERE expires_at < now()")
+	return err
+}
+
+// Revoke every refresh token in one of the user's token families
+func RevokeRefreshTokenFamily(db *pgxpool.Pool, userId int32, familyId string) error {
+	_, err := db.Exec(context.Background(), `
+		UPDATE refresh_tokens SET revoked_at = now()
+		WHERE user_id = $1 AND family_id = $2 AND revoked_at IS NULL`,
+		userId, familyId)
+	return err
+}
+
+// Revoke the refresh tokens of every one of the user's token families except
+// one
+func RevokeOtherRefreshTokenFamilies(db *pgxpool.Pool, userId int32, familyId string) error {
+	_, err := db.Exec(context.Background(), `
+		UPDATE refresh_tokens SET revoked_at = now()
+		WHERE user_id = $1 AND family_id <> $2 AND revoked_at IS NULL`,
+		userId, familyId)
+	return err
+}
+
+// Revoke every token issued to the user so far: their refresh tokens, and
+// through the returned "tokens valid after" time, their access tokens. API
+// keys are left alone.
+func RevokeAllTokens(db *pgxpool.Pool, userId int32) (time.Time, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var validAfter time.Time
+	row := tx.QueryRow(context.Background(),
+		"UPDATE users SET tokens_valid_after = now() WHERE id = $1 RETURNING tokens_valid_after",
+		userId)
+	if err := row.Scan(&validAfter); err != nil {
+		return time.Time{}, err
+	}
+	if _, err := tx.Exec(context.Background(),
+		"UPDATE refresh_tokens SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL",
+		userId); err != nil {
+		return time.Time{}, err
+	}
+	return validAfter, tx.Commit(context.Background())
+}
+
+// Get the time at or before which the user's access tokens were revoked, or
+// the zero time if they never were
+func GetTokensValidAfter(db *pgxpool.Pool, userId int32) (time.Time, error) {
+	var validAfter *time.Time
+	row := db.QueryRow(context.Background(),
+		"SELECT tokens_valid_after FROM users WHERE id = $1", userId)
+	if err := row.Scan(&validAfter); err != nil {
+		return time.Time{}, err
+	}
+	if validAfter == nil {
+		return time.Time{}, nil
+	}
+	return *validAfter, nil
+}
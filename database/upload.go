@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/models/storage"
+)
+
+const uploadColumns = "uploads.id, uploads.vault_id, uploads.object_key, uploads.content_type, uploads.metadata, uploads.upload_length, uploads.upload_offset, uploads.created_at, uploads.expires_at"
+
+func InsertUpload(db *pgxpool.Pool, upload *storage.Upload) error {
+	row := db.QueryRow(context.Background(), `
+		INSERT INTO uploads (id, vault_id, object_key, content_type, metadata, upload_length, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING created_at`,
+		upload.Id, upload.VaultId, upload.Key, upload.ContentType, upload.Metadata,
+		upload.Length, upload.ExpiresAt)
+	return row.Scan(&upload.CreatedAt)
+}
+
+// Get an upload into one of the owner's vaults
+func GetUploadForOwner(db *pgxpool.Pool, ownerId, vaultId int32, uploadId string) (*storage.Upload, error) {
+	row := db.QueryRow(context.Background(), `
+		SELECT `+uploadColumns+` FROM uploads
+		JOIN vaults ON vaults.id = uploads.vault_id
+		WHERE uploads.id = $1 AND uploads.vault_id = $2 AND vaults.owner_id = $3`,
+		uploadId, vaultId, ownerId)
+	return scanUpload(row)
+}
+
+func UpdateUploadOffset(db *pgxpool.Pool, uploadId string, offset int64) error {
+	_, err := db.Exec(context.Background(),
+		"UPDATE uploads SET upload_offset = $1 WHERE id = $2", offset, uploadId)
+	return err
+}
+
+func DeleteUpload(db *pgxpool.Pool, uploadId string) error {
+	_, err := db.Exec(context.Background(), "DELETE FROM uploads WHERE id = $1", uploadId)
+	return err
+}
+
+// Delete every expired upload and return their IDs so that their staged data
+// can be removed
+func DeleteExpiredUploads(db *pgxpool.Pool) ([]string, error) {
+	rows, err := db.Query(context.Background(),
+		"DELETE FROM uploads WHERE expires_at < now() RETURNING id")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func scanUpload(row pgx.Row) (*storage.Upload, error) {
+	upload := &storage.Upload{}
+	err := row.Scan(
+		&upload.Id, &upload.VaultId, &upload.Key, &upload.ContentType, &upload.Metadata,
+		&upload.Length, &upload.Offset, &upload.CreatedAt, &upload.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
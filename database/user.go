@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/raian621/dump/models/storage"
 )
@@ -13,31 +14,38 @@ func InsertUser(db *pgxpool.Pool, user *storage.User) {
 		user.Id, user.Username)
 }
 
-func GetUserById(db *pgxpool.Pool, id uint64) (*storage.User, error) {
+func GetUserById(db *pgxpool.Pool, id int32) (*storage.User, error) {
 	user := &storage.User{}
-	row := db.QueryRow(context.Background(), "SELECT id, username FROM users")
-	if err := row.Scan(&user.Id, &user.Username); err != nil {
+	row := db.QueryRow(context.Background(), `
+		SELECT id, username, COALESCE(email, ''), email_verified_at IS NOT NULL
+		FROM users WHERE id = $1`, id)
+	if err := row.Scan(&user.Id, &user.Username, &user.Email, &user.EmailVerified); err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
+// Whether a user has the username, or one differing from it only in case
 func UsernameExists(db *pgxpool.Pool, username string) (bool, error) {
 	// consider using a bloom filter if this becomes a bottleneck
 	var exists bool
 	row := db.QueryRow(context.Background(),
-		"SELECT COUNT(*) > 0 FROM users WHERE username = $1", username)
+		"SELECT COUNT(*) > 0 FROM users WHERE lower(username) = lower($1)", username)
 	if err := row.Scan(&exists); err != nil {
 		return false, err
 	}
 	return exists, nil
 }
 
+// Create a user with a password. Fails with a unique violation of
+// UsernameConstraint if the username, or one differing from it only in case,
+// is taken.
 func CreateUserWithCredentials(db *pgxpool.Pool, creds *storage.Credentials) error {
 	tx, err := db.Begin(context.Background())
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback(context.Background())
 	_, err = tx.Exec(context.Background(),
 		"INSERT INTO users (username) VALUES ($1)",
 		creds.Username)
@@ -60,3 +68,60 @@ func GetUserIdFromUsername(db *pgxpool.Pool, username string) (userId int32, err
 	err = row.Scan(&userId)
 	return userId, err
 }
+
+// Get the username of the user signing in as the given username or verified
+// email address. A username wins over someone else's email address.
+func GetUsernameForSignIn(db *pgxpool.Pool, usernameOrEmail string) (username string, err error) {
+	row := db.QueryRow(context.Background(), `
+		SELECT username FROM users
+		WHERE username = $1 OR (email = lower($1) AND email_verified_at IS NOT NULL)
+		ORDER BY username = $1 DESC LIMIT 1`,
+		usernameOrEmail)
+	err = row.Scan(&username)
+	return username, err
+}
+
+// Whether a user other than the given one has verified the email address
+func EmailTaken(db *pgxpool.Pool, userId int32, email string) (bool, error) {
+	var taken bool
+	row := db.QueryRow(context.Background(), `
+		SELECT EXISTS (SELECT 1 FROM users WHERE email = $1 AND email_verified_at IS NOT NULL AND id <> $2)`,
+		email, userId)
+	err := row.Scan(&taken)
+	return taken, err
+}
+
+// Set a user's email address, which needs verifying unless it's the verified
+// address they already have. An empty address removes it.
+func SetEmail(db *pgxpool.Pool, userId int32, email string) error {
+	tag, err := db.Exec(context.Background(), `
+		UPDATE users SET
+			email_verified_at = CASE WHEN email = $2 THEN email_verified_at END,
+			email = NULLIF($2, '')
+		WHERE id = $1`,
+		userId, email)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// Mark a user's email address verified, as long as it's still the given one.
+// Returns pgx.ErrNoRows if it isn't, and a unique violation if another user
+// has verified it in the meantime.
+func VerifyEmail(db *pgxpool.Pool, userId int32, email string) error {
+	tag, err := db.Exec(context.Background(), `
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, now())
+		WHERE id = $1 AND email = $2`,
+		userId, email)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
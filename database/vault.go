@@ -0,0 +1,159 @@
+package database
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raian621/dump/models/storage"
+)
+
+// Every query except InsertVault is scoped by owner_id so that a user can
+// never read or modify another user's vault. A vault owned by someone else
+// behaves exactly like one that doesn't exist (pgx.ErrNoRows).
+
+const vaultColumns = "id, owner_id, vault_name, vault_type, COALESCE(bucket, ''), data_key, COALESCE(master_key_id, ''), COALESCE(provider_key_id, 0)"
+
+// Insert a vault and fill in the ID assigned by the database
+func InsertVault(db *pgxpool.Pool, vault *storage.Vault) error {
+	row := db.QueryRow(
+		context.Background(),
+		`INSERT INTO vaults (owner_id, vault_name, vault_type, bucket, data_key, master_key_id, provider_key_id)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, NULLIF($7, 0)) RETURNING id`,
+		vault.OwnerId, vault.Name, vault.Type, vault.Bucket, vault.DataKey, vault.MasterKeyId, vault.ProviderKeyId)
+	return row.Scan(&vault.Id)
+}
+
+func VaultNameExists(db *pgxpool.Pool, ownerId int32, name string) (bool, error) {
+	var exists bool
+	row := db.QueryRow(context.Background(),
+		"SELECT COUNT(*) > 0 FROM vaults WHERE owner_id = $1 AND vault_name = $2",
+		ownerId, name)
+	if err := row.Scan(&exists); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func GetVaultForOwner(db *pgxpool.Pool, ownerId, vaultId int32) (*storage.Vault, error) {
+	row := db.QueryRow(context.Background(),
+		"SELECT "+vaultColumns+" FROM vaults WHERE id = $1 AND owner_id = $2",
+		vaultId, ownerId)
+	return scanVault(row)
+}
+
+func ListVaultsForOwner(db *pgxpool.Pool, ownerId int32, limit, offset int) ([]*storage.Vault, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT "+vaultColumns+" FROM vaults WHERE owner_id = $1 ORDER BY id LIMIT $2 OFFSET $3",
+		ownerId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vaults := make([]*storage.Vault, 0)
+	for rows.Next() {
+		vault, err := scanVault(rows)
+		if err != nil {
+			return nil, err
+		}
+		vaults = append(vaults, vault)
+	}
+	return vaults, rows.Err()
+}
+
+func CountVaultsForOwner(db *pgxpool.Pool, ownerId int32) (count int64, err error) {
+	row := db.QueryRow(context.Background(),
+		"SELECT COUNT(*) FROM vaults WHERE owner_id = $1", ownerId)
+	err = row.Scan(&count)
+	return count, err
+}
+
+// Rename a vault and return the updated row
+func RenameVault(db *pgxpool.Pool, ownerId, vaultId int32, name string) (*storage.Vault, error) {
+	row := db.QueryRow(context.Background(),
+		"UPDATE vaults SET vault_name = $1 WHERE id = $2 AND owner_id = $3 RETURNING "+vaultColumns,
+		name, vaultId, ownerId)
+	return scanVault(row)
+}
+
+// Delete a vault and schedule a storage purge of the objects it stored in its
+// backend. Returns the IDs of the vault's uploads, whose staged data is on the
+// server's disk.
+func DeleteVault(db *pgxpool.Pool, ownerId, vaultId int32) ([]string, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	row := tx.QueryRow(context.Background(),
+		"SELECT "+vaultColumns+" FROM vaults WHERE id = $1 AND owner_id = $2 FOR UPDATE",
+		vaultId, ownerId)
+	vault, err := scanVault(row)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(context.Background(), "SELECT id FROM uploads WHERE vault_id = $1", vaultId)
+	if err != nil {
+		return nil, err
+	}
+	uploadIds, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	if err := insertStoragePurge(tx, vault); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(context.Background(), "DELETE FROM vaults WHERE id = $1", vaultId); err != nil {
+		return nil, err
+	}
+	return uploadIds, tx.Commit(context.Background())
+}
+
+// List the vaults whose data key is missing or wasn't wrapped by the given
+// master key. Not scoped by owner: only used for key maintenance at startup.
+func ListVaultsNeedingDataKey(db *pgxpool.Pool, masterKeyId string) ([]*storage.Vault, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT "+vaultColumns+" FROM vaults WHERE data_key IS NULL OR master_key_id <> $1 ORDER BY id",
+		masterKeyId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vaults := make([]*storage.Vault, 0)
+	for rows.Next() {
+		vault, err := scanVault(rows)
+		if err != nil {
+			return nil, err
+		}
+		vaults = append(vaults, vault)
+	}
+	return vaults, rows.Err()
+}
+
+// Replace a vault's wrapped data key, as long as it is still wrapped by
+// vault.MasterKeyId (another server may have got there first). Reports
+// whether the key was replaced.
+func ReplaceVaultDataKey(db *pgxpool.Pool, vault *storage.Vault, dataKey []byte, masterKeyId string) (bool, error) {
+	tag, err := db.Exec(context.Background(), `
+		UPDATE vaults SET data_key = $1, master_key_id = $2
+		WHERE id = $3 AND COALESCE(master_key_id, '') = $4`,
+		dataKey, masterKeyId, vault.Id, vault.MasterKeyId)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func scanVault(row pgx.Row) (*storage.Vault, error) {
+	vault := &storage.Vault{}
+	err := row.Scan(
+		&vault.Id, &vault.OwnerId, &vault.Name, &vault.Type, &vault.Bucket,
+		&vault.DataKey, &vault.MasterKeyId, &vault.ProviderKeyId)
+	if err != nil {
+		return nil, err
+	}
+	return vault, nil
+}
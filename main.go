@@ -5,14 +5,22 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
 	"github.com/raian621/dump/auth"
+	"github.com/raian621/dump/crypt"
 	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/notify"
+	"github.com/raian621/dump/oidc"
+	"github.com/raian621/dump/policy"
 	"github.com/raian621/dump/server"
+	"github.com/raian621/dump/webauthn"
 )
 
 func main() {
@@ -22,11 +30,40 @@ func main() {
 	}
 	s := server.New()
 	accessTtl, refreshTtl := getTokenTtls()
-	s.AddTokenFactory(auth.NewTokenFactory(accessTtl, refreshTtl, getJwtSecret()))
+	s.AddTokenFactory(auth.NewTokenFactoryWithKeyring(
+		accessTtl, refreshTtl, getSigningKeys(), getTokenOptions()...))
+	s.AddKeyring(getKeyring())
+	s.AddAPIKeyPepper(getAPIKeyPepper())
+	if rp := getRelyingParty(); rp != nil {
+		s.AddRelyingParty(rp)
+	}
+	if proxies := getTrustedProxies(); len(proxies) > 0 {
+		s.AddTrustedProxies(proxies)
+	}
+	s.AddNotifier(getNotifier())
+	s.AddAppURL(getEnvVar("APP_URL", "", false))
+	if getEnvVar("REQUIRE_VERIFIED_EMAIL", "false", false) == "true" {
+		if getEnvVar("NOTIFIER", "none", false) == "none" {
+			log.Fatalln("REQUIRE_VERIFIED_EMAIL needs a NOTIFIER to send verification links")
+		}
+		s.RequireVerifiedEmail()
+	}
+	s.AddPasswordPolicy(getPasswordPolicy())
+	if providers := getOIDCProviders(); len(providers) > 0 {
+		s.AddOIDCProviders(providers)
+	}
 	s.AddHandlers()
 	db := getDbClient()
 	s.AddDatabaseClient(db)
+	s.AddVaultRoot(getEnvVar("VAULT_ROOT", "vaults", false))
+	s.AddStorageEndpointHosts(getStorageEndpointHosts())
+	s.AddUploadDir(getEnvVar("UPLOAD_DIR", "uploads", false))
+	s.AddExportDir(getEnvVar("EXPORT_DIR", "exports", false))
 	applyMigrations(db)
+	if err := s.RewrapVaultDataKeys(); err != nil {
+		log.Println("Failed to re-wrap vault data keys: ", err)
+	}
+	go s.PurgeDeletedStorage(context.Background())
 	log.Fatalln(s.Start(":1234"))
 }
 
@@ -61,9 +98,9 @@ func getDbClient() *pgxpool.Pool {
 
 func getConnString(requireSsl bool) string {
 	connStr := fmt.Sprintf(
-		"postgresql://%s:%s/%s?user=%s&password=%s", getDbEnvVar("DB_HOST", "127.0.0.1", false),
-		getDbEnvVar("DB_PORT", "1234", false), getDbEnvVar("DB_NAME", "postgres", false), getDbEnvVar("DB_USER", "postgres", false),
-		getDbEnvVar("DB_PASSWORD", "1234", false))
+		"postgresql://%s:%s/%s?user=%s&password=%s", getEnvVar("DB_HOST", "127.0.0.1", false),
+		getEnvVar("DB_PORT", "1234", false), getEnvVar("DB_NAME", "postgres", false), getEnvVar("DB_USER", "postgres", false),
+		getEnvVar("DB_PASSWORD", "1234", false))
 	if requireSsl {
 		return fmt.Sprintf("%s&sslmode=%s", connStr, "require")
 	}
@@ -71,7 +108,7 @@ func getConnString(requireSsl bool) string {
 	return connStr
 }
 
-func getDbEnvVar(name, defaultVal string, required bool) string {
+func getEnvVar(name, defaultVal string, required bool) string {
 	if envVar, found := os.LookupEnv(name); !found {
 		if required {
 			panic(fmt.Errorf("required env var `%s` not found", name))
@@ -105,8 +142,201 @@ func getTokenTtls() (int, int) {
 	return accessTtl, refreshTtl
 }
 
-func getJwtSecret() []byte {
-	secretBase64 := os.Getenv("JWT_SECRET")
+func getTokenOptions() []auth.TokenFactoryOption {
+	leeway := 30 // tolerate clocks 30 seconds apart
+	if envLeeway, found := os.LookupEnv("JWT_LEEWAY"); found {
+		var err error
+		if leeway, err = strconv.Atoi(envLeeway); err != nil {
+			panic(err)
+		}
+	}
+	return []auth.TokenFactoryOption{
+		auth.WithIssuer(getEnvVar("JWT_ISSUER", "dump", false)),
+		auth.WithAudience(getEnvVar("JWT_AUDIENCE", "dump", false)),
+		auth.WithLeeway(time.Second * time.Duration(leeway)),
+	}
+}
+
+// Tokens are signed with JWT_SECRET, under the key ID JWT_KEY_ID if it is
+// set. More keys can be kept as JSON files in JWT_KEY_DIR (see
+// auth.LoadKeyDir), including EdDSA and ES256 keys whose public halves are
+// published at /.well-known/jwks.json; the active key created last signs new
+// tokens, and a key in JWT_SECRET counts as created before any of them. To
+// rotate keys without signing anyone out, add the new key to every server
+// first, then retire the old one by giving its key file a retired_at (moving
+// a JWT_SECRET key into a key file first).
+func getSigningKeys() *auth.Keyring {
+	keys := make([]*auth.SigningKey, 0)
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		key := auth.NewSigningKey(decodeSecret(secret))
+		if id := getEnvVar("JWT_KEY_ID", "", false); id != "" {
+			key.Id = id
+		}
+		keys = append(keys, key)
+	}
+	if dir := getEnvVar("JWT_KEY_DIR", "", false); dir != "" {
+		dirKeys, err := auth.LoadKeyDir(dir)
+		if err != nil {
+			panic(err)
+		}
+		keys = append(keys, dirKeys...)
+	}
+	keyring, err := auth.NewKeyring(keys...)
+	if err != nil {
+		panic(err)
+	}
+	return keyring
+}
+
+// The master key (VAULT_MASTER_KEY) wraps the data key of every vault. To
+// rotate it, move the old key to VAULT_PREVIOUS_MASTER_KEYS (comma
+// separated); data keys are re-wrapped with the new key at startup, after
+// which the old key can be dropped.
+func getKeyring() *crypt.Keyring {
+	current := decodeSecret(getEnvVar("VAULT_MASTER_KEY", "", true))
+	previous := make([][]byte, 0)
+	if envPrevious := getEnvVar("VAULT_PREVIOUS_MASTER_KEYS", "", false); envPrevious != "" {
+		for _, key := range strings.Split(envPrevious, ",") {
+			previous = append(previous, decodeSecret(strings.TrimSpace(key)))
+		}
+	}
+	keyring, err := crypt.NewKeyring(current, previous...)
+	if err != nil {
+		panic(err)
+	}
+	return keyring
+}
+
+// Passkeys are enabled by setting WEBAUTHN_RP_ID to the domain the server is
+// reached at. WEBAUTHN_ORIGINS lists the origins of the web clients, comma
+// separated, and defaults to https://<WEBAUTHN_RP_ID>.
+func getRelyingParty() *webauthn.RelyingParty {
+	rpId := getEnvVar("WEBAUTHN_RP_ID", "", false)
+	if rpId == "" {
+		return nil
+	}
+	origins := make([]string, 0)
+	for _, origin := range strings.Split(getEnvVar("WEBAUTHN_ORIGINS", "https://"+rpId, false), ",") {
+		origins = append(origins, strings.TrimSpace(origin))
+	}
+	return &webauthn.RelyingParty{
+		Id:      rpId,
+		Name:    getEnvVar("WEBAUTHN_RP_NAME", "dump", false),
+		Origins: origins,
+	}
+}
+
+// TRUSTED_PROXIES lists the networks of reverse proxies, comma separated in
+// CIDR notation, whose X-Forwarded-For headers tell the client IP that
+// requests are throttled by
+func getTrustedProxies() []*net.IPNet {
+	networks := make([]*net.IPNet, 0)
+	for _, cidr := range strings.Split(getEnvVar("TRUSTED_PROXIES", "", false), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalln("Invalid TRUSTED_PROXIES: ", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// STORAGE_ENDPOINT_HOSTS is a comma separated list of hosts provider keys may
+// use as custom endpoints even when they're private or not https, such as an
+// S3-compatible server on the local network.
+func getStorageEndpointHosts() []string {
+	hosts := make([]string, 0)
+	for _, host := range strings.Split(getEnvVar("STORAGE_ENDPOINT_HOSTS", "", false), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// PASSWORD_MIN_LENGTH and PASSWORD_MAX_LENGTH bound the length of passwords,
+// RESERVED_USERNAMES adds comma separated names to those nobody can take, and
+// BREACHED_PASSWORDS_DIR is a directory of breached password hashes in the
+// Have I Been Pwned range format (a file per SHA-1 prefix) to refuse.
+func getPasswordPolicy() *policy.Policy {
+	p := policy.Default()
+	var err error
+	if minLength, found := os.LookupEnv("PASSWORD_MIN_LENGTH"); found {
+		if p.MinPasswordLength, err = strconv.Atoi(minLength); err != nil {
+			panic(err)
+		}
+	}
+	if maxLength, found := os.LookupEnv("PASSWORD_MAX_LENGTH"); found {
+		if p.MaxPasswordLength, err = strconv.Atoi(maxLength); err != nil {
+			panic(err)
+		}
+	}
+	if p.MinPasswordLength < 1 || p.MaxPasswordLength < p.MinPasswordLength {
+		log.Fatalln("PASSWORD_MIN_LENGTH must be at least 1 and at most PASSWORD_MAX_LENGTH")
+	}
+	for _, username := range strings.Split(getEnvVar("RESERVED_USERNAMES", "", false), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			p.ReservedUsernames = append(p.ReservedUsernames, strings.ToLower(username))
+		}
+	}
+	if dir := getEnvVar("BREACHED_PASSWORDS_DIR", "", false); dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			log.Fatalln("BREACHED_PASSWORDS_DIR must be a directory: ", dir)
+		}
+		p.Breached = &policy.BreachedPasswords{Dir: dir}
+	}
+	return p
+}
+
+// NOTIFIER picks how messages to users are delivered: "smtp" sends email
+// through SMTP_ADDR, "log" writes them to the log for development, and "none"
+// (the default) turns off features that need them, such as password resets.
+func getNotifier() notify.Notifier {
+	switch notifier := getEnvVar("NOTIFIER", "none", false); notifier {
+	case "smtp":
+		return &notify.SMTPNotifier{
+			Addr:       getEnvVar("SMTP_ADDR", "", true),
+			From:       getEnvVar("SMTP_FROM", "", true),
+			Username:   getEnvVar("SMTP_USERNAME", "", false),
+			Password:   getEnvVar("SMTP_PASSWORD", "", false),
+			RequireTLS: getEnvVar("SMTP_REQUIRE_TLS", "true", false) == "true",
+		}
+	case "log":
+		return &notify.LogNotifier{}
+	case "none":
+		return nil
+	default:
+		log.Fatalln("Unknown NOTIFIER: ", notifier)
+		return nil
+	}
+}
+
+// OIDC_PROVIDERS_FILE, if set, is a JSON file listing the OpenID Connect
+// providers users can sign in with
+func getOIDCProviders() []*oidc.ProviderConfig {
+	path := getEnvVar("OIDC_PROVIDERS_FILE", "", false)
+	if path == "" {
+		return nil
+	}
+	providers, err := oidc.LoadProviders(path)
+	if err != nil {
+		log.Fatalln("Failed to load OIDC providers: ", err)
+	}
+	return providers
+}
+
+// API_KEY_PEPPER, if set, keys the hashes of API keys stored in the database
+func getAPIKeyPepper() []byte {
+	if pepper := getEnvVar("API_KEY_PEPPER", "", false); pepper != "" {
+		return decodeSecret(pepper)
+	}
+	return nil
+}
+
+func decodeSecret(secretBase64 string) []byte {
 	secret := make([]byte, base64.RawURLEncoding.DecodedLen(len(secretBase64)))
 	n, err := base64.RawURLEncoding.Decode(secret, []byte(secretBase64))
 	if err != nil {
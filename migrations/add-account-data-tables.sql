@@ -0,0 +1,33 @@
+-- Vaults of deleted accounts whose stored objects are still to be deleted
+-- from their backends. The vault and its owner's provider keys are gone by
+-- then, so whatever it takes to reach the backend is kept here until the
+-- purge is done.
+CREATE TABLE storage_purges (
+  id              SERIAL PRIMARY KEY,
+  vault_id        INTEGER NOT NULL,
+  vault_type      VARCHAR(32) NOT NULL,
+  bucket          VARCHAR(255),
+  key_id          VARCHAR(500),
+  secret          TEXT,
+  region          VARCHAR(64),
+  endpoint        VARCHAR(500),
+  attempts        INTEGER NOT NULL DEFAULT 0,
+  last_error      TEXT,
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX storage_purges_next_attempt_at_idx ON storage_purges (next_attempt_at);
+
+-- Archives of everything stored about a user, generated in the background.
+-- The archives themselves are kept on the server's disk.
+CREATE TABLE data_exports (
+  id           VARCHAR(64) PRIMARY KEY, -- Random ID, also naming the archive
+  user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  status       VARCHAR(16) NOT NULL,    -- PENDING, READY or FAILED
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  completed_at TIMESTAMPTZ,
+  expires_at   TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX data_exports_user_id_created_at_idx ON data_exports (user_id, created_at);
+CREATE INDEX data_exports_expires_at_idx ON data_exports (expires_at);
@@ -0,0 +1,16 @@
+-- Long-lived keys users create for automation. Only a hash of each key is
+-- stored; key_id is the public part of the key used to look it up.
+CREATE TABLE api_keys (
+  id           SERIAL PRIMARY KEY,
+  user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  key_id       CHAR(16) NOT NULL UNIQUE,
+  key_hash     BYTEA NOT NULL,
+  key_name     VARCHAR(200) NOT NULL,
+  scopes       TEXT[] NOT NULL,
+  vault_id     INTEGER REFERENCES vaults(id) ON DELETE CASCADE, -- The only vault the key can access, if set
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at   TIMESTAMPTZ,
+  last_used_at TIMESTAMPTZ
+);
+
+CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);
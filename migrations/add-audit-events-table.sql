@@ -0,0 +1,12 @@
+-- Security relevant things that happened to users' accounts, included in
+-- their data exports. Deleted along with the account.
+CREATE TABLE audit_events (
+  id         BIGSERIAL PRIMARY KEY,
+  user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  event      VARCHAR(64) NOT NULL,
+  ip         VARCHAR(64) NOT NULL,       -- Client IP the request came from
+  details    JSONB NOT NULL DEFAULT '{}',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX audit_events_user_id_created_at_idx ON audit_events (user_id, created_at);
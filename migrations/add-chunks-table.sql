@@ -0,0 +1,25 @@
+-- Content-defined chunks of object data, stored once per vault no matter how
+-- many objects contain them
+CREATE TABLE chunks (
+  vault_id  INTEGER NOT NULL REFERENCES vaults(id) ON DELETE CASCADE,
+  hash      CHAR(64) NOT NULL,              -- Hex encoded SHA-256 of the chunk's contents
+  size      INTEGER NOT NULL,
+  ref_count INTEGER NOT NULL DEFAULT 0,     -- Number of object_chunks rows referencing the chunk
+  stored    BOOLEAN NOT NULL DEFAULT FALSE, -- Whether the chunk has been written to the vault's backend
+  PRIMARY KEY (vault_id, hash)
+);
+
+-- Manifest of the chunks an object is made of, in order
+CREATE TABLE object_chunks (
+  object_id    INTEGER NOT NULL REFERENCES objects(id) ON DELETE CASCADE,
+  seq          INTEGER NOT NULL,
+  vault_id     INTEGER NOT NULL,
+  chunk_hash   CHAR(64) NOT NULL,
+  chunk_offset BIGINT NOT NULL, -- Offset of the chunk within the object
+  size         INTEGER NOT NULL,
+  PRIMARY KEY (object_id, seq),
+  FOREIGN KEY (vault_id, chunk_hash) REFERENCES chunks (vault_id, hash)
+);
+
+-- Objects uploaded before chunking are stored whole under their own key
+ALTER TABLE objects ADD COLUMN chunked BOOLEAN NOT NULL DEFAULT FALSE;
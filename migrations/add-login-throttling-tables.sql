@@ -0,0 +1,20 @@
+-- Token buckets limiting how often clients may make requests, by a key such
+-- as "signin:<ip>"
+CREATE TABLE rate_limits (
+  key        VARCHAR(200) PRIMARY KEY,
+  tokens     DOUBLE PRECISION NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX rate_limits_updated_at_idx ON rate_limits (updated_at);
+
+-- Consecutive failed sign ins by login name. Names that don't belong to any
+-- user are tracked too, so that lockouts don't tell which names exist.
+CREATE TABLE login_failures (
+  login           VARCHAR(500) PRIMARY KEY,
+  failures        INTEGER NOT NULL,
+  last_failure_at TIMESTAMPTZ NOT NULL,
+  locked_until    TIMESTAMPTZ
+);
+
+CREATE INDEX login_failures_last_failure_at_idx ON login_failures (last_failure_at);
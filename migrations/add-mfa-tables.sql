@@ -0,0 +1,26 @@
+-- TOTP second factor of a user. The secret is pending until the user confirms
+-- it with a code from their authenticator.
+CREATE TABLE user_totp (
+  user_id      INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  secret       BYTEA NOT NULL,
+  confirmed_at TIMESTAMPTZ,
+  last_step    BIGINT NOT NULL DEFAULT 0 -- Time step of the last accepted code, which can't be used again
+);
+
+-- Single use codes that stand in for a TOTP code, stored hashed
+CREATE TABLE recovery_codes (
+  id        SERIAL PRIMARY KEY,
+  user_id   INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  used_at   TIMESTAMPTZ
+);
+
+CREATE INDEX recovery_codes_user_id_idx ON recovery_codes (user_id);
+
+-- Sign-ins waiting for a second factor
+CREATE TABLE mfa_challenges (
+  id         CHAR(32) PRIMARY KEY,
+  user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  expires_at TIMESTAMPTZ NOT NULL,
+  attempts   INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,18 @@
+CREATE TABLE objects (
+  id           SERIAL PRIMARY KEY,
+  vault_id     INTEGER NOT NULL REFERENCES vaults(id) ON DELETE CASCADE,
+  object_key   VARCHAR(1024) NOT NULL,
+  size         BIGINT NOT NULL,
+  content_hash CHAR(64) NOT NULL,      -- Hex encoded SHA-256 of the object's contents
+  content_type VARCHAR(255) NOT NULL,
+  etag         VARCHAR(255) NOT NULL,  -- Entity tag reported by the storage backend
+  metadata     JSONB NOT NULL DEFAULT '{}', -- User supplied X-Dump-Meta-* headers
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  UNIQUE (vault_id, object_key)
+);
+
+-- Listings page through keys in byte order
+CREATE INDEX objects_vault_id_object_key_c_idx ON objects (vault_id, object_key COLLATE "C");
+CREATE INDEX objects_vault_id_size_idx ON objects (vault_id, size);
+CREATE INDEX objects_vault_id_updated_at_idx ON objects (vault_id, updated_at);
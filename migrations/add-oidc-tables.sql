@@ -0,0 +1,24 @@
+-- Identities at external OpenID Connect providers that users sign in with
+CREATE TABLE user_identities (
+  id           SERIAL PRIMARY KEY,
+  user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  provider     VARCHAR(32) NOT NULL,  -- Name of the provider in its configuration
+  subject      VARCHAR(255) NOT NULL, -- Identifier of the user at the provider
+  email        VARCHAR(320),          -- As last reported by the provider
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_used_at TIMESTAMPTZ,
+  UNIQUE (provider, subject)
+);
+
+CREATE INDEX user_identities_user_id_idx ON user_identities (user_id);
+
+-- Authorization requests sent to providers that haven't come back yet. Each
+-- can only be finished once.
+CREATE TABLE oidc_logins (
+  state         VARCHAR(64) PRIMARY KEY,
+  provider      VARCHAR(32) NOT NULL,
+  nonce         VARCHAR(64) NOT NULL,
+  code_verifier VARCHAR(128) NOT NULL,
+  user_id       INTEGER REFERENCES users(id) ON DELETE CASCADE, -- Set when linking an identity to an account
+  expires_at    TIMESTAMPTZ NOT NULL
+);
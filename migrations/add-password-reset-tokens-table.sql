@@ -0,0 +1,9 @@
+-- Outstanding password reset tokens, stored hashed. Each can only be used
+-- once.
+CREATE TABLE password_reset_tokens (
+  token_hash BYTEA PRIMARY KEY, -- SHA-256 of the token
+  user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX password_reset_tokens_user_id_idx ON password_reset_tokens (user_id);
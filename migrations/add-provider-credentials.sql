@@ -0,0 +1,7 @@
+ALTER TABLE provider_keys
+  ADD COLUMN key_id   VARCHAR(500), -- AWS access key ID or GCP service account email
+  ADD COLUMN secret   TEXT,         -- AWS secret access key or GCP service account JSON
+  ADD COLUMN region   VARCHAR(64),
+  ADD COLUMN endpoint VARCHAR(500); -- Overrides the provider's default API endpoint
+
+ALTER TABLE vaults ADD COLUMN bucket VARCHAR(255); -- Bucket of S3_BUCKET and GCS_BUCKET vaults
@@ -0,0 +1,14 @@
+-- Refresh tokens issued to users. Each refresh token can only be used once;
+-- using it issues its replacement in the same family.
+CREATE TABLE refresh_tokens (
+  id         CHAR(32) PRIMARY KEY,  -- jti claim of the token
+  family_id  CHAR(32) NOT NULL,     -- Shared by every token descending from one sign-in
+  user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  issued_at  TIMESTAMPTZ NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_at    TIMESTAMPTZ,           -- Set once the token has been exchanged for its replacement
+  revoked_at TIMESTAMPTZ            -- Set when the token's family is revoked
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+CREATE INDEX refresh_tokens_expires_at_idx ON refresh_tokens (expires_at);
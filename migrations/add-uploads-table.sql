@@ -0,0 +1,15 @@
+-- Resumable (tus) uploads in progress. Data received so far is staged on the
+-- server's disk until the upload is complete.
+CREATE TABLE uploads (
+  id            VARCHAR(64) PRIMARY KEY, -- Random ID used in upload URLs
+  vault_id      INTEGER NOT NULL REFERENCES vaults(id) ON DELETE CASCADE,
+  object_key    VARCHAR(1024) NOT NULL,
+  content_type  VARCHAR(255) NOT NULL,
+  metadata      JSONB NOT NULL DEFAULT '{}',
+  upload_length BIGINT NOT NULL,
+  upload_offset BIGINT NOT NULL DEFAULT 0,
+  created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at    TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX uploads_expires_at_idx ON uploads (expires_at);
@@ -0,0 +1,8 @@
+-- Optional email addresses of users. An address can be set on several
+-- accounts, but verified on only one of them, so that nobody can hold an
+-- address they don't own to keep its owner from using it.
+ALTER TABLE users
+  ADD COLUMN email             VARCHAR(320),
+  ADD COLUMN email_verified_at TIMESTAMPTZ;
+
+CREATE UNIQUE INDEX users_verified_email_idx ON users (email) WHERE email_verified_at IS NOT NULL;
@@ -0,0 +1,2 @@
+-- Access tokens issued to a user at or before this time have been revoked
+ALTER TABLE users ADD COLUMN tokens_valid_after TIMESTAMPTZ;
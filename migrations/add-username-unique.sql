@@ -0,0 +1,3 @@
+-- Usernames differing only in case can't be told apart by people, so no two
+-- users may have them
+CREATE UNIQUE INDEX users_username_lower_key ON users (lower(username));
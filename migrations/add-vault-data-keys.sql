@@ -0,0 +1,9 @@
+-- Every vault's contents are encrypted with its own data key, stored wrapped
+-- by one of the server's master keys
+ALTER TABLE vaults
+  ADD COLUMN data_key      BYTEA,       -- Wrapped data key, filled in for existing vaults at startup
+  ADD COLUMN master_key_id VARCHAR(16); -- ID of the master key that wrapped data_key
+
+-- Chunks written before vaults were encrypted are stored in plaintext under
+-- their content hash
+ALTER TABLE chunks ADD COLUMN encrypted BOOLEAN NOT NULL DEFAULT FALSE;
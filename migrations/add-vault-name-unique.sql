@@ -0,0 +1 @@
+CREATE UNIQUE INDEX vaults_owner_id_vault_name_key ON vaults (owner_id, vault_name);
\ No newline at end of file
@@ -0,0 +1,15 @@
+-- Vaults keep using the provider credentials they were created with, even
+-- once their owner adds others for the same provider
+ALTER TABLE vaults ADD COLUMN provider_key_id INTEGER REFERENCES provider_keys(id);
+
+-- Until now, vaults were reached with their owner's latest key for the
+-- provider holding their bucket
+UPDATE vaults SET provider_key_id = (
+  SELECT id FROM provider_keys
+  WHERE provider_keys.user_id = vaults.owner_id
+    AND provider_keys.provider_type = CASE vaults.vault_type
+      WHEN 'S3_BUCKET' THEN 'AWS'
+      WHEN 'GCS_BUCKET' THEN 'GCP'
+    END
+  ORDER BY id DESC LIMIT 1
+);
@@ -0,0 +1,26 @@
+-- WebAuthn credentials (passkeys and security keys) users sign in with
+CREATE TABLE webauthn_credentials (
+  id               SERIAL PRIMARY KEY,
+  user_id          INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  credential_id    BYTEA NOT NULL UNIQUE,
+  public_key       BYTEA NOT NULL,  -- COSE_Key encoding
+  sign_count       BIGINT NOT NULL, -- Last signature counter reported by the authenticator
+  credential_name  VARCHAR(200) NOT NULL,
+  attestation_type VARCHAR(16) NOT NULL,
+  aaguid           BYTEA,
+  backup_eligible  BOOLEAN NOT NULL,
+  created_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_used_at     TIMESTAMPTZ
+);
+
+CREATE INDEX webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
+
+-- Challenges of WebAuthn ceremonies in progress. Each can only be answered
+-- once.
+CREATE TABLE webauthn_challenges (
+  id         CHAR(32) PRIMARY KEY,
+  user_id    INTEGER REFERENCES users(id) ON DELETE CASCADE, -- Unset when signing in
+  challenge  BYTEA NOT NULL,
+  ceremony   VARCHAR(16) NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL
+);
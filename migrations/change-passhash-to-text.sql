@@ -0,0 +1,3 @@
+-- Password hashes vary in length with their algorithm and parameters, and
+-- CHAR would pad shorter ones such as bcrypt's with spaces
+ALTER TABLE credentials ALTER COLUMN passhash TYPE TEXT;
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"time"
+
+	"github.com/raian621/dump/models/storage"
+)
+
+// Body of a request deleting the authenticated user's account. The password
+// is required of accounts that have one, and a second factor of accounts with
+// TOTP enabled.
+type AccountDeletion struct {
+	Password string `json:"password,omitempty"`
+	SecondFactor
+}
+
+// Status of an archive of everything stored about the authenticated user
+type DataExport struct {
+	Id          string     `json:"id"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+}
+
+func DataExportFromStorageModel(e *storage.DataExport) *DataExport {
+	return &DataExport{
+		Id:          e.Id,
+		Status:      e.Status,
+		CreatedAt:   e.CreatedAt,
+		CompletedAt: e.CompletedAt,
+		ExpiresAt:   e.ExpiresAt,
+	}
+}
+
+type AuditEvent struct {
+	Event     string            `json:"event"`
+	IP        string            `json:"ip"`
+	Details   map[string]string `json:"details,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+func AuditEventFromStorageModel(e *storage.AuditEvent) *AuditEvent {
+	return &AuditEvent{
+		Event:     e.Event,
+		IP:        e.IP,
+		Details:   e.Details,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+// account.json of a data export
+type ExportedAccount struct {
+	User         *User          `json:"user"`
+	Identities   []*Identity    `json:"identities"`
+	Passkeys     []*Passkey     `json:"passkeys"`
+	APIKeys      []*APIKey      `json:"api_keys"`
+	ProviderKeys []*ProviderKey `json:"provider_keys"` // without their secrets
+}
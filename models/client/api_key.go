@@ -0,0 +1,48 @@
+package client
+
+import (
+	"time"
+
+	"github.com/raian621/dump/models/storage"
+)
+
+type APIKey struct {
+	Id      int32    `json:"id,omitempty"`
+	Name    string   `json:"name"`
+	Scopes  []string `json:"scopes"`
+	VaultId int32    `json:"vault_id,omitempty"` // restricts the key to one vault
+	// The key itself, only sent back when the key is created
+	Key        string     `json:"key,omitempty"`
+	KeyId      string     `json:"key_id,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// Body of a request to rename an API key
+type APIKeyRename struct {
+	Name string `json:"name"`
+}
+
+func (k *APIKey) ToStorageModel() *storage.APIKey {
+	return &storage.APIKey{
+		Id:        k.Id,
+		Name:      k.Name,
+		Scopes:    k.Scopes,
+		VaultId:   k.VaultId,
+		ExpiresAt: k.ExpiresAt,
+	}
+}
+
+func APIKeyFromStorageModel(k *storage.APIKey) *APIKey {
+	return &APIKey{
+		Id:         k.Id,
+		Name:       k.Name,
+		Scopes:     k.Scopes,
+		VaultId:    k.VaultId,
+		KeyId:      k.KeyId,
+		CreatedAt:  &k.CreatedAt,
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+	}
+}
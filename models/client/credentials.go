@@ -6,7 +6,7 @@ import (
 )
 
 type Credentials struct {
-	Username string `json:"username"`
+	Username string `json:"username"` // or verified email address, when signing in
 	Password string `json:"password"`
 }
 
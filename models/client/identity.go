@@ -0,0 +1,45 @@
+package client
+
+import (
+	"time"
+
+	"github.com/raian621/dump/models/storage"
+)
+
+// An OpenID Connect provider users can sign in with
+type OIDCProvider struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+// Where to send the user to sign in with a provider. The state comes back
+// with the authorization code.
+type OIDCAuthorization struct {
+	AuthorizationURL string `json:"authorization_url"`
+	State            string `json:"state"`
+}
+
+// Body of a request finishing a sign in with a provider, with the parameters
+// the provider redirected back with
+type OIDCCallback struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
+type Identity struct {
+	Id         int32      `json:"id"`
+	Provider   string     `json:"provider"`
+	Email      string     `json:"email,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func IdentityFromStorageModel(i *storage.Identity) *Identity {
+	return &Identity{
+		Id:         i.Id,
+		Provider:   i.Provider,
+		Email:      i.Email,
+		CreatedAt:  i.CreatedAt,
+		LastUsedAt: i.LastUsedAt,
+	}
+}
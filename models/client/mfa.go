@@ -0,0 +1,32 @@
+package client
+
+// Returned by sign in instead of an AuthPayload when the user has to provide
+// a second factor. The token is exchanged for an AuthPayload along with the
+// second factor.
+type MFAChallenge struct {
+	MFAToken string   `json:"mfa_token"`
+	Methods  []string `json:"mfa_methods"`
+}
+
+// A second factor: either a code from the user's authenticator or one of
+// their recovery codes
+type SecondFactor struct {
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// Body of a request answering an MFA challenge
+type MFAVerification struct {
+	MFAToken string `json:"mfa_token"`
+	SecondFactor
+}
+
+// A pending TOTP secret, to be added to an authenticator app and confirmed
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth:// URI for QR codes
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
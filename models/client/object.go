@@ -0,0 +1,39 @@
+package client
+
+import (
+	"time"
+
+	"github.com/raian621/dump/models/storage"
+)
+
+type Object struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	ContentHash  string            `json:"content_hash"`
+	ContentType  string            `json:"content_type"`
+	ETag         string            `json:"etag"`
+	Metadata     map[string]string `json:"metadata"`
+	CreatedAt    time.Time         `json:"created_at"`
+	LastModified time.Time         `json:"last_modified"`
+}
+
+// A page of the objects in a vault. When listing with a delimiter, keys that
+// continue past the delimiter are rolled up into CommonPrefixes ("folders").
+type ObjectList struct {
+	Objects        []*Object `json:"objects"`
+	CommonPrefixes []string  `json:"common_prefixes,omitempty"`
+	NextCursor     string    `json:"next_cursor,omitempty"`
+}
+
+func ObjectFromStorageModel(o *storage.Object) *Object {
+	return &Object{
+		Key:          o.Key,
+		Size:         o.Size,
+		ContentHash:  o.ContentHash,
+		ContentType:  o.ContentType,
+		ETag:         o.ETag,
+		Metadata:     o.Metadata,
+		CreatedAt:    o.CreatedAt,
+		LastModified: o.UpdatedAt,
+	}
+}
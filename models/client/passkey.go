@@ -0,0 +1,57 @@
+package client
+
+import (
+	"time"
+
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/webauthn"
+)
+
+type Passkey struct {
+	Id             int32      `json:"id"`
+	Name           string     `json:"name"`
+	BackupEligible bool       `json:"backup_eligible"` // synced passkey rather than a device bound key
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+}
+
+func PasskeyFromStorageModel(p *storage.Passkey) *Passkey {
+	return &Passkey{
+		Id:             p.Id,
+		Name:           p.Name,
+		BackupEligible: p.BackupEligible,
+		CreatedAt:      p.CreatedAt,
+		LastUsedAt:     p.LastUsedAt,
+	}
+}
+
+// Options to start a passkey registration with. The challenge ID is sent back
+// with the new credential.
+type PasskeyRegistrationOptions struct {
+	ChallengeId string                    `json:"challenge_id"`
+	PublicKey   *webauthn.CreationOptions `json:"publicKey"`
+}
+
+// Body of a request finishing a passkey registration
+type PasskeyRegistration struct {
+	ChallengeId string                       `json:"challenge_id"`
+	Name        string                       `json:"name"`
+	Credential  webauthn.PublicKeyCredential `json:"credential"`
+}
+
+// Body of a request starting a passkey sign in. Without a username, the
+// authenticator offers any passkey it holds for the site.
+type PasskeySignInStart struct {
+	Username string `json:"username,omitempty"`
+}
+
+type PasskeySignInOptions struct {
+	ChallengeId string                   `json:"challenge_id"`
+	PublicKey   *webauthn.RequestOptions `json:"publicKey"`
+}
+
+// Body of a request finishing a passkey sign in
+type PasskeySignIn struct {
+	ChallengeId string                       `json:"challenge_id"`
+	Credential  webauthn.PublicKeyCredential `json:"credential"`
+}
@@ -0,0 +1,18 @@
+package client
+
+// Body of a request changing the authenticated user's password
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// Body of a request asking for a password reset token to be sent
+type PasswordResetRequest struct {
+	Username string `json:"username"` // or verified email address
+}
+
+// Body of a request resetting a password with a token that was sent
+type PasswordReset struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"github.com/raian621/dump/models/storage"
+)
+
+type ProviderKey struct {
+	Id           int32  `json:"id,omitempty"`
+	ProviderType string `json:"provider_type"`
+	KeyId        string `json:"key_id"`
+	Secret       string `json:"secret,omitempty"` // only ever sent by clients
+	Region       string `json:"region,omitempty"`
+	Endpoint     string `json:"endpoint,omitempty"`
+}
+
+func (k *ProviderKey) ToStorageModel() *storage.ProviderKey {
+	return &storage.ProviderKey{
+		Id:           k.Id,
+		ProviderType: k.ProviderType,
+		KeyId:        k.KeyId,
+		Secret:       k.Secret,
+		Region:       k.Region,
+		Endpoint:     k.Endpoint,
+	}
+}
+
+// The secret is never sent back to clients
+func ProviderKeyFromStorageModel(k *storage.ProviderKey) *ProviderKey {
+	return &ProviderKey{
+		Id:           k.Id,
+		ProviderType: k.ProviderType,
+		KeyId:        k.KeyId,
+		Region:       k.Region,
+		Endpoint:     k.Endpoint,
+	}
+}
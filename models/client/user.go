@@ -0,0 +1,29 @@
+package client
+
+import "github.com/raian621/dump/models/storage"
+
+type User struct {
+	Id            int32  `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func UserFromStorageModel(u *storage.User) *User {
+	return &User{
+		Id:            u.Id,
+		Username:      u.Username,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+	}
+}
+
+// Body of a request setting the authenticated user's email address
+type EmailChange struct {
+	Email string `json:"email"`
+}
+
+// Body of a request verifying an email address with the token sent to it
+type EmailVerification struct {
+	Token string `json:"token"`
+}
@@ -0,0 +1,6 @@
+package client
+
+// Body of a 422 response, listing every rule a request broke
+type ValidationErrors struct {
+	Errors []string `json:"errors"`
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"github.com/raian621/dump/models"
+	"github.com/raian621/dump/models/storage"
+)
+
+var _ models.ClientModel = (*Vault)(nil)
+
+func init() {
+	storage.VaultToClientModel = func(v *storage.Vault) models.ClientModel {
+		return VaultFromStorageModel(v)
+	}
+}
+
+type Vault struct {
+	Id     int32  `json:"id,omitempty"`
+	Name   string `json:"name"`
+	Type   string `json:"vault_type"`
+	Bucket string `json:"bucket,omitempty"`
+	// Provider key the bucket is reached with, by default the owner's latest
+	// key for the provider
+	ProviderKeyId int32 `json:"provider_key_id,omitempty"`
+	// Only included in the vault detail response
+	Stats *VaultStats `json:"stats,omitempty"`
+}
+
+type VaultStats struct {
+	ObjectCount  int64 `json:"object_count"`
+	LogicalBytes int64 `json:"logical_bytes"`
+	StoredBytes  int64 `json:"stored_bytes"`
+	// logical_bytes / stored_bytes; 1 for an empty vault
+	DedupRatio float64 `json:"dedup_ratio"`
+}
+
+// A page of the vaults owned by a user
+type VaultList struct {
+	Vaults []*Vault `json:"vaults"`
+	Total  int64    `json:"total"`
+	Limit  int      `json:"limit"`
+	Offset int      `json:"offset"`
+}
+
+// Body of a request to rename a vault
+type VaultRename struct {
+	Name string `json:"name"`
+}
+
+func (v *Vault) ToStorageModel() models.StorageModel {
+	return &storage.Vault{
+		Id:            v.Id,
+		Name:          v.Name,
+		Type:          v.Type,
+		Bucket:        v.Bucket,
+		ProviderKeyId: v.ProviderKeyId,
+	}
+}
+
+// storage can't import client without an import cycle, so the conversion back
+// to the client model lives on this side of the package boundary, and is
+// handed to storage when this package is initialized.
+func VaultFromStorageModel(v *storage.Vault) *Vault {
+	return &Vault{
+		Id:            v.Id,
+		Name:          v.Name,
+		Type:          v.Type,
+		Bucket:        v.Bucket,
+		ProviderKeyId: v.ProviderKeyId,
+	}
+}
+
+func VaultStatsFromStorageModel(s *storage.VaultStats) *VaultStats {
+	stats := &VaultStats{
+		ObjectCount:  s.ObjectCount,
+		LogicalBytes: s.LogicalBytes,
+		StoredBytes:  s.StoredBytes,
+		DedupRatio:   1,
+	}
+	if s.StoredBytes > 0 {
+		stats.DedupRatio = float64(s.LogicalBytes) / float64(s.StoredBytes)
+	}
+	return stats
+}
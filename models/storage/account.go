@@ -0,0 +1,30 @@
+package storage
+
+import "time"
+
+// The stored objects of a deleted vault, still to be deleted from its backend
+type StoragePurge struct {
+	Id    int32
+	Vault *Vault // only Id, Type and Bucket are kept
+	// Credentials of the provider holding the vault's bucket, nil for
+	// SELF_HOSTED vaults. Only ProviderType, KeyId, Secret, Region and
+	// Endpoint are kept.
+	ProviderKey *ProviderKey
+	Attempts    int32
+}
+
+const (
+	DataExportPending = "PENDING"
+	DataExportReady   = "READY"
+	DataExportFailed  = "FAILED"
+)
+
+// An archive of everything stored about a user
+type DataExport struct {
+	Id          string
+	UserId      int32
+	Status      string
+	CreatedAt   time.Time
+	CompletedAt *time.Time
+	ExpiresAt   time.Time
+}
@@ -0,0 +1,17 @@
+package storage
+
+import "time"
+
+// A key a user created to authenticate automated clients
+type APIKey struct {
+	Id         int32
+	UserId     int32
+	KeyId      string // public part of the key, used to look it up
+	KeyHash    []byte
+	Name       string
+	Scopes     []string
+	VaultId    int32 // the only vault the key can access, or 0 for any vault
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time // nil if the key never expires
+	LastUsedAt *time.Time
+}
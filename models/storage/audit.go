@@ -0,0 +1,13 @@
+package storage
+
+import "time"
+
+// Something security relevant that happened to a user's account
+type AuditEvent struct {
+	Id        int64
+	UserId    int32
+	Event     string
+	IP        string // client IP the request came from
+	Details   map[string]string
+	CreatedAt time.Time
+}
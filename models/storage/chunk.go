@@ -0,0 +1,12 @@
+package storage
+
+// One entry of an object's chunk manifest
+type ObjectChunk struct {
+	Seq    int32
+	Hash   string // hex encoded SHA-256 of the chunk's contents
+	Offset int64  // offset of the chunk within the object
+	Size   int32
+	// encrypted with the vault's data key and stored under a name derived
+	// from it, rather than in plaintext under Hash
+	Encrypted bool
+}
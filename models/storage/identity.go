@@ -0,0 +1,24 @@
+package storage
+
+import "time"
+
+// An identity at an external OpenID Connect provider linked to a user
+type Identity struct {
+	Id         int32
+	UserId     int32
+	Provider   string
+	Subject    string // identifier of the user at the provider
+	Email      string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// An authorization request sent to an OpenID Connect provider
+type OIDCLogin struct {
+	State        string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	UserId       int32 // 0 when signing in rather than linking an identity
+	ExpiresAt    time.Time
+}
@@ -0,0 +1,24 @@
+package storage
+
+import "time"
+
+// TOTP second factor of a user
+type TOTP struct {
+	UserId      int32
+	Secret      []byte
+	ConfirmedAt *time.Time // nil until the user has confirmed the secret
+	LastStep    int64      // time step of the last accepted code
+}
+
+type RecoveryCode struct {
+	Id       int32
+	UserId   int32
+	CodeHash string
+}
+
+// A sign-in waiting for a second factor
+type MFAChallenge struct {
+	Id        string
+	UserId    int32
+	ExpiresAt time.Time
+}
@@ -0,0 +1,17 @@
+package storage
+
+import "time"
+
+type Object struct {
+	Id          int32
+	VaultId     int32 // ID of the vault this object is stored in
+	Key         string
+	Size        int64
+	ContentHash string // hex encoded SHA-256 of the object's contents
+	ContentType string
+	ETag        string
+	Metadata    map[string]string
+	Chunked     bool // stored as deduplicated chunks rather than whole under Key
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
@@ -0,0 +1,32 @@
+package storage
+
+import "time"
+
+// A WebAuthn credential a user signs in with
+type Passkey struct {
+	Id              int32
+	UserId          int32
+	CredentialId    []byte
+	PublicKey       []byte // COSE_Key encoding
+	SignCount       uint32 // last signature counter reported by the authenticator
+	Name            string
+	AttestationType string
+	AAGUID          []byte
+	BackupEligible  bool
+	CreatedAt       time.Time
+	LastUsedAt      *time.Time
+}
+
+const (
+	CeremonyRegistration   = "registration"
+	CeremonyAuthentication = "authentication"
+)
+
+// The challenge of a WebAuthn ceremony in progress
+type WebAuthnChallenge struct {
+	Id        string
+	UserId    int32 // 0 when signing in
+	Challenge []byte
+	Ceremony  string
+	ExpiresAt time.Time
+}
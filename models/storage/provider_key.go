@@ -0,0 +1,17 @@
+package storage
+
+const (
+	ProviderTypeAWS  = "AWS"
+	ProviderTypeGCP  = "GCP"
+	ProviderTypeSelf = "SELF"
+)
+
+type ProviderKey struct {
+	Id           int32
+	UserId       int32 // ID of the user these provider credentials belong to
+	ProviderType string
+	KeyId        string
+	Secret       string
+	Region       string
+	Endpoint     string
+}
@@ -0,0 +1,12 @@
+package storage
+
+import "time"
+
+// A refresh token issued to a user
+type RefreshToken struct {
+	Id        string // jti claim of the token
+	FamilyId  string // shared by every token descending from one sign-in
+	UserId    int32
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
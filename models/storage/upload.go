@@ -0,0 +1,16 @@
+package storage
+
+import "time"
+
+// A resumable upload in progress
+type Upload struct {
+	Id          string
+	VaultId     int32 // ID of the vault the finished object is stored in
+	Key         string
+	ContentType string
+	Metadata    map[string]string
+	Length      int64 // total size of the upload in bytes
+	Offset      int64 // number of bytes received so far
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
@@ -1,6 +1,8 @@
 package storage
 
 type User struct {
-	Id       int32
-	Username string
+	Id            int32
+	Username      string
+	Email         string // lowercase; empty if the user hasn't given one
+	EmailVerified bool
 }
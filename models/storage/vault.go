@@ -0,0 +1,40 @@
+package storage
+
+import "github.com/raian621/dump/models"
+
+var _ models.StorageModel = (*Vault)(nil)
+
+const (
+	VaultTypeS3Bucket   = "S3_BUCKET"
+	VaultTypeGCSBucket  = "GCS_BUCKET"
+	VaultTypeSelfHosted = "SELF_HOSTED"
+)
+
+type Vault struct {
+	Id      int32
+	OwnerId int32 // ID of the user that owns this vault
+	Name    string
+	Type    string
+	Bucket  string // bucket holding the objects of S3_BUCKET and GCS_BUCKET vaults
+	// ID of the provider key the bucket is reached with, 0 for SELF_HOSTED
+	// vaults
+	ProviderKeyId int32
+
+	DataKey     []byte // data encryption key, wrapped by a master key
+	MasterKeyId string // ID of the master key that wrapped DataKey
+}
+
+// Converts vaults to the client model. Set by the client package, which this
+// one can't import without an import cycle.
+var VaultToClientModel func(*Vault) models.ClientModel
+
+func (v *Vault) ToClientModel() models.ClientModel {
+	return VaultToClientModel(v)
+}
+
+// Storage statistics of a vault
+type VaultStats struct {
+	ObjectCount  int64
+	LogicalBytes int64 // total size of the vault's objects
+	StoredBytes  int64 // bytes actually held by the vault's backend
+}
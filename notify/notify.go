@@ -0,0 +1,46 @@
+// Package notify delivers messages to users, such as password reset tokens.
+// Notifiers are pluggable: SMTP delivers by email, and the log notifier
+// writes messages to a log for development.
+package notify
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// Returned when a message can't be delivered because the user has no address
+// the notifier can reach
+var ErrNoAddress = errors.New("no address to deliver to")
+
+// Who a message is for
+type Recipient struct {
+	Username string
+	Address  string // email address, if known
+}
+
+type Message struct {
+	To      Recipient
+	Subject string
+	Body    string // plain text
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, message *Message) error
+}
+
+// Writes messages to a log instead of delivering them. Meant for development:
+// messages carry secrets such as reset tokens.
+type LogNotifier struct {
+	Logger *log.Logger // the standard logger if nil
+}
+
+func (n *LogNotifier) Notify(ctx context.Context, message *Message) error {
+	logger := n.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf("Message to %s <%s>: %s\n%s",
+		message.To.Username, message.To.Address, message.Subject, message.Body)
+	return nil
+}
@@ -0,0 +1,134 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+var ErrInvalidHeader = errors.New("invalid message header")
+
+// Delivers messages by email through an SMTP server. The connection is
+// upgraded with STARTTLS whenever the server offers it; credentials are only
+// sent over TLS or to localhost (see smtp.PlainAuth).
+type SMTPNotifier struct {
+	Addr     string // host:port of the SMTP server
+	From     string // sender address, such as "dump <noreply@example.com>"
+	Username string // no authentication if empty
+	Password string
+	// Require STARTTLS rather than falling back to plain text when the server
+	// doesn't offer it
+	RequireTLS bool
+	TLSConfig  *tls.Config // server name defaults to the host of Addr
+	Timeout    time.Duration
+}
+
+const defaultSMTPTimeout = 30 * time.Second
+
+func (n *SMTPNotifier) Notify(ctx context.Context, message *Message) error {
+	if message.To.Address == "" {
+		return ErrNoAddress
+	}
+	from, err := mail.ParseAddress(n.From)
+	if err != nil {
+		return fmt.Errorf("%w: from: %w", ErrInvalidHeader, err)
+	}
+	to, err := mail.ParseAddress(message.To.Address)
+	if err != nil {
+		return fmt.Errorf("%w: to: %w", ErrInvalidHeader, err)
+	}
+	data, err := formatMessage(from, to, message)
+	if err != nil {
+		return err
+	}
+
+	timeout := n.Timeout
+	if timeout == 0 {
+		timeout = defaultSMTPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", n.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return n.send(conn, from.Address, to.Address, data)
+}
+
+func (n *SMTPNotifier) send(conn net.Conn, from, to string, data []byte) error {
+	host, _, err := net.SplitHostPort(n.Addr)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := n.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: host}
+		}
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	} else if n.RequireTLS {
+		return errors.New("SMTP server doesn't support STARTTLS")
+	}
+	if n.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.Username, n.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func formatMessage(from, to *mail.Address, message *Message) ([]byte, error) {
+	if strings.ContainsAny(message.Subject, "\r\n") {
+		return nil, fmt.Errorf("%w: subject contains a line break", ErrInvalidHeader)
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", to)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	// the DATA writer turns line feeds into CRLF and takes care of
+	// dot-stuffing
+	buf.WriteString(message.Body)
+	return buf.Bytes(), nil
+}
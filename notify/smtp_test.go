@@ -0,0 +1,140 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A message received by the sink
+type received struct {
+	from string
+	to   []string
+	data string
+}
+
+// Start a local SMTP server that accepts every message without TLS or
+// authentication and sends them on the returned channel
+func startSMTPSink(t *testing.T) (string, <-chan *received) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan *received, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, messages)
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func serveSMTP(conn net.Conn, messages chan<- *received) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 sink ready")
+	message := &received{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimRight(line, "\r\n")
+		switch verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0]); verb {
+		case "EHLO", "HELO":
+			reply("250 sink")
+		case "MAIL":
+			message.from = strings.TrimPrefix(command, "MAIL FROM:")
+			reply("250 OK")
+		case "RCPT":
+			message.to = append(message.to, strings.TrimPrefix(command, "RCPT TO:"))
+			reply("250 OK")
+		case "DATA":
+			reply("354 go ahead")
+			data := &strings.Builder{}
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			message.data = data.String()
+			messages <- message
+			message = &received{}
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestSMTPNotify(t *testing.T) {
+	addr, messages := startSMTPSink(t)
+	notifier := &SMTPNotifier{Addr: addr, From: "dump <noreply@dump.example>"}
+
+	err := notifier.Notify(context.Background(), &Message{
+		To:      Recipient{Username: "alice", Address: "alice@example.com"},
+		Subject: "Réinitialiser",
+		Body:    "Your code:\n.abc\n",
+	})
+	require.NoError(t, err)
+
+	message := <-messages
+	assert.Equal(t, "<noreply@dump.example>", message.from)
+	assert.Equal(t, []string{"<alice@example.com>"}, message.to)
+	parsed, err := mail.ReadMessage(strings.NewReader(message.data))
+	require.NoError(t, err)
+	assert.Equal(t, "=?utf-8?q?R=C3=A9initialiser?=", parsed.Header.Get("Subject"))
+	assert.Equal(t, `"dump" <noreply@dump.example>`, parsed.Header.Get("From"))
+	body := &strings.Builder{}
+	_, err = bufio.NewReader(parsed.Body).WriteTo(body)
+	require.NoError(t, err)
+	// line endings are CRLF on the wire, and the leading dot survives
+	assert.Equal(t, "Your code:\r\n.abc\r\n", body.String())
+}
+
+func TestSMTPNotifyWithoutAddress(t *testing.T) {
+	notifier := &SMTPNotifier{Addr: "127.0.0.1:1", From: "noreply@dump.example"}
+	err := notifier.Notify(context.Background(), &Message{To: Recipient{Username: "alice"}})
+	assert.ErrorIs(t, err, ErrNoAddress)
+}
+
+func TestSMTPNotifyRejectsHeaderInjection(t *testing.T) {
+	notifier := &SMTPNotifier{Addr: "127.0.0.1:1", From: "noreply@dump.example"}
+	err := notifier.Notify(context.Background(), &Message{
+		To:      Recipient{Address: "alice@example.com"},
+		Subject: "Hello\r\nBcc: mallory@example.com",
+	})
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+
+	err = notifier.Notify(context.Background(), &Message{
+		To: Recipient{Address: "alice@example.com\r\nBcc: mallory@example.com"},
+	})
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
+
+func TestSMTPNotifyRequireTLS(t *testing.T) {
+	addr, _ := startSMTPSink(t)
+	notifier := &SMTPNotifier{Addr: addr, From: "noreply@dump.example", RequireTLS: true}
+	err := notifier.Notify(context.Background(), &Message{To: Recipient{Address: "alice@example.com"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,298 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrDiscovery         = errors.New("OIDC discovery failed")
+	ErrTokenExchange     = errors.New("OIDC code exchange failed")
+	ErrInvalidIDToken    = errors.New("invalid ID token")
+	ErrUnknownSigningKey = errors.New("ID token signed with an unknown key")
+)
+
+const (
+	// limit on the size of responses from providers
+	maxResponseSize = 1 << 20
+	// keys are refetched when a token names an unknown one, but no more often
+	// than this, so that tokens with made up key IDs can't hammer the provider
+	minKeyRefreshInterval = time.Minute
+	// tolerated difference between our clock and the provider's
+	clockSkew = time.Minute
+)
+
+// Signature algorithms accepted on ID tokens. HS256 is left out on purpose:
+// it would make the client secret a signing key.
+var idTokenAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "EdDSA"}
+
+// The parts of a provider's discovery document that are used
+type metadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+// Claims of an ID token that are used
+type IDTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	AuthorizedParty   string `json:"azp"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+	jwt.RegisteredClaims
+}
+
+// A client of one provider. Discovery happens on first use, so a provider
+// that's down doesn't keep the server from starting.
+type Client struct {
+	Config *ProviderConfig
+	http   *http.Client
+	now    func() time.Time
+
+	mu            sync.Mutex
+	metadata      *metadata
+	keys          map[string]any // by key ID
+	keysFetchedAt time.Time
+}
+
+func NewClient(config *ProviderConfig, httpClient *http.Client) *Client {
+	return &Client{Config: config, http: httpClient, now: time.Now}
+}
+
+// Parameters of an authorization request that are needed again to finish it
+type AuthRequest struct {
+	State        string // ties the callback to the request
+	Nonce        string // ties the ID token to the request
+	CodeVerifier string // PKCE
+	URL          string // where to send the user
+}
+
+// Start an authorization request
+func (c *Client) NewAuthRequest(ctx context.Context) (*AuthRequest, error) {
+	meta, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	request := &AuthRequest{
+		State:        randomString(),
+		Nonce:        randomString(),
+		CodeVerifier: randomString(),
+	}
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", c.Config.ClientId)
+	query.Set("redirect_uri", c.Config.RedirectURL)
+	query.Set("scope", strings.Join(append([]string{"openid"}, c.Config.Scopes...), " "))
+	query.Set("state", request.State)
+	query.Set("nonce", request.Nonce)
+	query.Set("code_challenge", CodeChallenge(request.CodeVerifier))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	request.URL = meta.AuthorizationEndpoint + separator + query.Encode()
+	return request, nil
+}
+
+// The S256 PKCE code challenge of a code verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Exchange an authorization code for an ID token and return its validated
+// claims
+func (c *Client) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*IDTokenClaims, error) {
+	meta, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", c.Config.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic, which every provider must support
+	req.SetBasicAuth(url.QueryEscape(c.Config.ClientId), url.QueryEscape(c.Config.ClientSecret))
+
+	tokens := &struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := c.doJSON(req, tokens); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenExchange, err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w: no ID token in response", ErrTokenExchange)
+	}
+	return c.VerifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+// Validate an ID token issued in response to an authorization request with
+// the given nonce
+func (c *Client) VerifyIDToken(ctx context.Context, rawToken, nonce string) (*IDTokenClaims, error) {
+	meta, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claims := &IDTokenClaims{}
+	_, err = jwt.ParseWithClaims(rawToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return c.signingKey(ctx, kid)
+	},
+		jwt.WithValidMethods(idTokenAlgorithms),
+		jwt.WithIssuer(meta.Issuer),
+		jwt.WithAudience(c.Config.ClientId),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clockSkew),
+		jwt.WithTimeFunc(c.now),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	// OIDC core 3.1.3.7: azp names the client the token was issued to, and
+	// must be present when there are several audiences
+	if (len(claims.Audience) > 1 || claims.AuthorizedParty != "") && claims.AuthorizedParty != c.Config.ClientId {
+		return nil, fmt.Errorf("%w: issued to %q", ErrInvalidIDToken, claims.AuthorizedParty)
+	}
+	return claims, nil
+}
+
+// Whether the configuration allows the user the claims describe to sign in
+func (c *Client) AllowsDomainOf(claims *IDTokenClaims) bool {
+	if len(c.Config.AllowedDomains) == 0 {
+		return true
+	}
+	_, domain, found := strings.Cut(claims.Email, "@")
+	return found && claims.EmailVerified && slices.Contains(c.Config.AllowedDomains, strings.ToLower(domain))
+}
+
+func (c *Client) discover(ctx context.Context) (*metadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.metadata != nil {
+		return c.metadata, nil
+	}
+
+	discoveryURL := strings.TrimSuffix(c.Config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	meta := &metadata{}
+	if err := c.doJSON(req, meta); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDiscovery, err)
+	}
+	// OIDC discovery 4.3: the issuer must be exactly the one configured
+	if meta.Issuer != c.Config.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q doesn't match %q", ErrDiscovery, meta.Issuer, c.Config.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: missing endpoints", ErrDiscovery)
+	}
+	if len(meta.CodeChallengeMethods) > 0 && !slices.Contains(meta.CodeChallengeMethods, "S256") {
+		return nil, fmt.Errorf("%w: provider doesn't support PKCE with S256", ErrDiscovery)
+	}
+	c.metadata = meta
+	return meta, nil
+}
+
+// Get the key with the given ID from the provider's key set, refetching the
+// set if the key isn't known
+func (c *Client) signingKey(ctx context.Context, kid string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, found := c.keys[kid]; found {
+		return key, nil
+	}
+	if c.now().Sub(c.keysFetchedAt) < minKeyRefreshInterval {
+		return nil, ErrUnknownSigningKey
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.metadata.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	set := &jwkSet{}
+	if err := c.doJSON(req, set); err != nil {
+		return nil, fmt.Errorf("fetching provider keys: %w", err)
+	}
+	keys := make(map[string]any)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// skip keys of types we can't use rather than failing on all of them
+			continue
+		}
+		keys[k.KeyId] = key
+	}
+	c.keys, c.keysFetchedAt = keys, c.now()
+
+	if key, found := c.keys[kid]; found {
+		return key, nil
+	}
+	return nil, ErrUnknownSigningKey
+}
+
+func (c *Client) doJSON(req *http.Request, v any) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: status %d: %s", req.Method, req.URL, resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// 256 random bits, base64url encoded: long enough for a state, nonce or PKCE
+// code verifier
+func randomString() string {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(random)
+}
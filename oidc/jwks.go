@@ -0,0 +1,88 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported JSON web key")
+
+// A JSON Web Key (RFC 7517) as published by providers
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyId     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+var curves = map[string]struct {
+	curve elliptic.Curve
+	ecdh  ecdh.Curve
+	size  int
+}{
+	"P-256": {elliptic.P256(), ecdh.P256(), 32},
+	"P-384": {elliptic.P384(), ecdh.P384(), 48},
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUnsupportedKey, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("%w: invalid RSA exponent", ErrUnsupportedKey)
+		}
+		if len(n) < 256 {
+			return nil, fmt.Errorf("%w: RSA keys must be at least 2048 bits", ErrUnsupportedKey)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curve, found := curves[k.Curve]
+		if !found {
+			return nil, fmt.Errorf("%w: curve %q", ErrUnsupportedKey, k.Curve)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil || len(x) != curve.size || len(y) != curve.size {
+			return nil, fmt.Errorf("%w: invalid EC point", ErrUnsupportedKey)
+		}
+		// crypto/ecdh checks the point is on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := curve.ecdh.NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUnsupportedKey, err)
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve.curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: invalid OKP key", ErrUnsupportedKey)
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("%w: key type %q", ErrUnsupportedKey, k.KeyType)
+	}
+}
@@ -0,0 +1,306 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A local identity provider issuing ID tokens for one authorization code
+type mockProvider struct {
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+	keyId  string
+
+	// what the next token request must carry, and the claims of the ID token
+	// it gets back
+	code          string
+	codeChallenge string
+	claims        jwt.MapClaims
+
+	keyFetches int
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p := &mockProvider{key: key, keyId: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                           p.server.URL,
+			"authorization_endpoint":           p.server.URL + "/authorize",
+			"token_endpoint":                   p.server.URL + "/token",
+			"jwks_uri":                         p.server.URL + "/jwks",
+			"code_challenge_methods_supported": []string{"S256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.keyFetches++
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "EC",
+			"kid": p.keyId,
+			"use": "sig",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(p.key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(p.key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		clientId, clientSecret, ok := r.BasicAuth()
+		if !ok || clientId != "client" || clientSecret != "secret" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != p.code ||
+			CodeChallenge(r.PostFormValue("code_verifier")) != p.codeChallenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "unused",
+			"token_type":   "Bearer",
+			"id_token":     p.sign(t, p.claims),
+		})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *mockProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = p.keyId
+	signed, err := token.SignedString(p.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func (p *mockProvider) config() *ProviderConfig {
+	return &ProviderConfig{
+		Name:         "mock",
+		Issuer:       p.server.URL,
+		ClientId:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://dump.example/oidc/callback",
+		Scopes:       []string{"email", "profile"},
+	}
+}
+
+// Authorize a request as the provider would once the user has signed in
+func (p *mockProvider) authorize(t *testing.T, request *AuthRequest, subject string) string {
+	authURL, err := url.Parse(request.URL)
+	require.NoError(t, err)
+	query := authURL.Query()
+	p.code = "code-" + subject
+	p.codeChallenge = query.Get("code_challenge")
+	now := time.Now()
+	p.claims = jwt.MapClaims{
+		"iss":            p.server.URL,
+		"sub":            subject,
+		"aud":            query.Get("client_id"),
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          query.Get("nonce"),
+		"email":          subject + "@example.com",
+		"email_verified": true,
+	}
+	return p.code
+}
+
+func TestSignIn(t *testing.T) {
+	provider := newMockProvider(t)
+	client := NewClient(provider.config(), provider.server.Client())
+
+	request, err := client.NewAuthRequest(context.Background())
+	require.NoError(t, err)
+	authURL, err := url.Parse(request.URL)
+	require.NoError(t, err)
+	query := authURL.Query()
+	assert.Equal(t, provider.server.URL+"/authorize", authURL.Scheme+"://"+authURL.Host+authURL.Path)
+	assert.Equal(t, "code", query.Get("response_type"))
+	assert.Equal(t, "openid email profile", query.Get("scope"))
+	assert.Equal(t, request.State, query.Get("state"))
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+	assert.NotContains(t, request.URL, request.CodeVerifier)
+
+	code := provider.authorize(t, request, "alice")
+	claims, err := client.Exchange(context.Background(), code, request.CodeVerifier, request.Nonce)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+	assert.Equal(t, "alice@example.com", claims.Email)
+	assert.True(t, claims.EmailVerified)
+}
+
+func TestExchangeWithWrongCodeVerifier(t *testing.T) {
+	provider := newMockProvider(t)
+	client := NewClient(provider.config(), provider.server.Client())
+	request, err := client.NewAuthRequest(context.Background())
+	require.NoError(t, err)
+	code := provider.authorize(t, request, "alice")
+
+	_, err = client.Exchange(context.Background(), code, randomString(), request.Nonce)
+	assert.ErrorIs(t, err, ErrTokenExchange)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	provider := newMockProvider(t)
+	client := NewClient(provider.config(), provider.server.Client())
+	now := time.Now()
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":   provider.server.URL,
+			"sub":   "alice",
+			"aud":   "client",
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+			"nonce": "nonce",
+		}
+	}
+
+	_, err := client.VerifyIDToken(context.Background(), provider.sign(t, validClaims()), "nonce")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		modify func(jwt.MapClaims)
+	}{
+		{"wrong issuer", func(c jwt.MapClaims) { c["iss"] = "https://attacker.example" }},
+		{"wrong audience", func(c jwt.MapClaims) { c["aud"] = "other-client" }},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Hour).Unix() }},
+		{"no expiry", func(c jwt.MapClaims) { delete(c, "exp") }},
+		{"issued in the future", func(c jwt.MapClaims) { c["iat"] = now.Add(time.Hour).Unix() }},
+		{"wrong nonce", func(c jwt.MapClaims) { c["nonce"] = "other" }},
+		{"no subject", func(c jwt.MapClaims) { delete(c, "sub") }},
+		{"several audiences without azp", func(c jwt.MapClaims) { c["aud"] = []string{"client", "other-client"} }},
+		{"issued to another party", func(c jwt.MapClaims) { c["azp"] = "other-client" }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := validClaims()
+			test.modify(claims)
+			_, err := client.VerifyIDToken(context.Background(), provider.sign(t, claims), "nonce")
+			assert.ErrorIs(t, err, ErrInvalidIDToken)
+		})
+	}
+}
+
+func TestVerifyIDTokenSignedWithOtherKey(t *testing.T) {
+	provider := newMockProvider(t)
+	client := NewClient(provider.config(), provider.server.Client())
+	claims := jwt.MapClaims{
+		"iss": provider.server.URL, "sub": "alice", "aud": "client",
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = provider.keyId
+	forged, err := token.SignedString(otherKey)
+	require.NoError(t, err)
+	_, err = client.VerifyIDToken(context.Background(), forged, "")
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+
+	// the client secret isn't a signing key
+	token = jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = provider.keyId
+	forged, err = token.SignedString([]byte("secret"))
+	require.NoError(t, err)
+	_, err = client.VerifyIDToken(context.Background(), forged, "")
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+}
+
+func TestKeyRotation(t *testing.T) {
+	provider := newMockProvider(t)
+	client := NewClient(provider.config(), provider.server.Client())
+	now := time.Now()
+	client.now = func() time.Time { return now }
+	claims := jwt.MapClaims{
+		"iss": provider.server.URL, "sub": "alice", "aud": "client",
+		"iat": now.Unix(), "exp": now.Add(time.Hour).Unix(),
+	}
+	_, err := client.VerifyIDToken(context.Background(), provider.sign(t, claims), "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, provider.keyFetches)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	provider.key, provider.keyId = key, "key-2"
+
+	// unknown keys don't trigger a refetch right after the last one
+	_, err = client.VerifyIDToken(context.Background(), provider.sign(t, claims), "")
+	assert.ErrorIs(t, err, ErrUnknownSigningKey)
+	assert.Equal(t, 1, provider.keyFetches)
+
+	now = now.Add(minKeyRefreshInterval)
+	_, err = client.VerifyIDToken(context.Background(), provider.sign(t, claims), "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, provider.keyFetches)
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	provider := newMockProvider(t)
+	config := provider.config()
+	config.Issuer = provider.server.URL + "/"
+	client := NewClient(config, provider.server.Client())
+	_, err := client.NewAuthRequest(context.Background())
+	assert.ErrorIs(t, err, ErrDiscovery)
+}
+
+func TestAllowsDomainOf(t *testing.T) {
+	client := NewClient(&ProviderConfig{AllowedDomains: []string{"example.com"}}, nil)
+	assert.True(t, client.AllowsDomainOf(&IDTokenClaims{Email: "alice@Example.com", EmailVerified: true}))
+	assert.False(t, client.AllowsDomainOf(&IDTokenClaims{Email: "alice@example.com", EmailVerified: false}))
+	assert.False(t, client.AllowsDomainOf(&IDTokenClaims{Email: "alice@example.org", EmailVerified: true}))
+	assert.False(t, client.AllowsDomainOf(&IDTokenClaims{EmailVerified: true}))
+
+	client = NewClient(&ProviderConfig{}, nil)
+	assert.True(t, client.AllowsDomainOf(&IDTokenClaims{}))
+}
+
+func TestLoadProviders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "providers.json")
+	write := func(configs ...map[string]any) {
+		data, err := json.Marshal(configs)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, data, 0o600))
+	}
+	provider := map[string]any{
+		"name":            "corp",
+		"issuer":          "https://idp.example.com",
+		"client_id":       "client",
+		"redirect_url":    "https://dump.example/oidc/callback",
+		"allowed_domains": []string{"Example.com"},
+	}
+
+	write(provider)
+	configs, err := LoadProviders(path)
+	require.NoError(t, err)
+	require.Len(t, configs, 1)
+	assert.Equal(t, "corp", configs[0].DisplayName)
+	assert.Equal(t, []string{"example.com"}, configs[0].AllowedDomains)
+
+	write(provider, provider)
+	_, err = LoadProviders(path)
+	assert.ErrorIs(t, err, ErrInvalidProviderConfig)
+
+	write(map[string]any{"name": "Bad Name", "issuer": "x", "client_id": "x", "redirect_url": "x"})
+	_, err = LoadProviders(path)
+	assert.ErrorIs(t, err, ErrInvalidProviderConfig)
+}
@@ -0,0 +1,76 @@
+// Package oidc signs users in with external OpenID Connect providers using
+// the authorization code flow with PKCE (RFC 7636). Providers are found by
+// discovery, and ID tokens are validated against the provider's published
+// keys.
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidProviderConfig = errors.New("invalid OIDC provider configuration")
+
+// Provider names appear in URLs and are stored with linked identities
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Configuration of an OpenID Connect provider
+type ProviderConfig struct {
+	Name         string   `json:"name"`         // identifies the provider in URLs, such as "google"
+	DisplayName  string   `json:"display_name"` // shown on sign in buttons
+	Issuer       string   `json:"issuer"`       // discovery is at <issuer>/.well-known/openid-configuration
+	ClientId     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"` // where the provider sends users back to with a code
+	Scopes       []string `json:"scopes"`       // requested in addition to "openid"
+	// Whether someone without an account can sign up by signing in with the
+	// provider. Otherwise only identities linked to an account can sign in.
+	AllowSignUp bool `json:"allow_sign_up"`
+	// Only accept users whose verified email is at one of these domains, if
+	// any are given
+	AllowedDomains []string `json:"allowed_domains"`
+}
+
+func (c *ProviderConfig) validate() error {
+	if !providerNamePattern.MatchString(c.Name) {
+		return fmt.Errorf("%w: invalid name %q", ErrInvalidProviderConfig, c.Name)
+	}
+	if c.Issuer == "" || c.ClientId == "" || c.RedirectURL == "" {
+		return fmt.Errorf("%w: %s: issuer, client_id and redirect_url are required",
+			ErrInvalidProviderConfig, c.Name)
+	}
+	for i, domain := range c.AllowedDomains {
+		c.AllowedDomains[i] = strings.ToLower(domain)
+	}
+	if c.DisplayName == "" {
+		c.DisplayName = c.Name
+	}
+	return nil
+}
+
+// Load provider configurations from a JSON file holding a list of them
+func LoadProviders(path string) ([]*ProviderConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	configs := make([]*ProviderConfig, 0)
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProviderConfig, err)
+	}
+	names := make(map[string]bool)
+	for _, config := range configs {
+		if err := config.validate(); err != nil {
+			return nil, err
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("%w: duplicate name %q", ErrInvalidProviderConfig, config.Name)
+		}
+		names[config.Name] = true
+	}
+	return configs, nil
+}
@@ -0,0 +1,59 @@
+package policy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A local corpus of breached passwords in the format of the Have I Been Pwned
+// range API: one file per 5 hex digit prefix of the passwords' SHA-1 hashes,
+// named by the prefix, each holding lines of "<35 digit suffix>:<count>".
+// Lookups only ever read the file for one prefix.
+type BreachedPasswords struct {
+	Dir string
+	// Passwords seen fewer times than this are allowed
+	MinCount int
+}
+
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(b.Dir, prefix))
+	if errors.Is(err, fs.ErrNotExist) {
+		file, err = os.Open(filepath.Join(b.Dir, prefix+".txt"))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineSuffix, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !strings.EqualFold(lineSuffix, suffix) {
+			continue
+		}
+		return b.MinCount <= 1 || parseCount(count) >= b.MinCount, nil
+	}
+	return false, scanner.Err()
+}
+
+// Counts are optional; a line without one counts once
+func parseCount(count string) int {
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,100 @@
+// Package policy checks usernames and passwords chosen for accounts against
+// configurable rules, and passwords against a corpus of breached ones.
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Usernames are ASCII, so that they can't be confused with each other, and
+// without "@", so that they can't be confused with email addresses. Nor can
+// two users have usernames differing only in case, which the database
+// enforces.
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// Names nobody can take, checked case insensitively
+var DefaultReservedUsernames = []string{
+	"admin", "administrator", "root", "system", "support", "security", "help",
+	"api", "me", "dump", "null", "undefined", "anonymous", "postmaster",
+	"webmaster", "noreply", "no-reply",
+}
+
+type Policy struct {
+	MinUsernameLength int
+	MaxUsernameLength int
+	ReservedUsernames []string
+	MinPasswordLength int // in characters
+	// in bytes, since that's what hashing costs scale with
+	MaxPasswordLength int
+	// Passwords found in breaches are rejected, if a corpus is given
+	Breached *BreachedPasswords
+}
+
+func Default() *Policy {
+	return &Policy{
+		MinUsernameLength: 3,
+		MaxUsernameLength: 32,
+		ReservedUsernames: slices.Clone(DefaultReservedUsernames),
+		MinPasswordLength: 8,
+		MaxPasswordLength: 256,
+	}
+}
+
+// Normalize a password (NFKC), so that it can be typed the same on any
+// keyboard or platform. Passwords are normalized before they're hashed.
+func NormalizePassword(password string) string {
+	return norm.NFKC.String(password)
+}
+
+// Check a username, returning every rule it breaks
+func (p *Policy) CheckUsername(username string) []string {
+	violations := make([]string, 0)
+	if length := len(username); length < p.MinUsernameLength || length > p.MaxUsernameLength {
+		violations = append(violations, fmt.Sprintf(
+			"Username must be %d to %d characters", p.MinUsernameLength, p.MaxUsernameLength))
+	}
+	if username != "" && !usernamePattern.MatchString(username) {
+		violations = append(violations,
+			"Username must start with a letter or digit and contain only letters, digits, \".\", \"_\" and \"-\"")
+	}
+	if slices.Contains(p.ReservedUsernames, strings.ToLower(username)) {
+		violations = append(violations, "Username is reserved")
+	}
+	return violations
+}
+
+// Check a normalized password chosen by the user with the given username,
+// returning every rule it breaks. Errors only come from looking the password
+// up in the breach corpus.
+func (p *Policy) CheckPassword(password, username string) ([]string, error) {
+	violations := make([]string, 0)
+	if utf8.RuneCountInString(password) < p.MinPasswordLength {
+		violations = append(violations, fmt.Sprintf(
+			"Password must be at least %d characters", p.MinPasswordLength))
+	}
+	if len(password) > p.MaxPasswordLength {
+		violations = append(violations, fmt.Sprintf(
+			"Password must be at most %d bytes", p.MaxPasswordLength))
+	}
+	if len(username) >= p.MinUsernameLength &&
+		strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		violations = append(violations, "Password must not contain the username")
+	}
+	if p.Breached != nil && len(password) <= p.MaxPasswordLength {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			violations = append(violations,
+				"Password has appeared in a data breach and can't be used")
+		}
+	}
+	return violations, nil
+}
@@ -0,0 +1,111 @@
+package policy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckUsername(t *testing.T) {
+	p := Default()
+	for _, username := range []string{"alice", "Alice_1", "a.b-c", "abc"} {
+		assert.Empty(t, p.CheckUsername(username), username)
+	}
+	for username, expected := range map[string]int{
+		"":                      1,
+		"ab":                    1,
+		strings.Repeat("a", 33): 1,
+		"alice@example.com":     1,
+		"_alice":                1,
+		"ålice":                 1,
+		"Admin":                 1,
+		"a@":                    2,
+		"al ice":                1,
+		"alice​smith":           1,
+	} {
+		assert.Len(t, p.CheckUsername(username), expected, username)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	p := Default()
+	violations, err := p.CheckPassword("correct horse battery staple", "alice")
+	require.NoError(t, err)
+	assert.Empty(t, violations)
+
+	// every violated rule is reported
+	violations, err = p.CheckPassword("Alice1", "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"Password must be at least 8 characters",
+		"Password must not contain the username",
+	}, violations)
+
+	violations, err = p.CheckPassword(strings.Repeat("x", 257), "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Password must be at most 256 bytes"}, violations)
+
+	// length is counted in characters
+	violations, err = p.CheckPassword("пароль12", "alice")
+	require.NoError(t, err)
+	assert.Empty(t, violations)
+}
+
+func TestNormalizePassword(t *testing.T) {
+	// precomposed and decomposed forms, and compatibility characters, become
+	// the same password
+	assert.Equal(t, NormalizePassword("café"), NormalizePassword("café"))
+	assert.Equal(t, "ffi1", NormalizePassword("ﬃ1"))
+}
+
+// Write a breach corpus holding the given passwords with their counts
+func writeCorpus(t *testing.T, passwords map[string]int) string {
+	dir := t.TempDir()
+	lines := make(map[string][]string)
+	for password, count := range passwords {
+		sum := sha1.Sum([]byte(password))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		lines[hash[:5]] = append(lines[hash[:5]], hash[5:]+":"+strings.Repeat("1", count))
+	}
+	for prefix, prefixLines := range lines {
+		content := "0000000000000000000000000000000000A:3\r\n" + strings.Join(prefixLines, "\r\n") + "\r\n"
+		require.NoError(t, os.WriteFile(filepath.Join(dir, prefix), []byte(content), 0o644))
+	}
+	return dir
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	// counts of 1 and 111
+	breached := &BreachedPasswords{Dir: writeCorpus(t, map[string]int{"password1": 1, "letmein123": 3})}
+	for password, expected := range map[string]bool{
+		"password1":                    true,
+		"letmein123":                   true,
+		"correct horse battery staple": false,
+	} {
+		contains, err := breached.Contains(password)
+		require.NoError(t, err)
+		assert.Equal(t, expected, contains, password)
+	}
+
+	breached.MinCount = 10
+	contains, err := breached.Contains("password1")
+	require.NoError(t, err)
+	assert.False(t, contains)
+	contains, err = breached.Contains("letmein123")
+	require.NoError(t, err)
+	assert.True(t, contains)
+}
+
+func TestCheckPasswordAgainstBreaches(t *testing.T) {
+	p := Default()
+	p.Breached = &BreachedPasswords{Dir: writeCorpus(t, map[string]int{"password1": 1})}
+	violations, err := p.CheckPassword("password1", "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Password has appeared in a data breach and can't be used"}, violations)
+}
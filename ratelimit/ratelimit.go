@@ -0,0 +1,74 @@
+// Package ratelimit holds the policies used to slow down guessing: token
+// buckets limiting how often a client may make a request, and exponential
+// backoff locking an account out after repeated failures. Policies are pure;
+// their state is persisted by the caller so that limits survive restarts.
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// A bucket holding up to Capacity tokens, refilled at Rate tokens a second.
+// Each request takes a token; requests finding the bucket empty are refused.
+type TokenBucket struct {
+	Capacity float64
+	Rate     float64
+}
+
+// Allow n requests in a burst, refilled one every interval
+func NewTokenBucket(n int, interval time.Duration) TokenBucket {
+	return TokenBucket{Capacity: float64(n), Rate: 1 / interval.Seconds()}
+}
+
+// The state of a bucket as of a point in time
+type State struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// The state of a bucket nobody has taken from yet
+func (b TokenBucket) Full(now time.Time) State {
+	return State{Tokens: b.Capacity, UpdatedAt: now}
+}
+
+// Take a token from a bucket in the given state. Returns the new state,
+// whether there was a token to take, and if not, how long until there is.
+func (b TokenBucket) Take(state State, now time.Time) (State, bool, time.Duration) {
+	elapsed := max(now.Sub(state.UpdatedAt).Seconds(), 0)
+	tokens := min(b.Capacity, state.Tokens+elapsed*b.Rate)
+	if tokens < 1 {
+		wait := time.Duration(math.Ceil((1 - tokens) / b.Rate * float64(time.Second)))
+		return State{Tokens: tokens, UpdatedAt: now}, false, wait
+	}
+	return State{Tokens: tokens - 1, UpdatedAt: now}, true, 0
+}
+
+// How long until an untouched bucket is full again, after which its state
+// needn't be kept
+func (b TokenBucket) RefillTime() time.Duration {
+	return time.Duration(b.Capacity / b.Rate * float64(time.Second))
+}
+
+// Locks an account out for Base after Threshold consecutive failures,
+// doubling with each further failure up to Max
+type Backoff struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+}
+
+// How long to lock an account out for after its nth consecutive failure
+func (b Backoff) Lockout(failures int) time.Duration {
+	if failures < b.Threshold {
+		return 0
+	}
+	lockout := b.Base
+	for range failures - b.Threshold {
+		lockout *= 2
+		if lockout >= b.Max {
+			return b.Max
+		}
+	}
+	return min(lockout, b.Max)
+}
@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := NewTokenBucket(3, 10*time.Second)
+	now := time.Unix(1_700_000_000, 0)
+	state := bucket.Full(now)
+
+	// a burst of up to the capacity is allowed
+	for range 3 {
+		var ok bool
+		state, ok, _ = bucket.Take(state, now)
+		assert.True(t, ok)
+	}
+	state, ok, wait := bucket.Take(state, now)
+	assert.False(t, ok)
+	assert.Equal(t, 10*time.Second, wait)
+
+	// refused requests don't push the refill back
+	now = now.Add(4 * time.Second)
+	state, ok, wait = bucket.Take(state, now)
+	assert.False(t, ok)
+	assert.Equal(t, 6*time.Second, wait)
+
+	now = now.Add(6 * time.Second)
+	state, ok, _ = bucket.Take(state, now)
+	assert.True(t, ok)
+	_, ok, _ = bucket.Take(state, now)
+	assert.False(t, ok)
+}
+
+func TestTokenBucketRefillsUpToCapacity(t *testing.T) {
+	bucket := NewTokenBucket(2, time.Second)
+	now := time.Unix(1_700_000_000, 0)
+	state := State{Tokens: 0, UpdatedAt: now}
+
+	now = now.Add(time.Hour)
+	state, ok, _ := bucket.Take(state, now)
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, state.Tokens)
+	assert.Equal(t, 2*time.Second, bucket.RefillTime())
+}
+
+func TestTokenBucketIgnoresClockGoingBackwards(t *testing.T) {
+	bucket := NewTokenBucket(1, time.Minute)
+	now := time.Unix(1_700_000_000, 0)
+	state := State{Tokens: 0.5, UpdatedAt: now}
+	_, ok, _ := bucket.Take(state, now.Add(-time.Hour))
+	assert.False(t, ok)
+}
+
+func TestBackoff(t *testing.T) {
+	backoff := Backoff{Threshold: 5, Base: 30 * time.Second, Max: time.Hour}
+	for failures, expected := range map[int]time.Duration{
+		0:    0,
+		4:    0,
+		5:    30 * time.Second,
+		6:    time.Minute,
+		7:    2 * time.Minute,
+		12:   time.Hour,
+		1000: time.Hour,
+	} {
+		assert.Equal(t, expected, backoff.Lockout(failures), failures)
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/auth"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/ratelimit"
+	"github.com/raian621/dump/store"
+)
+
+const (
+	// how recently users without a password must have signed in to the
+	// session deleting their account
+	reauthenticationWindow = 5 * time.Minute
+	storagePurgeInterval   = time.Minute
+	// how long one server may spend on a storage purge before another can
+	// take it over
+	storagePurgeLease = 30 * time.Minute
+)
+
+// Failed storage purges are retried after a minute, doubling with each
+// further failure up to a day
+var storagePurgeBackoff = ratelimit.Backoff{Threshold: 1, Base: time.Minute, Max: 24 * time.Hour}
+
+// Delete the authenticated user's account and everything stored for it. The
+// user has to prove it's them again: with their password, or if they have
+// none, with a session signed in to in the last few minutes, and with a
+// second factor if they have TOTP enabled. Their vaults' objects are deleted
+// from the storage backends in the background.
+func (s *Server) DeleteAccount(c echo.Context) error {
+	deletion := &client.AccountDeletion{}
+	if err := json.NewDecoder(c.Request().Body).Decode(deletion); err != nil {
+		c.Logger().Warn("Failed to decode account deletion: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode account deletion")
+	}
+	grant := grantFromContext(c)
+	if grant.APIKeyId != 0 {
+		return c.String(http.StatusForbidden, "API keys can't delete accounts")
+	}
+	if err := s.reauthenticate(c, grant, deletion); err != nil {
+		return err
+	}
+
+	userId := grant.UserId
+	deleted, err := database.DeleteUser(s.db, userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusNotFound, "User not found")
+	} else if err != nil {
+		c.Logger().Error("Failed to delete user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	c.Logger().Infof("Deleted user %d, purging the storage of %d vaults", userId, deleted.Purges)
+
+	// tokens of deleted users are never valid
+	if validAfter, err := s.tokensValidAfter(userId); err != nil {
+		c.Logger().Error("Failed to revoke user tokens: ", err)
+	} else {
+		s.revocations.Revoke(userId, validAfter)
+	}
+	for _, id := range deleted.UploadIds {
+		os.Remove(s.uploadPath(id))
+		s.uploadLocks.forget(id)
+	}
+	for _, id := range deleted.ExportIds {
+		os.Remove(s.exportPath(id))
+	}
+	s.wakeStoragePurger()
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Check that the user making a request is who the session says. Wrong
+// passwords and codes count towards the user's sign in lockout.
+func (s *Server) reauthenticate(c echo.Context, grant *auth.Grant, deletion *client.AccountDeletion) error {
+	user, err := database.GetUserById(s.db, grant.UserId)
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if err := s.checkLoginLockout(c, user.Username); err != nil {
+		return err
+	}
+
+	passhash, err := database.GetPasshashForUserId(s.db, user.Id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		if time.Since(grant.AuthTime) > reauthenticationWindow {
+			return echo.NewHTTPError(http.StatusForbidden, "Sign in again to confirm it's you")
+		}
+	} else if err != nil {
+		c.Logger().Error("Failed to get password hash: ", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	} else {
+		if s.passwordTooLongToVerify(deletion.Password) {
+			return echo.NewHTTPError(http.StatusForbidden, "Incorrect password")
+		}
+		ok, _, err := verifyPassword(deletion.Password, passhash)
+		if err != nil {
+			c.Logger().Error("Failed to verify password: ", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+		} else if !ok {
+			s.recordLoginFailure(c, user.Username)
+			return echo.NewHTTPError(http.StatusForbidden, "Incorrect password")
+		}
+	}
+
+	if enabled, err := database.TOTPEnabled(s.db, user.Id); err != nil {
+		c.Logger().Error("Failed to check for TOTP: ", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	} else if enabled {
+		if ok, err := s.checkSecondFactor(user.Id, &deletion.SecondFactor); err != nil {
+			c.Logger().Error("Failed to check second factor: ", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+		} else if !ok {
+			s.recordLoginFailure(c, user.Username)
+			return echo.NewHTTPError(http.StatusForbidden, "Incorrect code")
+		}
+	}
+	return nil
+}
+
+// Delete the stored objects of deleted vaults from their backends, checking
+// for purges that are due every minute and whenever a vault or account is
+// deleted, until ctx is done
+func (s *Server) PurgeDeletedStorage(ctx context.Context) {
+	ticker := time.NewTicker(storagePurgeInterval)
+	defer ticker.Stop()
+	for {
+		s.runStoragePurges(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.storagePurges:
+		}
+	}
+}
+
+func (s *Server) wakeStoragePurger() {
+	select {
+	case s.storagePurges <- struct{}{}:
+	default:
+		// already woken
+	}
+}
+
+// Run every storage purge that's due
+func (s *Server) runStoragePurges(ctx context.Context) {
+	logger := s.e.Logger
+	for ctx.Err() == nil {
+		purge, err := database.ClaimStoragePurge(s.db, storagePurgeLease)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return
+		} else if err != nil {
+			logger.Error("Failed to claim storage purge: ", err)
+			return
+		}
+
+		purgeCtx, cancel := context.WithTimeout(ctx, storagePurgeLease)
+		err = s.purgeVaultStorage(purgeCtx, purge)
+		cancel()
+		if err != nil {
+			retryAfter := storagePurgeBackoff.Lockout(int(purge.Attempts) + 1)
+			logger.Warnf("Failed to purge storage of deleted vault %d, retrying in %s: %v",
+				purge.Vault.Id, retryAfter, err)
+			if err := database.RetryStoragePurge(s.db, purge.Id, err.Error(), retryAfter); err != nil {
+				logger.Error("Failed to record storage purge failure: ", err)
+			}
+			continue
+		}
+		if err := database.DeleteStoragePurge(s.db, purge.Id); err != nil {
+			logger.Error("Failed to delete finished storage purge: ", err)
+		}
+	}
+}
+
+// Delete everything a deleted vault stored in its backend
+func (s *Server) purgeVaultStorage(ctx context.Context, purge *storage.StoragePurge) error {
+	backend, err := s.newBackend(purge.Vault, purge.ProviderKey)
+	if err != nil {
+		return err
+	}
+	objects, err := backend.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := backend.Delete(ctx, object.Key); err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurgeVaultStorage(t *testing.T) {
+	s := &Server{vaultRoot: t.TempDir()}
+	ctx := context.Background()
+	deleted, err := store.NewFilesystemBackend(s.vaultRoot, 1)
+	require.NoError(t, err)
+	kept, err := store.NewFilesystemBackend(s.vaultRoot, 2)
+	require.NoError(t, err)
+	for _, key := range []string{"a.txt", "dir/b.txt", ".chunks/ab/abcdef"} {
+		_, err := deleted.Put(ctx, key, strings.NewReader(key), int64(len(key)))
+		require.NoError(t, err)
+	}
+	_, err = kept.Put(ctx, "a.txt", strings.NewReader("kept"), 4)
+	require.NoError(t, err)
+
+	purge := &storage.StoragePurge{
+		Vault:       &storage.Vault{Id: 1, Type: storage.VaultTypeSelfHosted},
+		ProviderKey: &storage.ProviderKey{},
+	}
+	require.NoError(t, s.purgeVaultStorage(ctx, purge))
+
+	objects, err := deleted.List(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+	// other vaults are left alone
+	objects, err = kept.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, objects, 1)
+
+	// purging again finds nothing left to delete
+	assert.NoError(t, s.purgeVaultStorage(ctx, purge))
+}
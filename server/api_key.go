@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/auth"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/models/storage"
+)
+
+const maxAPIKeyNameLength = 200
+
+// Create an API key for the authenticated user. The key itself is only ever
+// included in this response.
+func (s *Server) CreateAPIKey(c echo.Context) error {
+	key := &client.APIKey{}
+	if err := json.NewDecoder(c.Request().Body).Decode(key); err != nil {
+		c.Logger().Warn("Failed to decode API key: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode API key")
+	}
+	key.Name = strings.TrimSpace(key.Name)
+	if msg := validateAPIKeyName(key.Name); msg != "" {
+		return c.String(http.StatusBadRequest, msg)
+	}
+	if !auth.ValidAPIKeyScopes(key.Scopes) {
+		return c.String(http.StatusBadRequest, fmt.Sprintf(
+			"Scopes must be one or more of %s", strings.Join(auth.APIKeyScopes, ", ")))
+	}
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(time.Now()) {
+		return c.String(http.StatusBadRequest, "Expiry must be in the future")
+	}
+
+	userId := userIdFromContext(c)
+	if key.VaultId != 0 {
+		_, err := database.GetVaultForOwner(s.db, userId, key.VaultId)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.String(http.StatusBadRequest, "Vault not found")
+		} else if err != nil {
+			c.Logger().Error("Failed to get vault: ", err)
+			return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+		}
+	}
+
+	storageKey := key.ToStorageModel()
+	storageKey.UserId = userId
+	secret, keyId, hash := s.apiKeys.Generate()
+	storageKey.KeyId, storageKey.KeyHash = keyId, hash
+	if err := database.InsertAPIKey(s.db, storageKey); err != nil {
+		c.Logger().Error("Failed to create API key: ", err)
+		return c.String(http.StatusInternalServerError, "Failed to create API key")
+	}
+
+	s.audit(c, userId, auditAPIKeyCreated, map[string]string{
+		"key_id": storageKey.KeyId, "name": storageKey.Name,
+	})
+
+	response := client.APIKeyFromStorageModel(storageKey)
+	response.Key = secret
+	return c.JSON(http.StatusCreated, response)
+}
+
+func (s *Server) ListAPIKeys(c echo.Context) error {
+	keys, err := database.ListAPIKeysForUser(s.db, userIdFromContext(c))
+	if err != nil {
+		c.Logger().Error("Failed to list API keys: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	clientKeys := make([]*client.APIKey, 0, len(keys))
+	for _, key := range keys {
+		clientKeys = append(clientKeys, client.APIKeyFromStorageModel(key))
+	}
+	return c.JSON(http.StatusOK, clientKeys)
+}
+
+func (s *Server) RenameAPIKey(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid API key ID")
+	}
+	rename := &client.APIKeyRename{}
+	if err := json.NewDecoder(c.Request().Body).Decode(rename); err != nil {
+		c.Logger().Warn("Failed to decode API key rename: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode API key rename")
+	}
+	rename.Name = strings.TrimSpace(rename.Name)
+	if msg := validateAPIKeyName(rename.Name); msg != "" {
+		return c.String(http.StatusBadRequest, msg)
+	}
+
+	key, err := database.RenameAPIKey(s.db, userIdFromContext(c), int32(id), rename.Name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusNotFound, "API key not found")
+	} else if err != nil {
+		c.Logger().Error("Failed to rename API key: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	return c.JSON(http.StatusOK, client.APIKeyFromStorageModel(key))
+}
+
+// Revoke an API key. Requests already authenticated by it are unaffected.
+func (s *Server) DeleteAPIKey(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid API key ID")
+	}
+
+	userId := userIdFromContext(c)
+	err = database.DeleteAPIKey(s.db, userId, int32(id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusNotFound, "API key not found")
+	} else if err != nil {
+		c.Logger().Error("Failed to delete API key: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.audit(c, userId, auditAPIKeyDeleted, map[string]string{"id": c.Param("id")})
+	return c.NoContent(http.StatusNoContent)
+}
+
+func validateAPIKeyName(name string) string {
+	if name == "" {
+		return "API key name is required"
+	}
+	if utf8.RuneCountInString(name) > maxAPIKeyNameLength {
+		return fmt.Sprintf("API key name must be at most %d characters", maxAPIKeyNameLength)
+	}
+	return ""
+}
+
+func (s *Server) lookupAPIKey(keyId string) (*storage.APIKey, error) {
+	key, err := database.GetAPIKeyByKeyId(s.db, keyId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, auth.ErrInvalidAPIKey
+	}
+	return key, err
+}
+
+func (s *Server) touchAPIKey(key *storage.APIKey) error {
+	return database.TouchAPIKey(s.db, key.Id)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/storage"
+)
+
+// Audit events recorded for users, included in their data exports
+const (
+	auditSignIn            = "sign_in"
+	auditSignOutAll        = "sign_out_all"
+	auditPasswordChanged   = "password_changed"
+	auditPasswordReset     = "password_reset"
+	auditEmailChanged      = "email_changed"
+	auditEmailVerified     = "email_verified"
+	auditTOTPEnabled       = "totp_enabled"
+	auditTOTPDisabled      = "totp_disabled"
+	auditPasskeyAdded      = "passkey_added"
+	auditPasskeyDeleted    = "passkey_deleted"
+	auditIdentityLinked    = "identity_linked"
+	auditIdentityUnlinked  = "identity_unlinked"
+	auditAPIKeyCreated     = "api_key_created"
+	auditAPIKeyDeleted     = "api_key_deleted"
+	auditVaultCreated      = "vault_created"
+	auditVaultDeleted      = "vault_deleted"
+	auditDataExportStarted = "data_export_started"
+)
+
+// Record an audit event for a user. Failures are only logged, since the
+// change being audited has already been made.
+func (s *Server) audit(c echo.Context, userId int32, event string, details map[string]string) {
+	err := database.InsertAuditEvent(s.db, &storage.AuditEvent{
+		UserId:  userId,
+		Event:   event,
+		IP:      c.RealIP(),
+		Details: details,
+	})
+	if err != nil {
+		c.Logger().Errorf("Failed to record %s audit event of user %d: %v", event, userId, err)
+	}
+}
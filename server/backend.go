@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/store"
+)
+
+var (
+	ErrUnsupportedVaultType = errors.New("vault type has no storage backend")
+	ErrNoProviderKey        = errors.New("vault has no provider key")
+)
+
+// Resolve the storage backend holding a vault's objects, reached with the
+// provider key the vault was created with
+func (s *Server) backendForVault(vault *storage.Vault) (store.Backend, error) {
+	if _, ok := vaultProviderTypes[vault.Type]; !ok {
+		return s.newBackend(vault, nil)
+	}
+	if vault.ProviderKeyId == 0 {
+		return nil, ErrNoProviderKey
+	}
+	key, err := database.GetProviderKey(s.db, vault.OwnerId, vault.ProviderKeyId)
+	if err != nil {
+		return nil, err
+	}
+	return s.newBackend(vault, key)
+}
+
+// Open the storage backend of a vault with the credentials of the provider
+// holding its bucket, if it has one
+func (s *Server) newBackend(vault *storage.Vault, key *storage.ProviderKey) (store.Backend, error) {
+	switch vault.Type {
+	case storage.VaultTypeSelfHosted:
+		return store.NewFilesystemBackend(s.vaultRoot, vault.Id)
+	case storage.VaultTypeS3Bucket:
+		return store.NewS3Backend(store.S3Config{
+			Endpoint: key.Endpoint,
+			Region:   key.Region,
+			Bucket:   vault.Bucket,
+			Prefix:   bucketPrefix(vault),
+			Credentials: store.AWSCredentials{
+				AccessKeyId:     key.KeyId,
+				SecretAccessKey: key.Secret,
+			},
+			// custom endpoints are S3-compatible servers, which rarely support
+			// virtual-hosted buckets
+			PathStyle:  key.Endpoint != "",
+			HTTPClient: s.storageClient(key.Endpoint),
+		})
+	case storage.VaultTypeGCSBucket:
+		account, err := store.ParseGCSServiceAccount([]byte(key.Secret))
+		if err != nil {
+			return nil, err
+		}
+		return store.NewGCSBackend(store.GCSConfig{
+			BaseURL:        key.Endpoint,
+			Bucket:         vault.Bucket,
+			Prefix:         bucketPrefix(vault),
+			ServiceAccount: account,
+			HTTPClient:     s.storageClient(key.Endpoint),
+		})
+	default:
+		return nil, ErrUnsupportedVaultType
+	}
+}
+
+// Several vaults can share a bucket, so each one keeps its objects under its
+// own prefix
+func bucketPrefix(vault *storage.Vault) string {
+	return fmt.Sprintf("dump/vaults/%d/", vault.Id)
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/chunker"
+	"github.com/raian621/dump/crypt"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/store"
+)
+
+// Object data is split into content-defined chunks, each stored once per
+// vault, encrypted with the vault's data key under a name derived from its
+// SHA-256. Chunks written before vaults were encrypted are stored in
+// plaintext under the hash itself, and objects uploaded before chunking was
+// introduced are stored whole under their own key; both are still read and
+// deleted as such.
+
+// Backend keys under this prefix hold chunks and can't be used by objects
+const chunkKeyPrefix = ".chunks/"
+
+func chunkKey(name string) string {
+	// fan out so that no directory or listing holds every chunk
+	return chunkKeyPrefix + name[:2] + "/" + name
+}
+
+// Backend key of a chunk of the vault with the given data key
+func chunkLocation(dataKey *crypt.DataKey, hash string, encrypted bool) string {
+	if encrypted {
+		return chunkKey(dataKey.ChunkName(hash))
+	}
+	return chunkKey(hash)
+}
+
+// Unwrap a vault's data key
+func (s *Server) vaultDataKey(vault *storage.Vault) (*crypt.DataKey, error) {
+	if vault.DataKey == nil {
+		return nil, fmt.Errorf("vault %d has no data key", vault.Id)
+	}
+	return s.keyring.UnwrapDataKey(vault.DataKey, vault.MasterKeyId)
+}
+
+// Give every vault a data key wrapped by the current master key, generating
+// keys for vaults that have none and re-wrapping those wrapped by a previous
+// master key. Vaults whose key can't be re-wrapped are reported and skipped.
+func (s *Server) RewrapVaultDataKeys() error {
+	vaults, err := database.ListVaultsNeedingDataKey(s.db, s.keyring.CurrentId())
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, vault := range vaults {
+		var dataKey []byte
+		var masterKeyId string
+		if vault.DataKey == nil {
+			dataKey, masterKeyId, err = s.keyring.GenerateDataKey()
+		} else {
+			dataKey, masterKeyId, err = s.keyring.Rewrap(vault.DataKey, vault.MasterKeyId)
+		}
+		if err == nil {
+			_, err = database.ReplaceVaultDataKey(s.db, vault, dataKey, masterKeyId)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("vault %d: %w", vault.Id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Split r into chunks and write the ones the vault doesn't hold yet to its
+// backend. The returned manifest holds a reference to each of its chunks.
+func (s *Server) writeChunks(c echo.Context, vault *storage.Vault, backend store.Backend, r io.Reader) ([]storage.ObjectChunk, error) {
+	ctx := c.Request().Context()
+	dataKey, err := s.vaultDataKey(vault)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := chunker.New(r, chunker.DefaultOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := make([]storage.ObjectChunk, 0)
+	var offset int64
+	for {
+		data, err := chunks.Next()
+		if errors.Is(err, io.EOF) {
+			return manifest, nil
+		} else if err != nil {
+			s.abandonChunks(c, vault, backend, manifest)
+			return nil, err
+		}
+
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		stored, encrypted, err := database.ClaimChunk(s.db, vault.Id, hash, int32(len(data)), true)
+		if err != nil {
+			s.abandonChunks(c, vault, backend, manifest)
+			return nil, err
+		}
+		manifest = append(manifest, storage.ObjectChunk{
+			Seq:       int32(len(manifest)),
+			Hash:      hash,
+			Offset:    offset,
+			Size:      int32(len(data)),
+			Encrypted: encrypted,
+		})
+		offset += int64(len(data))
+		if stored {
+			continue
+		}
+
+		// the chunk's hash is unique to its contents, so it can identify the
+		// encrypted stream
+		encryptedData, err := dataKey.EncryptReader(bytes.NewReader(data), hash)
+		if err == nil {
+			_, err = backend.Put(ctx, chunkLocation(dataKey, hash, true), encryptedData,
+				crypt.EncryptedSize(int64(len(data))))
+		}
+		if err != nil {
+			s.abandonChunks(c, vault, backend, manifest)
+			return nil, err
+		}
+		if err := database.MarkChunkStored(s.db, vault.Id, hash); err != nil {
+			s.abandonChunks(c, vault, backend, manifest)
+			return nil, err
+		}
+	}
+}
+
+// Release the references held by a manifest that won't be saved
+func (s *Server) abandonChunks(c echo.Context, vault *storage.Vault, backend store.Backend, manifest []storage.ObjectChunk) {
+	hashes := make([]string, len(manifest))
+	for i, chunk := range manifest {
+		hashes[i] = chunk.Hash
+	}
+	if err := database.ReleaseChunks(s.db, vault.Id, hashes); err != nil {
+		c.Logger().Errorf("Failed to release chunks in vault %d: %v", vault.Id, err)
+		return
+	}
+	s.collectChunks(c, vault, backend, hashes)
+}
+
+// Delete the chunks among hashes that no object references any more
+func (s *Server) collectChunks(c echo.Context, vault *storage.Vault, backend store.Backend, hashes []string) {
+	// finish cleaning up even if the client has gone away
+	ctx := context.WithoutCancel(c.Request().Context())
+	dataKey, err := s.vaultDataKey(vault)
+	if err != nil {
+		c.Logger().Errorf("Failed to unwrap data key of vault %d: %v", vault.Id, err)
+		return
+	}
+	err = database.CollectChunks(s.db, vault.Id, hashes, func(hash string, encrypted bool) error {
+		err := backend.Delete(ctx, chunkLocation(dataKey, hash, encrypted))
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		c.Logger().Errorf("Failed to collect unreferenced chunks in vault %d: %v", vault.Id, err)
+	}
+}
+
+// Clean up the data of an object version that has been removed from the
+// catalog
+func (s *Server) dropObjectData(c echo.Context, vault *storage.Vault, backend store.Backend, key string, replaced *database.ReplacedObject) {
+	if !replaced.Existed {
+		return
+	}
+	if replaced.Chunked {
+		s.collectChunks(c, vault, backend, replaced.ChunkHashes)
+		return
+	}
+	ctx := context.WithoutCancel(c.Request().Context())
+	if err := backend.Delete(ctx, key); err != nil && !errors.Is(err, store.ErrNotFound) {
+		c.Logger().Errorf("Failed to delete object data in vault %d: %v", vault.Id, err)
+	}
+}
+
+// Open an object's data, or the part of it covered by rng if it isn't nil.
+// The range must start within the object.
+func (s *Server) openObject(ctx context.Context, vault *storage.Vault, backend store.Backend, object *storage.Object, rng *store.Range) (io.ReadCloser, error) {
+	if !object.Chunked {
+		body, _, err := backend.Get(ctx, object.Key, rng)
+		return body, err
+	}
+	dataKey, err := s.vaultDataKey(vault)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := database.GetObjectChunks(s.db, object.Id)
+	if err != nil {
+		return nil, err
+	}
+	return newChunkReader(ctx, backend, dataKey, manifest, rng)
+}
+
+// Reads a range of an object from its chunks, opening each chunk as it is
+// reached
+type chunkReader struct {
+	ctx       context.Context
+	backend   store.Backend
+	dataKey   *crypt.DataKey
+	chunks    []storage.ObjectChunk // chunks that haven't been opened yet
+	skip      int64                 // bytes to skip at the start of the next chunk
+	remaining int64
+	current   io.ReadCloser
+}
+
+func newChunkReader(ctx context.Context, backend store.Backend, dataKey *crypt.DataKey, manifest []storage.ObjectChunk, rng *store.Range) (*chunkReader, error) {
+	var size int64
+	if len(manifest) > 0 {
+		last := manifest[len(manifest)-1]
+		size = last.Offset + int64(last.Size)
+	}
+	r := &chunkReader{ctx: ctx, backend: backend, dataKey: dataKey, chunks: manifest, remaining: size}
+	if rng != nil {
+		if rng.Offset < 0 || rng.Offset >= size {
+			return nil, store.ErrInvalidRange
+		}
+		first := sort.Search(len(manifest), func(i int) bool {
+			return manifest[i].Offset+int64(manifest[i].Size) > rng.Offset
+		})
+		r.chunks = manifest[first:]
+		r.skip = rng.Offset - manifest[first].Offset
+		r.remaining = size - rng.Offset
+		if rng.Length >= 0 {
+			r.remaining = min(r.remaining, rng.Length)
+		}
+	}
+	// open the first chunk straight away so that a missing chunk is reported
+	// before the response starts
+	if r.remaining > 0 {
+		if err := r.next(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *chunkReader) next() error {
+	if len(r.chunks) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	chunk := r.chunks[0]
+	r.chunks = r.chunks[1:]
+	skip := r.skip
+	r.skip = 0
+	if !chunk.Encrypted {
+		var rng *store.Range
+		if skip > 0 {
+			rng = &store.Range{Offset: skip, Length: -1}
+		}
+		body, _, err := r.backend.Get(r.ctx, chunkLocation(r.dataKey, chunk.Hash, false), rng)
+		if err != nil {
+			return fmt.Errorf("chunk %s: %w", chunk.Hash, err)
+		}
+		r.current = body
+		return nil
+	}
+
+	// start reading at the segment holding the first byte we need
+	offset, segment, skip := crypt.SegmentOffset(skip)
+	var rng *store.Range
+	if offset > 0 {
+		rng = &store.Range{Offset: offset, Length: -1}
+	}
+	body, _, err := r.backend.Get(r.ctx, chunkLocation(r.dataKey, chunk.Hash, true), rng)
+	if err != nil {
+		return fmt.Errorf("chunk %s: %w", chunk.Hash, err)
+	}
+	plain, err := r.dataKey.DecryptReader(body, chunk.Hash, segment)
+	if err == nil {
+		_, err = io.CopyN(io.Discard, plain, skip)
+	}
+	if err != nil {
+		body.Close()
+		return fmt.Errorf("chunk %s: %w", chunk.Hash, err)
+	}
+	r.current = readCloser{plain, body}
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.remaining <= 0 {
+			return 0, io.EOF
+		}
+		if r.current == nil {
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+		}
+		if int64(len(p)) > r.remaining {
+			p = p[:r.remaining]
+		}
+		n, err := r.current.Read(p)
+		r.remaining -= int64(n)
+		if errors.Is(err, io.EOF) {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
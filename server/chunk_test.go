@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/raian621/dump/crypt"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDataKey(t *testing.T) *crypt.DataKey {
+	keyring, err := crypt.NewKeyring(bytes.Repeat([]byte{1}, crypt.KeySize))
+	require.NoError(t, err)
+	wrapped, masterKeyId, err := keyring.GenerateDataKey()
+	require.NoError(t, err)
+	dataKey, err := keyring.UnwrapDataKey(wrapped, masterKeyId)
+	require.NoError(t, err)
+	return dataKey
+}
+
+// Store data in the backend as chunks of the given sizes, alternating
+// between encrypted and plaintext chunks, and return the manifest
+func storeTestChunks(t *testing.T, backend store.Backend, dataKey *crypt.DataKey, data []byte, sizes ...int) []storage.ObjectChunk {
+	manifest := make([]storage.ObjectChunk, 0)
+	var offset int64
+	for i, size := range sizes {
+		chunk := data[offset : offset+int64(size)]
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		encrypted := i%2 == 0
+		var r io.Reader = bytes.NewReader(chunk)
+		storedSize := int64(size)
+		if encrypted {
+			var err error
+			r, err = dataKey.EncryptReader(r, hash)
+			require.NoError(t, err)
+			storedSize = crypt.EncryptedSize(storedSize)
+		}
+		_, err := backend.Put(context.Background(), chunkLocation(dataKey, hash, encrypted), r, storedSize)
+		require.NoError(t, err)
+		manifest = append(manifest, storage.ObjectChunk{
+			Seq: int32(i), Hash: hash, Offset: offset, Size: int32(size), Encrypted: encrypted,
+		})
+		offset += int64(size)
+	}
+	return manifest
+}
+
+func TestChunkReader(t *testing.T) {
+	backend, err := store.NewFilesystemBackend(t.TempDir(), 1)
+	require.NoError(t, err)
+	dataKey := testDataKey(t)
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	manifest := storeTestChunks(t, backend, dataKey, data, 10, 5, 20, 8)
+
+	for _, rng := range []*store.Range{
+		nil,
+		{Offset: 0, Length: -1},
+		{Offset: 3, Length: 4},
+		{Offset: 8, Length: 10},
+		{Offset: 10, Length: 5},
+		{Offset: 12, Length: -1},
+		{Offset: 42, Length: 1},
+		{Offset: 40, Length: 100},
+	} {
+		name := fmt.Sprint(rng)
+		r, err := newChunkReader(context.Background(), backend, dataKey, manifest, rng)
+		require.NoError(t, err, name)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err, name)
+		assert.NoError(t, r.Close(), name)
+
+		expected := data
+		if rng != nil {
+			expected = data[rng.Offset:]
+			if rng.Length >= 0 && rng.Length < int64(len(expected)) {
+				expected = expected[:rng.Length]
+			}
+		}
+		assert.Equal(t, string(expected), string(got), name)
+	}
+}
+
+func TestChunkReaderSeeksWithinEncryptedChunks(t *testing.T) {
+	backend, err := store.NewFilesystemBackend(t.TempDir(), 1)
+	require.NoError(t, err)
+	dataKey := testDataKey(t)
+	data := make([]byte, 3*crypt.SegmentSize+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	manifest := storeTestChunks(t, backend, dataKey, data, len(data))
+
+	for _, rng := range []*store.Range{
+		{Offset: crypt.SegmentSize - 1, Length: 2},
+		{Offset: 2*crypt.SegmentSize + 5, Length: -1},
+		{Offset: 3 * crypt.SegmentSize, Length: 100},
+	} {
+		r, err := newChunkReader(context.Background(), backend, dataKey, manifest, rng)
+		require.NoError(t, err)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		r.Close()
+		end := int64(len(data))
+		if rng.Length >= 0 {
+			end = rng.Offset + rng.Length
+		}
+		assert.Equal(t, data[rng.Offset:end], got, fmt.Sprint(rng))
+	}
+}
+
+func TestChunkReaderRejectsChunksOfAnotherVault(t *testing.T) {
+	backend, err := store.NewFilesystemBackend(t.TempDir(), 1)
+	require.NoError(t, err)
+	manifest := storeTestChunks(t, backend, testDataKey(t), []byte("0123456789"), 10)
+
+	// another vault's data key neither finds nor decrypts the chunk
+	otherKey := testDataKey(t)
+	_, err = newChunkReader(context.Background(), backend, otherKey, manifest, nil)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestChunkReaderRejectsRangePastEnd(t *testing.T) {
+	backend, err := store.NewFilesystemBackend(t.TempDir(), 1)
+	require.NoError(t, err)
+	dataKey := testDataKey(t)
+	manifest := storeTestChunks(t, backend, dataKey, []byte("0123456789"), 4, 6)
+
+	_, err = newChunkReader(context.Background(), backend, dataKey, manifest, &store.Range{Offset: 10, Length: -1})
+	assert.ErrorIs(t, err, store.ErrInvalidRange)
+}
+
+func TestChunkReaderReportsMissingChunk(t *testing.T) {
+	backend, err := store.NewFilesystemBackend(t.TempDir(), 1)
+	require.NoError(t, err)
+	dataKey := testDataKey(t)
+	manifest := storeTestChunks(t, backend, dataKey, []byte("0123456789"), 4, 6)
+	require.NoError(t, backend.Delete(context.Background(), chunkLocation(dataKey, manifest[1].Hash, false)))
+
+	r, err := newChunkReader(context.Background(), backend, dataKey, manifest, nil)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	_, err = newChunkReader(context.Background(), backend, dataKey, manifest, &store.Range{Offset: 5, Length: 1})
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestEmptyChunkReader(t *testing.T) {
+	r, err := newChunkReader(context.Background(), nil, nil, []storage.ObjectChunk{}, nil)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+}
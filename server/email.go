@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/auth"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/notify"
+)
+
+const maxEmailLength = 320
+
+func (s *Server) GetCurrentUser(c echo.Context) error {
+	user, err := database.GetUserById(s.db, userIdFromContext(c))
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	return c.JSON(http.StatusOK, client.UserFromStorageModel(user))
+}
+
+// Set the authenticated user's email address and send a verification link to
+// it
+func (s *Server) SetEmail(c echo.Context) error {
+	change := &client.EmailChange{}
+	if err := json.NewDecoder(c.Request().Body).Decode(change); err != nil {
+		c.Logger().Warn("Failed to decode email change: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode email change")
+	}
+	email, ok := normalizeEmail(change.Email)
+	if !ok {
+		return c.String(http.StatusBadRequest, "Invalid email address")
+	}
+
+	userId := userIdFromContext(c)
+	if taken, err := database.EmailTaken(s.db, userId, email); err != nil {
+		c.Logger().Error("Failed to check for email: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	} else if taken {
+		return c.String(http.StatusConflict, "Email address is already in use")
+	}
+	if err := database.SetEmail(s.db, userId, email); err != nil {
+		c.Logger().Error("Failed to set email: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.audit(c, userId, auditEmailChanged, map[string]string{"email": email})
+
+	user, err := database.GetUserById(s.db, userId)
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if !user.EmailVerified {
+		if err := s.sendEmailVerification(c, user); err != nil {
+			c.Logger().Error("Failed to create email verification token: ", err)
+			return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+		}
+	}
+	return c.JSON(http.StatusOK, client.UserFromStorageModel(user))
+}
+
+func (s *Server) DeleteEmail(c echo.Context) error {
+	userId := userIdFromContext(c)
+	if err := database.SetEmail(s.db, userId, ""); err != nil {
+		c.Logger().Error("Failed to remove email: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.audit(c, userId, auditEmailChanged, nil)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Send another verification link to the authenticated user's email address
+func (s *Server) ResendEmailVerification(c echo.Context) error {
+	user, err := database.GetUserById(s.db, userIdFromContext(c))
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if user.Email == "" {
+		return c.String(http.StatusNotFound, "No email address to verify")
+	} else if user.EmailVerified {
+		return c.String(http.StatusConflict, "Email address is already verified")
+	}
+	if err := s.sendEmailVerification(c, user); err != nil {
+		c.Logger().Error("Failed to create email verification token: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	return c.NoContent(http.StatusAccepted)
+}
+
+// Verify an email address with the token sent to it. The token is all the
+// proof needed, so the link works in a browser that isn't signed in.
+func (s *Server) VerifyEmail(c echo.Context) error {
+	verification := &client.EmailVerification{}
+	if err := json.NewDecoder(c.Request().Body).Decode(verification); err != nil {
+		c.Logger().Warn("Failed to decode email verification: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode email verification")
+	}
+	token, err := s.tf.ParseEmailVerificationToken(verification.Token)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid or expired token")
+	}
+
+	claims := token.Claims.(*auth.EmailVerificationClaims)
+	err = database.VerifyEmail(s.db, claims.UserId, claims.Email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// the address has been changed since
+		return c.String(http.StatusBadRequest, "Invalid or expired token")
+	} else if database.IsUniqueViolation(err) {
+		return c.String(http.StatusConflict, "Email address is already in use")
+	} else if err != nil {
+		c.Logger().Error("Failed to verify email: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.audit(c, claims.UserId, auditEmailVerified, map[string]string{"email": claims.Email})
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) sendEmailVerification(c echo.Context, user *storage.User) error {
+	token, err := s.tf.SignedString(s.tf.CreateEmailVerificationToken(user.Id, user.Email))
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Confirm that %s is the email address of your dump account %s.\n\n",
+		user.Email, user.Username)
+	if s.appURL != "" {
+		body += fmt.Sprintf("Confirm it at %s/verify-email?token=%s\n\n", s.appURL, url.QueryEscape(token))
+	} else {
+		body += fmt.Sprintf("Confirm it with this code: %s\n\n", token)
+	}
+	body += fmt.Sprintf("This expires in %d hours. If it wasn't you, ignore this message.\n",
+		auth.EmailVerificationTtl/3600)
+	s.notifyInBackground(c, &notify.Message{
+		// verification links go to the address being verified, not to the
+		// user's verified address
+		To:      notify.Recipient{Username: user.Username, Address: user.Email},
+		Subject: "Confirm your email address",
+		Body:    body,
+	})
+	return nil
+}
+
+// The address messages to a user can be delivered to: only ever a verified
+// one, since anyone can claim any address
+func recipient(user *storage.User) notify.Recipient {
+	to := notify.Recipient{Username: user.Username}
+	if user.EmailVerified {
+		to.Address = user.Email
+	}
+	return to
+}
+
+// Check an email address is a bare address (no display name) and lowercase
+// it
+func normalizeEmail(email string) (string, bool) {
+	email = strings.TrimSpace(email)
+	if email == "" || len(email) > maxEmailLength {
+		return "", false
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || address.Name != "" {
+		return "", false
+	}
+	return strings.ToLower(email), true
+}
+
+// Reject requests from users who haven't verified an email address, when
+// that's required
+func (s *Server) requireVerifiedEmail(c echo.Context) error {
+	if !s.verifiedEmailRequired {
+		return nil
+	}
+	user, err := database.GetUserById(s.db, userIdFromContext(c))
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if !user.EmailVerified {
+		return echo.NewHTTPError(http.StatusForbidden, "Verify your email address first")
+	}
+	return nil
+}
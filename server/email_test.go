@@ -0,0 +1,31 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	for input, expected := range map[string]string{
+		"alice@example.com":     "alice@example.com",
+		" Alice@Example.COM ":   "alice@example.com",
+		"alice+dump@example.io": "alice+dump@example.io",
+	} {
+		email, ok := normalizeEmail(input)
+		assert.True(t, ok, input)
+		assert.Equal(t, expected, email, input)
+	}
+}
+
+func TestNormalizeEmailRejectsInvalidAddresses(t *testing.T) {
+	for _, input := range []string{
+		"", "alice", "alice@", "@example.com", "Alice <alice@example.com>",
+		"alice@example.com, bob@example.com", "alice@example.com\r\nBcc: bob@example.com",
+		strings.Repeat("a", 320) + "@example.com",
+	} {
+		_, ok := normalizeEmail(input)
+		assert.False(t, ok, input)
+	}
+}
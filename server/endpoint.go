@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errPrivateAddress = errors.New("storage endpoint resolves to a non-public address")
+
+// Client storage backends reach user-chosen endpoints with. Endpoints are
+// checked when they're saved, but the names they use can be pointed elsewhere
+// afterwards, so it refuses to connect to anything but public addresses too.
+var storageHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	},
+}
+
+// Allow provider keys to use custom endpoints on these hosts even though
+// they're private or not https, e.g. an S3-compatible server on the local
+// network
+func (s *Server) AddStorageEndpointHosts(hosts []string) {
+	s.storageEndpointHosts = make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		s.storageEndpointHosts[strings.ToLower(host)] = true
+	}
+}
+
+// Check a custom endpoint a provider key sends storage requests to. The
+// server makes those requests with the user's credentials from inside its
+// own network, so unless the operator allowed the endpoint's host, it must be
+// https and resolve only to public addresses. Returns what's wrong with the
+// endpoint, if anything.
+func (s *Server) checkStorageEndpoint(ctx context.Context, endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || u.User != nil {
+		return "Endpoint must be an absolute URL"
+	}
+	if s.storageEndpointAllowed(endpoint) {
+		return ""
+	}
+	if u.Scheme != "https" {
+		return "Endpoint must use https unless its host is allowed"
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return "Endpoint host can't be resolved"
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return "Endpoint must not be a private, loopback or link-local address"
+		}
+	}
+	return ""
+}
+
+// Whether the operator allowed the host of an endpoint
+func (s *Server) storageEndpointAllowed(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	return err == nil && s.storageEndpointHosts[strings.ToLower(u.Hostname())]
+}
+
+// The HTTP client to reach a storage endpoint with, which only connects to
+// public addresses unless the operator allowed the endpoint's host
+func (s *Server) storageClient(endpoint string) *http.Client {
+	if endpoint != "" && s.storageEndpointAllowed(endpoint) {
+		return http.DefaultClient
+	}
+	return storageHTTPClient
+}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		ip.IsUnspecified() || carrierGradeNAT.Contains(ip))
+}
+
+// Shared address space (RFC 6598), which isn't public either
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
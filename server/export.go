@@ -0,0 +1,266 @@
+package server
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/util"
+)
+
+const (
+	// how long a finished export can be downloaded for
+	dataExportTtl = 24 * time.Hour
+	// exports pending for longer than this were abandoned, by a server that
+	// stopped while generating them, and are started over
+	dataExportTimeout = time.Hour
+	// rows read from the database at a time while exporting
+	dataExportPageSize = 1000
+)
+
+// Export everything stored about the authenticated user as a zip archive of
+// JSON files: account.json, vaults.json, objects/<vault id>.json (the object
+// catalog of each vault) and audit_events.json. Archives are generated in the
+// background: until the user's latest export is ready, this responds 202 with
+// its status, starting one if there is none. Once ready, it responds with
+// the archive.
+func (s *Server) ExportAccount(c echo.Context) error {
+	if grantFromContext(c).VaultId != 0 {
+		return c.String(http.StatusForbidden, "API key is restricted to a single vault")
+	}
+
+	userId := userIdFromContext(c)
+	export, err := database.GetLatestDataExport(s.db, userId)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		c.Logger().Error("Failed to get data export: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if err == nil && export.Status == storage.DataExportReady {
+		return c.Attachment(s.exportPath(export.Id),
+			fmt.Sprintf("dump-export-%s.zip", export.CreatedAt.UTC().Format("2006-01-02")))
+	}
+	if err == nil && export.Status == storage.DataExportPending && time.Since(export.CreatedAt) < dataExportTimeout {
+		return exportPending(c, export)
+	}
+
+	// there's no export yet, or the last one failed or was abandoned
+	export = &storage.DataExport{
+		Id:        util.GenerateRandomId(),
+		UserId:    userId,
+		Status:    storage.DataExportPending,
+		ExpiresAt: time.Now().Add(dataExportTtl),
+	}
+	if err := database.InsertDataExport(s.db, export); err != nil {
+		c.Logger().Error("Failed to create data export: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.removeExpiredExports(c)
+	s.audit(c, userId, auditDataExportStarted, map[string]string{"id": export.Id})
+	s.exportInBackground(c, export)
+	return exportPending(c, export)
+}
+
+func exportPending(c echo.Context, export *storage.DataExport) error {
+	c.Response().Header().Set("Retry-After", "5")
+	return c.JSON(http.StatusAccepted, client.DataExportFromStorageModel(export))
+}
+
+// Generate an export's archive without holding up the response, and mark the
+// export READY or FAILED
+func (s *Server) exportInBackground(c echo.Context, export *storage.DataExport) {
+	logger := c.Logger()
+	go func() {
+		status := storage.DataExportReady
+		if err := s.writeDataExport(export); err != nil {
+			logger.Errorf("Failed to export data of user %d: %v", export.UserId, err)
+			status = storage.DataExportFailed
+			os.Remove(s.exportPath(export.Id))
+		}
+		err := database.CompleteDataExport(s.db, export.Id, status)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// the user was deleted in the meantime
+			os.Remove(s.exportPath(export.Id))
+		} else if err != nil {
+			logger.Error("Failed to complete data export: ", err)
+		}
+	}()
+}
+
+// Write the archive of an export, only putting it in place once it's whole
+func (s *Server) writeDataExport(export *storage.DataExport) error {
+	if err := os.MkdirAll(s.exportDir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.exportDir, "export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	archive := zip.NewWriter(tmp)
+	if err := s.writeExportedData(archive, export.UserId); err != nil {
+		return err
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.exportPath(export.Id))
+}
+
+func (s *Server) writeExportedData(archive *zip.Writer, userId int32) error {
+	user, err := database.GetUserById(s.db, userId)
+	if err != nil {
+		return err
+	}
+	account := &client.ExportedAccount{
+		User:         client.UserFromStorageModel(user),
+		Identities:   make([]*client.Identity, 0),
+		Passkeys:     make([]*client.Passkey, 0),
+		APIKeys:      make([]*client.APIKey, 0),
+		ProviderKeys: make([]*client.ProviderKey, 0),
+	}
+	identities, err := database.ListIdentitiesForUser(s.db, userId)
+	if err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		account.Identities = append(account.Identities, client.IdentityFromStorageModel(identity))
+	}
+	passkeys, err := database.ListPasskeysForUser(s.db, userId)
+	if err != nil {
+		return err
+	}
+	for _, passkey := range passkeys {
+		account.Passkeys = append(account.Passkeys, client.PasskeyFromStorageModel(passkey))
+	}
+	apiKeys, err := database.ListAPIKeysForUser(s.db, userId)
+	if err != nil {
+		return err
+	}
+	for _, key := range apiKeys {
+		account.APIKeys = append(account.APIKeys, client.APIKeyFromStorageModel(key))
+	}
+	providerKeys, err := database.ListProviderKeysForUser(s.db, userId)
+	if err != nil {
+		return err
+	}
+	for _, key := range providerKeys {
+		account.ProviderKeys = append(account.ProviderKeys, client.ProviderKeyFromStorageModel(key))
+	}
+	if err := writeZipJSON(archive, "account.json", account); err != nil {
+		return err
+	}
+
+	vaults := make([]*client.Vault, 0)
+	for offset := 0; ; offset += dataExportPageSize {
+		page, err := database.ListVaultsForOwner(s.db, userId, dataExportPageSize, offset)
+		if err != nil {
+			return err
+		}
+		for _, vault := range page {
+			stats, err := database.GetVaultStats(s.db, vault.Id)
+			if err != nil {
+				return err
+			}
+			exported := client.VaultFromStorageModel(vault)
+			exported.Stats = client.VaultStatsFromStorageModel(stats)
+			vaults = append(vaults, exported)
+			if err := s.writeObjectCatalog(archive, vault.Id); err != nil {
+				return err
+			}
+		}
+		if len(page) < dataExportPageSize {
+			break
+		}
+	}
+	if err := writeZipJSON(archive, "vaults.json", vaults); err != nil {
+		return err
+	}
+
+	events, err := database.ListAuditEventsForUser(s.db, userId)
+	if err != nil {
+		return err
+	}
+	exportedEvents := make([]*client.AuditEvent, 0, len(events))
+	for _, event := range events {
+		exportedEvents = append(exportedEvents, client.AuditEventFromStorageModel(event))
+	}
+	return writeZipJSON(archive, "audit_events.json", exportedEvents)
+}
+
+// Write a vault's object catalog a page at a time, since it can be far too
+// big to hold in memory
+func (s *Server) writeObjectCatalog(archive *zip.Writer, vaultId int32) error {
+	w, err := archive.Create(fmt.Sprintf("objects/%d.json", vaultId))
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	query := &database.ObjectListQuery{VaultId: vaultId, Sort: "key", Limit: dataExportPageSize}
+	separator := "\n"
+	for {
+		objects, err := database.ListObjects(s.db, query)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			encoded, err := json.Marshal(client.ObjectFromStorageModel(object))
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, separator+"  "+string(encoded)); err != nil {
+				return err
+			}
+			separator = ",\n"
+		}
+		if len(objects) < dataExportPageSize {
+			break
+		}
+		query.After = &database.ObjectCursor{Key: objects[len(objects)-1].Key}
+	}
+	_, err = io.WriteString(w, "\n]\n")
+	return err
+}
+
+func writeZipJSON(archive *zip.Writer, name string, v any) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// Sweep expired exports and their archives
+func (s *Server) removeExpiredExports(c echo.Context) {
+	ids, err := database.DeleteExpiredDataExports(s.db)
+	if err != nil {
+		c.Logger().Error("Failed to delete expired data exports: ", err)
+		return
+	}
+	for _, id := range ids {
+		os.Remove(s.exportPath(id))
+	}
+}
+
+func (s *Server) exportPath(exportId string) string {
+	return filepath.Join(s.exportDir, exportId+".zip")
+}
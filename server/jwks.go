@@ -0,0 +1,15 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Publish the public keys of the asymmetric keys tokens are signed with, so
+// that other services can verify access tokens without sharing a secret
+func (s *Server) GetJWKS(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(http.StatusOK, s.tf.PublicKeys(time.Now()))
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/auth"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/util"
+)
+
+const (
+	totpIssuer           = "dump" // shown by authenticator apps next to the code
+	recoveryCodeCount    = 10
+	mfaChallengeTtl      = 5 * time.Minute
+	mfaChallengeAttempts = 5 // wrong codes allowed per challenge
+)
+
+const (
+	mfaMethodTOTP         = "totp"
+	mfaMethodRecoveryCode = "recovery_code"
+)
+
+// Start enrolling the authenticated user in TOTP. The secret only takes
+// effect once confirmed with a code generated from it.
+func (s *Server) EnrollTOTP(c echo.Context) error {
+	userId := userIdFromContext(c)
+	user, err := database.GetUserById(s.db, userId)
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	secret := auth.GenerateTOTPSecret()
+	err = database.SetPendingTOTP(s.db, userId, secret)
+	if errors.Is(err, database.ErrTOTPAlreadyEnabled) {
+		return c.String(http.StatusConflict, "TOTP is already enabled")
+	} else if err != nil {
+		c.Logger().Error("Failed to store TOTP secret: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	return c.JSON(http.StatusCreated, client.TOTPEnrollment{
+		Secret: auth.EncodeTOTPSecret(secret),
+		URI:    auth.TOTPProvisioningURI(secret, totpIssuer, user.Username),
+	})
+}
+
+// Confirm the authenticated user's pending TOTP secret with a code generated
+// from it, enabling TOTP. Responds with the user's recovery codes, which are
+// never shown again.
+func (s *Server) ConfirmTOTP(c echo.Context) error {
+	factor := &client.SecondFactor{}
+	if err := json.NewDecoder(c.Request().Body).Decode(factor); err != nil {
+		c.Logger().Warn("Failed to decode TOTP code: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode TOTP code")
+	}
+
+	userId := userIdFromContext(c)
+	totp, err := database.GetTOTP(s.db, userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No TOTP enrollment in progress")
+	} else if err != nil {
+		c.Logger().Error("Failed to get TOTP secret: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if totp.ConfirmedAt != nil {
+		return c.String(http.StatusConflict, "TOTP is already enabled")
+	}
+	step, ok := auth.ValidateTOTP(totp.Secret, factor.Code, time.Now(), totp.LastStep)
+	if !ok {
+		return c.String(http.StatusBadRequest, "Incorrect code")
+	}
+
+	codes := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+	err = database.ConfirmTOTP(s.db, userId, step, hashes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// confirmed or replaced by a concurrent request
+		return c.String(http.StatusConflict, "TOTP enrollment changed, try again")
+	} else if err != nil {
+		c.Logger().Error("Failed to confirm TOTP: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.audit(c, userId, auditTOTPEnabled, nil)
+
+	return c.JSON(http.StatusOK, client.RecoveryCodes{RecoveryCodes: codes})
+}
+
+// Turn off TOTP for the authenticated user, which takes a current code or a
+// recovery code. Wrong codes count towards the user's sign in lockout, so that
+// a stolen access token can't be used to guess one.
+func (s *Server) DisableTOTP(c echo.Context) error {
+	factor := &client.SecondFactor{}
+	if err := json.NewDecoder(c.Request().Body).Decode(factor); err != nil {
+		c.Logger().Warn("Failed to decode second factor: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode second factor")
+	}
+
+	userId := userIdFromContext(c)
+	user, err := database.GetUserById(s.db, userId)
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if err := s.checkLoginLockout(c, user.Username); err != nil {
+		return err
+	}
+	if ok, err := s.checkSecondFactor(userId, factor); err != nil {
+		c.Logger().Error("Failed to check second factor: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	} else if !ok {
+		s.recordLoginFailure(c, user.Username)
+		return c.String(http.StatusForbidden, "Incorrect code")
+	}
+
+	if err := database.DeleteTOTP(s.db, userId); err != nil {
+		c.Logger().Error("Failed to delete TOTP: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.audit(c, userId, auditTOTPDisabled, nil)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Answer sign in with a challenge for the user's second factor
+func (s *Server) challengeSecondFactor(c echo.Context, userId int32) error {
+	challenge := &storage.MFAChallenge{
+		Id:        util.GenerateRandomId(),
+		UserId:    userId,
+		ExpiresAt: time.Now().Add(mfaChallengeTtl),
+	}
+	if err := database.InsertMFAChallenge(s.db, challenge); err != nil {
+		c.Logger().Error("Failed to create MFA challenge: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if err := database.DeleteExpiredMFAChallenges(s.db); err != nil {
+		c.Logger().Error("Failed to delete expired MFA challenges: ", err)
+	}
+
+	return c.JSON(http.StatusOK, client.MFAChallenge{
+		MFAToken: challenge.Id,
+		Methods:  []string{mfaMethodTOTP, mfaMethodRecoveryCode},
+	})
+}
+
+// Finish signing in by answering an MFA challenge with a second factor. Wrong
+// codes count towards the user's sign in lockout, like wrong passwords, since
+// every sign in with the password starts a new challenge.
+func (s *Server) VerifyMFA(c echo.Context) error {
+	verification := &client.MFAVerification{}
+	if err := json.NewDecoder(c.Request().Body).Decode(verification); err != nil {
+		c.Logger().Warn("Failed to decode MFA verification: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode MFA verification")
+	}
+
+	userId, err := database.AttemptMFAChallenge(s.db, verification.MFAToken, mfaChallengeAttempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusUnauthorized, "Invalid or expired MFA token")
+	} else if err != nil {
+		c.Logger().Error("Failed to check MFA challenge: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	user, err := database.GetUserById(s.db, userId)
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if err := s.checkLoginLockout(c, user.Username); err != nil {
+		return err
+	}
+
+	if ok, err := s.checkSecondFactor(userId, &verification.SecondFactor); err != nil {
+		c.Logger().Error("Failed to check second factor: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	} else if !ok {
+		c.Logger().Warn("Failed second factor for: ", user.Username)
+		s.recordLoginFailure(c, user.Username)
+		return c.String(http.StatusUnauthorized, "Incorrect code")
+	}
+	if err := database.ClearLoginFailures(s.db, user.Username); err != nil {
+		c.Logger().Error("Failed to clear login failures: ", err)
+	}
+
+	if err := database.DeleteMFAChallenge(s.db, verification.MFAToken); err != nil {
+		c.Logger().Error("Failed to delete MFA challenge: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	return s.signIn(c, userId)
+}
+
+// Check a TOTP code or recovery code of a user with TOTP enabled, using it up
+// if it is correct
+func (s *Server) checkSecondFactor(userId int32, factor *client.SecondFactor) (bool, error) {
+	totp, err := database.GetTOTP(s.db, userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if totp.ConfirmedAt == nil {
+		return false, nil
+	}
+
+	if factor.Code != "" {
+		step, ok := auth.ValidateTOTP(totp.Secret, factor.Code, time.Now(), totp.LastStep)
+		if !ok {
+			return false, nil
+		}
+		// fails if a concurrent request accepted the same code
+		return database.UseTOTPStep(s.db, userId, step)
+	}
+
+	code := auth.NormalizeRecoveryCode(factor.RecoveryCode)
+	if code == "" {
+		return false, nil
+	}
+	codes, err := database.ListUnusedRecoveryCodes(s.db, userId)
+	if err != nil {
+		return false, err
+	}
+	for _, stored := range codes {
+		if auth.RecoveryCodeMatches(code, stored.CodeHash) {
+			return database.UseRecoveryCode(s.db, stored.Id)
+		}
+	}
+	return false, nil
+}
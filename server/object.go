@@ -0,0 +1,460 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/store"
+)
+
+// Object bodies are streamed between the client and the vault's storage
+// backend; none of these handlers hold a whole object in memory.
+
+const (
+	defaultObjectContentType = echo.MIMEOctetStream
+	objectMetadataHeader     = "X-Dump-Meta-"
+	maxContentTypeLength     = 255 // as long as the catalog stores
+	defaultObjectLimit       = 100
+	maxObjectLimit           = 1000
+)
+
+// The content type to store an object with, given the one the client sent
+func objectContentType(contentType string) (string, error) {
+	if contentType == "" {
+		return defaultObjectContentType, nil
+	} else if len(contentType) > maxContentTypeLength {
+		return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf(
+			"Content type must be at most %d bytes", maxContentTypeLength))
+	}
+	return contentType, nil
+}
+
+// Upload an object. The Content-Type and any X-Dump-Meta-* headers are
+// recorded in the object catalog and returned with downloads.
+func (s *Server) PutObject(c echo.Context) error {
+	vault, backend, err := s.vaultBackend(c)
+	if err != nil {
+		return err
+	}
+	key, err := objectKeyParam(c)
+	if err != nil {
+		return err
+	}
+
+	req := c.Request()
+	contentType, err := objectContentType(req.Header.Get(echo.HeaderContentType))
+	if err != nil {
+		return err
+	}
+	metadata := make(map[string]string)
+	for name := range req.Header {
+		if field, found := strings.CutPrefix(name, objectMetadataHeader); found && field != "" {
+			metadata[strings.ToLower(field)] = req.Header.Get(name)
+		}
+	}
+
+	object, err := s.storeObject(c, vault, backend, &storage.Object{
+		Key:         key,
+		ContentType: contentType,
+		Metadata:    metadata,
+	}, req.Body, req.ContentLength)
+	if err != nil {
+		return objectError(c, vault, err)
+	}
+
+	setObjectHeaders(c, object)
+	return c.JSON(http.StatusOK, client.ObjectFromStorageModel(object))
+}
+
+// Write an object's chunks to the vault's backend and record it in the
+// catalog, replacing any previous version. object.Key, ContentType and
+// Metadata must be set; the rest is filled in.
+func (s *Server) storeObject(c echo.Context, vault *storage.Vault, backend store.Backend, object *storage.Object, r io.Reader, size int64) (*storage.Object, error) {
+	hash := sha256.New()
+	manifest, err := s.writeChunks(c, vault, backend, io.TeeReader(r, hash))
+	if err != nil {
+		return nil, err
+	}
+
+	object.VaultId = vault.Id
+	object.Size = 0
+	for _, chunk := range manifest {
+		object.Size += int64(chunk.Size)
+	}
+	if size >= 0 && object.Size != size {
+		s.abandonChunks(c, vault, backend, manifest)
+		return nil, store.ErrSizeMismatch
+	}
+	object.ContentHash = hex.EncodeToString(hash.Sum(nil))
+	object.ETag = object.ContentHash
+	replaced, err := database.SaveChunkedObject(s.db, object, manifest)
+	if err != nil {
+		s.abandonChunks(c, vault, backend, manifest)
+		return nil, err
+	}
+	s.dropObjectData(c, vault, backend, object.Key, replaced)
+	return object, nil
+}
+
+// List the objects in a vault from the catalog. Supports `prefix`,
+// `delimiter`, `sort` (key, size or updated), `order` (asc or desc), `limit`
+// and `cursor` (the next_cursor of the previous page).
+func (s *Server) ListObjects(c echo.Context) error {
+	vault, err := s.ownedVault(c)
+	if err != nil {
+		return err
+	}
+
+	limit, err := queryInt(c, "limit", defaultObjectLimit)
+	if err != nil || limit < 1 || limit > maxObjectLimit {
+		return c.String(http.StatusBadRequest,
+			fmt.Sprintf("limit must be between 1 and %d", maxObjectLimit))
+	}
+	query := &database.ObjectListQuery{
+		VaultId: vault.Id,
+		Prefix:  c.QueryParam("prefix"),
+		Sort:    c.QueryParam("sort"),
+		Limit:   limit + 1, // fetch one extra row to find out if there is another page
+	}
+	if query.Sort == "" {
+		query.Sort = "key"
+	}
+	switch c.QueryParam("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return c.String(http.StatusBadRequest, "order must be asc or desc")
+	}
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		if query.After, err = decodeObjectCursor(cursor); err != nil {
+			return c.String(http.StatusBadRequest, "Invalid cursor")
+		}
+	}
+
+	if delimiter := c.QueryParam("delimiter"); delimiter != "" {
+		if query.Sort != "key" {
+			return c.String(http.StatusBadRequest, "delimiter can only be used when sorting by key")
+		}
+		return s.listObjectEntries(c, query, delimiter)
+	}
+
+	if _, ok := objectSorts[query.Sort]; !ok {
+		return c.String(http.StatusBadRequest, "sort must be one of key, size, updated")
+	}
+	objects, err := database.ListObjects(s.db, query)
+	if err != nil {
+		c.Logger().Error("Failed to list objects: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	list := client.ObjectList{Objects: make([]*client.Object, 0, len(objects))}
+	if len(objects) > limit {
+		objects = objects[:limit]
+		last := objects[limit-1]
+		list.NextCursor = encodeObjectCursor(&database.ObjectCursor{
+			Key:       last.Key,
+			Size:      last.Size,
+			UpdatedAt: last.UpdatedAt,
+		})
+	}
+	for _, object := range objects {
+		list.Objects = append(list.Objects, client.ObjectFromStorageModel(object))
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+var objectSorts = map[string]bool{"key": true, "size": true, "updated": true}
+
+func (s *Server) listObjectEntries(c echo.Context, query *database.ObjectListQuery, delimiter string) error {
+	after := ""
+	if query.After != nil {
+		after = query.After.Key
+	}
+	entries, err := database.ListObjectEntries(
+		s.db, query.VaultId, query.Prefix, delimiter, after, query.Descending, query.Limit)
+	if err != nil {
+		c.Logger().Error("Failed to list objects: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	limit := query.Limit - 1
+	list := client.ObjectList{
+		Objects:        make([]*client.Object, 0, len(entries)),
+		CommonPrefixes: make([]string, 0),
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		list.NextCursor = encodeObjectCursor(&database.ObjectCursor{Key: entries[limit-1].Key})
+	}
+	for _, entry := range entries {
+		if entry.IsPrefix {
+			list.CommonPrefixes = append(list.CommonPrefixes, entry.Key)
+		} else if entry.Object != nil {
+			list.Objects = append(list.Objects, client.ObjectFromStorageModel(entry.Object))
+		}
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func encodeObjectCursor(cursor *database.ObjectCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeObjectCursor(s string) (*database.ObjectCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &database.ObjectCursor{}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// Download an object, honouring a single byte range in the Range header
+func (s *Server) GetObject(c echo.Context) error {
+	vault, backend, err := s.vaultBackend(c)
+	if err != nil {
+		return err
+	}
+	key, err := objectKeyParam(c)
+	if err != nil {
+		return err
+	}
+	object, err := s.catalogObject(c, vault, key)
+	if err != nil {
+		return err
+	}
+
+	var rng *store.Range
+	if header := c.Request().Header.Get("Range"); header != "" {
+		if rng, err = parseRange(header, object.Size); err != nil || rng.Offset >= object.Size {
+			return rangeNotSatisfiable(c, object)
+		}
+	}
+
+	body, err := s.openObject(c.Request().Context(), vault, backend, object, rng)
+	if errors.Is(err, store.ErrInvalidRange) {
+		return rangeNotSatisfiable(c, object)
+	} else if err != nil {
+		return objectError(c, vault, err)
+	}
+	defer body.Close()
+
+	setObjectHeaders(c, object)
+	status := http.StatusOK
+	length := object.Size
+	if rng != nil {
+		length = object.Size - rng.Offset
+		if rng.Length >= 0 && rng.Length < length {
+			length = rng.Length
+		}
+		c.Response().Header().Set("Content-Range", fmt.Sprintf(
+			"bytes %d-%d/%d", rng.Offset, rng.Offset+length-1, object.Size))
+		status = http.StatusPartialContent
+	}
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(length, 10))
+	return c.Stream(status, object.ContentType, body)
+}
+
+func rangeNotSatisfiable(c echo.Context, object *storage.Object) error {
+	c.Response().Header().Set("Content-Range", fmt.Sprintf("bytes */%d", object.Size))
+	return c.String(http.StatusRequestedRangeNotSatisfiable, "Invalid range")
+}
+
+// Answered from the catalog without touching the storage backend
+func (s *Server) HeadObject(c echo.Context) error {
+	vault, err := s.ownedVault(c)
+	if err != nil {
+		return err
+	}
+	key, err := objectKeyParam(c)
+	if err != nil {
+		return err
+	}
+	object, err := s.catalogObject(c, vault, key)
+	if err != nil {
+		return err
+	}
+
+	setObjectHeaders(c, object)
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(object.Size, 10))
+	c.Response().Header().Set(echo.HeaderContentType, object.ContentType)
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) DeleteObject(c echo.Context) error {
+	vault, backend, err := s.vaultBackend(c)
+	if err != nil {
+		return err
+	}
+	key, err := objectKeyParam(c)
+	if err != nil {
+		return err
+	}
+
+	replaced, err := database.DeleteObject(s.db, vault.Id, key)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusNotFound, "Object not found")
+	} else if err != nil {
+		c.Logger().Error("Failed to delete object from catalog: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.dropObjectData(c, vault, backend, key, replaced)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Look up an object in the catalog
+func (s *Server) catalogObject(c echo.Context, vault *storage.Vault, key string) (*storage.Object, error) {
+	object, err := database.GetObject(s.db, vault.Id, key)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Object not found")
+	} else if err != nil {
+		c.Logger().Error("Failed to get object: ", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	return object, nil
+}
+
+// Load the vault named in the path, which must belong to the authenticated
+// user and be accessible with the request's grant
+func (s *Server) ownedVault(c echo.Context) (*storage.Vault, error) {
+	vaultId, err := vaultIdParam(c)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid vault ID")
+	}
+	if !grantFromContext(c).AllowsVault(vaultId) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Vault not found")
+	}
+	vault, err := database.GetVaultForOwner(s.db, userIdFromContext(c), vaultId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Vault not found")
+	} else if err != nil {
+		c.Logger().Error("Failed to get vault: ", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	return vault, nil
+}
+
+// Load the vault named in the path, which must belong to the authenticated
+// user, and its storage backend
+func (s *Server) vaultBackend(c echo.Context) (*storage.Vault, store.Backend, error) {
+	vault, err := s.ownedVault(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	backend, err := s.backendForVault(vault)
+	if err != nil {
+		c.Logger().Errorf("Failed to open storage backend for vault %d: %v", vault.Id, err)
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "Vault storage unavailable")
+	}
+	return vault, backend, nil
+}
+
+// Get the object key from the wildcard at the end of the path
+func objectKeyParam(c echo.Context) (string, error) {
+	key := c.Param("*")
+	// echo matches against the escaped path when the URL has one
+	if c.Request().URL.RawPath != "" {
+		var err error
+		if key, err = url.PathUnescape(key); err != nil {
+			return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid object key")
+		}
+	}
+	if err := validateObjectKey(key); err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid object key")
+	}
+	return key, nil
+}
+
+// Check that a key can name an object: it has to be usable with every backend
+// and stay out of the prefix the vault's chunks are stored under
+func validateObjectKey(key string) error {
+	if err := store.ValidateKey(key); err != nil {
+		return err
+	}
+	if strings.HasPrefix(key, chunkKeyPrefix) {
+		return store.ErrInvalidKey
+	}
+	return nil
+}
+
+// Translate a storage backend error into an *echo.HTTPError
+func objectError(c echo.Context, vault *storage.Vault, err error) error {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Object not found")
+	case errors.Is(err, store.ErrInvalidKey):
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid object key")
+	case errors.Is(err, store.ErrKeyConflict):
+		return echo.NewHTTPError(http.StatusConflict, "Object key conflicts with an existing object")
+	case errors.Is(err, store.ErrSizeMismatch):
+		return echo.NewHTTPError(http.StatusBadRequest, "Request body does not match Content-Length")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return echo.NewHTTPError(http.StatusBadRequest, "Request body ended unexpectedly")
+	}
+	c.Logger().Errorf("Storage error for vault %d: %v", vault.Id, err)
+	return echo.NewHTTPError(http.StatusBadGateway, "Vault storage error")
+}
+
+func setObjectHeaders(c echo.Context, object *storage.Object) {
+	header := c.Response().Header()
+	header.Set("ETag", `"`+object.ETag+`"`)
+	header.Set(echo.HeaderLastModified, object.UpdatedAt.UTC().Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+	for field, value := range object.Metadata {
+		header.Set(objectMetadataHeader+field, value)
+	}
+}
+
+// Parse a Range header holding a single byte range of an object of the given
+// size. size is only consulted for suffix ranges ("bytes=-500").
+func parseRange(header string, size int64) (*store.Range, error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return nil, store.ErrInvalidRange
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return nil, store.ErrInvalidRange
+	}
+
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 {
+			return nil, store.ErrInvalidRange
+		}
+		suffix = min(suffix, size)
+		return &store.Range{Offset: size - suffix, Length: suffix}, nil
+	}
+
+	offset, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || offset < 0 {
+		return nil, store.ErrInvalidRange
+	}
+	if last == "" {
+		return &store.Range{Offset: offset, Length: -1}, nil
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < offset {
+		return nil, store.ErrInvalidRange
+	}
+	return &store.Range{Offset: offset, Length: end - offset + 1}, nil
+}
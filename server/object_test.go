@@ -0,0 +1,51 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/raian621/dump/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+	for header, expected := range map[string]*store.Range{
+		"bytes=0-9":   {Offset: 0, Length: 10},
+		"bytes=5-":    {Offset: 5, Length: -1},
+		"bytes=-10":   {Offset: 90, Length: 10},
+		"bytes=-1000": {Offset: 0, Length: 100},
+	} {
+		rng, err := parseRange(header, 100)
+		assert.NoError(t, err, header)
+		assert.Equal(t, expected, rng, header)
+	}
+}
+
+func TestParseRangeRejectsUnsupportedRanges(t *testing.T) {
+	for _, header := range []string{
+		"0-9", "bytes=9-0", "bytes=a-b", "bytes=0-1,5-6", "bytes=-0", "bytes=-", "items=0-9",
+	} {
+		_, err := parseRange(header, 100)
+		assert.ErrorIs(t, err, store.ErrInvalidRange, header)
+	}
+}
+
+func TestValidateObjectKey(t *testing.T) {
+	assert.NoError(t, validateObjectKey("photos/2024/beach.jpg"))
+	assert.NoError(t, validateObjectKey("chunks/a"))
+	assert.ErrorIs(t, validateObjectKey(".chunks/ab/abcdef"), store.ErrInvalidKey)
+	assert.ErrorIs(t, validateObjectKey("photos/../secrets"), store.ErrInvalidKey)
+}
+
+func TestObjectContentType(t *testing.T) {
+	contentType, err := objectContentType("")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultObjectContentType, contentType)
+
+	contentType, err = objectContentType("image/png")
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", contentType)
+
+	_, err = objectContentType("text/plain; x=" + strings.Repeat("a", maxContentTypeLength))
+	assert.Error(t, err)
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/oidc"
+	"github.com/raian621/dump/util"
+)
+
+const (
+	// how long users have to sign in at the provider
+	oidcLoginTtl = 10 * time.Minute
+	// attempts at finding a free username for a user signing up with a
+	// provider
+	maxUsernameAttempts = 5
+	// holds the state of the login started by the browser, so that nobody
+	// can finish their own login in someone else's browser
+	oidcStateCookie = "dump_oidc_state"
+)
+
+// List the OpenID Connect providers users can sign in with
+func (s *Server) ListOIDCProviders(c echo.Context) error {
+	providers := make([]*client.OIDCProvider, 0, len(s.oidcProviders))
+	for _, provider := range s.oidcProviders {
+		providers = append(providers, &client.OIDCProvider{
+			Name:        provider.Config.Name,
+			DisplayName: provider.Config.DisplayName,
+		})
+	}
+	return c.JSON(http.StatusOK, providers)
+}
+
+// Start signing in with a provider
+func (s *Server) BeginOIDCSignIn(c echo.Context) error {
+	return s.beginOIDCLogin(c, 0)
+}
+
+// Finish signing in with a provider. Users are found by the identity linked to
+// their account, never by email, since the provider's say-so about an email
+// address isn't proof of owning the account with it. Someone without an
+// account gets one if the provider allows signing up.
+func (s *Server) FinishOIDCSignIn(c echo.Context) error {
+	provider, claims, err := s.finishOIDCLogin(c, 0)
+	if err != nil {
+		return err
+	}
+
+	identity, err := database.GetIdentity(s.db, provider.Config.Name, claims.Subject)
+	if errors.Is(err, pgx.ErrNoRows) {
+		if !provider.Config.AllowSignUp {
+			return c.String(http.StatusForbidden, "No account is linked to this identity")
+		}
+		return s.signUpWithIdentity(c, provider, claims)
+	} else if err != nil {
+		c.Logger().Error("Failed to get identity: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if err := database.UseIdentity(s.db, identity.Id, claims.Email); err != nil {
+		c.Logger().Error("Failed to update identity: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	if enabled, err := database.TOTPEnabled(s.db, identity.UserId); err != nil {
+		c.Logger().Error("Failed to check for TOTP: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	} else if enabled {
+		return s.challengeSecondFactor(c, identity.UserId)
+	}
+	return s.signIn(c, identity.UserId)
+}
+
+// Start linking an identity at a provider to the authenticated user
+func (s *Server) BeginOIDCLink(c echo.Context) error {
+	return s.beginOIDCLogin(c, userIdFromContext(c))
+}
+
+// Finish linking an identity at a provider to the authenticated user
+func (s *Server) FinishOIDCLink(c echo.Context) error {
+	userId := userIdFromContext(c)
+	provider, claims, err := s.finishOIDCLogin(c, userId)
+	if err != nil {
+		return err
+	}
+
+	identity := &storage.Identity{
+		UserId:   userId,
+		Provider: provider.Config.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+	if err := database.InsertIdentity(s.db, identity); err != nil {
+		if database.IsUniqueViolation(err) {
+			return c.String(http.StatusConflict, "Identity is already linked to an account")
+		}
+		c.Logger().Error("Failed to link identity: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.audit(c, userId, auditIdentityLinked, map[string]string{"provider": identity.Provider})
+	return c.JSON(http.StatusCreated, client.IdentityFromStorageModel(identity))
+}
+
+func (s *Server) ListIdentities(c echo.Context) error {
+	identities, err := database.ListIdentitiesForUser(s.db, userIdFromContext(c))
+	if err != nil {
+		c.Logger().Error("Failed to list identities: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	clientIdentities := make([]*client.Identity, 0, len(identities))
+	for _, identity := range identities {
+		clientIdentities = append(clientIdentities, client.IdentityFromStorageModel(identity))
+	}
+	return c.JSON(http.StatusOK, clientIdentities)
+}
+
+// Unlink an identity from the authenticated user, unless it's their only way
+// of signing in
+func (s *Server) DeleteIdentity(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid identity ID")
+	}
+
+	userId := userIdFromContext(c)
+	if count, err := database.CountSignInMethods(s.db, userId); err != nil {
+		c.Logger().Error("Failed to count sign in methods: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	} else if count <= 1 {
+		return c.String(http.StatusConflict, "Can't remove the only way to sign in")
+	}
+
+	err = database.DeleteIdentity(s.db, userId, int32(id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusNotFound, "Identity not found")
+	} else if err != nil {
+		c.Logger().Error("Failed to delete identity: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.audit(c, userId, auditIdentityUnlinked, map[string]string{"id": c.Param("id")})
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Send the user off to sign in with the provider in the path, to sign in to
+// dump or, given a user, to link the identity to their account
+func (s *Server) beginOIDCLogin(c echo.Context, userId int32) error {
+	provider, err := s.oidcProvider(c)
+	if err != nil {
+		return err
+	}
+	request, err := provider.NewAuthRequest(c.Request().Context())
+	if err != nil {
+		c.Logger().Error("Failed to start OIDC sign in: ", err)
+		return c.String(http.StatusBadGateway, "Identity provider is unavailable")
+	}
+
+	login := &storage.OIDCLogin{
+		State:        request.State,
+		Provider:     provider.Config.Name,
+		Nonce:        request.Nonce,
+		CodeVerifier: request.CodeVerifier,
+		UserId:       userId,
+		ExpiresAt:    time.Now().Add(oidcLoginTtl),
+	}
+	if err := database.InsertOIDCLogin(s.db, login); err != nil {
+		c.Logger().Error("Failed to store OIDC login: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if err := database.DeleteExpiredOIDCLogins(s.db); err != nil {
+		c.Logger().Error("Failed to delete expired OIDC logins: ", err)
+	}
+	c.SetCookie(oidcCookie(c, request.State, int(oidcLoginTtl.Seconds())))
+	return c.JSON(http.StatusOK, client.OIDCAuthorization{
+		AuthorizationURL: request.URL,
+		State:            request.State,
+	})
+}
+
+// Redeem the authorization code the provider redirected back with for the
+// user's validated claims. The login must have been started by the same
+// browser, and by the same user, or by nobody in particular when signing in.
+func (s *Server) finishOIDCLogin(c echo.Context, userId int32) (*oidc.Client, *oidc.IDTokenClaims, error) {
+	provider, err := s.oidcProvider(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	callback := &client.OIDCCallback{}
+	if err := json.NewDecoder(c.Request().Body).Decode(callback); err != nil {
+		c.Logger().Warn("Failed to decode OIDC callback: ", err)
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "Failed to decode OIDC callback")
+	}
+	cookie, err := c.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(callback.State)) != 1 {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid or expired state")
+	}
+	c.SetCookie(oidcCookie(c, "", -1))
+
+	login, err := database.TakeOIDCLogin(s.db, callback.State, provider.Config.Name)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && login.UserId != userId) {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid or expired state")
+	} else if err != nil {
+		c.Logger().Error("Failed to get OIDC login: ", err)
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	claims, err := provider.Exchange(c.Request().Context(), callback.Code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		c.Logger().Warn("OIDC sign in failed: ", err)
+		return nil, nil, echo.NewHTTPError(http.StatusUnauthorized, "Identity provider sign in failed")
+	}
+	if !provider.AllowsDomainOf(claims) {
+		return nil, nil, echo.NewHTTPError(http.StatusForbidden, "Email domain is not allowed")
+	}
+	return provider, claims, nil
+}
+
+// Create an account for someone signing in with a provider for the first
+// time and sign them in
+func (s *Server) signUpWithIdentity(c echo.Context, provider *oidc.Client, claims *oidc.IDTokenClaims) error {
+	identity := &storage.Identity{
+		Provider: provider.Config.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+	for attempt := 1; ; attempt++ {
+		username, err := s.availableUsername(provider.Config.Name, claims)
+		if err != nil {
+			c.Logger().Error("Failed to pick a username: ", err)
+			return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+		}
+		err = database.CreateUserWithIdentity(s.db, username, identity)
+		if err == nil {
+			return s.signIn(c, identity.UserId)
+		}
+		if database.IsUniqueViolationOf(err, database.UsernameConstraint) {
+			// the username was taken by a concurrent request
+			if attempt < maxUsernameAttempts {
+				continue
+			}
+		} else if database.IsUniqueViolation(err) {
+			// signed up by a concurrent request
+			return c.String(http.StatusConflict, "Identity is already linked to an account")
+		}
+		c.Logger().Error("Failed to create user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+}
+
+// Pick a username for a user signing up with a provider, from the username or
+// email the provider reports, suffixed if it's taken. Names the username
+// policy refuses, such as reserved names or email addresses, are replaced by
+// the provider's name with a random suffix.
+func (s *Server) availableUsername(provider string, claims *oidc.IDTokenClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	fallback := provider + "-user"
+
+	username := base
+	for range maxUsernameAttempts {
+		if len(s.policy.CheckUsername(username)) > 0 {
+			// refused outright, or suffixed past the maximum length
+			base = fallback
+			username = base + "-" + util.GenerateRandomId()[:6]
+		}
+		exists, err := database.UsernameExists(s.db, username)
+		if err != nil || !exists {
+			return username, err
+		}
+		username = base + "-" + util.GenerateRandomId()[:6]
+	}
+	return fallback + "-" + util.GenerateRandomId()[:12], nil
+}
+
+// The cookie holding the state of the browser's login, or clearing it given a
+// negative maxAge
+func oidcCookie(c echo.Context, state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   c.Scheme() == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (s *Server) oidcProvider(c echo.Context) (*oidc.Client, error) {
+	provider, found := s.oidcClients[c.Param("provider")]
+	if !found {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Unknown identity provider")
+	}
+	return provider, nil
+}
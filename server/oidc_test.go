@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/oidc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFinishOIDCLoginRequiresStateCookie(t *testing.T) {
+	s := New()
+	s.AddOIDCProviders([]*oidc.ProviderConfig{{
+		Name: "example", Issuer: "https://id.example", ClientId: "dump", RedirectURL: "https://dump.example/cb",
+	}})
+
+	for name, cookie := range map[string]*http.Cookie{
+		"no cookie":      nil,
+		"another state":  {Name: oidcStateCookie, Value: "their-state"},
+		"an empty state": {Name: oidcStateCookie, Value: ""},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"state": "my-state", "code": "code"}`))
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		c := s.e.NewContext(req, httptest.NewRecorder())
+		c.SetParamNames("provider")
+		c.SetParamValues("example")
+
+		_, _, err := s.finishOIDCLogin(c, 0)
+		var httpErr *echo.HTTPError
+		if assert.ErrorAs(t, err, &httpErr, name) {
+			assert.Equal(t, http.StatusBadRequest, httpErr.Code, name)
+		}
+	}
+}
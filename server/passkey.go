@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/util"
+	"github.com/raian621/dump/webauthn"
+)
+
+const maxPasskeyNameLength = 200
+
+// Start registering a passkey for the authenticated user
+func (s *Server) BeginPasskeyRegistration(c echo.Context) error {
+	userId := userIdFromContext(c)
+	user, err := database.GetUserById(s.db, userId)
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	passkeys, err := database.ListPasskeysForUser(s.db, userId)
+	if err != nil {
+		c.Logger().Error("Failed to list passkeys: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	existing := make([][]byte, len(passkeys))
+	for i, passkey := range passkeys {
+		existing[i] = passkey.CredentialId
+	}
+
+	challenge, err := s.createWebAuthnChallenge(userId, storage.CeremonyRegistration)
+	if err != nil {
+		c.Logger().Error("Failed to create WebAuthn challenge: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	webauthnUser := webauthn.User{Id: userHandle(userId), Name: user.Username, DisplayName: user.Username}
+	return c.JSON(http.StatusOK, client.PasskeyRegistrationOptions{
+		ChallengeId: challenge.Id,
+		PublicKey:   s.webauthn.CreationOptions(challenge.Challenge, webauthnUser, existing),
+	})
+}
+
+// Finish registering a passkey with the authenticator's response
+func (s *Server) FinishPasskeyRegistration(c echo.Context) error {
+	registration := &client.PasskeyRegistration{}
+	if err := json.NewDecoder(c.Request().Body).Decode(registration); err != nil {
+		c.Logger().Warn("Failed to decode passkey registration: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode passkey registration")
+	}
+	registration.Name = strings.TrimSpace(registration.Name)
+	if registration.Name == "" || utf8.RuneCountInString(registration.Name) > maxPasskeyNameLength {
+		return c.String(http.StatusBadRequest, fmt.Sprintf(
+			"Passkey name must be 1 to %d characters", maxPasskeyNameLength))
+	}
+
+	userId := userIdFromContext(c)
+	challenge, err := database.TakeWebAuthnChallenge(s.db, registration.ChallengeId, storage.CeremonyRegistration)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && challenge.UserId != userId) {
+		return c.String(http.StatusBadRequest, "Invalid or expired challenge")
+	} else if err != nil {
+		c.Logger().Error("Failed to get WebAuthn challenge: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	response := registration.Credential.Response
+	credential, err := s.webauthn.VerifyRegistration(
+		challenge.Challenge, response.ClientDataJSON, response.AttestationObject)
+	if err != nil {
+		c.Logger().Warn("Passkey registration failed: ", err)
+		return c.String(http.StatusBadRequest, "Passkey registration failed")
+	}
+
+	passkey := &storage.Passkey{
+		UserId:          userId,
+		CredentialId:    credential.Id,
+		PublicKey:       credential.PublicKey,
+		SignCount:       credential.SignCount,
+		Name:            registration.Name,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.AAGUID,
+		BackupEligible:  credential.BackupEligible,
+	}
+	if err := database.InsertPasskey(s.db, passkey); err != nil {
+		if database.IsUniqueViolation(err) {
+			return c.String(http.StatusConflict, "Passkey is already registered")
+		}
+		c.Logger().Error("Failed to store passkey: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.audit(c, userId, auditPasskeyAdded, map[string]string{"name": passkey.Name})
+	return c.JSON(http.StatusCreated, client.PasskeyFromStorageModel(passkey))
+}
+
+func (s *Server) ListPasskeys(c echo.Context) error {
+	passkeys, err := database.ListPasskeysForUser(s.db, userIdFromContext(c))
+	if err != nil {
+		c.Logger().Error("Failed to list passkeys: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	clientPasskeys := make([]*client.Passkey, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		clientPasskeys = append(clientPasskeys, client.PasskeyFromStorageModel(passkey))
+	}
+	return c.JSON(http.StatusOK, clientPasskeys)
+}
+
+func (s *Server) DeletePasskey(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid passkey ID")
+	}
+
+	userId := userIdFromContext(c)
+	err = database.DeletePasskey(s.db, userId, int32(id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusNotFound, "Passkey not found")
+	} else if err != nil {
+		c.Logger().Error("Failed to delete passkey: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.audit(c, userId, auditPasskeyDeleted, map[string]string{"id": c.Param("id")})
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Start signing in with a passkey. Given a username, only that user's
+// passkeys are offered.
+func (s *Server) BeginPasskeySignIn(c echo.Context) error {
+	start := &client.PasskeySignInStart{}
+	if err := json.NewDecoder(c.Request().Body).Decode(start); err != nil {
+		c.Logger().Warn("Failed to decode passkey sign in: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode passkey sign in")
+	}
+
+	allowed := make([][]byte, 0)
+	if start.Username != "" {
+		userId, err := database.GetUserIdFromUsername(s.db, start.Username)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			c.Logger().Error("Failed to get user: ", err)
+			return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+		}
+		// an unknown user gets an empty list, as does a user without passkeys
+		if err == nil {
+			passkeys, err := database.ListPasskeysForUser(s.db, userId)
+			if err != nil {
+				c.Logger().Error("Failed to list passkeys: ", err)
+				return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+			}
+			for _, passkey := range passkeys {
+				allowed = append(allowed, passkey.CredentialId)
+			}
+		}
+	}
+
+	challenge, err := s.createWebAuthnChallenge(0, storage.CeremonyAuthentication)
+	if err != nil {
+		c.Logger().Error("Failed to create WebAuthn challenge: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	return c.JSON(http.StatusOK, client.PasskeySignInOptions{
+		ChallengeId: challenge.Id,
+		PublicKey:   s.webauthn.RequestOptions(challenge.Challenge, allowed),
+	})
+}
+
+// Finish signing in with a passkey. A passkey that verified the user (by PIN
+// or biometrics) is enough on its own; otherwise users with TOTP enabled are
+// asked for it as well.
+func (s *Server) FinishPasskeySignIn(c echo.Context) error {
+	signIn := &client.PasskeySignIn{}
+	if err := json.NewDecoder(c.Request().Body).Decode(signIn); err != nil {
+		c.Logger().Warn("Failed to decode passkey sign in: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode passkey sign in")
+	}
+
+	challenge, err := database.TakeWebAuthnChallenge(s.db, signIn.ChallengeId, storage.CeremonyAuthentication)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusUnauthorized, "Invalid or expired challenge")
+	} else if err != nil {
+		c.Logger().Error("Failed to get WebAuthn challenge: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	passkey, err := database.GetPasskeyByCredentialId(s.db, signIn.Credential.RawId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusUnauthorized, "Passkey sign in failed")
+	} else if err != nil {
+		c.Logger().Error("Failed to get passkey: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	response := signIn.Credential.Response
+	if response.UserHandle != nil && !bytes.Equal(response.UserHandle, userHandle(passkey.UserId)) {
+		return c.String(http.StatusUnauthorized, "Passkey sign in failed")
+	}
+
+	assertion, err := s.webauthn.VerifyAssertion(
+		challenge.Challenge, passkey.PublicKey, passkey.SignCount,
+		response.ClientDataJSON, response.AuthenticatorData, response.Signature)
+	if errors.Is(err, webauthn.ErrSignCountNotIncreased) {
+		c.Logger().Warnf("Signature counter of passkey %d of user %d went backwards", passkey.Id, passkey.UserId)
+		return c.String(http.StatusUnauthorized, "Passkey sign in failed")
+	} else if err != nil {
+		c.Logger().Warn("Passkey sign in failed: ", err)
+		return c.String(http.StatusUnauthorized, "Passkey sign in failed")
+	}
+	if ok, err := database.UsePasskey(s.db, passkey.Id, passkey.SignCount, assertion.SignCount); err != nil {
+		c.Logger().Error("Failed to update passkey: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	} else if !ok {
+		return c.String(http.StatusUnauthorized, "Passkey sign in failed")
+	}
+
+	if !assertion.UserVerified {
+		if enabled, err := database.TOTPEnabled(s.db, passkey.UserId); err != nil {
+			c.Logger().Error("Failed to check for TOTP: ", err)
+			return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+		} else if enabled {
+			return s.challengeSecondFactor(c, passkey.UserId)
+		}
+	}
+	return s.signIn(c, passkey.UserId)
+}
+
+func (s *Server) createWebAuthnChallenge(userId int32, ceremony string) (*storage.WebAuthnChallenge, error) {
+	challenge := &storage.WebAuthnChallenge{
+		Id:        util.GenerateRandomId(),
+		UserId:    userId,
+		Challenge: webauthn.NewChallenge(),
+		Ceremony:  ceremony,
+		ExpiresAt: time.Now().Add(webauthn.CeremonyTimeout),
+	}
+	if err := database.InsertWebAuthnChallenge(s.db, challenge); err != nil {
+		return nil, err
+	}
+	if err := database.DeleteExpiredWebAuthnChallenges(s.db); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// The WebAuthn user handle of a user. Authenticators store it with
+// discoverable credentials and return it when signing in.
+func userHandle(userId int32) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(userId))
+}
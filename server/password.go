@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/notify"
+	"github.com/raian621/dump/policy"
+	"github.com/raian621/dump/util"
+)
+
+const (
+	passwordResetTtl = 30 * time.Minute
+	// how long delivering a notification may take
+	notifyTimeout = time.Minute
+)
+
+// Change the authenticated user's password, signing out every other session.
+// Their refresh tokens are revoked at once and their access tokens run out
+// within the access token lifetime. Wrong current passwords count towards the
+// user's sign in lockout.
+func (s *Server) ChangePassword(c echo.Context) error {
+	change := &client.PasswordChange{}
+	if err := json.NewDecoder(c.Request().Body).Decode(change); err != nil {
+		c.Logger().Warn("Failed to decode password change: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode password change")
+	}
+
+	grant := grantFromContext(c)
+	userId := grant.UserId
+	passhash, err := database.GetPasshashForUserId(s.db, userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusConflict, "Account has no password")
+	} else if err != nil {
+		c.Logger().Error("Failed to get password hash: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	user, err := database.GetUserById(s.db, userId)
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if err := s.checkLoginLockout(c, user.Username); err != nil {
+		return err
+	}
+	if s.passwordTooLongToVerify(change.CurrentPassword) {
+		return c.String(http.StatusForbidden, "Incorrect password")
+	}
+	if ok, _, err := verifyPassword(change.CurrentPassword, passhash); err != nil {
+		c.Logger().Error("Failed to verify password: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	} else if !ok {
+		s.recordLoginFailure(c, user.Username)
+		return c.String(http.StatusForbidden, "Incorrect password")
+	}
+
+	password, err := s.checkNewPassword(c, userId, change.NewPassword)
+	if err != nil {
+		return err
+	}
+	// sessions whose access tokens don't name their family can't be told
+	// apart, so all of them are signed out
+	return s.setPassword(c, userId, password, auditPasswordChanged, grant.SessionFamilyId)
+}
+
+// Send a password reset token to a user, given their username or verified
+// email address. Responds the same whether or not the user exists, and
+// delivers in the background so that response times don't tell either.
+func (s *Server) RequestPasswordReset(c echo.Context) error {
+	request := &client.PasswordResetRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(request); err != nil {
+		c.Logger().Warn("Failed to decode password reset request: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode password reset request")
+	}
+
+	username, err := database.GetUsernameForSignIn(s.db, request.Username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.NoContent(http.StatusAccepted)
+	} else if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	// only users with a password can reset it
+	if _, err := database.GetPasshashForUsername(s.db, username); errors.Is(err, pgx.ErrNoRows) {
+		return c.NoContent(http.StatusAccepted)
+	} else if err != nil {
+		c.Logger().Error("Failed to get password hash: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	userId, err := database.GetUserIdFromUsername(s.db, username)
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	user, err := database.GetUserById(s.db, userId)
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	token := util.GenerateRandomId()
+	tokenHash := sha256.Sum256([]byte(token))
+	if err := database.ReplacePasswordResetToken(
+		s.db, userId, tokenHash[:], time.Now().Add(passwordResetTtl)); err != nil {
+		c.Logger().Error("Failed to store password reset token: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if err := database.DeleteExpiredPasswordResetTokens(s.db); err != nil {
+		c.Logger().Error("Failed to delete expired password reset tokens: ", err)
+	}
+
+	body := fmt.Sprintf("Someone asked to reset the password of your dump account %s.\n\n", user.Username)
+	if s.appURL != "" {
+		body += fmt.Sprintf("Reset it at %s/reset-password?token=%s\n\n", s.appURL, url.QueryEscape(token))
+	} else {
+		body += fmt.Sprintf("Reset it with this code: %s\n\n", token)
+	}
+	body += fmt.Sprintf("This expires in %d minutes. If it wasn't you, ignore this message.\n",
+		int(passwordResetTtl.Minutes()))
+	s.notifyInBackground(c, &notify.Message{
+		To:      recipient(user),
+		Subject: "Reset your dump password",
+		Body:    body,
+	})
+	return c.NoContent(http.StatusAccepted)
+}
+
+// Set a new password with a reset token. Every session of the user is signed
+// out and every API key of theirs revoked, since a reset is how users recover
+// an account someone else may have got into.
+func (s *Server) ResetPassword(c echo.Context) error {
+	reset := &client.PasswordReset{}
+	if err := json.NewDecoder(c.Request().Body).Decode(reset); err != nil {
+		c.Logger().Warn("Failed to decode password reset: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode password reset")
+	}
+
+	tokenHash := sha256.Sum256([]byte(reset.Token))
+	userId, err := database.GetPasswordResetTokenUser(s.db, tokenHash[:])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusBadRequest, "Invalid or expired token")
+	} else if err != nil {
+		c.Logger().Error("Failed to get password reset token: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	// the token is only used up once the new password has been accepted, so
+	// that a password the policy refuses doesn't cost the user their token
+	password, err := s.checkNewPassword(c, userId, reset.NewPassword)
+	if err != nil {
+		return err
+	}
+	if _, err := database.TakePasswordResetToken(s.db, tokenHash[:]); errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusBadRequest, "Invalid or expired token")
+	} else if err != nil {
+		c.Logger().Error("Failed to take password reset token: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if revoked, err := database.DeleteAPIKeysForUser(s.db, userId); err != nil {
+		c.Logger().Error("Failed to revoke API keys: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	} else if revoked > 0 {
+		c.Logger().Infof("Revoked %d API keys of user %d on password reset", revoked, userId)
+	}
+
+	return s.setPassword(c, userId, password, auditPasswordReset, "")
+}
+
+// Normalize a new password for a user and check it follows the policy
+func (s *Server) checkNewPassword(c echo.Context, userId int32, password string) (string, error) {
+	user, err := database.GetUserById(s.db, userId)
+	if err != nil {
+		c.Logger().Error("Failed to get user: ", err)
+		return "", echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	password = policy.NormalizePassword(password)
+	if err := s.checkPassword(c, password, user.Username); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// Replace a user's password with a normalized one, sign out every session of
+// theirs except the one of the given refresh token family, if any, and record
+// the change as the given audit event
+func (s *Server) setPassword(c echo.Context, userId int32, password, event, keepFamilyId string) error {
+	err := database.UpdatePasshash(s.db, userId, util.HashPassword(password))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusConflict, "Account has no password")
+	} else if err != nil {
+		c.Logger().Error("Failed to update password hash: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	if keepFamilyId != "" {
+		if err := database.RevokeOtherRefreshTokenFamilies(s.db, userId, keepFamilyId); err != nil {
+			c.Logger().Error("Failed to revoke user tokens: ", err)
+			return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+		}
+	} else {
+		validAfter, err := database.RevokeAllTokens(s.db, userId)
+		if err != nil {
+			c.Logger().Error("Failed to revoke user tokens: ", err)
+			return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+		}
+		s.revocations.Revoke(userId, validAfter)
+	}
+	s.audit(c, userId, event, nil)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Deliver a message without holding up the response. Failures are only
+// logged.
+func (s *Server) notifyInBackground(c echo.Context, message *notify.Message) {
+	logger := c.Logger()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if err := s.notifier.Notify(ctx, message); err != nil {
+			logger.Warnf("Failed to notify %s: %v", message.To.Username, err)
+		}
+	}()
+}
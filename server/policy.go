@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/policy"
+	"github.com/raian621/dump/util"
+)
+
+// Bytes of a password given to sign in with that are hashed at most
+const maxVerifiedPasswordLength = 4096
+
+// Set the rules usernames and passwords chosen for accounts must follow
+func (s *Server) AddPasswordPolicy(p *policy.Policy) {
+	s.policy = p
+}
+
+// Check a normalized password chosen by a user, refusing it with every rule
+// it breaks
+func (s *Server) checkPassword(c echo.Context, password, username string) error {
+	violations, err := s.policy.CheckPassword(password, username)
+	if err != nil {
+		c.Logger().Error("Failed to check password against breached passwords: ", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if len(violations) > 0 {
+		return validationErrors(violations)
+	}
+	return nil
+}
+
+// The error refusing a request that broke rules, listing all of them
+func validationErrors(violations []string) error {
+	return echo.NewHTTPError(http.StatusUnprocessableEntity, client.ValidationErrors{Errors: violations})
+}
+
+// Whether a password given to sign in with is too long to be worth hashing.
+// Passwords shrink when normalized, e.g. full-width letters to ASCII, and
+// those set before the policy had no maximum, so the limit leaves room for
+// both.
+func (s *Server) passwordTooLongToVerify(password string) bool {
+	return len(password) > max(maxVerifiedPasswordLength, 4*s.policy.MaxPasswordLength)
+}
+
+// Check a password against a hash. Hashes made before passwords were
+// normalized are of the password as it was typed, so that is tried too, and
+// a match is reported as needing a rehash of the normalized password.
+func verifyPassword(password, passhash string) (ok bool, needsRehash bool, err error) {
+	normalized := policy.NormalizePassword(password)
+	ok, needsRehash, err = util.VerifyPassword(normalized, passhash)
+	if ok || err != nil || normalized == password {
+		return ok, needsRehash, err
+	}
+	ok, _, err = util.VerifyPassword(password, passhash)
+	return ok, ok, err
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/raian621/dump/policy"
+	"github.com/raian621/dump/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	// "ﬁ" normalizes to "fi"
+	normalized := util.HashPassword("fish1234")
+	ok, needsRehash, err := verifyPassword("ﬁsh1234", normalized)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, needsRehash)
+
+	// hashed as typed, before passwords were normalized
+	legacy := util.HashPassword("ﬁsh1234")
+	ok, needsRehash, err = verifyPassword("ﬁsh1234", legacy)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, needsRehash)
+
+	ok, _, err = verifyPassword("fish1234", legacy)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestSignInWithPasswordThatShrinksWhenNormalized(t *testing.T) {
+	s := New()
+	// 300 bytes as typed, 100 once normalized
+	typed := strings.Repeat("Ｐ", 100)
+	require.Greater(t, len(typed), s.policy.MaxPasswordLength)
+
+	// signing up
+	password := policy.NormalizePassword(typed)
+	violations, err := s.policy.CheckPassword(password, "someone")
+	require.NoError(t, err)
+	require.Empty(t, violations)
+	passhash := util.HashPassword(password)
+
+	// signing in
+	require.False(t, s.passwordTooLongToVerify(typed))
+	ok, _, err := verifyPassword(typed, passhash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.True(t, s.passwordTooLongToVerify(strings.Repeat("a", maxVerifiedPasswordLength+1)))
+}
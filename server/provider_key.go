@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/store"
+)
+
+// Store credentials the server uses to reach a cloud provider on the
+// authenticated user's behalf
+func (s *Server) CreateProviderKey(c echo.Context) error {
+	key := &client.ProviderKey{}
+	if err := json.NewDecoder(c.Request().Body).Decode(key); err != nil {
+		c.Logger().Warn("Failed to decode provider key: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode provider key")
+	}
+	key.KeyId = strings.TrimSpace(key.KeyId)
+	switch key.ProviderType {
+	case storage.ProviderTypeAWS, storage.ProviderTypeGCP:
+	default:
+		return c.String(http.StatusBadRequest, "Provider type must be one of AWS, GCP")
+	}
+	if key.KeyId == "" || key.Secret == "" {
+		return c.String(http.StatusBadRequest, "Key ID and secret are required")
+	}
+
+	key.Endpoint = strings.TrimSpace(key.Endpoint)
+	if key.Endpoint != "" {
+		if msg := s.checkStorageEndpoint(c.Request().Context(), key.Endpoint); msg != "" {
+			return c.String(http.StatusBadRequest, msg)
+		}
+	}
+
+	if key.ProviderType == storage.ProviderTypeGCP {
+		// GCP secrets are service account key files
+		if _, err := store.ParseGCSServiceAccount([]byte(key.Secret)); err != nil {
+			return c.String(http.StatusBadRequest, "GCP secret must be a service account key file")
+		}
+	}
+
+	storageKey := key.ToStorageModel()
+	storageKey.UserId = userIdFromContext(c)
+	if err := database.InsertProviderKey(s.db, storageKey); err != nil {
+		c.Logger().Error("Failed to create provider key: ", err)
+		return c.String(http.StatusInternalServerError, "Failed to create provider key")
+	}
+
+	return c.JSON(http.StatusCreated, client.ProviderKeyFromStorageModel(storageKey))
+}
+
+func (s *Server) ListProviderKeys(c echo.Context) error {
+	keys, err := database.ListProviderKeysForUser(s.db, userIdFromContext(c))
+	if err != nil {
+		c.Logger().Error("Failed to list provider keys: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	clientKeys := make([]*client.ProviderKey, 0, len(keys))
+	for _, key := range keys {
+		clientKeys = append(clientKeys, client.ProviderKeyFromStorageModel(key))
+	}
+	return c.JSON(http.StatusOK, clientKeys)
+}
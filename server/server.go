@@ -1,23 +1,60 @@
 package server
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/raian621/dump/auth"
+	"github.com/raian621/dump/crypt"
 	"github.com/raian621/dump/database"
 	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/notify"
+	"github.com/raian621/dump/oidc"
+	"github.com/raian621/dump/policy"
 	"github.com/raian621/dump/util"
+	"github.com/raian621/dump/webauthn"
 )
 
 type Server struct {
 	e  *echo.Echo
 	db *pgxpool.Pool
 	tf *auth.TokenFactory
+	// "tokens valid after" times of users, checked on every authenticated
+	// request
+	revocations *auth.RevocationCache
+	apiKeys     *auth.APIKeyVerifier
+	webauthn    *webauthn.RelyingParty // nil unless passkeys are configured
+	keyring     *crypt.Keyring         // master keys wrapping the vaults' data keys
+	notifier    notify.Notifier        // nil unless messages to users can be delivered
+	appURL      string                 // base URL of the web client, used in links sent to users
+	// whether users must verify an email address before creating vaults
+	verifiedEmailRequired bool
+	policy                *policy.Policy // rules usernames and passwords must follow
+	vaultRoot             string         // root directory of SELF_HOSTED vaults
+	uploadDir             string         // staging directory of resumable uploads in progress
+	exportDir             string         // directory of the archives of data exports
+	// hosts provider keys may use as custom endpoints even though they're
+	// private
+	storageEndpointHosts map[string]bool
+
+	// OpenID Connect providers users can sign in with, in configured order
+	// and by name
+	oidcProviders []*oidc.Client
+	oidcClients   map[string]*oidc.Client
+
+	uploadLocks uploadLocks
+	// wakes the storage purger up when a vault or account is deleted
+	storagePurges chan struct{}
 }
 
 func (s *Server) Start(address string) error {
@@ -34,6 +71,16 @@ func (s *Server) CreateUserWithCredentials(c echo.Context) error {
 		c.Logger().Warn("Failed to decode user credentials: ", err)
 		return c.String(500, "Failed to decode user credentials")
 	}
+	creds.Password = policy.NormalizePassword(creds.Password)
+	violations := s.policy.CheckUsername(creds.Username)
+	passwordViolations, err := s.policy.CheckPassword(creds.Password, creds.Username)
+	if err != nil {
+		c.Logger().Error("Failed to check password against breached passwords: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if violations = append(violations, passwordViolations...); len(violations) > 0 {
+		return validationErrors(violations)
+	}
 	if exists, err := database.UsernameExists(s.db, creds.Username); err != nil {
 		c.Logger().Error("Unexpected error while checking for username: ", err)
 		return c.String(500, "Unexpected error")
@@ -41,13 +88,18 @@ func (s *Server) CreateUserWithCredentials(c echo.Context) error {
 		return c.String(http.StatusConflict, "Username already exists")
 	}
 	if err := database.CreateUserWithCredentials(s.db, creds.ToStorageModel()); err != nil {
+		// lost a race with a concurrent request for the same username
+		if database.IsUniqueViolationOf(err, database.UsernameConstraint) {
+			return c.String(http.StatusConflict, "Username already exists")
+		}
 		c.Logger().Error("Failed to create user: ", err)
 		return c.String(500, "Failed to create user")
 	}
 	return nil
 }
 
-// Sign a user in with credentials (username and password)
+// Sign a user in with credentials (username or verified email address, and
+// password)
 func (s *Server) SignInWithCredentials(c echo.Context) error {
 	creds := &client.Credentials{}
 	if err := json.NewDecoder(c.Request().Body).Decode(creds); err != nil {
@@ -55,24 +107,79 @@ func (s *Server) SignInWithCredentials(c echo.Context) error {
 		return c.String(
 			http.StatusUnprocessableEntity, "Failed to decode user credentials")
 	}
+	if len(creds.Username) > maxLoginNameLength {
+		return c.String(http.StatusBadRequest, fmt.Sprintf(
+			"Username must be at most %d bytes", maxLoginNameLength))
+	}
+	// no password this long can have been set, and hashing it would cost
+	// more the longer it is
+	if s.passwordTooLongToVerify(creds.Password) {
+		return c.String(http.StatusUnauthorized, "Incorrect username or password")
+	}
 
-	passhash, err := database.GetPasshashForUsername(s.db, creds.Username)
-	if err == sql.ErrNoRows {
-		c.Logger().Error("Couldn't find username: ", creds.Username)
-		return c.String(http.StatusBadRequest, "Incorrect username or password")
-	} else if err != nil {
+	username, err := database.GetUsernameForSignIn(s.db, creds.Username)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
 		c.Logger().Error("Unexpected error occurred: ", err)
 		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
 	}
+	login := loginName(username, creds.Username)
+	if err := s.checkLoginLockout(c, login); err != nil {
+		return err
+	}
 
-	if !util.ValidatePassword(creds.Password, passhash) {
-		c.Logger().Error("Incorrect password for user: ", creds.Username)
-		return c.String(http.StatusNotFound, "Incorrect username or password")
+	// users without a password are checked against a dummy hash, so that
+	// neither the response nor its timing tells whether a user exists
+	passhash := dummyPasshash()
+	if username != "" {
+		passhash, err = database.GetPasshashForUsername(s.db, username)
+		if errors.Is(err, pgx.ErrNoRows) {
+			passhash, username = dummyPasshash(), ""
+		} else if err != nil {
+			c.Logger().Error("Unexpected error occurred: ", err)
+			return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+		}
+	}
+	ok, needsRehash, err := verifyPassword(creds.Password, passhash)
+	if err != nil {
+		c.Logger().Error("Failed to verify password of user: ", username, ": ", err)
+	}
+	if !ok || username == "" {
+		c.Logger().Warn("Failed sign in for: ", login)
+		s.recordLoginFailure(c, login)
+		return c.String(http.StatusUnauthorized, "Incorrect username or password")
 	}
 
-	userId, err := database.GetUserIdFromUsername(s.db, creds.Username)
-	accessToken := s.tf.CreateAccessToken(userId)
-	refreshToken := s.tf.CreateRefreshToken(userId)
+	userId, err := database.GetUserIdFromUsername(s.db, username)
+	if err != nil {
+		c.Logger().Error("Unexpected error occurred: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if needsRehash {
+		// the password is at hand, so upgrade its hash to the current
+		// algorithm and parameters
+		if err := database.UpdatePasshash(s.db, userId, util.HashPassword(policy.NormalizePassword(creds.Password))); err != nil {
+			c.Logger().Error("Failed to upgrade password hash: ", err)
+		}
+	}
+
+	// failed sign ins keep counting until the second factor is passed too, so
+	// that a known password doesn't allow guessing codes without end
+	if enabled, err := database.TOTPEnabled(s.db, userId); err != nil {
+		c.Logger().Error("Failed to check for TOTP: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	} else if enabled {
+		return s.challengeSecondFactor(c, userId)
+	}
+	if err := database.ClearLoginFailures(s.db, login); err != nil {
+		c.Logger().Error("Failed to clear login failures: ", err)
+	}
+	return s.signIn(c, userId)
+}
+
+// Issue a new session's access and refresh tokens to a user who has proven
+// their identity
+func (s *Server) signIn(c echo.Context, userId int32) error {
+	accessToken, refreshToken := s.tf.CreateSessionTokens(userId)
 
 	accessTokenStr, err := s.tf.SignedString(accessToken)
 	if err != nil {
@@ -85,6 +192,16 @@ func (s *Server) SignInWithCredentials(c echo.Context) error {
 		c.Logger().Error("Unexpected error occurred: ", err)
 		return c.String(500, "Unexpected error occurred")
 	}
+	err = database.InsertRefreshToken(
+		s.db, refreshTokenRecord(refreshToken.Claims.(*auth.RefreshTokenClaims)))
+	if err != nil {
+		c.Logger().Error("Failed to record refresh token: ", err)
+		return c.String(500, "Unexpected error occurred")
+	}
+	if err := database.DeleteExpiredRefreshTokens(s.db); err != nil {
+		c.Logger().Error("Failed to delete expired refresh tokens: ", err)
+	}
+	s.audit(c, userId, auditSignIn, nil)
 
 	return c.JSON(200, client.AuthPayload{
 		AccessToken:  accessTokenStr,
@@ -92,34 +209,212 @@ func (s *Server) SignInWithCredentials(c echo.Context) error {
 	})
 }
 
+// Exchange a refresh token for a new access token and a replacement refresh
+// token. Presenting a refresh token that has already been exchanged revokes
+// every refresh token descending from the same sign-in.
 func (s *Server) RefreshAccessToken(c echo.Context) error {
 	tokens := &client.AuthPayload{}
 	if err := json.NewDecoder(c.Request().Body).Decode(tokens); err != nil {
-		c.Logger().Errorf("Failed to parse refresh access token payload: err=%v, payload=%v\n")
+		c.Logger().Error("Failed to parse refresh access token payload: ", err)
 		return c.String(500, "Unexpected error occurred")
 	}
 
-	newAccessTokenStr, err := s.tf.RefreshAccessToken(tokens.AccessToken, tokens.RefreshToken)
+	refreshed, err := s.tf.RefreshAccessToken(tokens.AccessToken, tokens.RefreshToken)
 	if err != nil {
 		c.Logger().Error("Failed to refresh access token: ", err)
 		return c.String(http.StatusUnauthorized, "Failed to refresh token")
 	}
 
+	err = database.RotateRefreshToken(
+		s.db, refreshed.UsedClaims.ID, refreshTokenRecord(refreshed.RefreshClaims))
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		c.Logger().Warnf("Refresh token reused, revoked token family %s of user %d",
+			refreshed.UsedClaims.FamilyId, refreshed.UsedClaims.UserId)
+		return c.String(http.StatusUnauthorized, "Failed to refresh token")
+	} else if errors.Is(err, pgx.ErrNoRows) {
+		c.Logger().Error("Unknown refresh token: ", refreshed.UsedClaims.ID)
+		return c.String(http.StatusUnauthorized, "Failed to refresh token")
+	} else if err != nil {
+		c.Logger().Error("Failed to rotate refresh token: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
 	return c.JSON(200, client.AuthPayload{
-		AccessToken: newAccessTokenStr,
+		AccessToken:  refreshed.AccessToken,
+		RefreshToken: refreshed.RefreshToken,
 	})
 }
 
+// Sign out of the session a refresh token belongs to by revoking every
+// refresh token descending from the same sign-in. The refresh token is the
+// only credential needed, so sign out works even once the access token has
+// expired. Access tokens already issued to the session stay valid until they
+// expire.
+func (s *Server) SignOut(c echo.Context) error {
+	tokens := &client.AuthPayload{}
+	if err := json.NewDecoder(c.Request().Body).Decode(tokens); err != nil {
+		c.Logger().Warn("Failed to decode sign out payload: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode sign out payload")
+	}
+	refreshToken, err := s.tf.ParseRefreshToken(tokens.RefreshToken)
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		// the session has already ended
+		return c.NoContent(http.StatusNoContent)
+	} else if err != nil {
+		return c.String(http.StatusUnauthorized, "Invalid refresh token")
+	}
+
+	claims := refreshToken.Claims.(*auth.RefreshTokenClaims)
+	if err := database.RevokeRefreshTokenFamily(s.db, claims.UserId, claims.FamilyId); err != nil {
+		c.Logger().Error("Failed to revoke refresh token family: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Sign out of every session of the authenticated user, revoking all of their
+// refresh and access tokens. API keys aren't sessions and keep working: they
+// are revoked one at a time, or all at once by a password reset.
+func (s *Server) SignOutAll(c echo.Context) error {
+	userId := userIdFromContext(c)
+	validAfter, err := database.RevokeAllTokens(s.db, userId)
+	if err != nil {
+		c.Logger().Error("Failed to revoke user tokens: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.revocations.Revoke(userId, validAfter)
+	s.audit(c, userId, auditSignOutAll, nil)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func refreshTokenRecord(claims *auth.RefreshTokenClaims) *storage.RefreshToken {
+	return &storage.RefreshToken{
+		Id:        claims.ID,
+		FamilyId:  claims.FamilyId,
+		UserId:    claims.UserId,
+		IssuedAt:  claims.IssuedAt.Time,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}
+}
+
+var vaultTypes = map[string]bool{
+	storage.VaultTypeS3Bucket:   true,
+	storage.VaultTypeGCSBucket:  true,
+	storage.VaultTypeSelfHosted: true,
+}
+
+// Create a vault owned by the authenticated user
 func (s *Server) CreateVault(c echo.Context) error {
-	return nil
+	vault := &client.Vault{}
+	if err := json.NewDecoder(c.Request().Body).Decode(vault); err != nil {
+		c.Logger().Warn("Failed to decode vault: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode vault")
+	}
+	vault.Name = strings.TrimSpace(vault.Name)
+	if msg := validateVaultName(vault.Name); msg != "" {
+		return c.String(http.StatusBadRequest, msg)
+	}
+	if !vaultTypes[vault.Type] {
+		return c.String(http.StatusBadRequest, fmt.Sprintf(
+			"Vault type must be one of %s, %s, %s", storage.VaultTypeS3Bucket,
+			storage.VaultTypeGCSBucket, storage.VaultTypeSelfHosted))
+	}
+
+	vault.Bucket = strings.TrimSpace(vault.Bucket)
+	providerType, needsBucket := vaultProviderTypes[vault.Type]
+	if needsBucket && vault.Bucket == "" {
+		return c.String(http.StatusBadRequest, "Bucket is required for "+vault.Type+" vaults")
+	} else if !needsBucket && vault.Bucket != "" {
+		return c.String(http.StatusBadRequest, "Bucket is only allowed for S3_BUCKET and GCS_BUCKET vaults")
+	}
+
+	if grantFromContext(c).VaultId != 0 {
+		return c.String(http.StatusForbidden, "API key is restricted to a single vault")
+	}
+
+	if err := s.requireVerifiedEmail(c); err != nil {
+		return err
+	}
+
+	userId := userIdFromContext(c)
+	if needsBucket {
+		var key *storage.ProviderKey
+		var err error
+		if vault.ProviderKeyId != 0 {
+			key, err = database.GetProviderKey(s.db, userId, vault.ProviderKeyId)
+		} else {
+			key, err = database.GetProviderKeyForUser(s.db, userId, providerType)
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			if vault.ProviderKeyId != 0 {
+				return c.String(http.StatusBadRequest, "Provider key not found")
+			}
+			return c.String(http.StatusBadRequest, "No "+providerType+" provider key configured")
+		} else if err != nil {
+			c.Logger().Error("Unexpected error while checking for provider key: ", err)
+			return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+		}
+		if key.ProviderType != providerType {
+			return c.String(http.StatusBadRequest, "Provider key must be a "+providerType+" key")
+		}
+		// the vault keeps using this key, whatever keys are added later
+		vault.ProviderKeyId = key.Id
+	} else if vault.ProviderKeyId != 0 {
+		return c.String(http.StatusBadRequest, "Provider key is only allowed for S3_BUCKET and GCS_BUCKET vaults")
+	}
+
+	if exists, err := database.VaultNameExists(s.db, userId, vault.Name); err != nil {
+		c.Logger().Error("Unexpected error while checking for vault name: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	} else if exists {
+		return c.String(http.StatusConflict, "Vault name already exists")
+	}
+
+	storageVault := vault.ToStorageModel().(*storage.Vault)
+	storageVault.OwnerId = userId
+	dataKey, masterKeyId, err := s.keyring.GenerateDataKey()
+	if err != nil {
+		c.Logger().Error("Failed to generate vault data key: ", err)
+		return c.String(http.StatusInternalServerError, "Failed to create vault")
+	}
+	storageVault.DataKey, storageVault.MasterKeyId = dataKey, masterKeyId
+	if err := database.InsertVault(s.db, storageVault); err != nil {
+		// lost a race with a concurrent request for the same name
+		if database.IsUniqueViolation(err) {
+			return c.String(http.StatusConflict, "Vault name already exists")
+		}
+		c.Logger().Error("Failed to create vault: ", err)
+		return c.String(http.StatusInternalServerError, "Failed to create vault")
+	}
+	s.audit(c, userId, auditVaultCreated, map[string]string{
+		"vault_id": fmt.Sprint(storageVault.Id), "name": storageVault.Name,
+	})
+
+	return c.JSON(http.StatusCreated, client.VaultFromStorageModel(storageVault))
 }
 
+// How long a user's revocation time is cached; a sign out from every device
+// made through another server takes up to this long to take effect here
+const revocationCacheTtl = 30 * time.Second
+
 func New() *Server {
-	s := &Server{e: echo.New()}
+	s := &Server{e: echo.New(), policy: policy.Default(), storagePurges: make(chan struct{}, 1)}
+	// X-Forwarded-For is only trusted from proxies added with AddTrustedProxies
+	s.e.IPExtractor = echo.ExtractIPDirect()
 	s.e.Use(middleware.Logger())
+	s.revocations = auth.NewRevocationCache(revocationCacheTtl, s.tokensValidAfter)
 	return s
 }
 
+func (s *Server) tokensValidAfter(userId int32) (time.Time, error) {
+	validAfter, err := database.GetTokensValidAfter(s.db, userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// the user has been deleted, so none of their tokens are valid
+		return time.Now().Add(100 * 365 * 24 * time.Hour), nil
+	}
+	return validAfter, err
+}
+
 func (s *Server) AddDatabaseClient(db *pgxpool.Pool) {
 	s.db = db
 }
@@ -128,10 +423,162 @@ func (s *Server) AddTokenFactory(tf *auth.TokenFactory) {
 	s.tf = tf
 }
 
+// The pepper keys the hashes of API keys stored in the database
+func (s *Server) AddAPIKeyPepper(pepper []byte) {
+	s.apiKeys = auth.NewAPIKeyVerifier(pepper, s.lookupAPIKey, s.touchAPIKey)
+}
+
+// Enable passkey sign in for a relying party
+func (s *Server) AddRelyingParty(rp *webauthn.RelyingParty) {
+	s.webauthn = rp
+}
+
+// Enable messages to users, such as password reset tokens
+func (s *Server) AddNotifier(notifier notify.Notifier) {
+	s.notifier = notifier
+}
+
+// Require users to verify an email address before creating vaults
+func (s *Server) RequireVerifiedEmail() {
+	s.verifiedEmailRequired = true
+}
+
+func (s *Server) AddAppURL(appURL string) {
+	s.appURL = strings.TrimSuffix(appURL, "/")
+}
+
+// How long requests to identity providers may take
+const oidcRequestTimeout = 10 * time.Second
+
+// Enable signing in with OpenID Connect providers
+func (s *Server) AddOIDCProviders(configs []*oidc.ProviderConfig) {
+	httpClient := &http.Client{Timeout: oidcRequestTimeout}
+	s.oidcClients = make(map[string]*oidc.Client)
+	for _, config := range configs {
+		provider := oidc.NewClient(config, httpClient)
+		s.oidcProviders = append(s.oidcProviders, provider)
+		s.oidcClients[config.Name] = provider
+	}
+}
+
+func (s *Server) AddKeyring(keyring *crypt.Keyring) {
+	s.keyring = keyring
+}
+
+func (s *Server) AddVaultRoot(root string) {
+	s.vaultRoot = root
+}
+
+func (s *Server) AddUploadDir(dir string) {
+	s.uploadDir = dir
+}
+
+func (s *Server) AddExportDir(dir string) {
+	s.exportDir = dir
+}
+
 func (s *Server) AddHandlers() {
 	s.e.GET("/hello", s.Hello)
-	s.e.POST("/users/create", s.CreateUserWithCredentials)
-	s.e.POST("/users/signin/credentials", s.SignInWithCredentials)
+	s.e.GET("/.well-known/jwks.json", s.GetJWKS)
+	s.e.POST("/users/create", s.CreateUserWithCredentials, s.throttle("create", createUserBucket))
+	s.e.POST("/users/signin/credentials", s.SignInWithCredentials, s.throttle("signin", signInBucket))
 	s.e.POST("/users/signin/refresh", s.RefreshAccessToken)
-	s.e.POST("/vaults/create", s.CreateVault, auth.AuthMiddleware(s.tf))
+	s.e.POST("/users/signin/mfa", s.VerifyMFA)
+	s.e.POST("/users/signout", s.SignOut)
+	s.e.POST("/users/signout/all", s.SignOutAll,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.POST("/users/password", s.ChangePassword,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.POST("/vaults/create", s.CreateVault,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeWrite))
+	s.e.GET("/vaults", s.ListVaults,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeRead))
+	s.e.GET("/vaults/:id", s.GetVault,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeRead))
+	s.e.PATCH("/vaults/:id", s.RenameVault,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeWrite))
+	s.e.DELETE("/vaults/:id", s.DeleteVault,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeWrite))
+	s.e.GET("/vaults/:id/objects", s.ListObjects,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeRead))
+	s.e.PUT("/vaults/:id/objects/*", s.PutObject,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeWrite))
+	s.e.GET("/vaults/:id/objects/*", s.GetObject,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeRead))
+	s.e.HEAD("/vaults/:id/objects/*", s.HeadObject,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeRead))
+	s.e.DELETE("/vaults/:id/objects/*", s.DeleteObject,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeWrite))
+	s.e.OPTIONS("/vaults/:id/uploads", s.TusOptions)
+	s.e.POST("/vaults/:id/uploads", s.CreateUpload,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeWrite))
+	s.e.HEAD("/vaults/:id/uploads/:upload_id", s.HeadUpload,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeWrite))
+	s.e.PATCH("/vaults/:id/uploads/:upload_id", s.PatchUpload,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeWrite))
+	s.e.DELETE("/vaults/:id/uploads/:upload_id", s.DeleteUpload,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeWrite))
+	s.e.POST("/providers/keys", s.CreateProviderKey,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.GET("/providers/keys", s.ListProviderKeys,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.POST("/users/api-keys", s.CreateAPIKey,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.GET("/users/api-keys", s.ListAPIKeys,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.PATCH("/users/api-keys/:id", s.RenameAPIKey,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.DELETE("/users/api-keys/:id", s.DeleteAPIKey,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.POST("/users/mfa/totp", s.EnrollTOTP,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.POST("/users/mfa/totp/confirm", s.ConfirmTOTP,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.DELETE("/users/mfa/totp", s.DisableTOTP,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+
+	s.e.GET("/users/me", s.GetCurrentUser,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.DELETE("/users/me", s.DeleteAccount,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.GET("/users/me/export", s.ExportAccount,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	s.e.DELETE("/users/email", s.DeleteEmail,
+		auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+
+	if s.notifier != nil {
+		s.e.POST("/users/password/reset", s.RequestPasswordReset)
+		s.e.POST("/users/password/reset/confirm", s.ResetPassword)
+		s.e.POST("/users/email/verify", s.VerifyEmail)
+		s.e.PUT("/users/email", s.SetEmail,
+			auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+		s.e.POST("/users/email/verify/resend", s.ResendEmailVerification,
+			auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	}
+	if s.webauthn != nil {
+		s.e.POST("/users/signin/passkey/begin", s.BeginPasskeySignIn)
+		s.e.POST("/users/signin/passkey/finish", s.FinishPasskeySignIn)
+		s.e.POST("/users/passkeys/register/begin", s.BeginPasskeyRegistration,
+			auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+		s.e.POST("/users/passkeys/register/finish", s.FinishPasskeyRegistration,
+			auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+		s.e.GET("/users/passkeys", s.ListPasskeys,
+			auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+		s.e.DELETE("/users/passkeys/:id", s.DeletePasskey,
+			auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	}
+
+	if len(s.oidcProviders) > 0 {
+		s.e.GET("/users/signin/oidc", s.ListOIDCProviders)
+		s.e.POST("/users/signin/oidc/:provider/begin", s.BeginOIDCSignIn)
+		s.e.POST("/users/signin/oidc/:provider/finish", s.FinishOIDCSignIn)
+		s.e.POST("/users/identities/:provider/begin", s.BeginOIDCLink,
+			auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+		s.e.POST("/users/identities/:provider/finish", s.FinishOIDCLink,
+			auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+		s.e.GET("/users/identities", s.ListIdentities,
+			auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+		s.e.DELETE("/users/identities/:id", s.DeleteIdentity,
+			auth.AuthMiddleware(s.tf, s.revocations, s.apiKeys), auth.RequireScope(auth.ScopeAccount))
+	}
 }
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/ratelimit"
+	"github.com/raian621/dump/util"
+)
+
+var (
+	// sign in attempts per client IP: a burst of 10, then one every 6 seconds
+	signInBucket = ratelimit.NewTokenBucket(10, 6*time.Second)
+	// accounts created per client IP: a burst of 5, then one every 12 minutes
+	createUserBucket = ratelimit.NewTokenBucket(5, 12*time.Minute)
+	// consecutive failed sign ins lock a login name out for 30 seconds after
+	// the 5th, doubling with each further failure up to an hour
+	loginBackoff = ratelimit.Backoff{Threshold: 5, Base: 30 * time.Second, Max: time.Hour}
+)
+
+const (
+	// Failed sign ins older than this no longer count towards a lockout
+	loginFailureResetAfter = 24 * time.Hour
+	// Longest login name failed sign ins are counted against as given, which
+	// is as long as the database stores
+	maxLoginNameLength = 500
+)
+
+// Hash to check passwords against when signing in as someone who doesn't
+// exist, so that it takes as long as signing in as someone who does
+var dummyPasshash = sync.OnceValue(func() string { return util.HashPassword("") })
+
+// Limit how often each client IP can make requests to a route
+func (s *Server) throttle(name string, bucket ratelimit.TokenBucket) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := name + ":" + clientKey(c.RealIP())
+			ok, wait, err := database.TakeRateLimitToken(s.db, key, bucket)
+			if err != nil {
+				c.Logger().Error("Failed to take rate limit token: ", err)
+				return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+			}
+			if !ok {
+				return tooManyRequests(c, wait)
+			}
+			if err := database.DeleteStaleRateLimits(s.db, time.Now().Add(-bucket.RefillTime())); err != nil {
+				c.Logger().Error("Failed to delete stale rate limits: ", err)
+			}
+			return next(c)
+		}
+	}
+}
+
+// The key a client is throttled by: its IP, or for IPv6, its /64 network,
+// since a single host is typically handed a whole one
+func clientKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	} else if v4 := parsed.To4(); v4 != nil {
+		return v4.String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// The name failed sign ins are counted against: the username when it belongs
+// to a user, otherwise whatever was given, hashed if it's too long to store
+func loginName(username, given string) string {
+	if username != "" {
+		return username
+	}
+	login := strings.ToLower(given)
+	if len(login) > maxLoginNameLength {
+		sum := sha256.Sum256([]byte(login))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return login
+}
+
+// Refuse to check a password for a login name that's locked out
+func (s *Server) checkLoginLockout(c echo.Context, login string) error {
+	lockedUntil, err := database.GetLoginLockout(s.db, login)
+	if err != nil {
+		c.Logger().Error("Failed to get login lockout: ", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if wait := time.Until(lockedUntil); wait > 0 {
+		return tooManyRequests(c, wait)
+	}
+	return nil
+}
+
+// Count a failed sign in against a login name
+func (s *Server) recordLoginFailure(c echo.Context, login string) {
+	failures, lockout, err := database.RecordLoginFailure(s.db, login, loginBackoff, loginFailureResetAfter)
+	if err != nil {
+		c.Logger().Error("Failed to record login failure: ", err)
+		return
+	}
+	if lockout > 0 {
+		c.Logger().Warnf("Locked out %q for %s after %d failed sign ins", login, lockout, failures)
+	}
+	if err := database.DeleteStaleLoginFailures(s.db, time.Now().Add(-loginFailureResetAfter)); err != nil {
+		c.Logger().Error("Failed to delete stale login failures: ", err)
+	}
+}
+
+// The error refusing a request that's over a limit, telling the client how
+// long to wait
+func tooManyRequests(c echo.Context, wait time.Duration) error {
+	c.Response().Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	return echo.NewHTTPError(http.StatusTooManyRequests, "Too many attempts, try again later")
+}
+
+// Trust the X-Forwarded-For header of requests from the given networks to
+// tell the client IP. Otherwise the IP requests come from is used.
+func (s *Server) AddTrustedProxies(networks []*net.IPNet) {
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false),
+	}
+	for _, network := range networks {
+		options = append(options, echo.TrustIPRange(network))
+	}
+	s.e.IPExtractor = echo.ExtractIPFromXFFHeader(options...)
+}
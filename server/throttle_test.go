@@ -0,0 +1,25 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientKey(t *testing.T) {
+	assert.Equal(t, "203.0.113.7", clientKey("203.0.113.7"))
+	assert.Equal(t, "2001:db8:1:2::/64", clientKey("2001:db8:1:2:aaaa:bbbb:cccc:dddd"))
+	assert.Equal(t, clientKey("2001:db8:1:2::1"), clientKey("2001:db8:1:2:ffff::1"))
+	assert.NotEqual(t, clientKey("2001:db8:1:2::1"), clientKey("2001:db8:1:3::1"))
+	assert.Equal(t, "203.0.113.7", clientKey("::ffff:203.0.113.7"))
+}
+
+func TestLoginName(t *testing.T) {
+	assert.Equal(t, "Alice", loginName("Alice", "alice@example.com"))
+	assert.Equal(t, "nobody@example.com", loginName("", "Nobody@Example.com"))
+
+	long := loginName("", strings.Repeat("a", maxLoginNameLength+1))
+	assert.LessOrEqual(t, len(long), maxLoginNameLength)
+	assert.Equal(t, long, loginName("", strings.Repeat("A", maxLoginNameLength+1)))
+}
@@ -0,0 +1,436 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/storage"
+	"github.com/raian621/dump/util"
+)
+
+// Resumable uploads following the tus 1.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, expiration, termination and checksum extensions. Upload
+// state lives in the uploads table and the bytes received so far are staged
+// in the server's upload directory until the upload is complete, at which
+// point the object is written to the vault's storage backend.
+
+const (
+	tusVersion        = "1.0.0"
+	tusExtensions     = "creation,expiration,termination,checksum"
+	tusMaxSize        = 1 << 40 // 1 TiB
+	tusUploadLifetime = 24 * time.Hour
+	tusContentType    = "application/offset+octet-stream"
+
+	// Returned when the Upload-Checksum of a PATCH doesn't match its body
+	statusChecksumMismatch = 460
+)
+
+var tusChecksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// Serializes PATCH requests to the same upload within this process
+type uploadLocks struct {
+	locks sync.Map // upload ID -> *sync.Mutex
+}
+
+func (l *uploadLocks) tryLock(uploadId string) (unlock func(), ok bool) {
+	lock, _ := l.locks.LoadOrStore(uploadId, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+// Drop the lock of an upload that has finished or been deleted
+func (l *uploadLocks) forget(uploadId string) {
+	l.locks.Delete(uploadId)
+}
+
+// Advertise the protocol version and extensions the server supports
+func (s *Server) TusOptions(c echo.Context) error {
+	header := c.Response().Header()
+	header.Set("Tus-Resumable", tusVersion)
+	header.Set("Tus-Version", tusVersion)
+	header.Set("Tus-Extension", tusExtensions)
+	header.Set("Tus-Max-Size", strconv.FormatInt(tusMaxSize, 10))
+	header.Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Start an upload. The object key is taken from the `key` (or `filename`)
+// entry of Upload-Metadata and the content type from `content_type` (or
+// `filetype`); every other entry is stored as object metadata.
+func (s *Server) CreateUpload(c echo.Context) error {
+	if err := checkTusResumable(c); err != nil {
+		return err
+	}
+	vault, err := s.ownedVault(c)
+	if err != nil {
+		return err
+	}
+
+	req := c.Request()
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return c.String(http.StatusBadRequest, "Upload-Length must be a non-negative integer")
+	}
+	if length > tusMaxSize {
+		return c.String(http.StatusRequestEntityTooLarge, "Upload exceeds Tus-Max-Size")
+	}
+	metadata, err := parseUploadMetadata(req.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid Upload-Metadata")
+	}
+
+	upload := &storage.Upload{
+		Id:          util.GenerateRandomId(),
+		VaultId:     vault.Id,
+		Key:         popMetadata(metadata, "key", "filename"),
+		ContentType: popMetadata(metadata, "content_type", "filetype"),
+		Metadata:    metadata,
+		Length:      length,
+		ExpiresAt:   time.Now().Add(tusUploadLifetime),
+	}
+	if err := validateObjectKey(upload.Key); err != nil {
+		return c.String(http.StatusBadRequest, "Upload-Metadata must include a valid object key")
+	}
+	if upload.ContentType, err = objectContentType(upload.ContentType); err != nil {
+		return err
+	}
+
+	s.removeExpiredUploads(c)
+	if err := os.MkdirAll(s.uploadDir, 0o700); err != nil {
+		c.Logger().Error("Failed to create upload directory: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	f, err := os.OpenFile(s.uploadPath(upload.Id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		c.Logger().Error("Failed to create upload staging file: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	f.Close()
+	if err := database.InsertUpload(s.db, upload); err != nil {
+		os.Remove(s.uploadPath(upload.Id))
+		c.Logger().Error("Failed to create upload: ", err)
+		return c.String(http.StatusInternalServerError, "Failed to create upload")
+	}
+	// clients send no PATCH for an empty upload, so it's complete already
+	if upload.Length == 0 {
+		if err := s.finishUpload(c, upload); err != nil {
+			if dbErr := database.DeleteUpload(s.db, upload.Id); dbErr != nil {
+				c.Logger().Error("Failed to delete upload: ", dbErr)
+			}
+			os.Remove(s.uploadPath(upload.Id))
+			return err
+		}
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderLocation, fmt.Sprintf("/vaults/%d/uploads/%s", vault.Id, upload.Id))
+	header.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.NoContent(http.StatusCreated)
+}
+
+// Report how much of an upload the server has received
+func (s *Server) HeadUpload(c echo.Context) error {
+	if err := checkTusResumable(c); err != nil {
+		return err
+	}
+	upload, err := s.ownedUpload(c)
+	if err != nil {
+		return err
+	}
+
+	header := c.Response().Header()
+	header.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	header.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	header.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	header.Set(echo.HeaderCacheControl, "no-store")
+	return c.NoContent(http.StatusOK)
+}
+
+// Append the request body to an upload. Bytes received before a dropped
+// connection are kept so the client can resume from them, unless the request
+// carried an Upload-Checksum, in which case the whole request is discarded.
+func (s *Server) PatchUpload(c echo.Context) error {
+	if err := checkTusResumable(c); err != nil {
+		return err
+	}
+	req := c.Request()
+	if req.Header.Get(echo.HeaderContentType) != tusContentType {
+		return c.String(http.StatusUnsupportedMediaType, "Content-Type must be "+tusContentType)
+	}
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return c.String(http.StatusBadRequest, "Upload-Offset must be a non-negative integer")
+	}
+	var (
+		checksum     []byte
+		checksumHash hash.Hash
+	)
+	if header := req.Header.Get("Upload-Checksum"); header != "" {
+		algorithm, encoded, _ := strings.Cut(header, " ")
+		newHash, ok := tusChecksumAlgorithms[algorithm]
+		if !ok {
+			return c.String(http.StatusBadRequest, "Unsupported checksum algorithm")
+		}
+		if checksum, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return c.String(http.StatusBadRequest, "Invalid Upload-Checksum")
+		}
+		checksumHash = newHash()
+	}
+
+	upload, err := s.ownedUpload(c)
+	if err != nil {
+		return err
+	}
+	unlock, ok := s.uploadLocks.tryLock(upload.Id)
+	if !ok {
+		return c.String(http.StatusLocked, "Upload is being written by another request")
+	}
+	defer unlock()
+	// re-read the offset now that no other request can change it
+	if upload, err = s.ownedUpload(c); err != nil {
+		return err
+	}
+	if offset != upload.Offset {
+		return c.String(http.StatusConflict, "Upload-Offset does not match the upload's offset")
+	}
+	if req.ContentLength > upload.Length-upload.Offset {
+		return c.String(http.StatusBadRequest, "Request body exceeds the upload's length")
+	}
+
+	if upload.Offset < upload.Length {
+		written, err := s.appendToUpload(upload, req.Body, checksumHash)
+		if checksumHash != nil && err == nil && !bytes.Equal(checksumHash.Sum(nil), checksum) {
+			err = errChecksumMismatch
+		}
+		if (checksumHash != nil && err != nil) || errors.Is(err, errUploadTooLong) {
+			// the data can't be trusted without a verified checksum, nor
+			// when the client sent more than it said it would
+			if truncErr := os.Truncate(s.uploadPath(upload.Id), upload.Offset); truncErr != nil {
+				c.Logger().Error("Failed to discard upload data: ", truncErr)
+			}
+			written = 0
+		}
+		if written > 0 {
+			upload.Offset += written
+			if dbErr := database.UpdateUploadOffset(s.db, upload.Id, upload.Offset); dbErr != nil {
+				c.Logger().Error("Failed to update upload offset: ", dbErr)
+				return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+			}
+		}
+		if errors.Is(err, errChecksumMismatch) {
+			return c.String(statusChecksumMismatch, "Checksum mismatch")
+		} else if errors.Is(err, errUploadTooLong) {
+			return c.String(http.StatusBadRequest, "Request body exceeds the upload's length")
+		} else if err != nil {
+			c.Logger().Warn("Upload interrupted: ", err)
+			return c.String(http.StatusBadRequest, "Failed to read upload data")
+		}
+	}
+
+	// a failed finalization is retried by the client's next PATCH
+	if upload.Offset == upload.Length {
+		if err := s.finishUpload(c, upload); err != nil {
+			return err
+		}
+	}
+
+	c.Response().Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Response().Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.NoContent(http.StatusNoContent)
+}
+
+var (
+	errChecksumMismatch = errors.New("upload checksum mismatch")
+	errUploadTooLong    = errors.New("upload data exceeds its length")
+)
+
+// Append r to the upload's staged data, up to the upload's length, returning
+// errUploadTooLong if r holds more. Returns the number of bytes durably
+// written, even when an error occurs.
+func (s *Server) appendToUpload(upload *storage.Upload, r io.Reader, checksumHash hash.Hash) (int64, error) {
+	f, err := os.OpenFile(s.uploadPath(upload.Id), os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var w io.Writer = f
+	if checksumHash != nil {
+		w = io.MultiWriter(f, checksumHash)
+	}
+	written, copyErr := io.Copy(w, io.LimitReader(r, upload.Length-upload.Offset))
+	if copyErr == nil {
+		if n, _ := io.ReadFull(r, make([]byte, 1)); n > 0 {
+			copyErr = errUploadTooLong
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return written, copyErr
+}
+
+// Move a complete upload into the vault's storage backend. Errors are
+// returned as *echo.HTTPError.
+func (s *Server) finishUpload(c echo.Context, upload *storage.Upload) error {
+	vault, backend, err := s.vaultBackend(c)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(s.uploadPath(upload.Id))
+	if err != nil {
+		c.Logger().Error("Failed to open upload staging file: ", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	defer f.Close()
+
+	_, err = s.storeObject(c, vault, backend, &storage.Object{
+		Key:         upload.Key,
+		ContentType: upload.ContentType,
+		Metadata:    upload.Metadata,
+	}, f, upload.Length)
+	if err != nil {
+		return objectError(c, vault, err)
+	}
+
+	if err := database.DeleteUpload(s.db, upload.Id); err != nil {
+		c.Logger().Error("Failed to delete finished upload: ", err)
+	}
+	os.Remove(s.uploadPath(upload.Id))
+	s.uploadLocks.forget(upload.Id)
+	return nil
+}
+
+// Abandon an upload and discard the data received so far
+func (s *Server) DeleteUpload(c echo.Context) error {
+	if err := checkTusResumable(c); err != nil {
+		return err
+	}
+	upload, err := s.ownedUpload(c)
+	if err != nil {
+		return err
+	}
+	unlock, ok := s.uploadLocks.tryLock(upload.Id)
+	if !ok {
+		return c.String(http.StatusLocked, "Upload is being written by another request")
+	}
+	defer unlock()
+
+	if err := database.DeleteUpload(s.db, upload.Id); err != nil {
+		c.Logger().Error("Failed to delete upload: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	os.Remove(s.uploadPath(upload.Id))
+	s.uploadLocks.forget(upload.Id)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Load the upload named in the path, which must be into one of the
+// authenticated user's vaults and not have expired
+func (s *Server) ownedUpload(c echo.Context) (*storage.Upload, error) {
+	vaultId, err := vaultIdParam(c)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid vault ID")
+	}
+	if !grantFromContext(c).AllowsVault(vaultId) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Upload not found")
+	}
+	upload, err := database.GetUploadForOwner(s.db, userIdFromContext(c), vaultId, c.Param("upload_id"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Upload not found")
+	} else if err != nil {
+		c.Logger().Error("Failed to get upload: ", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		return nil, echo.NewHTTPError(http.StatusGone, "Upload expired")
+	}
+	return upload, nil
+}
+
+// Sweep expired uploads and their staged data
+func (s *Server) removeExpiredUploads(c echo.Context) {
+	ids, err := database.DeleteExpiredUploads(s.db)
+	if err != nil {
+		c.Logger().Error("Failed to delete expired uploads: ", err)
+		return
+	}
+	for _, id := range ids {
+		os.Remove(s.uploadPath(id))
+		s.uploadLocks.forget(id)
+	}
+}
+
+func (s *Server) uploadPath(uploadId string) string {
+	return filepath.Join(s.uploadDir, uploadId)
+}
+
+// Every tus request except OPTIONS must name the protocol version it speaks,
+// and every response names the version the server speaks
+func checkTusResumable(c echo.Context) error {
+	c.Response().Header().Set("Tus-Resumable", tusVersion)
+	if c.Request().Header.Get("Tus-Resumable") != tusVersion {
+		c.Response().Header().Set("Tus-Version", tusVersion)
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "Unsupported tus version")
+	}
+	return nil
+}
+
+// Parse an Upload-Metadata header: comma separated pairs of a key and an
+// optional base64 encoded value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// Remove and return the value of the first of keys present in metadata
+func popMetadata(metadata map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if value, ok := metadata[key]; ok {
+			delete(metadata, key)
+			return value
+		}
+	}
+	return ""
+}
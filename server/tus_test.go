@@ -0,0 +1,50 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/raian621/dump/models/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUploadMetadata(t *testing.T) {
+	metadata, err := parseUploadMetadata("filename ZHVtcHMvZGIuc3Fs, filetype YXBwbGljYXRpb24vc3Fs,is_confidential")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"filename":        "dumps/db.sql",
+		"filetype":        "application/sql",
+		"is_confidential": "",
+	}, metadata)
+
+	assert.Equal(t, "dumps/db.sql", popMetadata(metadata, "key", "filename"))
+	assert.NotContains(t, metadata, "filename")
+
+	metadata, err = parseUploadMetadata("")
+	assert.NoError(t, err)
+	assert.Empty(t, metadata)
+}
+
+func TestParseUploadMetadataRejectsMalformedValues(t *testing.T) {
+	for _, header := range []string{"filename not-base64!", " , ", "a YQ==,,b Yg=="} {
+		_, err := parseUploadMetadata(header)
+		assert.Error(t, err, header)
+	}
+}
+
+func TestAppendToUploadRejectsExcessData(t *testing.T) {
+	s := New()
+	s.AddUploadDir(t.TempDir())
+	upload := &storage.Upload{Id: "upload", Length: 4, Offset: 1}
+	require.NoError(t, os.WriteFile(s.uploadPath(upload.Id), []byte("a"), 0o600))
+
+	written, err := s.appendToUpload(upload, strings.NewReader("bcd"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), written)
+
+	upload.Offset = 1
+	_, err = s.appendToUpload(upload, strings.NewReader("bcde"), nil)
+	assert.ErrorIs(t, err, errUploadTooLong)
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/raian621/dump/auth"
+	"github.com/raian621/dump/database"
+	"github.com/raian621/dump/models/client"
+	"github.com/raian621/dump/models/storage"
+)
+
+const (
+	maxVaultNameLength = 200
+	defaultVaultLimit  = 50
+	maxVaultLimit      = 100
+)
+
+// Provider whose credentials are used to reach each vault type's bucket
+var vaultProviderTypes = map[string]string{
+	storage.VaultTypeS3Bucket:  storage.ProviderTypeAWS,
+	storage.VaultTypeGCSBucket: storage.ProviderTypeGCP,
+}
+
+// List the authenticated user's vaults, paginated with `limit` and `offset`
+func (s *Server) ListVaults(c echo.Context) error {
+	limit, err := queryInt(c, "limit", defaultVaultLimit)
+	if err != nil || limit < 1 || limit > maxVaultLimit {
+		return c.String(http.StatusBadRequest,
+			fmt.Sprintf("limit must be between 1 and %d", maxVaultLimit))
+	}
+	offset, err := queryInt(c, "offset", 0)
+	if err != nil || offset < 0 {
+		return c.String(http.StatusBadRequest, "offset must be a non-negative integer")
+	}
+
+	userId := userIdFromContext(c)
+	if restricted := grantFromContext(c).VaultId; restricted != 0 {
+		return s.listRestrictedVault(c, userId, restricted, limit, offset)
+	}
+	vaults, err := database.ListVaultsForOwner(s.db, userId, limit, offset)
+	if err != nil {
+		c.Logger().Error("Failed to list vaults: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	total, err := database.CountVaultsForOwner(s.db, userId)
+	if err != nil {
+		c.Logger().Error("Failed to count vaults: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	list := client.VaultList{
+		Vaults: make([]*client.Vault, 0, len(vaults)),
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+	}
+	for _, vault := range vaults {
+		list.Vaults = append(list.Vaults, client.VaultFromStorageModel(vault))
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+// List the only vault an API key restricted to one vault can see
+func (s *Server) listRestrictedVault(c echo.Context, userId, vaultId int32, limit, offset int) error {
+	list := client.VaultList{Vaults: make([]*client.Vault, 0, 1), Limit: limit, Offset: offset}
+	vault, err := database.GetVaultForOwner(s.db, userId, vaultId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusOK, list)
+	} else if err != nil {
+		c.Logger().Error("Failed to get vault: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	list.Total = 1
+	if offset == 0 {
+		list.Vaults = append(list.Vaults, client.VaultFromStorageModel(vault))
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func (s *Server) GetVault(c echo.Context) error {
+	vaultId, err := vaultIdParam(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid vault ID")
+	}
+	if !grantFromContext(c).AllowsVault(vaultId) {
+		return c.String(http.StatusNotFound, "Vault not found")
+	}
+
+	vault, err := database.GetVaultForOwner(s.db, userIdFromContext(c), vaultId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusNotFound, "Vault not found")
+	} else if err != nil {
+		c.Logger().Error("Failed to get vault: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	stats, err := database.GetVaultStats(s.db, vault.Id)
+	if err != nil {
+		c.Logger().Error("Failed to get vault stats: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	response := client.VaultFromStorageModel(vault)
+	response.Stats = client.VaultStatsFromStorageModel(stats)
+	return c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) RenameVault(c echo.Context) error {
+	vaultId, err := vaultIdParam(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid vault ID")
+	}
+	if !grantFromContext(c).AllowsVault(vaultId) {
+		return c.String(http.StatusNotFound, "Vault not found")
+	}
+	rename := &client.VaultRename{}
+	if err := json.NewDecoder(c.Request().Body).Decode(rename); err != nil {
+		c.Logger().Warn("Failed to decode vault rename: ", err)
+		return c.String(http.StatusBadRequest, "Failed to decode vault rename")
+	}
+	rename.Name = strings.TrimSpace(rename.Name)
+	if msg := validateVaultName(rename.Name); msg != "" {
+		return c.String(http.StatusBadRequest, msg)
+	}
+
+	vault, err := database.RenameVault(s.db, userIdFromContext(c), vaultId, rename.Name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusNotFound, "Vault not found")
+	} else if database.IsUniqueViolation(err) {
+		return c.String(http.StatusConflict, "Vault name already exists")
+	} else if err != nil {
+		c.Logger().Error("Failed to rename vault: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	stats, err := database.GetVaultStats(s.db, vault.Id)
+	if err != nil {
+		c.Logger().Error("Failed to get vault stats: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+
+	response := client.VaultFromStorageModel(vault)
+	response.Stats = client.VaultStatsFromStorageModel(stats)
+	return c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) DeleteVault(c echo.Context) error {
+	vaultId, err := vaultIdParam(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid vault ID")
+	}
+	if !grantFromContext(c).AllowsVault(vaultId) {
+		return c.String(http.StatusNotFound, "Vault not found")
+	}
+
+	userId := userIdFromContext(c)
+	uploadIds, err := database.DeleteVault(s.db, userId, vaultId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.String(http.StatusNotFound, "Vault not found")
+	} else if err != nil {
+		c.Logger().Error("Failed to delete vault: ", err)
+		return c.String(http.StatusInternalServerError, "Unexpected error occurred")
+	}
+	s.audit(c, userId, auditVaultDeleted, map[string]string{"vault_id": c.Param("id")})
+	for _, id := range uploadIds {
+		os.Remove(s.uploadPath(id))
+		s.uploadLocks.forget(id)
+	}
+	// the vault's objects are deleted from its backend in the background
+	s.wakeStoragePurger()
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Returns a message describing why the vault name is invalid, or an empty
+// string if it is valid
+func validateVaultName(name string) string {
+	if name == "" {
+		return "Vault name is required"
+	}
+	if utf8.RuneCountInString(name) > maxVaultNameLength {
+		return fmt.Sprintf("Vault name must be at most %d characters", maxVaultNameLength)
+	}
+	return ""
+}
+
+func vaultIdParam(c echo.Context) (int32, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	return int32(id), err
+}
+
+// Parse an integer query parameter, falling back to defaultVal when absent
+func queryInt(c echo.Context, name string, defaultVal int) (int, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return defaultVal, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// Get the ID of the user authenticated by auth.AuthMiddleware
+func userIdFromContext(c echo.Context) int32 {
+	return c.Get("user_id").(int32)
+}
+
+// Get what auth.AuthMiddleware granted the request
+func grantFromContext(c echo.Context) *auth.Grant {
+	return c.Get("grant").(*auth.Grant)
+}
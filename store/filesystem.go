@@ -0,0 +1,237 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Stores objects as files under a root directory, one subtree per vault:
+//
+//	<root>/vaults/<vault id>/<key>
+//	<root>/tmp/ (partially written objects)
+//
+// Objects are written to the temporary directory first and renamed into place
+// once complete, so readers never observe a partially written object.
+type FilesystemBackend struct {
+	dir    string // directory holding this vault's objects
+	tmpDir string
+}
+
+var _ Backend = (*FilesystemBackend)(nil)
+
+func NewFilesystemBackend(root string, vaultId int32) (*FilesystemBackend, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	b := &FilesystemBackend{
+		dir:    filepath.Join(root, "vaults", strconv.Itoa(int(vaultId))),
+		tmpDir: filepath.Join(root, "tmp"),
+	}
+	if err := os.MkdirAll(b.dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(b.tmpDir, 0o700); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *FilesystemBackend) Put(ctx context.Context, key string, r io.Reader, size int64) (*ObjectInfo, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(b.tmpDir, "put-*")
+	if err != nil {
+		return nil, err
+	}
+	// removing the temporary file fails harmlessly once it has been renamed
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, &contextReader{ctx, r})
+	if err == nil && size >= 0 && written != size {
+		err = ErrSizeMismatch
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, conflictError(err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, conflictError(err)
+	}
+	return b.Stat(ctx, key)
+}
+
+func (b *FilesystemBackend) Get(ctx context.Context, key string, rng *Range) (io.ReadCloser, *ObjectInfo, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, notFoundError(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if stat.IsDir() {
+		f.Close()
+		return nil, nil, ErrNotFound
+	}
+	info := fileInfo(key, stat)
+	if rng == nil {
+		return f, info, nil
+	}
+
+	if rng.Offset < 0 || rng.Offset > info.Size {
+		f.Close()
+		return nil, nil, ErrInvalidRange
+	}
+	if _, err := f.Seek(rng.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	length := info.Size - rng.Offset
+	if rng.Length >= 0 && rng.Length < length {
+		length = rng.Length
+	}
+	return &limitedReadCloser{io.LimitReader(f, length), f}, info, nil
+}
+
+func (b *FilesystemBackend) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, notFoundError(err)
+	}
+	if stat.IsDir() {
+		return nil, ErrNotFound
+	}
+	return fileInfo(key, stat), nil
+}
+
+func (b *FilesystemBackend) Delete(ctx context.Context, key string) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if stat, err := os.Stat(path); err != nil {
+		return notFoundError(err)
+	} else if stat.IsDir() {
+		return ErrNotFound
+	}
+	if err := os.Remove(path); err != nil {
+		return notFoundError(err)
+	}
+
+	// prune directories left empty by the removal, stopping at the vault root
+	for dir := filepath.Dir(path); dir != b.dir; dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *FilesystemBackend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	err := filepath.WalkDir(b.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(b.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, *fileInfo(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Resolve key to a path inside this vault's directory
+func (b *FilesystemBackend) path(key string) (string, error) {
+	if err := ValidateKey(key); err != nil {
+		return "", err
+	}
+	path := filepath.Join(b.dir, filepath.FromSlash(key))
+	// ValidateKey already rejects ".." segments; this guards against anything
+	// it might miss on an unusual platform.
+	if !strings.HasPrefix(path, b.dir+string(filepath.Separator)) {
+		return "", ErrInvalidKey
+	}
+	return path, nil
+}
+
+func fileInfo(key string, stat fs.FileInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ETag:         fmt.Sprintf("%x-%x", stat.ModTime().UnixNano(), stat.Size()),
+		LastModified: stat.ModTime(),
+	}
+}
+
+func notFoundError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// A key can't be both an object and a "directory" of other objects
+func conflictError(err error) error {
+	if errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.EEXIST) || errors.Is(err, syscall.EISDIR) {
+		return ErrKeyConflict
+	}
+	return err
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFilesystemBackend(t *testing.T, root string, vaultId int32) *FilesystemBackend {
+	b, err := NewFilesystemBackend(root, vaultId)
+	require.NoError(t, err)
+	return b
+}
+
+func readObject(t *testing.T, b Backend, key string, rng *Range) string {
+	r, _, err := b.Get(context.Background(), key, rng)
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestFilesystemPutGet(t *testing.T) {
+	ctx := context.Background()
+	b := newTestFilesystemBackend(t, t.TempDir(), 1)
+	info, err := b.Put(ctx, "dumps/2024-01-01.sql", strings.NewReader("hello world"), 11)
+	require.NoError(t, err)
+	assert.Equal(t, "dumps/2024-01-01.sql", info.Key)
+	assert.Equal(t, int64(11), info.Size)
+	assert.NotEmpty(t, info.ETag)
+
+	assert.Equal(t, "hello world", readObject(t, b, "dumps/2024-01-01.sql", nil))
+	assert.Equal(t, "world", readObject(t, b, "dumps/2024-01-01.sql", &Range{Offset: 6, Length: -1}))
+	assert.Equal(t, "lo w", readObject(t, b, "dumps/2024-01-01.sql", &Range{Offset: 3, Length: 4}))
+
+	_, _, err = b.Get(ctx, "dumps/2024-01-01.sql", &Range{Offset: 12, Length: 1})
+	assert.ErrorIs(t, err, ErrInvalidRange)
+}
+
+func TestFilesystemPutReplacesObject(t *testing.T) {
+	ctx := context.Background()
+	b := newTestFilesystemBackend(t, t.TempDir(), 1)
+	_, err := b.Put(ctx, "a", strings.NewReader("first"), -1)
+	require.NoError(t, err)
+	_, err = b.Put(ctx, "a", strings.NewReader("second"), -1)
+	require.NoError(t, err)
+	assert.Equal(t, "second", readObject(t, b, "a", nil))
+}
+
+func TestFilesystemPutSizeMismatch(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	b := newTestFilesystemBackend(t, root, 1)
+	_, err := b.Put(ctx, "a", strings.NewReader("short"), 100)
+	assert.ErrorIs(t, err, ErrSizeMismatch)
+	_, err = b.Stat(ctx, "a")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// the partially written object must not be left behind
+	entries, err := os.ReadDir(filepath.Join(root, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestFilesystemRejectsInvalidKeys(t *testing.T) {
+	ctx := context.Background()
+	b := newTestFilesystemBackend(t, t.TempDir(), 1)
+	for _, key := range []string{
+		"", "../escape", "a/../../escape", "/absolute", "a//b", "a/./b", "trailing/",
+		"back\\slash", "nul\x00", strings.Repeat("k", MaxKeyLength+1),
+	} {
+		_, err := b.Put(ctx, key, strings.NewReader("data"), -1)
+		assert.ErrorIs(t, err, ErrInvalidKey, "key %q", key)
+		_, _, err = b.Get(ctx, key, nil)
+		assert.ErrorIs(t, err, ErrInvalidKey, "key %q", key)
+	}
+}
+
+func TestFilesystemVaultsAreIsolated(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	b1 := newTestFilesystemBackend(t, root, 1)
+	b2 := newTestFilesystemBackend(t, root, 2)
+	_, err := b1.Put(ctx, "secret", strings.NewReader("data"), -1)
+	require.NoError(t, err)
+
+	_, err = b2.Stat(ctx, "secret")
+	assert.ErrorIs(t, err, ErrNotFound)
+	objects, err := b2.List(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+func TestFilesystemKeyConflict(t *testing.T) {
+	ctx := context.Background()
+	b := newTestFilesystemBackend(t, t.TempDir(), 1)
+	_, err := b.Put(ctx, "a", strings.NewReader("data"), -1)
+	require.NoError(t, err)
+	_, err = b.Put(ctx, "a/b", strings.NewReader("data"), -1)
+	assert.ErrorIs(t, err, ErrKeyConflict)
+}
+
+func TestFilesystemListAndDelete(t *testing.T) {
+	ctx := context.Background()
+	b := newTestFilesystemBackend(t, t.TempDir(), 1)
+	for _, key := range []string{"logs/b", "logs/a", "dumps/x/y", "logs-old"} {
+		_, err := b.Put(ctx, key, bytes.NewReader([]byte(key)), int64(len(key)))
+		require.NoError(t, err)
+	}
+
+	objects, err := b.List(ctx, "logs")
+	require.NoError(t, err)
+	keys := make([]string, 0)
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	assert.Equal(t, []string{"logs-old", "logs/a", "logs/b"}, keys)
+
+	require.NoError(t, b.Delete(ctx, "dumps/x/y"))
+	assert.ErrorIs(t, b.Delete(ctx, "dumps/x/y"), ErrNotFound)
+	assert.ErrorIs(t, b.Delete(ctx, "dumps/x"), ErrNotFound)
+	// empty parent directories are pruned
+	_, err = os.Stat(filepath.Join(b.dir, "dumps"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,477 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	DefaultGCSBaseURL  = "https://storage.googleapis.com"
+	DefaultGCSTokenURL = "https://oauth2.googleapis.com/token"
+	// Every chunk of a resumable upload except the last must be a multiple of
+	// this size
+	GCSChunkGranularity = 256 * 1024
+	DefaultGCSChunkSize = 32 * GCSChunkGranularity
+
+	gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// The fields of a service account key file needed to authenticate
+type GCSServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	// must be DefaultGCSTokenURL if set: the backend only ever requests
+	// tokens from Google
+	TokenURI string `json:"token_uri"`
+}
+
+type GCSConfig struct {
+	// Base URL of the Cloud Storage JSON API, e.g. http://localhost:4443 for
+	// a local fake server. Defaults to DefaultGCSBaseURL.
+	BaseURL string
+	Bucket  string
+	// Prepended to every object name so that several vaults can share a bucket
+	Prefix         string
+	ServiceAccount *GCSServiceAccount
+	// URL access tokens are requested from, e.g. that of a local fake server.
+	// Defaults to DefaultGCSTokenURL; the token URI of the service account is
+	// never used.
+	TokenURL string
+	// Objects larger than this are sent as resumable uploads in chunks of this
+	// size. Must be a multiple of GCSChunkGranularity.
+	ChunkSize  int64
+	HTTPClient *http.Client
+}
+
+// Stores objects in a Google Cloud Storage bucket
+type GCSBackend struct {
+	baseURL   string
+	bucket    string
+	prefix    string
+	chunkSize int64
+	client    *http.Client
+	tokens    *gcsTokenSource
+}
+
+var _ Backend = (*GCSBackend)(nil)
+
+// An error response from the Cloud Storage API
+type GCSError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *GCSError) Error() string {
+	return fmt.Sprintf("gcs: %d: %s", e.Code, e.Message)
+}
+
+// The subset of the object resource the backend reads
+type gcsObject struct {
+	Name    string    `json:"name"`
+	Size    string    `json:"size"` // int64 encoded as a string
+	ETag    string    `json:"etag"`
+	Updated time.Time `json:"updated"`
+}
+
+func ParseGCSServiceAccount(keyFile []byte) (*GCSServiceAccount, error) {
+	account := &GCSServiceAccount{}
+	if err := json.Unmarshal(keyFile, account); err != nil {
+		return nil, err
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, errors.New("gcs: service account requires client_email and private_key")
+	}
+	if account.TokenURI != "" && account.TokenURI != DefaultGCSTokenURL {
+		return nil, errors.New("gcs: service account token_uri must be " + DefaultGCSTokenURL)
+	}
+	return account, nil
+}
+
+func NewGCSBackend(config GCSConfig) (*GCSBackend, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("gcs: bucket is required")
+	}
+	if config.ServiceAccount == nil {
+		return nil, errors.New("gcs: service account is required")
+	}
+	if config.BaseURL == "" {
+		config.BaseURL = DefaultGCSBaseURL
+	}
+	if config.TokenURL == "" {
+		config.TokenURL = DefaultGCSTokenURL
+	}
+	if config.ChunkSize == 0 {
+		config.ChunkSize = DefaultGCSChunkSize
+	}
+	if config.ChunkSize%GCSChunkGranularity != 0 {
+		return nil, fmt.Errorf("gcs: chunk size must be a multiple of %d", GCSChunkGranularity)
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(config.ServiceAccount.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return &GCSBackend{
+		baseURL:   strings.TrimSuffix(config.BaseURL, "/"),
+		bucket:    config.Bucket,
+		prefix:    config.Prefix,
+		chunkSize: config.ChunkSize,
+		client:    config.HTTPClient,
+		tokens: &gcsTokenSource{
+			email:    config.ServiceAccount.ClientEmail,
+			key:      key,
+			tokenURL: config.TokenURL,
+			client:   config.HTTPClient,
+		},
+	}, nil
+}
+
+// Objects that fit in a single chunk are sent with one media upload; anything
+// larger uses a resumable upload, so at most two chunks are held in memory.
+func (b *GCSBackend) Put(ctx context.Context, key string, r io.Reader, size int64) (*ObjectInfo, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, b.chunkSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if size >= 0 && int64(n) != size {
+			return nil, ErrSizeMismatch
+		}
+		return b.putMedia(ctx, key, buf[:n])
+	} else if err != nil {
+		return nil, err
+	}
+	return b.putResumable(ctx, key, r, size, buf)
+}
+
+func (b *GCSBackend) putMedia(ctx context.Context, key string, data []byte) (*ObjectInfo, error) {
+	query := url.Values{"uploadType": {"media"}, "name": {b.prefix + key}}
+	resp, err := b.do(ctx, http.MethodPost, b.uploadURL(query), nil, data)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return b.decodeObject(resp.Body)
+}
+
+// first holds the first chunk, already read from r
+func (b *GCSBackend) putResumable(ctx context.Context, key string, r io.Reader, size int64, first []byte) (*ObjectInfo, error) {
+	headers := http.Header{}
+	if size >= 0 {
+		headers.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	}
+	query := url.Values{"uploadType": {"resumable"}, "name": {b.prefix + key}}
+	resp, err := b.do(ctx, http.MethodPost, b.uploadURL(query), headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return nil, errors.New("gcs: resumable upload session has no location")
+	}
+
+	info, err := b.uploadChunks(ctx, session, r, size, first)
+	if err != nil {
+		// cancel the session so the partial upload is discarded
+		if resp, cancelErr := b.do(context.Background(), http.MethodDelete, session, nil, nil); cancelErr == nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+	info.Key = key
+	return info, nil
+}
+
+func (b *GCSBackend) uploadChunks(ctx context.Context, session string, r io.Reader, size int64, current []byte) (*ObjectInfo, error) {
+	next := make([]byte, b.chunkSize)
+	var offset int64
+	for {
+		// read ahead to find out whether the current chunk is the last one
+		n, err := io.ReadFull(r, next)
+		last := err == io.EOF
+		if err != nil && !last && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		total := "*"
+		if last {
+			total = strconv.FormatInt(offset+int64(len(current)), 10)
+			if size >= 0 && total != strconv.FormatInt(size, 10) {
+				return nil, ErrSizeMismatch
+			}
+		}
+		headers := http.Header{}
+		headers.Set("Content-Range", fmt.Sprintf(
+			"bytes %d-%d/%s", offset, offset+int64(len(current))-1, total))
+		resp, err := b.do(ctx, http.MethodPut, session, headers, current)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			defer resp.Body.Close()
+			return b.decodeObject(resp.Body)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPermanentRedirect {
+			return nil, fmt.Errorf("gcs: unexpected status %d for intermediate chunk", resp.StatusCode)
+		}
+
+		offset += int64(len(current))
+		current, next = next[:n], current[:cap(current)]
+	}
+}
+
+func (b *GCSBackend) Get(ctx context.Context, key string, rng *Range) (io.ReadCloser, *ObjectInfo, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, nil, err
+	}
+	if rng != nil && rng.Length == 0 {
+		// an empty range can't be expressed with a Range header
+		info, err := b.Stat(ctx, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rng.Offset < 0 || rng.Offset > info.Size {
+			return nil, nil, ErrInvalidRange
+		}
+		return io.NopCloser(strings.NewReader("")), info, nil
+	}
+
+	headers := http.Header{}
+	if rng != nil {
+		if rng.Offset < 0 {
+			return nil, nil, ErrInvalidRange
+		}
+		if rng.Length < 0 {
+			headers.Set("Range", fmt.Sprintf("bytes=%d-", rng.Offset))
+		} else {
+			headers.Set("Range", fmt.Sprintf("bytes=%d-%d", rng.Offset, rng.Offset+rng.Length-1))
+		}
+	}
+
+	resp, err := b.do(ctx, http.MethodGet, b.objectURL(key)+"?alt=media", headers, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := responseInfo(key, resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	return resp.Body, info, nil
+}
+
+func (b *GCSBackend) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := b.do(ctx, http.MethodGet, b.objectURL(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	info, err := b.decodeObject(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	info.Key = key
+	return info, nil
+}
+
+func (b *GCSBackend) Delete(ctx context.Context, key string) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+	resp, err := b.do(ctx, http.MethodDelete, b.objectURL(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *GCSBackend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	query := url.Values{"prefix": {b.prefix + prefix}}
+	for {
+		listURL := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", b.baseURL, url.PathEscape(b.bucket), query.Encode())
+		resp, err := b.do(ctx, http.MethodGet, listURL, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Items         []gcsObject `json:"items"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range result.Items {
+			info, err := item.info(b.prefix)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, *info)
+		}
+		if result.NextPageToken == "" {
+			return objects, nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+func (b *GCSBackend) uploadURL(query url.Values) string {
+	return fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", b.baseURL, url.PathEscape(b.bucket), query.Encode())
+}
+
+// Object names are a single path segment in the JSON API, slashes included
+func (b *GCSBackend) objectURL(key string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s",
+		b.baseURL, url.PathEscape(b.bucket), url.PathEscape(b.prefix+key))
+}
+
+// Send an authorized request. Responses other than 2xx and 308 (an incomplete
+// resumable upload) are converted to errors.
+func (b *GCSBackend) do(ctx context.Context, method, rawURL string, headers http.Header, body []byte) (*http.Response, error) {
+	token, err := b.tokens.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 || resp.StatusCode == http.StatusPermanentRedirect {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, ErrInvalidRange
+	}
+	var errResp struct {
+		Error *GCSError `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&errResp); err == nil && errResp.Error != nil {
+		return nil, errResp.Error
+	}
+	return nil, &GCSError{Code: resp.StatusCode, Message: resp.Status}
+}
+
+func (b *GCSBackend) decodeObject(r io.Reader) (*ObjectInfo, error) {
+	var object gcsObject
+	if err := json.NewDecoder(r).Decode(&object); err != nil {
+		return nil, err
+	}
+	return object.info(b.prefix)
+}
+
+func (o *gcsObject) info(prefix string) (*ObjectInfo, error) {
+	size, err := strconv.ParseInt(o.Size, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: malformed object size %q", o.Size)
+	}
+	return &ObjectInfo{
+		Key:          strings.TrimPrefix(o.Name, prefix),
+		Size:         size,
+		ETag:         o.ETag,
+		LastModified: o.Updated,
+	}, nil
+}
+
+// Exchanges a signed service account assertion for OAuth2 access tokens,
+// caching each token until shortly before it expires
+type gcsTokenSource struct {
+	email    string
+	key      *rsa.PrivateKey
+	tokenURL string
+	client   *http.Client
+
+	mu        sync.Mutex
+	cached    string
+	expiresAt time.Time
+}
+
+func (s *gcsTokenSource) token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached != "" && time.Now().Before(s.expiresAt) {
+		return s.cached, nil
+	}
+
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   s.email,
+		"scope": gcsScope,
+		"aud":   s.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(s.key)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gcs: token exchange failed with status %d", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	s.cached = token.AccessToken
+	// refresh a minute early so a token never expires mid-request
+	s.expiresAt = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return s.cached, nil
+}
@@ -0,0 +1,342 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fakeGCSAccessToken = "fake-access-token"
+
+// A minimal in-process stand-in for the Cloud Storage JSON API and the OAuth2
+// token endpoint
+type fakeGCS struct {
+	mu            sync.Mutex
+	url           string
+	bucket        string
+	publicKey     *rsa.PublicKey
+	objects       map[string][]byte
+	sessions      map[string]*fakeGCSSession
+	nextSession   int
+	tokenRequests int
+	chunkPuts     int
+}
+
+type fakeGCSSession struct {
+	name string
+	data []byte
+}
+
+func newFakeGCS(t *testing.T, bucket string, publicKey *rsa.PublicKey) *fakeGCS {
+	fake := &fakeGCS{
+		bucket:    bucket,
+		publicKey: publicKey,
+		objects:   make(map[string][]byte),
+		sessions:  make(map[string]*fakeGCSSession),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.url = server.URL
+	return fake
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		f.token(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+fakeGCSAccessToken {
+		writeFakeGCSError(w, http.StatusUnauthorized)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+
+	if id, found := strings.CutPrefix(r.URL.Path, "/upload/session/"); found {
+		f.uploadChunk(w, r, id, body)
+		return
+	}
+	if uploadPath := "/upload/storage/v1/b/" + f.bucket + "/o"; r.URL.Path == uploadPath {
+		name := r.URL.Query().Get("name")
+		switch r.URL.Query().Get("uploadType") {
+		case "media":
+			f.objects[name] = body
+			f.writeObject(w, name)
+		case "resumable":
+			f.nextSession++
+			id := strconv.Itoa(f.nextSession)
+			f.sessions[id] = &fakeGCSSession{name: name}
+			w.Header().Set("Location", f.url+"/upload/session/"+id)
+		}
+		return
+	}
+
+	objectsPath := "/storage/v1/b/" + f.bucket + "/o"
+	if r.URL.Path == objectsPath {
+		f.list(w, r.URL.Query())
+		return
+	}
+	escapedName, found := strings.CutPrefix(r.URL.EscapedPath(), objectsPath+"/")
+	if !found {
+		writeFakeGCSError(w, http.StatusNotFound)
+		return
+	}
+	name, _ := url.PathUnescape(escapedName)
+	data, ok := f.objects[name]
+	if !ok {
+		writeFakeGCSError(w, http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodDelete:
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Query().Get("alt") == "media":
+		f.media(w, r, data)
+	default:
+		f.writeObject(w, name)
+	}
+}
+
+func (f *fakeGCS) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	_, err := jwt.Parse(r.PostForm.Get("assertion"), func(token *jwt.Token) (any, error) {
+		return f.publicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithAudience(f.url+"/token"))
+	if err != nil {
+		writeFakeGCSError(w, http.StatusUnauthorized)
+		return
+	}
+	f.tokenRequests++
+	fmt.Fprintf(w, `{"access_token": %q, "expires_in": 3600, "token_type": "Bearer"}`, fakeGCSAccessToken)
+}
+
+func (f *fakeGCS) uploadChunk(w http.ResponseWriter, r *http.Request, id string, body []byte) {
+	session, ok := f.sessions[id]
+	if !ok {
+		writeFakeGCSError(w, http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		delete(f.sessions, id)
+		w.WriteHeader(499)
+		return
+	}
+	f.chunkPuts++
+
+	var start, end int
+	var total string
+	fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%s", &start, &end, &total)
+	if start != len(session.data) || end-start+1 != len(body) {
+		writeFakeGCSError(w, http.StatusBadRequest)
+		return
+	}
+	session.data = append(session.data, body...)
+	if total == "*" {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+	f.objects[session.name] = session.data
+	delete(f.sessions, id)
+	f.writeObject(w, session.name)
+}
+
+func (f *fakeGCS) media(w http.ResponseWriter, r *http.Request, data []byte) {
+	w.Header().Set("ETag", "etag-"+strconv.Itoa(len(data)))
+	w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		var start, end int
+		spec := strings.TrimPrefix(rangeHeader, "bytes=")
+		if strings.HasSuffix(spec, "-") {
+			start, _ = strconv.Atoi(strings.TrimSuffix(spec, "-"))
+			end = len(data) - 1
+		} else {
+			fmt.Sscanf(spec, "%d-%d", &start, &end)
+			end = min(end, len(data)-1)
+		}
+		if start >= len(data) {
+			writeFakeGCSError(w, http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Lists one object per page to exercise page tokens
+func (f *fakeGCS) list(w http.ResponseWriter, query url.Values) {
+	names := make([]string, 0)
+	for name := range f.objects {
+		if strings.HasPrefix(name, query.Get("prefix")) && name > query.Get("pageToken") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := map[string]any{"kind": "storage#objects"}
+	if len(names) > 0 {
+		result["items"] = []any{f.object(names[0])}
+	}
+	if len(names) > 1 {
+		result["nextPageToken"] = names[0]
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeGCS) writeObject(w http.ResponseWriter, name string) {
+	json.NewEncoder(w).Encode(f.object(name))
+}
+
+func (f *fakeGCS) object(name string) map[string]any {
+	return map[string]any{
+		"name":    name,
+		"bucket":  f.bucket,
+		"size":    strconv.Itoa(len(f.objects[name])),
+		"etag":    "etag-" + strconv.Itoa(len(f.objects[name])),
+		"updated": "2024-01-01T00:00:00.000Z",
+	}
+}
+
+func writeFakeGCSError(w http.ResponseWriter, status int) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": "fake"}}`, status)
+}
+
+func newTestGCSBackend(t *testing.T) (*fakeGCS, *GCSBackend) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	fake := newFakeGCS(t, "backups", &key.PublicKey)
+
+	keyFile, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "dump@example.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    DefaultGCSTokenURL,
+	})
+	require.NoError(t, err)
+	account, err := ParseGCSServiceAccount(keyFile)
+	require.NoError(t, err)
+
+	b, err := NewGCSBackend(GCSConfig{
+		BaseURL:        fake.url,
+		Bucket:         "backups",
+		Prefix:         "vaults/1/",
+		ServiceAccount: account,
+		TokenURL:       fake.url + "/token",
+		ChunkSize:      GCSChunkGranularity,
+	})
+	require.NoError(t, err)
+	return fake, b
+}
+
+func TestGCSPutGet(t *testing.T) {
+	ctx := context.Background()
+	fake, b := newTestGCSBackend(t)
+	info, err := b.Put(ctx, "dumps/db 1.sql", strings.NewReader("hello world"), 11)
+	require.NoError(t, err)
+	assert.Equal(t, "dumps/db 1.sql", info.Key)
+	assert.Equal(t, int64(11), info.Size)
+	assert.Contains(t, fake.objects, "vaults/1/dumps/db 1.sql")
+
+	assert.Equal(t, "hello world", readObject(t, b, "dumps/db 1.sql", nil))
+	assert.Equal(t, "world", readObject(t, b, "dumps/db 1.sql", &Range{Offset: 6, Length: -1}))
+	assert.Equal(t, "lo w", readObject(t, b, "dumps/db 1.sql", &Range{Offset: 3, Length: 4}))
+
+	_, info, err = b.Get(ctx, "dumps/db 1.sql", &Range{Offset: 3, Length: 4})
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size)
+	_, _, err = b.Get(ctx, "dumps/db 1.sql", &Range{Offset: 20, Length: -1})
+	assert.ErrorIs(t, err, ErrInvalidRange)
+	_, _, err = b.Get(ctx, "missing", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// the access token is cached between requests
+	assert.Equal(t, 1, fake.tokenRequests)
+}
+
+func TestGCSResumablePut(t *testing.T) {
+	ctx := context.Background()
+	for _, size := range []int{2*GCSChunkGranularity + 100, 2 * GCSChunkGranularity} {
+		fake, b := newTestGCSBackend(t)
+		data := make([]byte, size)
+		rand.Read(data)
+
+		info, err := b.Put(ctx, "big", bytes.NewReader(data), int64(size))
+		require.NoError(t, err)
+		assert.Equal(t, "big", info.Key)
+		assert.Equal(t, int64(size), info.Size)
+		assert.Equal(t, (size+GCSChunkGranularity-1)/GCSChunkGranularity, fake.chunkPuts)
+		assert.Equal(t, data, fake.objects["vaults/1/big"])
+		assert.Empty(t, fake.sessions)
+	}
+}
+
+func TestGCSResumablePutSizeMismatchCancels(t *testing.T) {
+	ctx := context.Background()
+	fake, b := newTestGCSBackend(t)
+	data := make([]byte, GCSChunkGranularity+1)
+	_, err := b.Put(ctx, "big", bytes.NewReader(data), int64(len(data)+1))
+	assert.ErrorIs(t, err, ErrSizeMismatch)
+	assert.NotContains(t, fake.objects, "vaults/1/big")
+	assert.Empty(t, fake.sessions)
+}
+
+func TestGCSListStatDelete(t *testing.T) {
+	ctx := context.Background()
+	fake, b := newTestGCSBackend(t)
+	fake.objects["vaults/2/logs/other-vault"] = []byte("x")
+	for _, key := range []string{"logs/b", "logs/a", "dumps/x"} {
+		_, err := b.Put(ctx, key, strings.NewReader(key), -1)
+		require.NoError(t, err)
+	}
+
+	objects, err := b.List(ctx, "logs/")
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	assert.Equal(t, "logs/a", objects[0].Key)
+	assert.Equal(t, "logs/b", objects[1].Key)
+
+	info, err := b.Stat(ctx, "dumps/x")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size)
+	assert.Equal(t, "dumps/x", info.Key)
+
+	require.NoError(t, b.Delete(ctx, "dumps/x"))
+	assert.ErrorIs(t, b.Delete(ctx, "dumps/x"), ErrNotFound)
+}
+
+func TestParseGCSServiceAccountRejectsOtherTokenURI(t *testing.T) {
+	keyFile := []byte(`{"client_email": "dump@example.iam.gserviceaccount.com",
+		"private_key": "key", "token_uri": "http://169.254.169.254/token"}`)
+	_, err := ParseGCSServiceAccount(keyFile)
+	assert.Error(t, err)
+}
@@ -0,0 +1,396 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultS3PartSize = 8 * 1024 * 1024
+	// S3 rejects multipart uploads whose parts (other than the last) are smaller
+	MinS3PartSize = 5 * 1024 * 1024
+)
+
+type S3Config struct {
+	// Base URL of the S3 API, e.g. http://localhost:9000 for a local stand-in.
+	// Defaults to the AWS endpoint of Region.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prepended to every key so that several vaults can share a bucket
+	Prefix      string
+	Credentials AWSCredentials
+	// Address buckets as <endpoint>/<bucket> instead of <bucket>.<endpoint>.
+	// Most S3-compatible servers expect this.
+	PathStyle bool
+	// Objects larger than this are uploaded in parts of this size
+	PartSize   int64
+	HTTPClient *http.Client
+}
+
+// Stores objects in an S3-compatible bucket
+type S3Backend struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	pathStyle bool
+	partSize  int64
+	client    *http.Client
+	signer    *sigV4Signer
+}
+
+var _ Backend = (*S3Backend)(nil)
+
+// An error response from the S3 API
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func NewS3Backend(config S3Config) (*S3Backend, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("s3: bucket is required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.Region)
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if config.PartSize == 0 {
+		config.PartSize = DefaultS3PartSize
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &S3Backend{
+		endpoint:  endpoint,
+		bucket:    config.Bucket,
+		prefix:    config.Prefix,
+		pathStyle: config.PathStyle,
+		partSize:  config.PartSize,
+		client:    config.HTTPClient,
+		signer:    &sigV4Signer{config.Credentials, config.Region, "s3"},
+	}, nil
+}
+
+// Objects that fit in a single part are uploaded with one PUT; anything larger
+// is streamed as a multipart upload, so at most one part is held in memory.
+func (b *S3Backend) Put(ctx context.Context, key string, r io.Reader, size int64) (*ObjectInfo, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, b.partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if size >= 0 && int64(n) != size {
+			return nil, ErrSizeMismatch
+		}
+		return b.putObject(ctx, key, buf[:n])
+	} else if err != nil {
+		return nil, err
+	}
+	return b.putMultipart(ctx, key, r, size, buf)
+}
+
+func (b *S3Backend) putObject(ctx context.Context, key string, data []byte) (*ObjectInfo, error) {
+	resp, err := b.do(ctx, http.MethodPut, key, nil, nil, data)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return &ObjectInfo{
+		Key:          key,
+		Size:         int64(len(data)),
+		ETag:         strings.Trim(resp.Header.Get("ETag"), `"`),
+		LastModified: time.Now().UTC().Truncate(time.Second),
+	}, nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// first holds the first part, already read from r
+func (b *S3Backend) putMultipart(ctx context.Context, key string, r io.Reader, size int64, first []byte) (*ObjectInfo, error) {
+	resp, err := b.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	parts, total, err := b.uploadParts(ctx, key, initiated.UploadId, r, first)
+	if err == nil && size >= 0 && total != size {
+		err = ErrSizeMismatch
+	}
+	if err == nil {
+		err = b.completeMultipart(ctx, key, initiated.UploadId, parts)
+	}
+	if err != nil {
+		// don't leave orphaned parts in the bucket; use a fresh context in case
+		// ctx is the reason the upload failed
+		if resp, abortErr := b.do(context.Background(), http.MethodDelete, key,
+			url.Values{"uploadId": {initiated.UploadId}}, nil, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+	return b.Stat(ctx, key)
+}
+
+func (b *S3Backend) uploadParts(ctx context.Context, key, uploadId string, r io.Reader, buf []byte) ([]completedPart, int64, error) {
+	var (
+		parts []completedPart
+		total int64
+		data  = buf
+	)
+	for partNumber := 1; ; partNumber++ {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadId},
+		}
+		resp, err := b.do(ctx, http.MethodPut, key, query, nil, data)
+		if err != nil {
+			return nil, 0, err
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{partNumber, resp.Header.Get("ETag")})
+		total += int64(len(data))
+
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return parts, total, nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, 0, err
+		}
+		data = buf[:n]
+	}
+}
+
+func (b *S3Backend) completeMultipart(ctx context.Context, key, uploadId string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadId}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 can report a failed completion in the body of a 200 response
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if s3Err := parseS3Error(resp.StatusCode, respBody); s3Err != nil {
+		return s3Err
+	}
+	return nil
+}
+
+func (b *S3Backend) Get(ctx context.Context, key string, rng *Range) (io.ReadCloser, *ObjectInfo, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, nil, err
+	}
+	if rng != nil && rng.Length == 0 {
+		// an empty range can't be expressed with a Range header
+		info, err := b.Stat(ctx, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rng.Offset < 0 || rng.Offset > info.Size {
+			return nil, nil, ErrInvalidRange
+		}
+		return io.NopCloser(strings.NewReader("")), info, nil
+	}
+
+	headers := http.Header{}
+	if rng != nil {
+		if rng.Offset < 0 {
+			return nil, nil, ErrInvalidRange
+		}
+		if rng.Length < 0 {
+			headers.Set("Range", fmt.Sprintf("bytes=%d-", rng.Offset))
+		} else {
+			headers.Set("Range", fmt.Sprintf("bytes=%d-%d", rng.Offset, rng.Offset+rng.Length-1))
+		}
+	}
+
+	resp, err := b.do(ctx, http.MethodGet, key, nil, headers, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := responseInfo(key, resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	return resp.Body, info, nil
+}
+
+func (b *S3Backend) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := b.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return responseInfo(key, resp)
+}
+
+func (b *S3Backend) Delete(ctx context.Context, key string) error {
+	// S3 deletes are idempotent, so check that the object exists to match the
+	// other backends
+	if _, err := b.Stat(ctx, key); err != nil {
+		return err
+	}
+	resp, err := b.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *S3Backend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {b.prefix + prefix},
+	}
+	for {
+		resp, err := b.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          strings.TrimPrefix(object.Key, b.prefix),
+				Size:         object.Size,
+				ETag:         strings.Trim(object.ETag, `"`),
+				LastModified: object.LastModified,
+			})
+		}
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Send a signed request for key (or the bucket itself if key is empty).
+// Responses outside the 2xx range are converted to errors.
+func (b *S3Backend) do(ctx context.Context, method, key string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	u := b.objectURL(key)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	b.signer.sign(req, hexSha256(body), time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	s3Err := parseS3Error(resp.StatusCode, respBody)
+	switch {
+	// HEAD responses have no body to tell a missing key from a missing bucket
+	case resp.StatusCode == http.StatusNotFound && (s3Err == nil || s3Err.Code == "NoSuchKey"):
+		return nil, ErrNotFound
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return nil, ErrInvalidRange
+	case s3Err != nil:
+		return nil, s3Err
+	}
+	return nil, &S3Error{StatusCode: resp.StatusCode, Code: resp.Status}
+}
+
+func (b *S3Backend) objectURL(key string) *url.URL {
+	u := *b.endpoint
+	path := ""
+	if b.pathStyle {
+		path = "/" + b.bucket
+	} else {
+		u.Host = b.bucket + "." + u.Host
+	}
+	if key != "" {
+		path += "/" + b.prefix + key
+	} else if path == "" {
+		path = "/"
+	}
+	u.Path = strings.TrimSuffix(b.endpoint.Path, "/") + path
+	u.RawPath = canonicalURI(&u)
+	return &u
+}
+
+// Returns nil unless body is an S3 <Error> document
+func parseS3Error(statusCode int, body []byte) *S3Error {
+	s3Err := &S3Error{StatusCode: statusCode}
+	if err := xml.Unmarshal(body, s3Err); err != nil || s3Err.Code == "" {
+		return nil
+	}
+	return s3Err
+}
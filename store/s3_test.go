@@ -0,0 +1,278 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A minimal in-process stand-in for the parts of the S3 API the backend uses,
+// addressed path style as /<bucket>/<key>
+type fakeS3 struct {
+	mu          sync.Mutex
+	bucket      string
+	accessKeyId string
+	objects     map[string][]byte
+	uploads     map[string]map[int][]byte
+	nextUpload  int
+	partUploads int
+}
+
+func newFakeS3(t *testing.T, bucket, accessKeyId string) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{
+		bucket:      bucket,
+		accessKeyId: accessKeyId,
+		objects:     make(map[string][]byte),
+		uploads:     make(map[string]map[int][]byte),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+f.accessKeyId+"/") {
+		writeFakeS3Error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		writeFakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextUpload++
+		uploadId := strconv.Itoa(f.nextUpload)
+		f.uploads[uploadId] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadId)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][partNumber] = body
+		f.partUploads++
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		var complete struct {
+			Parts []completedPart `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		parts := f.uploads[query.Get("uploadId")]
+		var data []byte
+		for _, part := range complete.Parts {
+			data = append(data, parts[part.PartNumber]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.get(w, r, key)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) get(w http.ResponseWriter, r *http.Request, key string) {
+	data, ok := f.objects[key]
+	if !ok {
+		writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("ETag", etag(data))
+	w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		var start, end int
+		spec := strings.TrimPrefix(rangeHeader, "bytes=")
+		if strings.HasSuffix(spec, "-") {
+			start, _ = strconv.Atoi(strings.TrimSuffix(spec, "-"))
+			end = len(data) - 1
+		} else {
+			fmt.Sscanf(spec, "%d-%d", &start, &end)
+			end = min(end, len(data)-1)
+		}
+		if start >= len(data) {
+			writeFakeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+// Lists one key per page to exercise continuation tokens
+func (f *fakeS3) list(w http.ResponseWriter, query map[string][]string) {
+	prefix := ""
+	if values := query["prefix"]; len(values) > 0 {
+		prefix = values[0]
+	}
+	after := ""
+	if values := query["continuation-token"]; len(values) > 0 {
+		after = values[0]
+	}
+	keys := make([]string, 0)
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	fmt.Fprint(w, "<ListBucketResult>")
+	if len(keys) > 0 {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>2024-01-01T00:00:00.000Z</LastModified><ETag>%s</ETag><Size>%d</Size></Contents>",
+			keys[0], etag(f.objects[keys[0]]), len(f.objects[keys[0]]))
+	}
+	if len(keys) > 1 {
+		fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", keys[0])
+	} else {
+		fmt.Fprint(w, "<IsTruncated>false</IsTruncated>")
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func writeFakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>fake</Message></Error>", code)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func newTestS3Backend(t *testing.T, partSize int64) (*fakeS3, *S3Backend) {
+	fake, server := newFakeS3(t, "backups", "AKIDTEST")
+	b, err := NewS3Backend(S3Config{
+		Endpoint:    server.URL,
+		Bucket:      "backups",
+		Prefix:      "vaults/1/",
+		Credentials: AWSCredentials{"AKIDTEST", "secret"},
+		PathStyle:   true,
+		PartSize:    partSize,
+	})
+	require.NoError(t, err)
+	return fake, b
+}
+
+func TestS3PutGet(t *testing.T) {
+	ctx := context.Background()
+	fake, b := newTestS3Backend(t, MinS3PartSize)
+	info, err := b.Put(ctx, "dumps/db 1.sql", strings.NewReader("hello world"), 11)
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size)
+	assert.Equal(t, strings.Trim(etag([]byte("hello world")), `"`), info.ETag)
+	assert.Contains(t, fake.objects, "vaults/1/dumps/db 1.sql")
+
+	assert.Equal(t, "hello world", readObject(t, b, "dumps/db 1.sql", nil))
+	assert.Equal(t, "world", readObject(t, b, "dumps/db 1.sql", &Range{Offset: 6, Length: -1}))
+	assert.Equal(t, "lo w", readObject(t, b, "dumps/db 1.sql", &Range{Offset: 3, Length: 4}))
+
+	_, info, err = b.Get(ctx, "dumps/db 1.sql", &Range{Offset: 3, Length: 4})
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size)
+
+	_, _, err = b.Get(ctx, "dumps/db 1.sql", &Range{Offset: 20, Length: -1})
+	assert.ErrorIs(t, err, ErrInvalidRange)
+	_, _, err = b.Get(ctx, "missing", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestS3MultipartPut(t *testing.T) {
+	ctx := context.Background()
+	fake, b := newTestS3Backend(t, 4)
+	data := []byte("0123456789abcdefghij!")
+	info, err := b.Put(ctx, "big", bytes.NewReader(data), -1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+	assert.Equal(t, 6, fake.partUploads)
+	assert.Equal(t, data, fake.objects["vaults/1/big"])
+	assert.Empty(t, fake.uploads)
+}
+
+func TestS3MultipartPutSizeMismatchAborts(t *testing.T) {
+	ctx := context.Background()
+	fake, b := newTestS3Backend(t, 4)
+	_, err := b.Put(ctx, "big", strings.NewReader("0123456789"), 100)
+	assert.ErrorIs(t, err, ErrSizeMismatch)
+	assert.NotContains(t, fake.objects, "vaults/1/big")
+	assert.Empty(t, fake.uploads)
+}
+
+func TestS3ListStatDelete(t *testing.T) {
+	ctx := context.Background()
+	fake, b := newTestS3Backend(t, MinS3PartSize)
+	fake.objects["vaults/2/logs/other-vault"] = []byte("x")
+	for _, key := range []string{"logs/b", "logs/a", "dumps/x"} {
+		_, err := b.Put(ctx, key, strings.NewReader(key), -1)
+		require.NoError(t, err)
+	}
+
+	objects, err := b.List(ctx, "logs/")
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	assert.Equal(t, "logs/a", objects[0].Key)
+	assert.Equal(t, "logs/b", objects[1].Key)
+	assert.Equal(t, int64(6), objects[1].Size)
+
+	info, err := b.Stat(ctx, "dumps/x")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size)
+
+	require.NoError(t, b.Delete(ctx, "dumps/x"))
+	assert.ErrorIs(t, b.Delete(ctx, "dumps/x"), ErrNotFound)
+	_, err = b.Stat(ctx, "dumps/x")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestS3WrongCredentials(t *testing.T) {
+	_, server := newFakeS3(t, "backups", "AKIDTEST")
+	b, err := NewS3Backend(S3Config{
+		Endpoint:    server.URL,
+		Bucket:      "backups",
+		Credentials: AWSCredentials{"AKIDOTHER", "secret"},
+		PathStyle:   true,
+	})
+	require.NoError(t, err)
+	_, err = b.Put(context.Background(), "a", strings.NewReader("data"), -1)
+	var s3Err *S3Error
+	require.ErrorAs(t, err, &s3Err)
+	assert.Equal(t, "AccessDenied", s3Err.Code)
+}
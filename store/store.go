@@ -0,0 +1,104 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const MaxKeyLength = 1024
+
+var (
+	ErrNotFound     = errors.New("object not found")
+	ErrInvalidKey   = errors.New("invalid object key")
+	ErrInvalidRange = errors.New("invalid byte range")
+	ErrKeyConflict  = errors.New("object key conflicts with an existing object")
+	ErrSizeMismatch = errors.New("object size does not match the declared size")
+)
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string // opaque, unquoted entity tag
+	LastModified time.Time
+}
+
+// A byte range of an object. A negative Length reads to the end of the object.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// Stores the objects of a single vault. Keys are slash separated paths that
+// have passed ValidateKey.
+type Backend interface {
+	// Store everything read from r under key, replacing any existing object.
+	// size is the number of bytes r will produce, or -1 if it isn't known.
+	Put(ctx context.Context, key string, r io.Reader, size int64) (*ObjectInfo, error)
+	// Open the object stored under key. A nil rng reads the whole object.
+	Get(ctx context.Context, key string, rng *Range) (io.ReadCloser, *ObjectInfo, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// List every object whose key starts with prefix, sorted by key
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// Check that key is usable with every backend: a non-empty, slash separated
+// path of at most MaxKeyLength bytes with no empty, "." or ".." segments.
+func ValidateKey(key string) error {
+	if key == "" || len(key) > MaxKeyLength || !utf8.ValidString(key) {
+		return ErrInvalidKey
+	}
+	if strings.ContainsAny(key, "\x00\\") {
+		return ErrInvalidKey
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
+
+// Wraps a reader so copies stop once ctx is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// Object info from the headers of a response to an HTTP GET or HEAD request
+func responseInfo(key string, resp *http.Response) (*ObjectInfo, error) {
+	info := &ObjectInfo{
+		Key:  key,
+		Size: resp.ContentLength,
+		ETag: strings.Trim(resp.Header.Get("ETag"), `"`),
+	}
+	// ranged responses report the size of the whole object in Content-Range
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+		_, total, found := strings.Cut(contentRange, "/")
+		size, err := strconv.ParseInt(total, 10, 64)
+		if !found || err != nil {
+			return nil, fmt.Errorf("malformed Content-Range %q", contentRange)
+		}
+		info.Size = size
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		if t, err := http.ParseTime(lastModified); err == nil {
+			info.LastModified = t
+		}
+	}
+	return info, nil
+}
@@ -2,13 +2,20 @@ package util
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
 )
 
+// Parameters of new hashes. Hashes made with weaker parameters still verify,
+// using the parameters encoded in them, and are reported as needing a rehash.
 const (
 	ARGON2ID_TIME        = 1
 	ARGON2ID_MEMORY      = 64 * 1024
@@ -17,6 +24,23 @@ const (
 	ARGON2ID_SALT_LENGTH = 16
 )
 
+var (
+	ErrUnsupportedHash = errors.New("unsupported password hash algorithm")
+	ErrMalformedHash   = errors.New("malformed password hash")
+)
+
+// Bounds on the parameters of stored hashes, so that a bad one can't make
+// verifying a password take all the memory or time there is. scrypt uses
+// 128*r*N bytes of memory and runs p times over it.
+const (
+	maxArgon2idMemory = 1024 * 1024 // KiB
+	maxArgon2idTime   = 64
+	maxScryptLogN     = 24
+	maxScryptMemory   = 1 << 30 // bytes
+	maxScryptP        = 16
+	maxHashKeyLength  = 1024
+)
+
 func HashPassword(password string) string {
 	return argon2idHash(password, generateRandomSalt())
 }
@@ -40,12 +64,153 @@ func generateRandomSalt() []byte {
 }
 
 func ValidatePassword(password string, hash string) bool {
+	ok, _, err := VerifyPassword(password, hash)
+	return ok && err == nil
+}
+
+// Check a password against a hash in PHC string format: argon2id, or scrypt
+// as written by passlib ($scrypt$ln=..,r=..,p=..$salt$hash), or a bcrypt hash.
+// needsRehash reports that the password verified but the hash is weaker than
+// HashPassword makes, and should be replaced by a new one.
+func VerifyPassword(password, hash string) (ok bool, needsRehash bool, err error) {
+	hash = strings.TrimSpace(hash)
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(password, hash)
+	case strings.HasPrefix(hash, "$scrypt$"):
+		ok, err := verifyScrypt(password, hash)
+		return ok, ok, err
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, fmt.Errorf("%w: %w", ErrMalformedHash, err)
+		}
+		return true, true, nil
+	default:
+		return false, false, ErrUnsupportedHash
+	}
+}
+
+func verifyArgon2id(password, hash string) (bool, bool, error) {
+	// "", "argon2id", "v=19", "m=65536,t=1,p=4", salt, key
 	fields := strings.Split(hash, "$")
-	saltBase64 := fields[len(fields)-2]
-	salt := make([]byte, ARGON2ID_SALT_LENGTH)
-	if _, err := base64.URLEncoding.Decode(salt, []byte(saltBase64)); err != nil {
-		panic(err)
+	if len(fields) != 6 {
+		return false, false, ErrMalformedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, fmt.Errorf("%w: version %q", ErrMalformedHash, fields[2])
+	}
+	params, err := parseParams(fields[3], "m", "t", "p")
+	if err != nil {
+		return false, false, err
+	}
+	memory, time, threads := params["m"], params["t"], params["p"]
+	if memory < 8*threads || memory > maxArgon2idMemory || time < 1 || time > maxArgon2idTime ||
+		threads < 1 || threads > 255 {
+		return false, false, fmt.Errorf("%w: parameters out of range", ErrMalformedHash)
+	}
+	salt, key, err := decodeSaltAndKey(fields[4], fields[5])
+	if err != nil {
+		return false, false, err
+	}
+
+	computed := argon2.IDKey(
+		[]byte(password), salt, uint32(time), uint32(memory), uint8(threads), uint32(len(key)))
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return false, false, nil
+	}
+	needsRehash := memory < ARGON2ID_MEMORY || time < ARGON2ID_TIME || threads < ARGON2ID_THREADS ||
+		len(key) < ARGON2ID_KEY_LENGTH || len(salt) < ARGON2ID_SALT_LENGTH
+	return true, needsRehash, nil
+}
+
+func verifyScrypt(password, hash string) (bool, error) {
+	// "", "scrypt", "ln=16,r=8,p=1", salt, key
+	fields := strings.Split(hash, "$")
+	if len(fields) != 5 {
+		return false, ErrMalformedHash
+	}
+	params, err := parseParams(fields[2], "ln", "r", "p")
+	if err != nil {
+		return false, err
+	}
+	logN, r, p := params["ln"], params["r"], params["p"]
+	if logN < 1 || logN > maxScryptLogN || r < 1 || r > maxScryptMemory/128>>logN ||
+		p < 1 || p > maxScryptP {
+		return false, fmt.Errorf("%w: parameters out of range", ErrMalformedHash)
+	}
+	salt, key, err := decodeSaltAndKey(fields[3], fields[4])
+	if err != nil {
+		return false, err
+	}
+
+	computed, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, len(key))
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrMalformedHash, err)
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+// Parse comma separated key=value parameters, requiring exactly the given
+// keys
+func parseParams(field string, keys ...string) (map[string]int, error) {
+	params := make(map[string]int, len(keys))
+	for _, param := range strings.Split(field, ",") {
+		key, value, found := strings.Cut(param, "=")
+		n, err := strconv.Atoi(value)
+		if !found || err != nil || n < 0 {
+			return nil, fmt.Errorf("%w: parameter %q", ErrMalformedHash, param)
+		}
+		params[key] = n
+	}
+	for _, key := range keys {
+		if _, found := params[key]; !found {
+			return nil, fmt.Errorf("%w: missing parameter %q", ErrMalformedHash, key)
+		}
+	}
+	if len(params) != len(keys) {
+		return nil, fmt.Errorf("%w: unknown parameters in %q", ErrMalformedHash, field)
+	}
+	return params, nil
+}
+
+func decodeSaltAndKey(encodedSalt, encodedKey string) ([]byte, []byte, error) {
+	salt, err := decodeHashBase64(encodedSalt)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := decodeHashBase64(encodedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(key) < 16 || len(key) > maxHashKeyLength {
+		return nil, nil, fmt.Errorf("%w: key length %d", ErrMalformedHash, len(key))
+	}
+	return salt, key, nil
+}
+
+// Decode the base64 of a hash's salt or key. The PHC format uses standard
+// base64 without padding, passlib swaps "+" for ".", and the hashes this
+// package has always made use the padded URL alphabet.
+func decodeHashBase64(encoded string) ([]byte, error) {
+	encoded = strings.ReplaceAll(encoded, ".", "+")
+	if strings.ContainsAny(encoded, "-_") {
+		return decodeOptionalPadding(base64.URLEncoding, base64.RawURLEncoding, encoded)
+	}
+	return decodeOptionalPadding(base64.StdEncoding, base64.RawStdEncoding, encoded)
+}
+
+func decodeOptionalPadding(padded, raw *base64.Encoding, encoded string) ([]byte, error) {
+	encoding := raw
+	if strings.HasSuffix(encoded, "=") {
+		encoding = padded
+	}
+	decoded, err := encoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedHash, err)
 	}
-	hash2 := argon2idHash(password, salt)
-	return hash2 == hash
+	return decoded, nil
 }
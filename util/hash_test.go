@@ -1,9 +1,16 @@
 package util
 
 import (
+	"encoding/base64"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
 )
 
 func TestHashPassword(t *testing.T) {
@@ -18,3 +25,93 @@ func TestValidateHash(t *testing.T) {
 	assert.True(t, ValidatePassword(password, hash))
 	assert.False(t, ValidatePassword("NotMySuperSecurePassword", hash))
 }
+
+// Hash a password with the given argon2id parameters, in PHC format
+func argon2idHashWithParams(password string, memory, time uint32, threads uint8) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, ARGON2ID_KEY_LENGTH)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestVerifyPasswordUsesEncodedParameters(t *testing.T) {
+	hash := argon2idHashWithParams("password", 8*1024, 2, 1)
+	ok, needsRehash, err := VerifyPassword("password", hash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, needsRehash, "weaker memory and threads than current policy")
+
+	ok, _, err = VerifyPassword("wrong", hash)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestVerifyPasswordCurrentHashNeedsNoRehash(t *testing.T) {
+	ok, needsRehash, err := VerifyPassword("password", HashPassword("password"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, needsRehash)
+
+	// CHAR columns pad hashes with spaces
+	ok, _, err = VerifyPassword("password", HashPassword("password")+"   ")
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestVerifyBcryptPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	require.NoError(t, err)
+	ok, needsRehash, err := VerifyPassword("password", string(hash))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, needsRehash)
+
+	ok, needsRehash, err = VerifyPassword("wrong", string(hash))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, needsRehash)
+}
+
+func TestVerifyScryptPassword(t *testing.T) {
+	salt := []byte("saltsaltsaltsalt")
+	key, err := scrypt.Key([]byte("password"), salt, 1<<10, 8, 1, 32)
+	require.NoError(t, err)
+	// passlib's format, with "." in place of "+"
+	encode := func(b []byte) string {
+		return strings.ReplaceAll(base64.RawStdEncoding.EncodeToString(b), "+", ".")
+	}
+	hash := "$scrypt$ln=10,r=8,p=1$" + encode(salt) + "$" + encode(key)
+
+	ok, needsRehash, err := VerifyPassword("password", hash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, needsRehash)
+	ok, _, err = VerifyPassword("wrong", hash)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestVerifyPasswordRejectsBadHashes(t *testing.T) {
+	valid := argon2idHashWithParams("password", 8*1024, 1, 1)
+	for _, hash := range []string{
+		"$argon2id$v=19$m=8192,t=1$c2FsdHNhbHRzYWx0c2FsdA$" + strings.Split(valid, "$")[5],
+		"$argon2id$v=16$m=8192,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$" + strings.Split(valid, "$")[5],
+		"$argon2id$v=19$m=99999999,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$" + strings.Split(valid, "$")[5],
+		"$argon2id$v=19$m=8192,t=1,p=1,x=2$c2FsdHNhbHRzYWx0c2FsdA$" + strings.Split(valid, "$")[5],
+		"$argon2id$v=19$m=8192,t=1,p=1$!!!$" + strings.Split(valid, "$")[5],
+		"$argon2id$v=19$m=8192,t=1,p=1$c2FsdA$c2hvcnQ",
+		"$scrypt$ln=40,r=8,p=1$c2FsdA$c2FsdHNhbHRzYWx0c2FsdA",
+		"$scrypt$ln=24,r=1000,p=1$c2FsdA$c2FsdHNhbHRzYWx0c2FsdA",
+		"$scrypt$ln=10,r=8,p=1000$c2FsdA$c2FsdHNhbHRzYWx0c2FsdA",
+		"$argon2id$v=19$m=4194304,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$" + strings.Split(valid, "$")[5],
+		"$2b$04$tooshort",
+	} {
+		ok, _, err := VerifyPassword("password", hash)
+		assert.ErrorIs(t, err, ErrMalformedHash, hash)
+		assert.False(t, ok, hash)
+	}
+
+	_, _, err := VerifyPassword("password", "$argon2i$v=19$m=8192,t=1,p=1$c2FsdA$c2FsdA")
+	assert.ErrorIs(t, err, ErrUnsupportedHash)
+	assert.False(t, ValidatePassword("password", "plaintext"))
+}
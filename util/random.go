@@ -0,0 +1,15 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Generate a random, hex encoded 128 bit identifier
+func GenerateRandomId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
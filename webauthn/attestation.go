@@ -0,0 +1,106 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"slices"
+)
+
+// Attestation types
+const (
+	AttestationNone  = "none"
+	AttestationSelf  = "self"  // signed by the credential key itself
+	AttestationBasic = "basic" // signed by an attestation certificate
+)
+
+// id-fido-gen-ce-aaguid, the extension of packed attestation certificates
+// naming the authenticator model
+var oidAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// Verify an attestation statement and return the type of attestation
+func verifyAttestation(format string, statement map[any]any, rawAuthData, clientDataHash []byte, authData *authenticatorData) (string, error) {
+	switch format {
+	case "none":
+		if len(statement) != 0 {
+			return "", fmt.Errorf("%w: none attestation with a statement", ErrInvalidAttestation)
+		}
+		return AttestationNone, nil
+	case "packed":
+		return verifyPackedAttestation(statement, rawAuthData, clientDataHash, authData)
+	default:
+		return "", fmt.Errorf("%w: unsupported format %q", ErrInvalidAttestation, format)
+	}
+}
+
+// WebAuthn §8.2
+func verifyPackedAttestation(statement map[any]any, rawAuthData, clientDataHash []byte, authData *authenticatorData) (string, error) {
+	alg, ok := statement["alg"].(int64)
+	if !ok {
+		return "", fmt.Errorf("%w: packed attestation without alg", ErrInvalidAttestation)
+	}
+	sig, ok := statement["sig"].([]byte)
+	if !ok {
+		return "", fmt.Errorf("%w: packed attestation without sig", ErrInvalidAttestation)
+	}
+	signed := append(bytes.Clone(rawAuthData), clientDataHash...)
+
+	x5c, hasX5c := statement["x5c"].([]any)
+	if !hasX5c {
+		// self attestation: signed by the credential key
+		if alg != authData.credential.alg {
+			return "", fmt.Errorf("%w: self attestation alg doesn't match the credential key", ErrInvalidAttestation)
+		}
+		if err := authData.credential.verify(signed, sig); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrInvalidAttestation, err)
+		}
+		return AttestationSelf, nil
+	}
+
+	if len(x5c) == 0 {
+		return "", fmt.Errorf("%w: empty x5c", ErrInvalidAttestation)
+	}
+	leaf, ok := x5c[0].([]byte)
+	if !ok {
+		return "", fmt.Errorf("%w: x5c is not a list of certificates", ErrInvalidAttestation)
+	}
+	cert, err := x509.ParseCertificate(leaf)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidAttestation, err)
+	}
+	if err := verifySignature(alg, cert.PublicKey, signed, sig); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidAttestation, err)
+	}
+	if err := checkPackedCertificate(cert, authData.aaguid); err != nil {
+		return "", err
+	}
+	return AttestationBasic, nil
+}
+
+// WebAuthn §8.2.1: requirements of packed attestation certificates
+func checkPackedCertificate(cert *x509.Certificate, aaguid []byte) error {
+	if cert.Version != 3 {
+		return fmt.Errorf("%w: attestation certificate must be X.509 v3", ErrInvalidAttestation)
+	}
+	if !slices.Contains(cert.Subject.OrganizationalUnit, "Authenticator Attestation") ||
+		len(cert.Subject.Country) == 0 || len(cert.Subject.Organization) == 0 || cert.Subject.CommonName == "" {
+		return fmt.Errorf("%w: attestation certificate subject is invalid", ErrInvalidAttestation)
+	}
+	if cert.BasicConstraintsValid && cert.IsCA {
+		return fmt.Errorf("%w: attestation certificate is a CA", ErrInvalidAttestation)
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidAAGUID) {
+			continue
+		}
+		if ext.Critical {
+			return fmt.Errorf("%w: AAGUID extension must not be critical", ErrInvalidAttestation)
+		}
+		var certAAGUID []byte
+		if _, err := asn1.Unmarshal(ext.Value, &certAAGUID); err != nil || !bytes.Equal(certAAGUID, aaguid) {
+			return fmt.Errorf("%w: AAGUID doesn't match the attestation certificate", ErrInvalidAttestation)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidCBOR = errors.New("invalid CBOR")
+
+// Nesting deeper than this is rejected; nothing an authenticator sends comes
+// close
+const maxCBORDepth = 16
+
+// Decode the CBOR (RFC 8949) data item at the start of data, returning it and
+// the bytes following it. Only what authenticators produce is supported:
+// integers, byte and text strings, arrays, maps, tags (which are dropped) and
+// the simple values false, true and null. Integers decode to int64, byte
+// strings to []byte, text strings to string, arrays to []any and maps to
+// map[any]any.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deeply", ErrInvalidCBOR)
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidCBOR)
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		default:
+			return nil, nil, fmt.Errorf("%w: unsupported simple value %d", ErrInvalidCBOR, info)
+		}
+	}
+
+	arg, data, err := decodeCBORArgument(info, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("%w: integer overflows int64", ErrInvalidCBOR)
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("%w: integer overflows int64", ErrInvalidCBOR)
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidCBOR)
+		}
+		value, rest := data[:arg], data[arg:]
+		if major == 3 {
+			return string(value), rest, nil
+		}
+		return bytes.Clone(value), rest, nil
+	case 4:
+		// every item takes at least a byte, which bounds the allocation
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidCBOR)
+		}
+		array := make([]any, arg)
+		for i := range array {
+			if array[i], data, err = decodeCBORItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return array, data, nil
+	case 5:
+		if arg > uint64(len(data))/2 {
+			return nil, nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidCBOR)
+		}
+		m := make(map[any]any, arg)
+		for range arg {
+			var key, value any
+			if key, data, err = decodeCBORItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key type %T", ErrInvalidCBOR, key)
+			}
+			if _, found := m[key]; found {
+				return nil, nil, fmt.Errorf("%w: duplicate map key %v", ErrInvalidCBOR, key)
+			}
+			if value, data, err = decodeCBORItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, data, nil
+	default: // 6, a tag
+		return decodeCBORItem(data, depth+1)
+	}
+}
+
+// Decode the argument of a data item's initial byte. Indefinite lengths
+// (info 31) aren't supported.
+func decodeCBORArgument(info byte, data []byte) (uint64, []byte, error) {
+	if info < 24 {
+		return uint64(info), data, nil
+	}
+	var size int
+	switch info {
+	case 24:
+		size = 1
+	case 25:
+		size = 2
+	case 26:
+		size = 4
+	case 27:
+		size = 8
+	default:
+		return 0, nil, fmt.Errorf("%w: unsupported argument %d", ErrInvalidCBOR, info)
+	}
+	if len(data) < size {
+		return 0, nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidCBOR)
+	}
+	var arg uint64
+	switch size {
+	case 1:
+		arg = uint64(data[0])
+	case 2:
+		arg = uint64(binary.BigEndian.Uint16(data))
+	case 4:
+		arg = uint64(binary.BigEndian.Uint32(data))
+	case 8:
+		arg = binary.BigEndian.Uint64(data)
+	}
+	return arg, data[size:], nil
+}
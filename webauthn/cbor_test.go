@@ -0,0 +1,82 @@
+package webauthn
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Examples from RFC 8949 appendix A
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		encoded string
+		decoded any
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3903e7", int64(-1000)},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"83010203", []any{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.encoded)
+		require.NoError(t, err)
+		decoded, rest, err := decodeCBOR(data)
+		require.NoError(t, err, test.encoded)
+		assert.Equal(t, test.decoded, decoded, test.encoded)
+		assert.Empty(t, rest, test.encoded)
+	}
+}
+
+func TestDecodeCBORReturnsTrailingBytes(t *testing.T) {
+	decoded, rest, err := decodeCBOR([]byte{0x01, 0x02, 0x03})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), decoded)
+	assert.Equal(t, []byte{0x02, 0x03}, rest)
+}
+
+func TestDecodeCBORRejectsInvalidData(t *testing.T) {
+	for _, encoded := range []string{
+		"",                   // nothing
+		"18",                 // truncated argument
+		"4401",               // truncated byte string
+		"830102",             // truncated array
+		"9b7fffffffffffffff", // array longer than the data
+		"5f",                 // indefinite length
+		"fb3ff199999999999a", // float
+		"a201020103",         // duplicate map key
+		"a1400102",           // byte string map key
+		"1bffffffffffffffff", // overflows int64
+	} {
+		data, err := hex.DecodeString(encoded)
+		require.NoError(t, err)
+		_, _, err = decodeCBOR(data)
+		assert.ErrorIs(t, err, ErrInvalidCBOR, encoded)
+	}
+}
+
+func TestDecodeCBORRejectsDeepNesting(t *testing.T) {
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = 0x81 // array of one item
+	}
+	_, _, err := decodeCBOR(append(data, 0x00))
+	assert.ErrorIs(t, err, ErrInvalidCBOR)
+}
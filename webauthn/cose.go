@@ -0,0 +1,130 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	ErrUnsupportedKey = errors.New("unsupported credential public key")
+	ErrBadSignature   = errors.New("signature verification failed")
+)
+
+// COSE algorithm identifiers (RFC 9053) of the signatures we can verify
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Offered to authenticators at registration, in order of preference
+var SupportedAlgorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1 // also n of RSA keys
+	coseX   = -2 // also e of RSA keys
+	coseY   = -3
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// A credential public key, as parsed from its COSE_Key encoding
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+func parsePublicKey(encoded []byte) (*publicKey, []byte, error) {
+	item, rest, err := decodeCBOR(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, ok := item.(map[any]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: not a COSE key", ErrUnsupportedKey)
+	}
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, nil, fmt.Errorf("%w: invalid P-256 key", ErrUnsupportedKey)
+		}
+		// crypto/ecdh checks the point is on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrUnsupportedKey, err)
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		return &publicKey{alg: alg, key: key}, rest, nil
+	case kty == coseKtyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, nil, fmt.Errorf("%w: invalid Ed25519 key", ErrUnsupportedKey)
+		}
+		return &publicKey{alg: alg, key: ed25519.PublicKey(x)}, rest, nil
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseCrv)].([]byte)
+		e, _ := m[int64(coseX)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, nil, fmt.Errorf("%w: invalid RSA key", ErrUnsupportedKey)
+		}
+		exponent := int(new(big.Int).SetBytes(e).Int64())
+		return &publicKey{alg: alg, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}}, rest, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: key type %d, algorithm %d", ErrUnsupportedKey, kty, alg)
+	}
+}
+
+func (k *publicKey) verify(data, sig []byte) error {
+	return verifySignature(k.alg, k.key, data, sig)
+}
+
+// Verify a signature made with the given COSE algorithm
+func verifySignature(alg int64, key crypto.PublicKey, data, sig []byte) error {
+	var ok bool
+	switch alg {
+	case AlgES256:
+		ecKey, isEC := key.(*ecdsa.PublicKey)
+		digest := sha256.Sum256(data)
+		ok = isEC && ecdsa.VerifyASN1(ecKey, digest[:], sig)
+	case AlgEdDSA:
+		edKey, isEd := key.(ed25519.PublicKey)
+		ok = isEd && ed25519.Verify(edKey, data, sig)
+	case AlgRS256:
+		rsaKey, isRSA := key.(*rsa.PublicKey)
+		digest := sha256.Sum256(data)
+		ok = isRSA && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], sig) == nil
+	default:
+		return fmt.Errorf("%w: algorithm %d", ErrUnsupportedKey, alg)
+	}
+	if !ok {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package webauthn
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// How long browsers give users to complete a ceremony
+const CeremonyTimeout = 5 * time.Minute
+
+// Binary data, which the WebAuthn JSON encoding represents as unpadded
+// base64url
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// The user account a credential is registered for
+type User struct {
+	Id          Bytes  `json:"id"` // user handle, which mustn't identify the user to others
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type RelyingPartyEntity struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	Id   Bytes  `json:"id"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// PublicKeyCredentialCreationOptions, passed to navigator.credentials.create()
+type CreationOptions struct {
+	RP                     RelyingPartyEntity     `json:"rp"`
+	User                   User                   `json:"user"`
+	Challenge              Bytes                  `json:"challenge"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// PublicKeyCredentialRequestOptions, passed to navigator.credentials.get()
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPId             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// Options of a registration ceremony. Credentials the user already has are
+// excluded so that an authenticator isn't registered twice.
+func (rp *RelyingParty) CreationOptions(challenge []byte, user User, existing [][]byte) *CreationOptions {
+	params := make([]CredentialParameter, len(SupportedAlgorithms))
+	for i, alg := range SupportedAlgorithms {
+		params[i] = CredentialParameter{Type: "public-key", Alg: alg}
+	}
+	return &CreationOptions{
+		RP:                 RelyingPartyEntity{Id: rp.Id, Name: rp.Name},
+		User:               user,
+		Challenge:          challenge,
+		PubKeyCredParams:   params,
+		Timeout:            CeremonyTimeout.Milliseconds(),
+		ExcludeCredentials: credentialDescriptors(existing),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: rp.userVerification(),
+		},
+		Attestation: "none",
+	}
+}
+
+// Options of an authentication ceremony. With no allowed credentials, the
+// authenticator offers whichever passkeys it holds for the relying party.
+func (rp *RelyingParty) RequestOptions(challenge []byte, allowed [][]byte) *RequestOptions {
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          CeremonyTimeout.Milliseconds(),
+		RPId:             rp.Id,
+		AllowCredentials: credentialDescriptors(allowed),
+		UserVerification: rp.userVerification(),
+	}
+}
+
+func (rp *RelyingParty) userVerification() string {
+	if rp.RequireUserVerification {
+		return "required"
+	}
+	return "preferred"
+}
+
+func credentialDescriptors(ids [][]byte) []CredentialDescriptor {
+	descriptors := make([]CredentialDescriptor, len(ids))
+	for i, id := range ids {
+		descriptors[i] = CredentialDescriptor{Type: "public-key", Id: id}
+	}
+	return descriptors
+}
+
+// The JSON encoding of a PublicKeyCredential, as produced by its toJSON()
+type PublicKeyCredential struct {
+	Id       string                      `json:"id"`
+	RawId    Bytes                       `json:"rawId"`
+	Type     string                      `json:"type"`
+	Response AuthenticatorResponseFields `json:"response"`
+}
+
+// The fields of AuthenticatorAttestationResponse (registration) and
+// AuthenticatorAssertionResponse (authentication)
+type AuthenticatorResponseFields struct {
+	ClientDataJSON    Bytes `json:"clientDataJSON"`
+	AttestationObject Bytes `json:"attestationObject,omitempty"`
+	AuthenticatorData Bytes `json:"authenticatorData,omitempty"`
+	Signature         Bytes `json:"signature,omitempty"`
+	UserHandle        Bytes `json:"userHandle,omitempty"`
+}
@@ -0,0 +1,254 @@
+// Package webauthn verifies the registration and authentication ceremonies of
+// WebAuthn (https://www.w3.org/TR/webauthn-2/), which let users sign in with
+// passkeys and security keys instead of passwords.
+//
+// Only what a relying party needs is implemented: "none" and "packed"
+// attestation, and ES256, EdDSA and RS256 credential keys. Attestation
+// certificates aren't checked against a trust store, so attestation proves
+// nothing about the make of an authenticator; only the credential key and
+// the checks on each ceremony matter.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const ChallengeSize = 32
+
+var (
+	ErrInvalidClientData     = errors.New("invalid client data")
+	ErrInvalidAuthData       = errors.New("invalid authenticator data")
+	ErrInvalidAttestation    = errors.New("invalid attestation")
+	ErrUserNotPresent        = errors.New("user presence was not confirmed")
+	ErrUserNotVerified       = errors.New("user verification was required but not performed")
+	ErrSignCountNotIncreased = errors.New("signature counter did not increase; the authenticator may have been cloned")
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagBackupEligible   = 0x08
+	flagBackedUp         = 0x10
+	flagAttestedCredData = 0x40
+	flagExtensionData    = 0x80
+)
+
+// A relying party: the site credentials are scoped to
+type RelyingParty struct {
+	Id      string   // a domain, such as "example.com"
+	Name    string   // shown by authenticators
+	Origins []string // origins ceremonies may come from, such as "https://example.com"
+	// whether the authenticator must verify the user (by PIN or biometrics)
+	// rather than only check that someone is present
+	RequireUserVerification bool
+}
+
+func NewChallenge() []byte {
+	challenge := make([]byte, ChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		panic(err)
+	}
+	return challenge
+}
+
+// A credential created by a registration ceremony
+type Credential struct {
+	Id              []byte
+	PublicKey       []byte // COSE_Key encoding
+	SignCount       uint32
+	AAGUID          []byte // identifies the make of authenticator, if it says
+	AttestationType string // "none", "self" or "basic"
+	UserVerified    bool
+	BackupEligible  bool // whether the credential can be synced to other devices
+}
+
+// Verify the response to a registration ceremony and return the new
+// credential
+func (rp *RelyingParty) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte) (*Credential, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	item, rest, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAttestation, err)
+	}
+	object, ok := item.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: not an attestation object", ErrInvalidAttestation)
+	}
+	format, _ := object["fmt"].(string)
+	statement, _ := object["attStmt"].(map[any]any)
+	rawAuthData, _ := object["authData"].([]byte)
+	if statement == nil || rawAuthData == nil {
+		return nil, fmt.Errorf("%w: not an attestation object", ErrInvalidAttestation)
+	}
+
+	authData, err := rp.verifyAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.credential == nil {
+		return nil, fmt.Errorf("%w: no attested credential", ErrInvalidAuthData)
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	attestationType, err := verifyAttestation(
+		format, statement, rawAuthData, clientDataHash[:], authData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		Id:              authData.credentialId,
+		PublicKey:       authData.rawPublicKey,
+		SignCount:       authData.signCount,
+		AAGUID:          authData.aaguid,
+		AttestationType: attestationType,
+		UserVerified:    authData.flags&flagUserVerified != 0,
+		BackupEligible:  authData.flags&flagBackupEligible != 0,
+	}, nil
+}
+
+// The outcome of an authentication ceremony
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+// Verify the response to an authentication ceremony with a credential's
+// public key and its last known signature counter
+func (rp *RelyingParty) VerifyAssertion(
+	challenge, publicKeyCOSE []byte, signCount uint32,
+	clientDataJSON, rawAuthData, signature []byte,
+) (*Assertion, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return nil, err
+	}
+	authData, err := rp.verifyAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, err := parsePublicKey(publicKeyCOSE)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if err := key.verify(append(bytes.Clone(rawAuthData), clientDataHash[:]...), signature); err != nil {
+		return nil, err
+	}
+
+	// authenticators that don't keep a counter always report 0
+	if (authData.signCount != 0 || signCount != 0) && authData.signCount <= signCount {
+		return nil, ErrSignCountNotIncreased
+	}
+	return &Assertion{
+		SignCount:    authData.signCount,
+		UserVerified: authData.flags&flagUserVerified != 0,
+	}, nil
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+func (rp *RelyingParty) verifyClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	data := &clientData{}
+	if err := json.Unmarshal(clientDataJSON, data); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidClientData, err)
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("%w: type %q is not %q", ErrInvalidClientData, data.Type, ceremony)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(data.Challenge, "="))
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("%w: challenge mismatch", ErrInvalidClientData)
+	}
+	if !slices.Contains(rp.Origins, data.Origin) {
+		return fmt.Errorf("%w: unexpected origin %q", ErrInvalidClientData, data.Origin)
+	}
+	if data.CrossOrigin {
+		return fmt.Errorf("%w: cross-origin ceremony", ErrInvalidClientData)
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	flags     byte
+	signCount uint32
+	// attested credential data, only present at registration
+	aaguid       []byte
+	credentialId []byte
+	rawPublicKey []byte
+	credential   *publicKey
+}
+
+// Parse authenticator data and check it was made for this relying party
+func (rp *RelyingParty) verifyAuthData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, fmt.Errorf("%w: too short", ErrInvalidAuthData)
+	}
+	rpIdHash := sha256.Sum256([]byte(rp.Id))
+	if subtle.ConstantTimeCompare(raw[:32], rpIdHash[:]) != 1 {
+		return nil, fmt.Errorf("%w: relying party ID mismatch", ErrInvalidAuthData)
+	}
+	data := &authenticatorData{flags: raw[32], signCount: binary.BigEndian.Uint32(raw[33:37])}
+	if data.flags&flagUserPresent == 0 {
+		return nil, ErrUserNotPresent
+	}
+	if rp.RequireUserVerification && data.flags&flagUserVerified == 0 {
+		return nil, ErrUserNotVerified
+	}
+	if data.flags&flagBackedUp != 0 && data.flags&flagBackupEligible == 0 {
+		return nil, fmt.Errorf("%w: backed up but not backup eligible", ErrInvalidAuthData)
+	}
+
+	rest := raw[37:]
+	if data.flags&flagAttestedCredData != 0 {
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: truncated attested credential data", ErrInvalidAuthData)
+		}
+		data.aaguid = bytes.Clone(rest[:16])
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength > 1023 || len(rest) < idLength {
+			return nil, fmt.Errorf("%w: invalid credential ID", ErrInvalidAuthData)
+		}
+		data.credentialId = bytes.Clone(rest[:idLength])
+		rest = rest[idLength:]
+
+		key, afterKey, err := parsePublicKey(rest)
+		if err != nil {
+			return nil, err
+		}
+		data.credential = key
+		data.rawPublicKey = bytes.Clone(rest[:len(rest)-len(afterKey)])
+		rest = afterKey
+	}
+	if data.flags&flagExtensionData != 0 {
+		_, afterExtensions, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidAuthData, err)
+		}
+		rest = afterExtensions
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing bytes", ErrInvalidAuthData)
+	}
+	return data, nil
+}
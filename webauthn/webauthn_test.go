@@ -0,0 +1,390 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testRP = &RelyingParty{Id: "dump.example", Name: "dump", Origins: []string{"https://dump.example"}}
+
+// CBOR map with its keys in a fixed order
+type cborMap [][2]any
+
+// Encode the CBOR the tests need to play the authenticator
+func encodeCBOR(value any) []byte {
+	head := func(major byte, arg uint64) []byte {
+		switch {
+		case arg < 24:
+			return []byte{major<<5 | byte(arg)}
+		case arg <= 0xff:
+			return []byte{major<<5 | 24, byte(arg)}
+		case arg <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+		default:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+		}
+	}
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []any:
+		out := head(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	case cborMap:
+		out := head(5, uint64(len(v)))
+		for _, pair := range v {
+			out = append(out, encodeCBOR(pair[0])...)
+			out = append(out, encodeCBOR(pair[1])...)
+		}
+		return out
+	default:
+		panic(fmt.Sprintf("can't encode %T", value))
+	}
+}
+
+// A software authenticator holding one credential
+type authenticator struct {
+	rpId         string
+	credentialId []byte
+	alg          int
+	key          crypto.Signer
+	signCount    uint32
+	noCounter    bool // always report a signature counter of 0
+	flags        byte
+}
+
+func newAuthenticator(t *testing.T, alg int) *authenticator {
+	a := &authenticator{
+		rpId:         testRP.Id,
+		credentialId: make([]byte, 16),
+		alg:          alg,
+		flags:        flagUserPresent | flagUserVerified,
+	}
+	rand.Read(a.credentialId)
+	var err error
+	switch alg {
+	case AlgES256:
+		a.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, a.key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	require.NoError(t, err)
+	return a
+}
+
+func (a *authenticator) coseKey() []byte {
+	switch key := a.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		return encodeCBOR(cborMap{
+			{coseKty, coseKtyEC2}, {coseAlg, AlgES256}, {coseCrv, coseCrvP256},
+			{coseX, key.X.FillBytes(make([]byte, 32))}, {coseY, key.Y.FillBytes(make([]byte, 32))},
+		})
+	case ed25519.PublicKey:
+		return encodeCBOR(cborMap{
+			{coseKty, coseKtyOKP}, {coseAlg, AlgEdDSA}, {coseCrv, coseCrvEd25519}, {coseX, []byte(key)},
+		})
+	}
+	panic("unsupported key")
+}
+
+func sign(key crypto.Signer, data []byte) []byte {
+	var sig []byte
+	var err error
+	if _, isEd := key.(ed25519.PrivateKey); isEd {
+		sig, err = key.Sign(rand.Reader, data, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(data)
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+func (a *authenticator) authData(attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(a.rpId))
+	flags := a.flags
+	if attested {
+		flags |= flagAttestedCredData
+	}
+	data := append(rpIdHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialId)))
+		data = append(data, a.credentialId...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func clientDataJSON(ceremony string, challenge []byte, origin string) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	return data
+}
+
+// Answer a registration ceremony with the given attestation format. Packed
+// attestation is signed by attestationKey, or the credential key if nil, and
+// is self attestation unless certificates are given.
+func (a *authenticator) register(challenge []byte, format string, attestationKey crypto.Signer, x5c [][]byte) (clientData, attestationObject []byte) {
+	clientData = clientDataJSON("webauthn.create", challenge, testRP.Origins[0])
+	authData := a.authData(true)
+	statement := cborMap{}
+	if format == "packed" {
+		clientDataHash := sha256.Sum256(clientData)
+		signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+		if attestationKey == nil {
+			attestationKey = a.key
+		}
+		if x5c == nil {
+			statement = cborMap{{"alg", a.alg}, {"sig", sign(attestationKey, signed)}}
+		} else {
+			certs := make([]any, len(x5c))
+			for i, cert := range x5c {
+				certs[i] = cert
+			}
+			statement = cborMap{{"alg", AlgES256}, {"sig", sign(attestationKey, signed)}, {"x5c", certs}}
+		}
+	}
+	attestationObject = encodeCBOR(cborMap{{"fmt", format}, {"attStmt", statement}, {"authData", authData}})
+	return clientData, attestationObject
+}
+
+// Answer an authentication ceremony
+func (a *authenticator) assert(challenge []byte) (clientData, authData, signature []byte) {
+	if !a.noCounter {
+		a.signCount++
+	}
+	clientData = clientDataJSON("webauthn.get", challenge, testRP.Origins[0])
+	authData = a.authData(false)
+	clientDataHash := sha256.Sum256(clientData)
+	signature = sign(a.key, append(append([]byte(nil), authData...), clientDataHash[:]...))
+	return clientData, authData, signature
+}
+
+func TestRegisterAndAuthenticate(t *testing.T) {
+	for _, alg := range []int{AlgES256, AlgEdDSA} {
+		a := newAuthenticator(t, alg)
+		challenge := NewChallenge()
+		clientData, attestationObject := a.register(challenge, "none", nil, nil)
+		credential, err := testRP.VerifyRegistration(challenge, clientData, attestationObject)
+		require.NoError(t, err)
+		assert.Equal(t, a.credentialId, credential.Id)
+		assert.Equal(t, AttestationNone, credential.AttestationType)
+		assert.True(t, credential.UserVerified)
+
+		challenge = NewChallenge()
+		clientData, authData, sig := a.assert(challenge)
+		assertion, err := testRP.VerifyAssertion(
+			challenge, credential.PublicKey, credential.SignCount, clientData, authData, sig)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1), assertion.SignCount)
+		assert.True(t, assertion.UserVerified)
+	}
+}
+
+func TestPackedSelfAttestation(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	challenge := NewChallenge()
+	clientData, attestationObject := a.register(challenge, "packed", nil, nil)
+	credential, err := testRP.VerifyRegistration(challenge, clientData, attestationObject)
+	require.NoError(t, err)
+	assert.Equal(t, AttestationSelf, credential.AttestationType)
+
+	// signed by some other key
+	other := newAuthenticator(t, AlgES256)
+	clientData, attestationObject = a.register(challenge, "packed", other.key, nil)
+	_, err = testRP.VerifyRegistration(challenge, clientData, attestationObject)
+	assert.ErrorIs(t, err, ErrInvalidAttestation)
+
+	// claiming an algorithm other than the credential key's
+	a.alg = AlgEdDSA
+	clientData, attestationObject = a.register(challenge, "packed", nil, nil)
+	_, err = testRP.VerifyRegistration(challenge, clientData, attestationObject)
+	assert.ErrorIs(t, err, ErrInvalidAttestation)
+}
+
+func attestationCertificate(t *testing.T, subject pkix.Name, isCA bool) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	aaguid, err := asn1.Marshal(make([]byte, 16))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		ExtraExtensions:       []pkix.Extension{{Id: oidAAGUID, Value: aaguid}},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	return key, cert
+}
+
+func TestPackedBasicAttestation(t *testing.T) {
+	subject := pkix.Name{
+		Country:            []string{"US"},
+		Organization:       []string{"Authenticator Vendor"},
+		OrganizationalUnit: []string{"Authenticator Attestation"},
+		CommonName:         "Test Authenticator",
+	}
+	a := newAuthenticator(t, AlgEdDSA)
+	challenge := NewChallenge()
+
+	attestationKey, cert := attestationCertificate(t, subject, false)
+	clientData, attestationObject := a.register(challenge, "packed", attestationKey, [][]byte{cert})
+	credential, err := testRP.VerifyRegistration(challenge, clientData, attestationObject)
+	require.NoError(t, err)
+	assert.Equal(t, AttestationBasic, credential.AttestationType)
+
+	// signed by a key other than the certificate's
+	otherKey, _ := attestationCertificate(t, subject, false)
+	clientData, attestationObject = a.register(challenge, "packed", otherKey, [][]byte{cert})
+	_, err = testRP.VerifyRegistration(challenge, clientData, attestationObject)
+	assert.ErrorIs(t, err, ErrInvalidAttestation)
+
+	// certificates not meant for attestation
+	caKey, caCert := attestationCertificate(t, subject, true)
+	clientData, attestationObject = a.register(challenge, "packed", caKey, [][]byte{caCert})
+	_, err = testRP.VerifyRegistration(challenge, clientData, attestationObject)
+	assert.ErrorIs(t, err, ErrInvalidAttestation)
+	subject.OrganizationalUnit = nil
+	plainKey, plainCert := attestationCertificate(t, subject, false)
+	clientData, attestationObject = a.register(challenge, "packed", plainKey, [][]byte{plainCert})
+	_, err = testRP.VerifyRegistration(challenge, clientData, attestationObject)
+	assert.ErrorIs(t, err, ErrInvalidAttestation)
+}
+
+func TestRegistrationChecks(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	challenge := NewChallenge()
+	clientData, attestationObject := a.register(challenge, "none", nil, nil)
+
+	_, err := testRP.VerifyRegistration(NewChallenge(), clientData, attestationObject)
+	assert.ErrorIs(t, err, ErrInvalidClientData)
+
+	otherOrigin := &RelyingParty{Id: testRP.Id, Origins: []string{"https://evil.example"}}
+	_, err = otherOrigin.VerifyRegistration(challenge, clientData, attestationObject)
+	assert.ErrorIs(t, err, ErrInvalidClientData)
+
+	otherRP := &RelyingParty{Id: "evil.example", Origins: testRP.Origins}
+	_, err = otherRP.VerifyRegistration(challenge, clientData, attestationObject)
+	assert.ErrorIs(t, err, ErrInvalidAuthData)
+
+	// an assertion's client data can't be used to register
+	getData := clientDataJSON("webauthn.get", challenge, testRP.Origins[0])
+	_, err = testRP.VerifyRegistration(challenge, getData, attestationObject)
+	assert.ErrorIs(t, err, ErrInvalidClientData)
+
+	_, unsupported := a.register(challenge, "fido-u2f", nil, nil)
+	_, err = testRP.VerifyRegistration(challenge, clientData, unsupported)
+	assert.ErrorIs(t, err, ErrInvalidAttestation)
+}
+
+func TestUserPresenceAndVerification(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	a.flags = flagUserPresent
+	challenge := NewChallenge()
+	clientData, attestationObject := a.register(challenge, "none", nil, nil)
+	credential, err := testRP.VerifyRegistration(challenge, clientData, attestationObject)
+	require.NoError(t, err)
+	assert.False(t, credential.UserVerified)
+
+	strict := *testRP
+	strict.RequireUserVerification = true
+	_, err = strict.VerifyRegistration(challenge, clientData, attestationObject)
+	assert.ErrorIs(t, err, ErrUserNotVerified)
+
+	a.flags = 0
+	clientData, authData, sig := a.assert(challenge)
+	_, err = testRP.VerifyAssertion(challenge, credential.PublicKey, 0, clientData, authData, sig)
+	assert.ErrorIs(t, err, ErrUserNotPresent)
+}
+
+func TestAssertionChecks(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	challenge := NewChallenge()
+	clientData, attestationObject := a.register(challenge, "none", nil, nil)
+	credential, err := testRP.VerifyRegistration(challenge, clientData, attestationObject)
+	require.NoError(t, err)
+
+	clientData, authData, sig := a.assert(challenge)
+	_, err = testRP.VerifyAssertion(NewChallenge(), credential.PublicKey, 0, clientData, authData, sig)
+	assert.ErrorIs(t, err, ErrInvalidClientData)
+
+	sig[len(sig)-1] ^= 1
+	_, err = testRP.VerifyAssertion(challenge, credential.PublicKey, 0, clientData, authData, sig)
+	assert.ErrorIs(t, err, ErrBadSignature)
+
+	other := newAuthenticator(t, AlgES256)
+	clientData, authData, sig = other.assert(challenge)
+	_, err = testRP.VerifyAssertion(challenge, credential.PublicKey, 0, clientData, authData, sig)
+	assert.ErrorIs(t, err, ErrBadSignature)
+}
+
+func TestAssertionRejectsSignCountRegression(t *testing.T) {
+	a := newAuthenticator(t, AlgEdDSA)
+	challenge := NewChallenge()
+	clientData, attestationObject := a.register(challenge, "none", nil, nil)
+	credential, err := testRP.VerifyRegistration(challenge, clientData, attestationObject)
+	require.NoError(t, err)
+
+	clientData, authData, sig := a.assert(challenge)
+	assertion, err := testRP.VerifyAssertion(challenge, credential.PublicKey, 5, clientData, authData, sig)
+	assert.ErrorIs(t, err, ErrSignCountNotIncreased)
+	assert.Nil(t, assertion)
+
+	// authenticators without a counter always report 0
+	a.signCount, a.noCounter = 0, true
+	clientData, authData, sig = a.assert(challenge)
+	_, err = testRP.VerifyAssertion(challenge, credential.PublicKey, 0, clientData, authData, sig)
+	assert.NoError(t, err)
+}
+
+func TestBytesJSON(t *testing.T) {
+	encoded, err := json.Marshal(Bytes{0xfb, 0xff})
+	require.NoError(t, err)
+	assert.Equal(t, `"-_8"`, string(encoded))
+
+	var decoded Bytes
+	require.NoError(t, json.Unmarshal([]byte(`"-_8"`), &decoded))
+	assert.Equal(t, Bytes{0xfb, 0xff}, decoded)
+	// some clients pad
+	require.NoError(t, json.Unmarshal([]byte(`"-_8="`), &decoded))
+	assert.Equal(t, Bytes{0xfb, 0xff}, decoded)
+	assert.Error(t, json.Unmarshal([]byte(`"+/8="`), &decoded))
+}